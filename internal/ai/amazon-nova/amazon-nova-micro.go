@@ -3,14 +3,14 @@ package amazon_nova
 import (
 	"context"
 	"encoding/json"
-	"fmt"
-	"log"
+	"imageclust/internal/ai/bedrock"
+	"imageclust/internal/ai/prompt"
+	"imageclust/internal/logger"
 	"strings"
 	"time"
 	"unicode/utf8"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
-	"github.com/aws/aws-sdk-go-v2/config"
 	"github.com/aws/aws-sdk-go-v2/service/bedrockruntime"
 )
 
@@ -21,35 +21,35 @@ type AmazonNovaMicroResponse struct {
 	} `json:"Results"`
 }
 
-func GenerateTitleAndCatchyPhrase(aggregatedText string, retries int) (string, string) {
-	// Load AWS configuration with explicit region
-	cfg, err := config.LoadDefaultConfig(context.TODO(),
-		config.WithRegion("us-west-2"),
-	)
+// modelID is the Nova Micro model, invoked through the inference profile of each Bedrock region
+const modelID = "amazon.nova-micro-v1:0"
+
+// defaultPrompt is used unless PROMPT_TEMPLATE_DIR holds an amazon-nova.tmpl override
+const defaultPrompt = "You are an assistant that generates a single concise and creative title and a catchy phrase for an image cluster. " +
+	"The title must be no more than {{.TitleMaxChars}} characters, and the catchy phrase must be no more than {{.PhraseMaxChars}} characters. " +
+	"Return the results in JSON format with the fields 'title'{{if .Category}}, 'catchy_phrase' and 'category'{{else}} and 'catchy_phrase'{{end}} only. " +
+	"{{if .Category}}The category is a short product category for the cluster, such as \"Summer Dresses\". {{end}}" +
+	"Do not include any Markdown or code block formatting in your response. " +
+	"Ensure that only one JSON object is returned, containing only {{if .Category}}these three fields{{else}}these two fields{{end}}. " +
+	"Features: {{.Features}}."
+
+func GenerateTitleAndCatchyPhrase(ctx context.Context, aggregatedText string, retries int) (string, string, string) {
+	// Create Bedrock client that fails over across the configured regions
+	client, err := bedrock.NewFailoverClient(bedrock.Regions())
 	if err != nil {
-		log.Printf("Unable to load AWS SDK config: %v", err)
-		return "No Title", "No phrase available"
+		logger.Errorf("Unable to create Bedrock client: %v", err)
+		return "No Title", "No phrase available", ""
 	}
 
-	// Create Bedrock client
-	client := bedrockruntime.NewFromConfig(cfg)
-
-	// Define the Bedrock model ID you want to use
-	modelID := "arn:aws:bedrock:us-west-2:224418580241:inference-profile/us.amazon.nova-micro-v1:0"
-
 	// Truncate and sanitize aggregatedText
 	sanitizedText := truncateAndSanitize(aggregatedText, 1000)
 
 	// Construct the prompt text
-	promptText := fmt.Sprintf(
-		"You are an assistant that generates a single concise and creative title and a catchy phrase for an image cluster. "+
-			"The title must be no more than 25 characters, and the catchy phrase must be no more than 100 characters. "+
-			"Return the results in JSON format with the fields 'title' and 'catchy_phrase' only. "+
-			"Do not include any Markdown or code block formatting in your response. "+
-			"Ensure that only one JSON object is returned, containing only these two fields. "+
-			"Features: %s.",
-		sanitizedText,
-	)
+	promptText, err := prompt.Render(ctx, "amazon-nova", defaultPrompt, prompt.NewData(sanitizedText))
+	if err != nil {
+		logger.Errorf("Error building prompt: %v", err)
+		return "No Title", "No phrase available", ""
+	}
 
 	// Create the request payload as a map
 	requestPayload := map[string]string{
@@ -59,27 +59,33 @@ func GenerateTitleAndCatchyPhrase(aggregatedText string, retries int) (string, s
 	// Marshal the request payload to JSON
 	requestBody, err := json.Marshal(requestPayload)
 	if err != nil {
-		log.Printf("Error marshaling request body: %v", err)
-		return "No Title", "No phrase available"
+		logger.Warnf("Error marshaling request body: %v", err)
+		return "No Title", "No phrase available", ""
 	}
 
 	for attempt := 0; attempt < retries; attempt++ {
+		if ctx.Err() != nil {
+			break
+		}
+
 		// Create the request input
 		reqInput := &bedrockruntime.InvokeModelInput{
-			ModelId:     aws.String(modelID),
 			Body:        requestBody,
 			ContentType: aws.String("application/json"),
 			Accept:      aws.String("application/json"),
 		}
 
 		// Log the request being sent to Bedrock
-		log.Println("Sending request to Amazon Bedrock:")
-		log.Println(string(requestBody))
+		logger.Debugf("Sending request to Amazon Bedrock:")
+		logger.Debugf("%s", string(requestBody))
 
 		// Send the request to Bedrock
-		resp, err := client.InvokeModel(context.TODO(), reqInput)
+		resp, err := client.InvokeInferenceProfile(ctx, modelID, reqInput)
 		if err != nil {
-			log.Printf("Error invoking Bedrock model: %v", err)
+			logger.Warnf("Error invoking Bedrock model: %v", err)
+			if ctx.Err() != nil {
+				break
+			}
 			time.Sleep(2 * time.Second)
 			continue
 		}
@@ -91,14 +97,14 @@ func GenerateTitleAndCatchyPhrase(aggregatedText string, retries int) (string, s
 		var bedrockResp AmazonNovaMicroResponse
 		err = json.Unmarshal(bodyBytes, &bedrockResp)
 		if err != nil {
-			log.Printf("Error unmarshaling Bedrock response: %v", err)
+			logger.Warnf("Error unmarshaling Bedrock response: %v", err)
 			time.Sleep(2 * time.Second)
 			continue
 		}
 
 		// Check if any results are returned
 		if len(bedrockResp.Results) == 0 {
-			log.Println("No results returned from Bedrock")
+			logger.Warnf("No results returned from Bedrock")
 			time.Sleep(2 * time.Second)
 			continue
 		}
@@ -106,14 +112,14 @@ func GenerateTitleAndCatchyPhrase(aggregatedText string, retries int) (string, s
 		assistantReply := bedrockResp.Results[0].OutputText
 
 		// Log the response received from Bedrock
-		log.Println("Received response from Amazon Bedrock:")
-		log.Println(assistantReply)
+		logger.Debugf("Received response from Amazon Bedrock:")
+		logger.Debugf("%s", assistantReply)
 
 		// Attempt to unmarshal the assistant's reply into a map
 		var result map[string]interface{}
 		err = json.Unmarshal([]byte(assistantReply), &result)
 		if err != nil {
-			log.Printf("Error unmarshaling Bedrock response JSON: %v", err)
+			logger.Warnf("Error unmarshaling Bedrock response JSON: %v", err)
 			time.Sleep(2 * time.Second)
 			continue
 		}
@@ -142,17 +148,20 @@ func GenerateTitleAndCatchyPhrase(aggregatedText string, retries int) (string, s
 		catchyPhrase, okPhraseExtracted := extractString(catchyPhraseValue)
 
 		if !okTitle || !okTitleExtracted || !okPhrase || !okPhraseExtracted {
-			log.Println("Bedrock response missing 'title' or 'catchy_phrase'")
+			logger.Warnf("Bedrock response missing 'title' or 'catchy_phrase'")
 			time.Sleep(2 * time.Second)
 			continue
 		}
 
-		return title, catchyPhrase
+		// category is only present when requested
+		category, _ := extractString(result["category"])
+
+		return title, catchyPhrase, strings.TrimSpace(category)
 	}
 
 	// If all retries fail, return default values
-	log.Println("Failed to generate title and catchy phrase after retries")
-	return "No Title", "No phrase available"
+	logger.Errorf("Failed to generate title and catchy phrase after retries")
+	return "No Title", "No phrase available", ""
 }
 
 // truncateAndSanitize truncates the input string to a maximum length and removes or replaces characters that could interfere with JSON formatting.
@@ -175,3 +184,58 @@ func truncateAndSanitize(input string, maxLen int) string {
 
 	return input
 }
+
+// GenerateSummary writes a paragraph describing the whole collection from its clusters.
+// It returns an empty string when every attempt fails.
+func GenerateSummary(ctx context.Context, clusterText string, retries int) string {
+	client, err := bedrock.NewFailoverClient(bedrock.Regions())
+	if err != nil {
+		logger.Errorf("Unable to create Bedrock client: %v", err)
+		return ""
+	}
+
+	promptText, err := prompt.RenderSummary("amazon-nova", truncateAndSanitize(clusterText, prompt.SummaryMaxInputChars))
+	if err != nil {
+		logger.Errorf("Error building summary prompt: %v", err)
+		return ""
+	}
+
+	requestBody, err := json.Marshal(map[string]string{"inputText": promptText})
+	if err != nil {
+		logger.Warnf("Error marshaling request body: %v", err)
+		return ""
+	}
+
+	for attempt := 0; attempt < retries; attempt++ {
+		if ctx.Err() != nil {
+			break
+		}
+
+		resp, err := client.InvokeInferenceProfile(ctx, modelID, &bedrockruntime.InvokeModelInput{
+			Body:        requestBody,
+			ContentType: aws.String("application/json"),
+			Accept:      aws.String("application/json"),
+		})
+		if err != nil {
+			logger.Warnf("Error invoking Bedrock model: %v", err)
+			if ctx.Err() != nil {
+				break
+			}
+			time.Sleep(2 * time.Second)
+			continue
+		}
+
+		var bedrockResp AmazonNovaMicroResponse
+		if err := json.Unmarshal(resp.Body, &bedrockResp); err != nil || len(bedrockResp.Results) == 0 {
+			logger.Warnf("Empty or invalid summary response from Bedrock: %v", err)
+			time.Sleep(2 * time.Second)
+			continue
+		}
+		if summary := strings.TrimSpace(bedrockResp.Results[0].OutputText); summary != "" {
+			return summary
+		}
+	}
+
+	logger.Errorf("Failed to generate collection summary after retries")
+	return ""
+}
@@ -0,0 +1,140 @@
+package bedrock
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"imageclust/internal/logger"
+	"os"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/bedrockruntime"
+	"github.com/aws/aws-sdk-go-v2/service/bedrockruntime/types"
+)
+
+// DefaultRegion is used when BEDROCK_REGIONS is not set
+const DefaultRegion = "us-west-2"
+
+// InvokeModelAPI is the subset of the Bedrock runtime client used by the generators
+type InvokeModelAPI interface {
+	InvokeModel(ctx context.Context, params *bedrockruntime.InvokeModelInput, optFns ...func(*bedrockruntime.Options)) (*bedrockruntime.InvokeModelOutput, error)
+}
+
+// FailoverClient invokes models against an ordered list of regions,
+// moving on to the next region when one is throttling or unavailable
+type FailoverClient struct {
+	Regions []string
+	Clients []InvokeModelAPI // One client per region, in the same order as Regions
+}
+
+// Regions returns the ordered regions from BEDROCK_REGIONS (comma-separated), defaulting to DefaultRegion
+func Regions() []string {
+	var regions []string
+	for _, region := range strings.Split(os.Getenv("BEDROCK_REGIONS"), ",") {
+		if region = strings.TrimSpace(region); region != "" {
+			regions = append(regions, region)
+		}
+	}
+	if len(regions) == 0 {
+		regions = []string{DefaultRegion}
+	}
+	return regions
+}
+
+// NewFailoverClient loads a Bedrock runtime client for each of the given regions
+func NewFailoverClient(regions []string) (*FailoverClient, error) {
+	if len(regions) == 0 {
+		return nil, fmt.Errorf("no Bedrock regions configured")
+	}
+
+	clients := make([]InvokeModelAPI, 0, len(regions))
+	for _, region := range regions {
+		cfg, err := config.LoadDefaultConfig(context.Background(),
+			config.WithRegion(region),
+		)
+		if err != nil {
+			return nil, fmt.Errorf("unable to load AWS config for region %s: %v", region, err)
+		}
+		clients = append(clients, bedrockruntime.NewFromConfig(cfg))
+	}
+
+	return &FailoverClient{Regions: regions, Clients: clients}, nil
+}
+
+// InferenceProfileID returns the ID of the cross-region inference profile that serves modelID from region,
+// such as "us.amazon.nova-micro-v1:0" for us-west-2. Profile IDs carry no account or region, so Bedrock
+// resolves them in the caller's account. Regions outside the US, EU and Asia Pacific profiles get modelID.
+func InferenceProfileID(region, modelID string) string {
+	switch {
+	case strings.HasPrefix(region, "us-gov-"):
+		return "us-gov." + modelID
+	case strings.HasPrefix(region, "us-"):
+		return "us." + modelID
+	case strings.HasPrefix(region, "eu-"):
+		return "eu." + modelID
+	case strings.HasPrefix(region, "ap-"):
+		return "apac." + modelID
+	default:
+		return modelID
+	}
+}
+
+// InvokeModel invokes the model in the first region that is not failing.
+// Errors that are not region-level (e.g. validation or access errors) are returned immediately.
+func (c *FailoverClient) InvokeModel(ctx context.Context, params *bedrockruntime.InvokeModelInput, optFns ...func(*bedrockruntime.Options)) (*bedrockruntime.InvokeModelOutput, error) {
+	return c.invoke(ctx, func(string) *bedrockruntime.InvokeModelInput { return params }, optFns...)
+}
+
+// InvokeInferenceProfile behaves like InvokeModel but addresses modelID through the inference
+// profile of each region's geography, so failing over to another geography keeps a valid profile.
+// The ModelId of params is ignored.
+func (c *FailoverClient) InvokeInferenceProfile(ctx context.Context, modelID string, params *bedrockruntime.InvokeModelInput, optFns ...func(*bedrockruntime.Options)) (*bedrockruntime.InvokeModelOutput, error) {
+	return c.invoke(ctx, func(region string) *bedrockruntime.InvokeModelInput {
+		regional := *params
+		regional.ModelId = aws.String(InferenceProfileID(region, modelID))
+		return &regional
+	}, optFns...)
+}
+
+// invoke tries each region in order with the input built for it
+func (c *FailoverClient) invoke(ctx context.Context, input func(region string) *bedrockruntime.InvokeModelInput, optFns ...func(*bedrockruntime.Options)) (*bedrockruntime.InvokeModelOutput, error) {
+	var lastErr error
+	for i, client := range c.Clients {
+		output, err := client.InvokeModel(ctx, input(c.Regions[i]), optFns...)
+		if err == nil {
+			return output, nil
+		}
+		if ctx.Err() != nil || !isRegionFailure(err) {
+			return nil, err
+		}
+
+		logger.Warnf("Bedrock region %s failed, trying next region: %v", c.Regions[i], err)
+		lastErr = err
+	}
+	return nil, lastErr
+}
+
+// isRegionFailure reports whether the error indicates the region itself is throttling or unavailable
+func isRegionFailure(err error) bool {
+	var throttling *types.ThrottlingException
+	var unavailable *types.ServiceUnavailableException
+	var internal *types.InternalServerException
+	var notReady *types.ModelNotReadyException
+	var timeout *types.ModelTimeoutException
+	if errors.As(err, &throttling) || errors.As(err, &unavailable) || errors.As(err, &internal) ||
+		errors.As(err, &notReady) || errors.As(err, &timeout) {
+		return true
+	}
+
+	// Other HTTP responses only fail over on throttling or server errors
+	var responseErr interface{ HTTPStatusCode() int }
+	if errors.As(err, &responseErr) {
+		status := responseErr.HTTPStatusCode()
+		return status == 429 || status >= 500
+	}
+
+	// Errors without a response (e.g. connection failures) are treated as regional outages
+	return true
+}
@@ -0,0 +1,106 @@
+package bedrock
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/bedrockruntime"
+	"github.com/aws/aws-sdk-go-v2/service/bedrockruntime/types"
+)
+
+// recordingClient records the model IDs it is invoked with and fails with err
+type recordingClient struct {
+	modelIDs []string
+	err      error
+}
+
+func (c *recordingClient) InvokeModel(ctx context.Context, params *bedrockruntime.InvokeModelInput, optFns ...func(*bedrockruntime.Options)) (*bedrockruntime.InvokeModelOutput, error) {
+	c.modelIDs = append(c.modelIDs, aws.ToString(params.ModelId))
+	if c.err != nil {
+		return nil, c.err
+	}
+	return &bedrockruntime.InvokeModelOutput{}, nil
+}
+
+func TestInferenceProfileID(t *testing.T) {
+	tests := map[string]string{
+		"us-west-2":      "us.amazon.nova-micro-v1:0",
+		"us-east-1":      "us.amazon.nova-micro-v1:0",
+		"us-gov-west-1":  "us-gov.amazon.nova-micro-v1:0",
+		"eu-central-1":   "eu.amazon.nova-micro-v1:0",
+		"ap-northeast-1": "apac.amazon.nova-micro-v1:0",
+		"sa-east-1":      "amazon.nova-micro-v1:0",
+	}
+	for region, want := range tests {
+		if got := InferenceProfileID(region, "amazon.nova-micro-v1:0"); got != want {
+			t.Errorf("InferenceProfileID(%q) = %q, want %q", region, got, want)
+		}
+	}
+}
+
+func TestInvokeInferenceProfileUsesEachRegionsProfile(t *testing.T) {
+	throttled := &recordingClient{err: &types.ThrottlingException{Message: aws.String("slow down")}}
+	fallback := &recordingClient{}
+	client := &FailoverClient{
+		Regions: []string{"us-west-2", "eu-west-1"},
+		Clients: []InvokeModelAPI{throttled, fallback},
+	}
+
+	params := &bedrockruntime.InvokeModelInput{Body: []byte("{}")}
+	if _, err := client.InvokeInferenceProfile(context.Background(), "amazon.nova-micro-v1:0", params); err != nil {
+		t.Fatal(err)
+	}
+	if len(throttled.modelIDs) != 1 || throttled.modelIDs[0] != "us.amazon.nova-micro-v1:0" {
+		t.Errorf("first region invoked with %v", throttled.modelIDs)
+	}
+	if len(fallback.modelIDs) != 1 || fallback.modelIDs[0] != "eu.amazon.nova-micro-v1:0" {
+		t.Errorf("failover region invoked with %v", fallback.modelIDs)
+	}
+	if params.ModelId != nil {
+		t.Error("the caller's input was modified")
+	}
+}
+
+func TestInvokeModelStopsWhenTheContextIsCancelled(t *testing.T) {
+	// The endpoint does not answer until the test ends, so only cancellation can end the call
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+	}))
+	defer server.Close()
+	defer close(release)
+
+	sdkClient := bedrockruntime.New(bedrockruntime.Options{
+		Region:       "us-west-2",
+		BaseEndpoint: aws.String(server.URL),
+		Credentials:  aws.AnonymousCredentials{},
+	})
+	next := &recordingClient{}
+	client := &FailoverClient{
+		Regions: []string{"us-west-2", "eu-west-1"},
+		Clients: []InvokeModelAPI{sdkClient, next},
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+	start := time.Now()
+	_, err := client.InvokeModel(ctx, &bedrockruntime.InvokeModelInput{ModelId: aws.String("model"), Body: []byte("{}")})
+
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("err = %v, want context.Canceled", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("cancelled call took %s to return", elapsed)
+	}
+	if len(next.modelIDs) != 0 {
+		t.Error("a cancelled call failed over to the next region")
+	}
+}
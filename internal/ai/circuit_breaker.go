@@ -0,0 +1,103 @@
+package ai
+
+import (
+	"context"
+	"imageclust/internal/logger"
+	"sync"
+	"time"
+)
+
+// Circuit breaker defaults applied to every service
+var (
+	CircuitBreakerThreshold = 3           // Consecutive failures before the circuit opens
+	CircuitBreakerCooldown  = time.Minute // How long an open circuit short-circuits calls
+)
+
+// CircuitBreaker stops calling a service after repeated consecutive failures
+type CircuitBreaker struct {
+	mu                  sync.Mutex
+	threshold           int
+	cooldown            time.Duration
+	consecutiveFailures int
+	openUntil           time.Time
+}
+
+// NewCircuitBreaker returns a circuit breaker that opens after threshold consecutive failures
+func NewCircuitBreaker(threshold int, cooldown time.Duration) *CircuitBreaker {
+	return &CircuitBreaker{
+		threshold: threshold,
+		cooldown:  cooldown,
+	}
+}
+
+// Allow reports whether a call may proceed
+func (cb *CircuitBreaker) Allow() bool {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	return time.Now().After(cb.openUntil)
+}
+
+// RecordSuccess closes the circuit
+func (cb *CircuitBreaker) RecordSuccess() {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	cb.consecutiveFailures = 0
+	cb.openUntil = time.Time{}
+}
+
+// RecordFailure counts a failure and opens the circuit once the threshold is reached.
+// A failure after the cooldown expires reopens the circuit immediately.
+func (cb *CircuitBreaker) RecordFailure() {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	cb.consecutiveFailures++
+	if cb.consecutiveFailures >= cb.threshold {
+		cb.openUntil = time.Now().Add(cb.cooldown)
+	}
+}
+
+var (
+	breakers   = make(map[int]*CircuitBreaker)
+	breakersMu sync.Mutex
+)
+
+// breakerFor returns the circuit breaker for a service type, creating it on first use
+func breakerFor(serviceType int) *CircuitBreaker {
+	breakersMu.Lock()
+	defer breakersMu.Unlock()
+	cb, ok := breakers[serviceType]
+	if !ok {
+		cb = NewCircuitBreaker(CircuitBreakerThreshold, CircuitBreakerCooldown)
+		breakers[serviceType] = cb
+	}
+	return cb
+}
+
+// withCircuitBreaker runs generate unless the service's circuit is open, in which case the sentinel is returned immediately.
+// The call waits for a free slot under the global concurrency cap, giving up when ctx is cancelled.
+// Failures caused by cancellation are not counted against the service.
+func withCircuitBreaker(ctx context.Context, serviceType int, generate func() (string, string, string)) (string, string, string) {
+	cb := breakerFor(serviceType)
+	if !cb.Allow() {
+		logger.Warnf("Circuit open for service %d, skipping call", serviceType)
+		return NoTitle, NoPhrase, ""
+	}
+
+	select {
+	case callSlots <- struct{}{}:
+	case <-ctx.Done():
+		return NoTitle, NoPhrase, ""
+	}
+	title, catchyPhrase, category := generate()
+	<-callSlots
+
+	if ctx.Err() != nil {
+		return title, catchyPhrase, category
+	}
+	if title == NoTitle {
+		cb.RecordFailure()
+	} else {
+		cb.RecordSuccess()
+	}
+	return title, catchyPhrase, category
+}
@@ -0,0 +1,103 @@
+package ai
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestCircuitBreakerShortCircuitsAfterTripping(t *testing.T) {
+	// An unused service type gets its own breaker
+	const serviceType = 99
+	defer func() {
+		breakersMu.Lock()
+		delete(breakers, serviceType)
+		breakersMu.Unlock()
+	}()
+
+	calls := 0
+	failing := func() (string, string, string) {
+		calls++
+		return NoTitle, NoPhrase, ""
+	}
+	for i := 0; i < CircuitBreakerThreshold; i++ {
+		withCircuitBreaker(context.Background(), serviceType, failing)
+	}
+	if calls != CircuitBreakerThreshold {
+		t.Fatalf("generator called %d times before tripping, want %d", calls, CircuitBreakerThreshold)
+	}
+
+	start := time.Now()
+	title, phrase, _ := withCircuitBreaker(context.Background(), serviceType, failing)
+	if calls != CircuitBreakerThreshold {
+		t.Error("generator called while the circuit was open")
+	}
+	if title != NoTitle || phrase != NoPhrase {
+		t.Errorf("got %q, %q, want the sentinels", title, phrase)
+	}
+	if elapsed := time.Since(start); elapsed > 100*time.Millisecond {
+		t.Errorf("open circuit took %v to return", elapsed)
+	}
+}
+
+func TestCircuitBreakerClosesOnSuccess(t *testing.T) {
+	cb := NewCircuitBreaker(2, time.Minute)
+	cb.RecordFailure()
+	cb.RecordSuccess()
+	cb.RecordFailure()
+	if !cb.Allow() {
+		t.Error("circuit opened although the failures were not consecutive")
+	}
+	cb.RecordFailure()
+	if cb.Allow() {
+		t.Error("circuit still closed after two consecutive failures")
+	}
+}
+
+func TestUnknownServiceReturnsSentinels(t *testing.T) {
+	title, phrase := GenerateTitleAndCatchyPhrase(context.Background(), "labels", 1, 0)
+	if title != NoTitle || phrase != NoPhrase {
+		t.Errorf("got %q, %q, want %q, %q", title, phrase, NoTitle, NoPhrase)
+	}
+}
+
+func TestConcurrentModelCallsStayUnderTheCap(t *testing.T) {
+	const serviceType, maxCalls = 98, 2
+	original := callSlots
+	defer func() {
+		callSlots = original
+		breakersMu.Lock()
+		delete(breakers, serviceType)
+		breakersMu.Unlock()
+	}()
+	SetMaxConcurrentCalls(maxCalls)
+
+	var mu sync.Mutex
+	inFlight, peak := 0, 0
+	generate := func() (string, string, string) {
+		mu.Lock()
+		inFlight++
+		peak = max(peak, inFlight)
+		mu.Unlock()
+		time.Sleep(10 * time.Millisecond)
+		mu.Lock()
+		inFlight--
+		mu.Unlock()
+		return "Title", "Phrase", ""
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			withCircuitBreaker(context.Background(), serviceType, generate)
+		}()
+	}
+	wg.Wait()
+
+	if peak > maxCalls {
+		t.Errorf("%d model calls ran at once, want at most %d", peak, maxCalls)
+	}
+}
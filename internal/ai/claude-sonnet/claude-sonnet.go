@@ -3,14 +3,14 @@ package claude_sonnet
 import (
 	"context"
 	"encoding/json"
-	"fmt"
-	"log"
+	"imageclust/internal/ai/bedrock"
+	"imageclust/internal/ai/prompt"
+	"imageclust/internal/logger"
 	"strings"
 	"time"
 	"unicode/utf8"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
-	"github.com/aws/aws-sdk-go-v2/config"
 	"github.com/aws/aws-sdk-go-v2/service/bedrockruntime"
 )
 
@@ -34,42 +34,52 @@ type Claude3Response struct {
 	} `json:"content"`
 }
 
+// defaultPrompt is used unless PROMPT_TEMPLATE_DIR holds a claude-sonnet.tmpl override
+const defaultPrompt = `You are an assistant that generates concise and creative titles and catchy phrases for image clusters.
+Each title must be no more than {{.TitleMaxChars}} characters, and each catchy phrase must be no more than {{.PhraseMaxChars}} characters. 
+Return the results in JSON format with the fields 'title'{{if .Category}}, 'catchy_phrase' and 'category'{{else}} and 'catchy_phrase'{{end}} only.
+{{- if .Category}}
+The category is a short product category for the cluster, such as "Summer Dresses".{{end}}
+Do not include any extra text, markdown, or code block formatting in your response.
+Ensure that only the JSON object is returned.
+
+Features: {{.Features}}.`
+
 // BedrockClient implements the AIClient interface using AWS Bedrock's Claude
 type BedrockClient struct {
-	client *bedrockruntime.Client
+	client bedrock.InvokeModelAPI
 }
 
-// NewBedrockClient returns a new instance of BedrockClient
+// NewBedrockClient returns a new instance of BedrockClient that fails over across the configured regions
 func NewBedrockClient() (*BedrockClient, error) {
-	cfg, err := config.LoadDefaultConfig(context.Background(),
-		config.WithRegion("us-west-2"),
-	)
+	client, err := bedrock.NewFailoverClient(bedrock.Regions())
 	if err != nil {
-		return nil, fmt.Errorf("unable to load AWS config: %v", err)
+		return nil, err
 	}
-
-	client := bedrockruntime.NewFromConfig(cfg)
 	return &BedrockClient{client: client}, nil
 }
 
 // GenerateTitleAndCatchyPhrase generates a title and a catchy phrase using Claude via AWS Bedrock
-func (b *BedrockClient) GenerateTitleAndCatchyPhrase(aggregatedText string, retries int) (string, string) {
+func (b *BedrockClient) GenerateTitleAndCatchyPhrase(ctx context.Context, aggregatedText string, retries int) (string, string, string) {
 	sanitizedText := truncateAndSanitize(aggregatedText, 1000)
+	promptText, err := prompt.Render(ctx, "claude-sonnet", defaultPrompt, prompt.NewData(sanitizedText))
+	if err != nil {
+		logger.Errorf("Error building prompt: %v", err)
+		return "No Title", "No phrase available", ""
+	}
 
 	for attempt := 0; attempt < retries; attempt++ {
+		if ctx.Err() != nil {
+			break
+		}
+
 		// Create the request body using the Messages format
 		requestBody := Claude3Request{
 			AnthropicVersion: "bedrock-2023-05-31",
 			Messages: []Message{
 				{
-					Role: "user",
-					Content: fmt.Sprintf(`You are an assistant that generates concise and creative titles and catchy phrases for image clusters.
-Each title must be no more than 25 characters, and each catchy phrase must be no more than 100 characters. 
-Return the results in JSON format with the fields 'title' and 'catchy_phrase' only.
-Do not include any extra text, markdown, or code block formatting in your response.
-Ensure that only the JSON object is returned.
-
-Features: %s.`, sanitizedText),
+					Role:    "user",
+					Content: promptText,
 				},
 			},
 			MaxTokens:   100,
@@ -79,13 +89,13 @@ Features: %s.`, sanitizedText),
 		// Marshal the request body
 		requestData, err := json.Marshal(requestBody)
 		if err != nil {
-			log.Printf("Error marshaling request body: %v", err)
+			logger.Warnf("Error marshaling request body: %v", err)
 			continue
 		}
 
 		// Log the request being sent to Claude
-		log.Println("Sending request to Claude 3.5 Sonnet via Bedrock:")
-		log.Println(string(requestData))
+		logger.Debugf("Sending request to Claude 3.5 Sonnet via Bedrock:")
+		logger.Debugf("%s", string(requestData))
 
 		// Create the Bedrock invoke request
 		input := &bedrockruntime.InvokeModelInput{
@@ -96,9 +106,12 @@ Features: %s.`, sanitizedText),
 		}
 
 		// Invoke the model
-		output, err := b.client.InvokeModel(context.Background(), input)
+		output, err := b.client.InvokeModel(ctx, input)
 		if err != nil {
-			log.Printf("Error invoking Bedrock model: %v", err)
+			logger.Warnf("Error invoking Bedrock model: %v", err)
+			if ctx.Err() != nil {
+				break
+			}
 			time.Sleep(2 * time.Second)
 			continue
 		}
@@ -107,14 +120,14 @@ Features: %s.`, sanitizedText),
 		var claudeResp Claude3Response
 		err = json.Unmarshal(output.Body, &claudeResp)
 		if err != nil {
-			log.Printf("Error unmarshaling Claude response: %v", err)
+			logger.Warnf("Error unmarshaling Claude response: %v", err)
 			time.Sleep(2 * time.Second)
 			continue
 		}
 
 		// Make sure we have content in the response
 		if len(claudeResp.Content) == 0 {
-			log.Println("Empty response from Claude")
+			logger.Warnf("Empty response from Claude")
 			time.Sleep(2 * time.Second)
 			continue
 		}
@@ -122,32 +135,32 @@ Features: %s.`, sanitizedText),
 		responseText := claudeResp.Content[0].Text
 
 		// Log the response received from Claude
-		log.Println("Received response from Claude:")
-		log.Println(responseText)
+		logger.Debugf("Received response from Claude:")
+		logger.Debugf("%s", responseText)
 
 		// Attempt to parse the response as JSON
 		var result map[string]string
 		err = json.Unmarshal([]byte(responseText), &result)
 		if err != nil {
-			log.Printf("Error unmarshaling response JSON: %v", err)
+			logger.Warnf("Error unmarshaling response JSON: %v", err)
 			time.Sleep(2 * time.Second)
 			continue
 		}
 
-		// Extract title and catchy_phrase from the response
+		// Extract title and catchy_phrase from the response; category is only present when requested
 		title, okTitle := result["title"]
 		catchyPhrase, okPhrase := result["catchy_phrase"]
 		if !okTitle || !okPhrase {
-			log.Println("Claude response missing 'title' or 'catchy_phrase'")
+			logger.Warnf("Claude response missing 'title' or 'catchy_phrase'")
 			time.Sleep(2 * time.Second)
 			continue
 		}
 
-		return title, catchyPhrase
+		return title, catchyPhrase, strings.TrimSpace(result["category"])
 	}
 
-	log.Println("Failed to generate title and catchy phrase after retries")
-	return "No Title", "No phrase available"
+	logger.Errorf("Failed to generate title and catchy phrase after retries")
+	return "No Title", "No phrase available", ""
 }
 
 func truncateAndSanitize(input string, maxLen int) string {
@@ -169,11 +182,76 @@ func truncateAndSanitize(input string, maxLen int) string {
 }
 
 // GenerateTitleAndCatchyPhrase is a package-level function that creates a new BedrockClient and calls its method
-func GenerateTitleAndCatchyPhrase(aggregatedText string, retries int) (string, string) {
+func GenerateTitleAndCatchyPhrase(ctx context.Context, aggregatedText string, retries int) (string, string, string) {
+	client, err := NewBedrockClient()
+	if err != nil {
+		logger.Errorf("Error creating Bedrock client: %v", err)
+		return "No Title", "No phrase available", ""
+	}
+	return client.GenerateTitleAndCatchyPhrase(ctx, aggregatedText, retries)
+}
+
+// GenerateSummary writes a paragraph describing the whole collection from its clusters using Claude via AWS Bedrock.
+// It returns an empty string when every attempt fails.
+func (b *BedrockClient) GenerateSummary(ctx context.Context, clusterText string, retries int) string {
+	promptText, err := prompt.RenderSummary("claude-sonnet", truncateAndSanitize(clusterText, prompt.SummaryMaxInputChars))
+	if err != nil {
+		logger.Errorf("Error building summary prompt: %v", err)
+		return ""
+	}
+
+	requestData, err := json.Marshal(Claude3Request{
+		AnthropicVersion: "bedrock-2023-05-31",
+		Messages:         []Message{{Role: "user", Content: promptText}},
+		MaxTokens:        400,
+		Temperature:      0.7,
+	})
+	if err != nil {
+		logger.Warnf("Error marshaling request body: %v", err)
+		return ""
+	}
+
+	for attempt := 0; attempt < retries; attempt++ {
+		if ctx.Err() != nil {
+			break
+		}
+
+		output, err := b.client.InvokeModel(ctx, &bedrockruntime.InvokeModelInput{
+			ModelId:     aws.String("anthropic.claude-3-sonnet-20240229-v1:0"),
+			Body:        requestData,
+			ContentType: aws.String("application/json"),
+			Accept:      aws.String("application/json"),
+		})
+		if err != nil {
+			logger.Warnf("Error invoking Bedrock model: %v", err)
+			if ctx.Err() != nil {
+				break
+			}
+			time.Sleep(2 * time.Second)
+			continue
+		}
+
+		var claudeResp Claude3Response
+		if err := json.Unmarshal(output.Body, &claudeResp); err != nil || len(claudeResp.Content) == 0 {
+			logger.Warnf("Empty or invalid summary response from Claude: %v", err)
+			time.Sleep(2 * time.Second)
+			continue
+		}
+		if summary := strings.TrimSpace(claudeResp.Content[0].Text); summary != "" {
+			return summary
+		}
+	}
+
+	logger.Errorf("Failed to generate collection summary after retries")
+	return ""
+}
+
+// GenerateSummary is a package-level function that creates a new BedrockClient and calls its method
+func GenerateSummary(ctx context.Context, clusterText string, retries int) string {
 	client, err := NewBedrockClient()
 	if err != nil {
-		log.Printf("Error creating Bedrock client: %v", err)
-		return "No Title", "No phrase available"
+		logger.Errorf("Error creating Bedrock client: %v", err)
+		return ""
 	}
-	return client.GenerateTitleAndCatchyPhrase(aggregatedText, retries)
+	return client.GenerateSummary(ctx, clusterText, retries)
 }
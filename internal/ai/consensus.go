@@ -0,0 +1,121 @@
+package ai
+
+import (
+	"strings"
+	"unicode/utf8"
+)
+
+// Strategies for selecting a cluster's default title from the outputs of every service
+const (
+	ConsensusFirst    = "first"    // First successful output in display order
+	ConsensusShortest = "shortest" // Shortest title within the title limit
+	ConsensusMajority = "majority" // Title returned by the most services, falling back to first
+)
+
+// TruncateAtWord shortens text to at most maxChars characters, cutting at the last word boundary
+// and ending with an ellipsis. Text within the limit, or a non-positive limit, leaves it unchanged.
+func TruncateAtWord(text string, maxChars int) string {
+	runes := []rune(strings.TrimSpace(text))
+	if maxChars <= 0 || len(runes) <= maxChars {
+		return string(runes)
+	}
+	if maxChars == 1 {
+		return "…"
+	}
+
+	// Leave room for the ellipsis and prefer to cut at a space
+	cut := runes[:maxChars-1]
+	if next := runes[maxChars-1]; next != ' ' {
+		if lastSpace := strings.LastIndex(string(cut), " "); lastSpace > 0 {
+			cut = []rune(string(cut)[:lastSpace])
+		}
+	}
+	return strings.TrimRight(string(cut), " ,.;:-") + "…"
+}
+
+// SelectConsensusOutput selects the output used as the cluster's default title and catchy phrase.
+// Outputs carrying the failure sentinel are ignored; false is returned when none remain.
+func SelectConsensusOutput(outputs []ModelOutput, strategy string, maxTitleLength int) (ModelOutput, bool) {
+	candidates := make([]ModelOutput, 0, len(outputs))
+	for _, output := range outputs {
+		if output.Title != "" && output.Title != NoTitle {
+			candidates = append(candidates, output)
+		}
+	}
+	if len(candidates) == 0 {
+		return ModelOutput{}, false
+	}
+
+	switch strategy {
+	case ConsensusShortest:
+		best := -1
+		for i, candidate := range candidates {
+			length := utf8.RuneCountInString(candidate.Title)
+			if length > maxTitleLength {
+				continue
+			}
+			if best == -1 || length < utf8.RuneCountInString(candidates[best].Title) {
+				best = i
+			}
+		}
+		// No title respects the limit, so fall back to the shortest overall
+		if best == -1 {
+			best = 0
+			for i, candidate := range candidates {
+				if utf8.RuneCountInString(candidate.Title) < utf8.RuneCountInString(candidates[best].Title) {
+					best = i
+				}
+			}
+		}
+		return candidates[best], true
+
+	case ConsensusMajority:
+		counts := make(map[string]int)
+		best := 0
+		for i, candidate := range candidates {
+			key := strings.ToLower(strings.TrimSpace(candidate.Title))
+			counts[key]++
+			bestKey := strings.ToLower(strings.TrimSpace(candidates[best].Title))
+			if counts[key] > counts[bestKey] {
+				best = i
+			}
+		}
+		return candidates[best], true
+
+	default:
+		return candidates[0], true
+	}
+}
+
+// TitleSimilarity scores how alike two titles are from 0 to 1, ignoring case and surrounding whitespace.
+// It is one minus the edit distance between the titles divided by the length of the longer one.
+func TitleSimilarity(a, b string) float64 {
+	ra := []rune(strings.ToLower(strings.TrimSpace(a)))
+	rb := []rune(strings.ToLower(strings.TrimSpace(b)))
+	longest := len(ra)
+	if len(rb) > longest {
+		longest = len(rb)
+	}
+	if longest == 0 {
+		return 1
+	}
+
+	// Levenshtein distance, keeping only the previous row of the table
+	previous := make([]int, len(rb)+1)
+	current := make([]int, len(rb)+1)
+	for j := range previous {
+		previous[j] = j
+	}
+	for i := 1; i <= len(ra); i++ {
+		current[0] = i
+		for j := 1; j <= len(rb); j++ {
+			cost := 1
+			if ra[i-1] == rb[j-1] {
+				cost = 0
+			}
+			current[j] = min(previous[j]+1, current[j-1]+1, previous[j-1]+cost)
+		}
+		previous, current = current, previous
+	}
+	return 1 - float64(previous[len(rb)])/float64(longest)
+}
@@ -0,0 +1,53 @@
+package ai
+
+import "testing"
+
+func TestSelectConsensusOutput(t *testing.T) {
+	outputs := []ModelOutput{
+		{ServiceName: "haiku", Title: NoTitle, CatchyPhrase: NoPhrase},
+		{ServiceName: "sonnet", Title: "Everyday Running Shoes"},
+		{ServiceName: "nova", Title: "Running Shoes"},
+		{ServiceName: "openai", Title: "everyday running shoes "},
+		{ServiceName: "gpt", Title: "Shoes"},
+	}
+
+	tests := []struct {
+		strategy  string
+		maxLength int
+		want      string
+	}{
+		{strategy: ConsensusFirst, maxLength: 50, want: "sonnet"},
+		{strategy: "", maxLength: 50, want: "sonnet"},
+		{strategy: ConsensusShortest, maxLength: 50, want: "gpt"},
+		{strategy: ConsensusMajority, maxLength: 50, want: "sonnet"},
+	}
+	for _, tt := range tests {
+		got, ok := SelectConsensusOutput(outputs, tt.strategy, tt.maxLength)
+		if !ok || got.ServiceName != tt.want {
+			t.Errorf("strategy %q selected %q (ok %v), want %q", tt.strategy, got.ServiceName, ok, tt.want)
+		}
+	}
+}
+
+func TestSelectConsensusShortestRespectsTheLimit(t *testing.T) {
+	outputs := []ModelOutput{
+		{ServiceName: "sonnet", Title: "Everyday Running Shoes"},
+		{ServiceName: "nova", Title: "Trail Running Shoes For Mud"},
+	}
+
+	// Both titles exceed the limit, so the shortest overall is used
+	if got, _ := SelectConsensusOutput(outputs, ConsensusShortest, 10); got.ServiceName != "sonnet" {
+		t.Errorf("selected %q, want the shortest title overall", got.ServiceName)
+	}
+	outputs = append(outputs, ModelOutput{ServiceName: "gpt", Title: "Sneakers"})
+	if got, _ := SelectConsensusOutput(outputs, ConsensusShortest, 10); got.ServiceName != "gpt" {
+		t.Errorf("selected %q, want the title within the limit", got.ServiceName)
+	}
+}
+
+func TestSelectConsensusOutputWithoutSuccesses(t *testing.T) {
+	outputs := []ModelOutput{{ServiceName: "haiku", Title: NoTitle}, {ServiceName: "nova"}}
+	if _, ok := SelectConsensusOutput(outputs, ConsensusMajority, 50); ok {
+		t.Error("a consensus was selected although every service failed")
+	}
+}
@@ -2,12 +2,15 @@ package openai
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
+	"imageclust/internal/ai/prompt"
+	"imageclust/internal/logger"
 	"io"
-	"log"
 	"net/http"
 	"os"
+	"strings"
 	"time"
 )
 
@@ -43,6 +46,35 @@ type OpenAIClient struct {
 	Model OpenAIModel
 }
 
+// httpClient is shared by every OpenAI call so connections are pooled and reused
+var httpClient = newHTTPClient(60*time.Second, 8)
+
+// newHTTPClient builds a client that keeps up to maxIdleConnsPerHost connections open to the API.
+// The default transport keeps only two, which forces concurrent cluster titling to reconnect.
+func newHTTPClient(timeout time.Duration, maxIdleConnsPerHost int) *http.Client {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.MaxIdleConnsPerHost = maxIdleConnsPerHost
+	return &http.Client{Timeout: timeout, Transport: transport}
+}
+
+// ConfigureHTTPClient replaces the shared client; non-positive values keep the defaults.
+// It must be called before any titles are generated.
+func ConfigureHTTPClient(timeout time.Duration, maxIdleConnsPerHost int) {
+	if timeout <= 0 {
+		timeout = httpClient.Timeout
+	}
+	if maxIdleConnsPerHost <= 0 {
+		maxIdleConnsPerHost = httpClient.Transport.(*http.Transport).MaxIdleConnsPerHost
+	}
+	httpClient = newHTTPClient(timeout, maxIdleConnsPerHost)
+}
+
+// drainAndClose reads any unread response body so the connection can return to the pool
+func drainAndClose(body io.ReadCloser) {
+	io.Copy(io.Discard, body)
+	body.Close()
+}
+
 // NewOpenAIClient returns a new instance of OpenAIClient
 func NewOpenAIClient(model OpenAIModel) *OpenAIClient {
 	return &OpenAIClient{
@@ -50,26 +82,41 @@ func NewOpenAIClient(model OpenAIModel) *OpenAIClient {
 	}
 }
 
+// defaultSystemPrompt is used unless PROMPT_TEMPLATE_DIR holds an openai.tmpl override.
+// The features are always sent separately as the user message.
+const defaultSystemPrompt = "You are an assistant that generates concise and creative titles and catchy phrases for image clusters. " +
+	"Each title must be no more than {{.TitleMaxChars}} characters, and each catchy phrase must be no more than {{.PhraseMaxChars}} characters. " +
+	"Return the results in JSON format with the fields 'title'{{if .Category}}, 'catchy_phrase' and 'category'{{else}} and 'catchy_phrase'{{end}} only. " +
+	"{{if .Category}}The category is a short product category for the cluster, such as \"Summer Dresses\". {{end}}" +
+	"Do not include any Markdown or code block formatting in your response. " +
+	"Ensure that only one JSON object is returned."
+
 // GenerateTitleAndCatchyPhrase generates a title and a catchy phrase using OpenAI's GPT model
-func (o *OpenAIClient) GenerateTitleAndCatchyPhrase(aggregatedText string, retries int) (string, string) {
+func (o *OpenAIClient) GenerateTitleAndCatchyPhrase(ctx context.Context, aggregatedText string, retries int) (string, string, string) {
 	apiKey := os.Getenv("OPENAI_API_KEY")
 	if apiKey == "" {
-		log.Println("OPENAI_API_KEY is not set")
-		return "No Title", "No phrase available"
+		logger.Warnf("OPENAI_API_KEY is not set")
+		return "No Title", "No phrase available", ""
+	}
+
+	systemPrompt, err := prompt.Render(ctx, "openai", defaultSystemPrompt, prompt.NewData(aggregatedText))
+	if err != nil {
+		logger.Errorf("Error building prompt: %v", err)
+		return "No Title", "No phrase available", ""
 	}
 
 	for attempt := 0; attempt < retries; attempt++ {
+		if ctx.Err() != nil {
+			break
+		}
+
 		// Construct the request body
 		requestBody := map[string]interface{}{
 			"model": o.Model.ModelName,
 			"messages": []map[string]string{
 				{
-					"role": "system",
-					"content": "You are an assistant that generates concise and creative titles and catchy phrases for image clusters. " +
-						"Each title must be no more than 25 characters, and each catchy phrase must be no more than 100 characters. " +
-						"Return the results in JSON format with the fields 'title' and 'catchy_phrase' only. " +
-						"Do not include any Markdown or code block formatting in your response. " +
-						"Ensure that only one JSON object is returned.",
+					"role":    "system",
+					"content": systemPrompt,
 				},
 				{
 					"role":    "user",
@@ -81,25 +128,25 @@ func (o *OpenAIClient) GenerateTitleAndCatchyPhrase(aggregatedText string, retri
 		// Marshal the request body to JSON
 		requestData, err := json.Marshal(requestBody)
 		if err != nil {
-			log.Printf("Error marshaling OpenAI request body: %v", err)
+			logger.Warnf("Error marshaling OpenAI request body: %v", err)
 			continue
 		}
 
 		// Log the request being sent to GPT
-		log.Printf("Sending request to OpenAI (%s):", o.Model.ServiceName)
+		logger.Debugf("Sending request to OpenAI (%s):", o.Model.ServiceName)
 		var prettyRequest bytes.Buffer
 		err = json.Indent(&prettyRequest, requestData, "", "  ")
 		if err != nil {
-			log.Printf("Error formatting request JSON: %v", err)
-			log.Println(string(requestData)) // Fallback to raw JSON
+			logger.Warnf("Error formatting request JSON: %v", err)
+			logger.Debugf("%s", string(requestData)) // Fallback to raw JSON
 		} else {
-			log.Println(prettyRequest.String())
+			logger.Debugf("%s", prettyRequest.String())
 		}
 
 		// Create the HTTP POST request
-		req, err := http.NewRequest("POST", "https://api.openai.com/v1/chat/completions", bytes.NewBuffer(requestData))
+		req, err := http.NewRequestWithContext(ctx, "POST", "https://api.openai.com/v1/chat/completions", bytes.NewBuffer(requestData))
 		if err != nil {
-			log.Printf("Error creating OpenAI request: %v", err)
+			logger.Warnf("Error creating OpenAI request: %v", err)
 			continue
 		}
 
@@ -107,28 +154,26 @@ func (o *OpenAIClient) GenerateTitleAndCatchyPhrase(aggregatedText string, retri
 		req.Header.Set("Authorization", "Bearer "+apiKey)
 		req.Header.Set("Content-Type", "application/json")
 
-		// Initialize the HTTP client with a timeout
-		client := &http.Client{
-			Timeout: 60 * time.Second, // Increased timeout for API response
-		}
-
 		// Send the request to OpenAI
-		resp, err := client.Do(req)
+		resp, err := httpClient.Do(req)
 		if err != nil {
-			log.Printf("Error performing OpenAI request: %v", err)
+			logger.Warnf("Error performing OpenAI request: %v", err)
+			if ctx.Err() != nil {
+				break
+			}
 			time.Sleep(2 * time.Second) // Simple backoff strategy
 			continue
 		}
 
 		// Handle rate limiting or server errors
 		if resp.StatusCode == http.StatusTooManyRequests {
-			log.Printf("OpenAI rate limit exceeded. Attempt %d/%d", attempt+1, retries)
-			resp.Body.Close()
+			logger.Warnf("OpenAI rate limit exceeded. Attempt %d/%d", attempt+1, retries)
+			drainAndClose(resp.Body)
 			time.Sleep(2 * time.Second)
 			continue
 		} else if resp.StatusCode != http.StatusOK {
 			bodyBytes, _ := io.ReadAll(resp.Body)
-			log.Printf("OpenAI API error. Status: %d, Response: %s", resp.StatusCode, string(bodyBytes))
+			logger.Warnf("OpenAI API error. Status: %d, Response: %s", resp.StatusCode, string(bodyBytes))
 			resp.Body.Close()
 			time.Sleep(2 * time.Second)
 			continue
@@ -137,50 +182,132 @@ func (o *OpenAIClient) GenerateTitleAndCatchyPhrase(aggregatedText string, retri
 		// Read and decode the response
 		var gptResp GPTResponse
 		err = json.NewDecoder(resp.Body).Decode(&gptResp)
-		resp.Body.Close()
+		drainAndClose(resp.Body)
 		if err != nil {
-			log.Printf("Error decoding OpenAI response: %v", err)
+			logger.Warnf("Error decoding OpenAI response: %v", err)
 			continue
 		}
 
 		// Check if any choices are returned
 		if len(gptResp.Choices) == 0 {
-			log.Println("No choices returned from OpenAI")
+			logger.Warnf("No choices returned from OpenAI")
 			continue
 		}
 
 		assistantReply := gptResp.Choices[0].Message.Content
 
 		// Log the response received from GPT
-		log.Printf("Received response from OpenAI (%s):", o.Model.ServiceName)
-		log.Println(assistantReply)
+		logger.Debugf("Received response from OpenAI (%s):", o.Model.ServiceName)
+		logger.Debugf("%s", assistantReply)
 
 		// Attempt to unmarshal the JSON response
 		var result map[string]string
 		err = json.Unmarshal([]byte(assistantReply), &result)
 		if err != nil {
-			log.Printf("Error unmarshaling OpenAI response JSON: %v", err)
+			logger.Warnf("Error unmarshaling OpenAI response JSON: %v", err)
 			continue
 		}
 
-		// Extract title and catchy_phrase from the response
+		// Extract title and catchy_phrase from the response; category is only present when requested
 		title, okTitle := result["title"]
 		catchyPhrase, okPhrase := result["catchy_phrase"]
 		if !okTitle || !okPhrase {
-			log.Println("OpenAI response missing 'title' or 'catchy_phrase'")
+			logger.Warnf("OpenAI response missing 'title' or 'catchy_phrase'")
 			continue
 		}
 
-		return title, catchyPhrase
+		return title, catchyPhrase, strings.TrimSpace(result["category"])
 	}
 
 	// If all retries fail, return default values
-	log.Printf("Failed to generate title and catchy phrase after %d retries using %s", retries, o.Model.ServiceName)
-	return "No Title", "No phrase available"
+	logger.Errorf("Failed to generate title and catchy phrase after %d retries using %s", retries, o.Model.ServiceName)
+	return "No Title", "No phrase available", ""
 }
 
 // GenerateTitleAndCatchyPhrase is a package-level function that creates a new OpenAIClient and calls its method
-func GenerateTitleAndCatchyPhrase(aggregatedText string, retries int, model OpenAIModel) (string, string) {
+func GenerateTitleAndCatchyPhrase(ctx context.Context, aggregatedText string, retries int, model OpenAIModel) (string, string, string) {
 	client := NewOpenAIClient(model)
-	return client.GenerateTitleAndCatchyPhrase(aggregatedText, retries)
+	return client.GenerateTitleAndCatchyPhrase(ctx, aggregatedText, retries)
+}
+
+// GenerateSummary writes a paragraph describing the whole collection from its clusters using OpenAI's GPT model.
+// It returns an empty string when every attempt fails.
+func (o *OpenAIClient) GenerateSummary(ctx context.Context, clusterText string, retries int) string {
+	apiKey := os.Getenv("OPENAI_API_KEY")
+	if apiKey == "" {
+		logger.Warnf("OPENAI_API_KEY is not set")
+		return ""
+	}
+
+	if runes := []rune(clusterText); len(runes) > prompt.SummaryMaxInputChars {
+		clusterText = string(runes[:prompt.SummaryMaxInputChars])
+	}
+	promptText, err := prompt.RenderSummary("openai", clusterText)
+	if err != nil {
+		logger.Errorf("Error building summary prompt: %v", err)
+		return ""
+	}
+
+	requestData, err := json.Marshal(map[string]interface{}{
+		"model": o.Model.ModelName,
+		"messages": []map[string]string{
+			{
+				"role":    "user",
+				"content": promptText,
+			},
+		},
+	})
+	if err != nil {
+		logger.Warnf("Error marshaling OpenAI request body: %v", err)
+		return ""
+	}
+
+	for attempt := 0; attempt < retries; attempt++ {
+		if ctx.Err() != nil {
+			break
+		}
+
+		req, err := http.NewRequestWithContext(ctx, "POST", "https://api.openai.com/v1/chat/completions", bytes.NewBuffer(requestData))
+		if err != nil {
+			logger.Warnf("Error creating OpenAI request: %v", err)
+			continue
+		}
+		req.Header.Set("Authorization", "Bearer "+apiKey)
+		req.Header.Set("Content-Type", "application/json")
+
+		resp, err := httpClient.Do(req)
+		if err != nil {
+			logger.Warnf("Error performing OpenAI request: %v", err)
+			if ctx.Err() != nil {
+				break
+			}
+			time.Sleep(2 * time.Second)
+			continue
+		}
+		if resp.StatusCode != http.StatusOK {
+			logger.Warnf("OpenAI API error. Status: %d. Attempt %d/%d", resp.StatusCode, attempt+1, retries)
+			drainAndClose(resp.Body)
+			time.Sleep(2 * time.Second)
+			continue
+		}
+
+		var gptResp GPTResponse
+		err = json.NewDecoder(resp.Body).Decode(&gptResp)
+		drainAndClose(resp.Body)
+		if err != nil || len(gptResp.Choices) == 0 {
+			logger.Warnf("Empty or invalid summary response from OpenAI: %v", err)
+			continue
+		}
+		if summary := strings.TrimSpace(gptResp.Choices[0].Message.Content); summary != "" {
+			return summary
+		}
+	}
+
+	logger.Errorf("Failed to generate collection summary after %d retries using %s", retries, o.Model.ServiceName)
+	return ""
+}
+
+// GenerateSummary is a package-level function that creates a new OpenAIClient and calls its method
+func GenerateSummary(ctx context.Context, clusterText string, retries int, model OpenAIModel) string {
+	return NewOpenAIClient(model).GenerateSummary(ctx, clusterText, retries)
 }
@@ -0,0 +1,148 @@
+package openai
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"imageclust/internal/ai/prompt"
+)
+
+// roundTripFunc lets a test answer requests without a network
+type roundTripFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+// useTransport swaps the shared client for one sending every request to rt
+func useTransport(t *testing.T, rt http.RoundTripper) {
+	t.Helper()
+	previous := httpClient
+	httpClient = &http.Client{Timeout: previous.Timeout, Transport: rt}
+	t.Cleanup(func() { httpClient = previous })
+}
+
+// reply returns a successful chat completion whose message is content
+func reply(content string) *http.Response {
+	body, _ := json.Marshal(map[string]interface{}{
+		"choices": []map[string]interface{}{
+			{"message": map[string]string{"content": content}},
+		},
+	})
+	return &http.Response{
+		StatusCode: http.StatusOK,
+		Header:     http.Header{"Content-Type": []string{"application/json"}},
+		Body:       io.NopCloser(strings.NewReader(string(body))),
+	}
+}
+
+func TestCustomTemplateIsSentAsTheSystemPrompt(t *testing.T) {
+	dir := t.TempDir()
+	custom := "Write a playful title for these products in at most {{.TitleMaxChars}} characters."
+	if err := os.WriteFile(filepath.Join(dir, "openai.tmpl"), []byte(custom), 0644); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PROMPT_TEMPLATE_DIR", dir)
+	t.Setenv("OPENAI_API_KEY", "test-key")
+
+	var messages []map[string]string
+	useTransport(t, roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		var body struct {
+			Messages []map[string]string `json:"messages"`
+		}
+		if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+			t.Errorf("failed to decode request: %v", err)
+		}
+		messages = body.Messages
+		return reply(`{"title": "Sunny Picks", "catchy_phrase": "Bright finds for warm days"}`), nil
+	}))
+
+	title, phrase, _ := GenerateTitleAndCatchyPhrase(context.Background(), "dress, sandal", 1, GPT4)
+	if title != "Sunny Picks" || phrase != "Bright finds for warm days" {
+		t.Fatalf("got %q / %q", title, phrase)
+	}
+	if len(messages) == 0 || messages[0]["role"] != "system" {
+		t.Fatalf("no system message was sent: %v", messages)
+	}
+	want := "Write a playful title for these products in at most 25 characters."
+	if messages[0]["content"] != want {
+		t.Errorf("system prompt = %q, want %q", messages[0]["content"], want)
+	}
+}
+
+func TestCallsShareTheConfiguredClient(t *testing.T) {
+	previous := httpClient
+	t.Cleanup(func() { httpClient = previous })
+	t.Setenv("PROMPT_TEMPLATE_DIR", "")
+	t.Setenv("OPENAI_API_KEY", "test-key")
+
+	ConfigureHTTPClient(5*time.Second, 4)
+	configured := httpClient
+	if configured.Timeout != 5*time.Second {
+		t.Errorf("timeout = %s, want 5s", configured.Timeout)
+	}
+	if idle := configured.Transport.(*http.Transport).MaxIdleConnsPerHost; idle != 4 {
+		t.Errorf("MaxIdleConnsPerHost = %d, want 4", idle)
+	}
+
+	// Non-positive values keep the current settings
+	ConfigureHTTPClient(0, 0)
+	if httpClient.Timeout != 5*time.Second || httpClient.Transport.(*http.Transport).MaxIdleConnsPerHost != 4 {
+		t.Errorf("zero values changed the client to %s and %d idle connections",
+			httpClient.Timeout, httpClient.Transport.(*http.Transport).MaxIdleConnsPerHost)
+	}
+
+	calls := 0
+	useTransport(t, roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		calls++
+		return reply(`{"title": "Shoes", "catchy_phrase": "Walk on"}`), nil
+	}))
+	shared := httpClient
+	GenerateTitleAndCatchyPhrase(context.Background(), "shoe", 1, GPT4)
+	GenerateTitleAndCatchyPhrase(context.Background(), "hat", 1, GPT35Turbo)
+	if calls != 2 {
+		t.Errorf("the shared transport handled %d of 2 calls", calls)
+	}
+	if httpClient != shared {
+		t.Error("a call replaced the shared client")
+	}
+}
+
+func TestCategoryIsRequestedAndParsed(t *testing.T) {
+	t.Setenv("PROMPT_TEMPLATE_DIR", "")
+	t.Setenv("OPENAI_API_KEY", "test-key")
+
+	var system string
+	useTransport(t, roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		var body struct {
+			Messages []map[string]string `json:"messages"`
+		}
+		if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+			t.Errorf("failed to decode request: %v", err)
+		}
+		if len(body.Messages) > 0 {
+			system = body.Messages[0]["content"]
+		}
+		return reply(`{"title": "Sunny Picks", "catchy_phrase": "Bright finds", "category": " Summer Dresses "}`), nil
+	}))
+
+	_, _, category := GenerateTitleAndCatchyPhrase(prompt.WithCategory(context.Background()), "dress", 1, GPT4)
+	if category != "Summer Dresses" {
+		t.Errorf("category = %q, want the trimmed %q", category, "Summer Dresses")
+	}
+	if !strings.Contains(system, "'category'") {
+		t.Errorf("prompt %q does not ask for a category", system)
+	}
+
+	GenerateTitleAndCatchyPhrase(context.Background(), "dress", 1, GPT4)
+	if strings.Contains(system, "'category'") {
+		t.Errorf("prompt %q asks for a category that was not requested", system)
+	}
+}
@@ -0,0 +1,138 @@
+package prompt
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"imageclust/internal/logger"
+	"os"
+	"path/filepath"
+	"text/template"
+)
+
+// Default length limits requested from the models
+const (
+	DefaultTitleMaxChars  = 25
+	DefaultPhraseMaxChars = 100
+)
+
+// SummaryMaxInputChars caps the cluster list sent when asking for a collection summary
+const SummaryMaxInputChars = 4000
+
+// DefaultSummaryTemplate asks for a paragraph describing a whole collection; Features holds its clusters
+const DefaultSummaryTemplate = `Here are the groups an image collection was clustered into, each with its title, its most common labels and its size: {{.Features}}
+
+Write one paragraph of at most 600 characters summarizing the collection for the person who uploaded it: its overall themes, the most notable groups and anything that stands out. Respond with the paragraph only, in plain text without Markdown, quotes or a heading.`
+
+// Data holds the values available to prompt templates
+type Data struct {
+	Features       string // Sanitized cluster labels
+	TitleMaxChars  int
+	PhraseMaxChars int
+	Category       bool // Whether a 'category' field is requested alongside the title and phrase
+}
+
+// NewData returns template data for the features with the default length limits
+func NewData(features string) Data {
+	return Data{
+		Features:       features,
+		TitleMaxChars:  DefaultTitleMaxChars,
+		PhraseMaxChars: DefaultPhraseMaxChars,
+	}
+}
+
+// templateKey is the context key of a per-request template override
+type templateKey struct{}
+
+// categoryKey is the context key of the category request flag
+type categoryKey struct{}
+
+// limitsKey is the context key of the requested length limits
+type limitsKey struct{}
+
+// limits are the title and catchy phrase lengths requested from the models
+type limits struct {
+	title, phrase int
+}
+
+// WithCategory returns a context whose prompts also ask the models for a short category label
+func WithCategory(ctx context.Context) context.Context {
+	return context.WithValue(ctx, categoryKey{}, true)
+}
+
+// WithLimits returns a context whose prompts ask for titles of at most titleMaxChars and catchy phrases
+// of at most phraseMaxChars characters. A limit that is not positive keeps the default.
+func WithLimits(ctx context.Context, titleMaxChars, phraseMaxChars int) context.Context {
+	return context.WithValue(ctx, limitsKey{}, limits{title: titleMaxChars, phrase: phraseMaxChars})
+}
+
+// WithTemplate returns a context whose prompts for every service are rendered from text,
+// taking precedence over both the template files and the defaults. Check the text with Validate first.
+func WithTemplate(ctx context.Context, text string) context.Context {
+	return context.WithValue(ctx, templateKey{}, text)
+}
+
+// Validate reports whether text is a usable prompt template
+func Validate(text string) error {
+	_, err := execute("request", text, NewData("example"))
+	return err
+}
+
+// Render builds the prompt for a service, with the category flag and length limits set on the context.
+// A template set on the context with WithTemplate is used first.
+// Otherwise a template file named <service>.tmpl in PROMPT_TEMPLATE_DIR overrides defaultTemplate; it is
+// read on every call so prompts can be tuned without a restart. A missing or invalid override falls back
+// to the default template.
+func Render(ctx context.Context, service, defaultTemplate string, data Data) (string, error) {
+	if requested, ok := ctx.Value(categoryKey{}).(bool); ok && requested {
+		data.Category = true
+	}
+	if requested, ok := ctx.Value(limitsKey{}).(limits); ok {
+		if requested.title > 0 {
+			data.TitleMaxChars = requested.title
+		}
+		if requested.phrase > 0 {
+			data.PhraseMaxChars = requested.phrase
+		}
+	}
+	if custom, ok := ctx.Value(templateKey{}).(string); ok && custom != "" {
+		return execute(service, custom, data)
+	}
+	return renderFile(service, defaultTemplate, data)
+}
+
+// RenderSummary builds the collection summary prompt for a service from <service>-summary.tmpl in
+// PROMPT_TEMPLATE_DIR or DefaultSummaryTemplate. Templates set with WithTemplate ask for titles, so they are ignored.
+func RenderSummary(service, clusters string) (string, error) {
+	return renderFile(service+"-summary", DefaultSummaryTemplate, NewData(clusters))
+}
+
+// renderFile runs the template file override of a service, falling back to defaultTemplate
+func renderFile(service, defaultTemplate string, data Data) (string, error) {
+	if dir := os.Getenv("PROMPT_TEMPLATE_DIR"); dir != "" {
+		path := filepath.Join(dir, service+".tmpl")
+		if custom, err := os.ReadFile(path); err == nil {
+			text, err := execute(service, string(custom), data)
+			if err == nil {
+				return text, nil
+			}
+			logger.Warnf("Invalid prompt template %s, using the default: %v", path, err)
+		} else if !os.IsNotExist(err) {
+			logger.Warnf("Failed to read prompt template %s, using the default: %v", path, err)
+		}
+	}
+	return execute(service, defaultTemplate, data)
+}
+
+// execute parses and runs a single prompt template
+func execute(name, text string, data Data) (string, error) {
+	t, err := template.New(name).Option("missingkey=error").Parse(text)
+	if err != nil {
+		return "", fmt.Errorf("failed to parse prompt template: %v", err)
+	}
+	var buf bytes.Buffer
+	if err := t.Execute(&buf, data); err != nil {
+		return "", fmt.Errorf("failed to execute prompt template: %v", err)
+	}
+	return buf.String(), nil
+}
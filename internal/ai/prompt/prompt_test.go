@@ -0,0 +1,30 @@
+package prompt
+
+import (
+	"context"
+	"testing"
+)
+
+const limitsTemplate = "{{.TitleMaxChars}}/{{.PhraseMaxChars}}"
+
+func TestRenderUsesContextLimits(t *testing.T) {
+	t.Setenv("PROMPT_TEMPLATE_DIR", "")
+	tests := []struct {
+		name string
+		ctx  context.Context
+		want string
+	}{
+		{"defaults", context.Background(), "25/100"},
+		{"configured", WithLimits(context.Background(), 40, 150), "40/150"},
+		{"unset limit keeps the default", WithLimits(context.Background(), 0, 60), "25/60"},
+	}
+	for _, tt := range tests {
+		got, err := Render(tt.ctx, "test", limitsTemplate, NewData("labels"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != tt.want {
+			t.Errorf("%s: got %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
@@ -1,6 +1,8 @@
 package ai
 
 import (
+	"context"
+	"fmt"
 	"imageclust/internal/ai/amazon-nova"
 	"imageclust/internal/ai/claude-haiku"
 	"imageclust/internal/ai/claude-sonnet"
@@ -16,6 +18,12 @@ const (
 	ClaudeSonnetService    = 5
 )
 
+// Sentinel values returned by the generators when no title could be produced
+const (
+	NoTitle  = "No Title"
+	NoPhrase = "No phrase available"
+)
+
 // ServiceConfig represents a service configuration
 type ServiceConfig struct {
 	ServiceType int
@@ -29,7 +37,8 @@ type ModelOutput struct {
 	ServiceName  string
 	Title        string
 	CatchyPhrase string
-	Order        int // Added to control display order
+	Category     string // Empty unless a category was requested
+	Order        int    // Added to control display order
 }
 
 // AvailableServices defines all available AI services in desired order
@@ -68,55 +77,147 @@ var AvailableServices = []ServiceConfig{
 	*/
 }
 
+// defaultService names the service whose output fills a cluster's default title and catchy phrase
+var defaultService string
+
+// SetDefaultService selects the service whose output becomes a cluster's default title and catchy phrase.
+// The name must match an enabled service; an empty name restores the first service in display order.
+func SetDefaultService(name string) error {
+	if name == "" {
+		defaultService = ""
+		return nil
+	}
+	var enabled []string
+	for _, service := range AvailableServices {
+		if service.Name == name {
+			defaultService = name
+			return nil
+		}
+		enabled = append(enabled, service.Name)
+	}
+	return fmt.Errorf("unknown or disabled AI service %q, enabled services are %q", name, enabled)
+}
+
+// DefaultService returns the name of the service that provides a cluster's default title
+func DefaultService() string {
+	if defaultService != "" {
+		return defaultService
+	}
+	var first *ServiceConfig
+	for i := range AvailableServices {
+		if first == nil || AvailableServices[i].Order < first.Order {
+			first = &AvailableServices[i]
+		}
+	}
+	if first == nil {
+		return ""
+	}
+	return first.Name
+}
+
+// callSlots caps the number of model calls in flight across all clusters and services
+var callSlots = make(chan struct{}, 8)
+
+// SetMaxConcurrentCalls sets the global cap on concurrent model calls.
+// It must be called before any titles are generated.
+func SetMaxConcurrentCalls(n int) {
+	if n > 0 {
+		callSlots = make(chan struct{}, n)
+	}
+}
+
 // GenerateTitleAndCatchyPhrase maintains backward compatibility
-func GenerateTitleAndCatchyPhrase(aggregatedText string, retries int, serviceType int) (string, string) {
+func GenerateTitleAndCatchyPhrase(ctx context.Context, aggregatedText string, retries int, serviceType int) (string, string) {
+	var generate func() (string, string, string)
 	switch serviceType {
 	case AmazonNovaMicroService:
-		return amazon_nova.GenerateTitleAndCatchyPhrase(aggregatedText, retries)
+		generate = func() (string, string, string) {
+			return amazon_nova.GenerateTitleAndCatchyPhrase(ctx, aggregatedText, retries)
+		}
 	case GPT4Service:
-		return openai.GenerateTitleAndCatchyPhrase(aggregatedText, retries, openai.GPT4)
+		generate = func() (string, string, string) {
+			return openai.GenerateTitleAndCatchyPhrase(ctx, aggregatedText, retries, openai.GPT4)
+		}
 	case GPT35Service:
-		return openai.GenerateTitleAndCatchyPhrase(aggregatedText, retries, openai.GPT35Turbo)
+		generate = func() (string, string, string) {
+			return openai.GenerateTitleAndCatchyPhrase(ctx, aggregatedText, retries, openai.GPT35Turbo)
+		}
 	case ClaudeHaikuService:
-		return claude_haiku.GenerateTitleAndCatchyPhrase(aggregatedText, retries)
+		generate = func() (string, string, string) {
+			return claude_haiku.GenerateTitleAndCatchyPhrase(ctx, aggregatedText, retries)
+		}
 	case ClaudeSonnetService:
-		return claude_sonnet.GenerateTitleAndCatchyPhrase(aggregatedText, retries)
+		generate = func() (string, string, string) {
+			return claude_sonnet.GenerateTitleAndCatchyPhrase(ctx, aggregatedText, retries)
+		}
 	default:
-		return "No Title", "No Catchy Phrase"
+		return NoTitle, NoPhrase
+	}
+	title, catchyPhrase, _ := withCircuitBreaker(ctx, serviceType, generate)
+	return title, catchyPhrase
+}
+
+// ServicesByName returns the enabled services with the given names, in the order given.
+// No names selects every enabled service.
+func ServicesByName(names []string) ([]ServiceConfig, error) {
+	if len(names) == 0 {
+		return AvailableServices, nil
+	}
+	services := make([]ServiceConfig, 0, len(names))
+	for _, name := range names {
+		found := false
+		for _, service := range AvailableServices {
+			if service.Name == name {
+				services = append(services, service)
+				found = true
+				break
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("unknown or disabled AI service %q", name)
+		}
 	}
+	return services, nil
 }
 
 // GenerateTitleAndCatchyPhraseMultiService generates titles and catchy phrases using all available services
-func GenerateTitleAndCatchyPhraseMultiService(aggregatedText string, retries int) []ModelOutput {
-	outputs := make([]ModelOutput, 0, len(AvailableServices))
+func GenerateTitleAndCatchyPhraseMultiService(ctx context.Context, aggregatedText string, retries int) []ModelOutput {
+	return GenerateTitleAndCatchyPhraseWithServices(ctx, aggregatedText, retries, AvailableServices)
+}
+
+// GenerateTitleAndCatchyPhraseWithServices generates titles and catchy phrases using the given services
+func GenerateTitleAndCatchyPhraseWithServices(ctx context.Context, aggregatedText string, retries int, services []ServiceConfig) []ModelOutput {
+	outputs := make([]ModelOutput, 0, len(services))
 	var mu sync.Mutex
 	var wg sync.WaitGroup
 
-	for _, service := range AvailableServices {
+	for _, service := range services {
 		wg.Add(1)
 		go func(svc ServiceConfig) {
 			defer wg.Done()
 
-			var title, catchyPhrase string
-
-			switch svc.ServiceType {
-			case AmazonNovaMicroService:
-				title, catchyPhrase = amazon_nova.GenerateTitleAndCatchyPhrase(aggregatedText, retries)
-			case GPT4Service, GPT35Service:
-				if openaiModel, ok := svc.Model.(openai.OpenAIModel); ok {
-					title, catchyPhrase = openai.GenerateTitleAndCatchyPhrase(aggregatedText, retries, openaiModel)
+			title, catchyPhrase, category := withCircuitBreaker(ctx, svc.ServiceType, func() (title, catchyPhrase, category string) {
+				switch svc.ServiceType {
+				case AmazonNovaMicroService:
+					title, catchyPhrase, category = amazon_nova.GenerateTitleAndCatchyPhrase(ctx, aggregatedText, retries)
+				case GPT4Service, GPT35Service:
+					if openaiModel, ok := svc.Model.(openai.OpenAIModel); ok {
+						title, catchyPhrase, category = openai.GenerateTitleAndCatchyPhrase(ctx, aggregatedText, retries, openaiModel)
+					}
+				case ClaudeHaikuService:
+					title, catchyPhrase, category = claude_haiku.GenerateTitleAndCatchyPhrase(ctx, aggregatedText, retries)
+				case ClaudeSonnetService:
+					title, catchyPhrase, category = claude_sonnet.GenerateTitleAndCatchyPhrase(ctx, aggregatedText, retries)
 				}
-			case ClaudeHaikuService:
-				title, catchyPhrase = claude_haiku.GenerateTitleAndCatchyPhrase(aggregatedText, retries)
-			case ClaudeSonnetService:
-				title, catchyPhrase = claude_sonnet.GenerateTitleAndCatchyPhrase(aggregatedText, retries)
-			}
+				return title, catchyPhrase, category
+			})
 
 			mu.Lock()
 			outputs = append(outputs, ModelOutput{
 				ServiceName:  svc.Name,
 				Title:        title,
 				CatchyPhrase: catchyPhrase,
+				Category:     category,
 				Order:        svc.Order,
 			})
 			mu.Unlock()
@@ -138,3 +239,39 @@ func GenerateTitleAndCatchyPhraseMultiService(aggregatedText string, retries int
 
 	return sortedOutputs
 }
+
+// GenerateCollectionSummary asks the default service for a paragraph describing the whole collection,
+// given a description of its clusters. It returns an empty string when no summary could be produced.
+func GenerateCollectionSummary(ctx context.Context, clusterText string, retries int) string {
+	name := DefaultService()
+	for _, svc := range AvailableServices {
+		if svc.Name != name {
+			continue
+		}
+		summary, _, _ := withCircuitBreaker(ctx, svc.ServiceType, func() (string, string, string) {
+			var summary string
+			switch svc.ServiceType {
+			case AmazonNovaMicroService:
+				summary = amazon_nova.GenerateSummary(ctx, clusterText, retries)
+			case GPT4Service, GPT35Service:
+				if openaiModel, ok := svc.Model.(openai.OpenAIModel); ok {
+					summary = openai.GenerateSummary(ctx, clusterText, retries, openaiModel)
+				}
+			case ClaudeHaikuService:
+				summary = claude_haiku.GenerateSummary(ctx, clusterText, retries)
+			case ClaudeSonnetService:
+				summary = claude_sonnet.GenerateSummary(ctx, clusterText, retries)
+			}
+			if summary == "" {
+				// Counts as a failure against the service's circuit breaker
+				return NoTitle, "", ""
+			}
+			return summary, "", ""
+		})
+		if summary == NoTitle {
+			return ""
+		}
+		return summary
+	}
+	return ""
+}
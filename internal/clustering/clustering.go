@@ -3,8 +3,9 @@ package clustering
 
 import (
 	"fmt"
-	"log"
+	"imageclust/internal/logger"
 	"math"
+	"sort"
 )
 
 // Cluster represents a cluster of data points.
@@ -46,6 +47,51 @@ func MergeClusters(a, b Cluster) Cluster {
 	}
 }
 
+// Centroid update strategies for the hierarchical merges. Incremental updates are fastest but
+// accumulate floating-point drift over many merges; the others recompute from the member embeddings.
+const (
+	CentroidIncremental = ""      // Weighted average of the two merged centroids
+	CentroidEachMerge   = "merge" // Recomputed from the members after every merge, so merge decisions use exact centroids
+	CentroidFinal       = "final" // Incremental while merging, recomputed from the members once clustering is done
+)
+
+// mergeClustersWith merges two clusters, recomputing the centroid from the members for CentroidEachMerge
+func mergeClustersWith(a, b Cluster, embeddings [][]float32, centroidUpdate string) Cluster {
+	merged := MergeClusters(a, b)
+	if centroidUpdate == CentroidEachMerge {
+		merged.Centroid = MemberMean(merged.Indices, embeddings)
+	}
+	return merged
+}
+
+// MemberMean returns the mean of the embeddings at the given indices.
+// Sums are accumulated in float64, so the result is the true mean to float32 precision.
+func MemberMean(indices []int, embeddings [][]float32) []float32 {
+	members := make([][]float32, len(indices))
+	for i, idx := range indices {
+		members[i] = embeddings[idx]
+	}
+	return meanOf(members)
+}
+
+// meanOf averages equally long vectors in float64; it returns nil for no vectors
+func meanOf(vectors [][]float32) []float32 {
+	if len(vectors) == 0 {
+		return nil
+	}
+	sums := make([]float64, len(vectors[0]))
+	for _, vector := range vectors {
+		for i, value := range vector {
+			sums[i] += float64(value)
+		}
+	}
+	mean := make([]float32, len(sums))
+	for i, sum := range sums {
+		mean[i] = float32(sum / float64(len(vectors)))
+	}
+	return mean
+}
+
 // RemoveClusters removes clusters at indices i and j from the clusters slice.
 // It assumes that i < j.
 func RemoveClusters(clusters []Cluster, i, j int) []Cluster {
@@ -185,6 +231,56 @@ func CalculateOptimalClusters(totalItems, minSize, maxSize int) (int, error) {
 	return nClusters, nil
 }
 
+// Relaxation strategies for cluster size constraints that cannot be satisfied
+const (
+	RelaxGrowMax   = "grow_max"   // Raise maxSize first, producing fewer, larger clusters
+	RelaxShrinkMin = "shrink_min" // Lower minSize first, allowing undersized clusters
+)
+
+// RelaxConstraints returns the closest feasible size constraints for totalItems.
+// Feasible constraints are returned unchanged. Otherwise they are relaxed in this order:
+//  1. When there are fewer items than minSize, minSize is lowered to totalItems so they form one cluster.
+//  2. With RelaxGrowMax, maxSize is raised one step at a time. This always succeeds by
+//     2*minSize-1, since any count of at least minSize items can then be partitioned.
+//  3. With RelaxShrinkMin, minSize is lowered one step at a time, down to 1 if necessary.
+//
+// Returns an error for an unknown strategy or when there are no items.
+func RelaxConstraints(totalItems, minSize, maxSize int, strategy string) (int, int, error) {
+	if totalItems < 1 {
+		return 0, 0, fmt.Errorf("cannot relax cluster size constraints without items")
+	}
+	if _, err := CalculateOptimalClusters(totalItems, minSize, maxSize); err == nil {
+		return minSize, maxSize, nil
+	}
+
+	if totalItems < minSize {
+		minSize = totalItems
+		if maxSize < minSize {
+			maxSize = minSize
+		}
+	}
+
+	switch strategy {
+	case RelaxGrowMax:
+		for {
+			if _, err := CalculateOptimalClusters(totalItems, minSize, maxSize); err == nil {
+				return minSize, maxSize, nil
+			}
+			maxSize++
+		}
+	case RelaxShrinkMin:
+		for minSize > 1 {
+			if _, err := CalculateOptimalClusters(totalItems, minSize, maxSize); err == nil {
+				return minSize, maxSize, nil
+			}
+			minSize--
+		}
+		return minSize, maxSize, nil
+	default:
+		return 0, 0, fmt.Errorf("unknown constraint relaxation strategy: %s", strategy)
+	}
+}
+
 // PerformClusteringWithConstraints performs hierarchical clustering with size constraints.
 // It ensures that each cluster has between minSize and maxSize items.
 // Parameters:
@@ -195,17 +291,25 @@ func CalculateOptimalClusters(totalItems, minSize, maxSize int) (int, error) {
 // Returns:
 // - A map where keys are cluster IDs (starting from 0) and values are slices of product reference IDs.
 // - A boolean indicating whether clustering was successful.
-func PerformClusteringWithConstraints(embeddings [][]float32, productReferenceIDs []string, minSize, maxSize int) (map[int][]string, bool) {
+func PerformClusteringWithConstraints(embeddings [][]float32, productReferenceIDs []string, minSize, maxSize int, centroidUpdate string) (map[int][]string, bool) {
+	clusterMap, _, success := PerformClusteringWithCentroids(embeddings, productReferenceIDs, minSize, maxSize, centroidUpdate)
+	return clusterMap, success
+}
+
+// PerformClusteringWithCentroids behaves like PerformClusteringWithConstraints but also returns
+// the centroid of every cluster, keyed by the same cluster IDs. centroidUpdate selects how
+// centroids are maintained across merges (CentroidIncremental, CentroidEachMerge or CentroidFinal).
+func PerformClusteringWithCentroids(embeddings [][]float32, productReferenceIDs []string, minSize, maxSize int, centroidUpdate string) (map[int][]string, map[int][]float32, bool) {
 	totalItems := len(embeddings)
-	log.Printf("Total items for clustering: %d", totalItems)
+	logger.Infof("Total items for clustering: %d", totalItems)
 
 	// Calculate the optimal number of clusters
 	nClusters, err := CalculateOptimalClusters(totalItems, minSize, maxSize)
 	if err != nil {
-		log.Printf("Clustering constraint error: %v", err)
-		return nil, false
+		logger.Errorf("Clustering constraint error: %v", err)
+		return nil, nil, false
 	}
-	log.Printf("Optimal number of clusters calculated: %d", nClusters)
+	logger.Infof("Optimal number of clusters calculated: %d", nClusters)
 
 	// Initialize clusters: each embedding starts as its own cluster
 	clusters := make([]Cluster, totalItems)
@@ -220,7 +324,7 @@ func PerformClusteringWithConstraints(embeddings [][]float32, productReferenceID
 	for len(clusters) > nClusters {
 		i, j := FindClosestClusters(distanceMatrix)
 		if i == -1 || j == -1 {
-			log.Println("No more clusters to merge.")
+			logger.Debugf("No more clusters to merge.")
 			break
 		}
 
@@ -229,12 +333,12 @@ func PerformClusteringWithConstraints(embeddings [][]float32, productReferenceID
 			// Mark this pair as non-mergeable by setting their distance to infinity
 			distanceMatrix[i][j] = math.MaxFloat32
 			distanceMatrix[j][i] = math.MaxFloat32
-			log.Printf("Skipping merge of clusters %d and %d to avoid exceeding maxSize (%d)", i, j, maxSize)
+			logger.Debugf("Skipping merge of clusters %d and %d to avoid exceeding maxSize (%d)", i, j, maxSize)
 			continue
 		}
 
 		// Merge clusters[i] and clusters[j]
-		newCluster := MergeClusters(clusters[i], clusters[j])
+		newCluster := mergeClustersWith(clusters[i], clusters[j], embeddings, centroidUpdate)
 
 		// Remove old clusters and add the new merged cluster
 		clusters = RemoveClusters(clusters, i, j)
@@ -242,7 +346,7 @@ func PerformClusteringWithConstraints(embeddings [][]float32, productReferenceID
 
 		// Update the distance matrix with the new cluster
 		distanceMatrix = UpdateDistanceMatrix(distanceMatrix, clusters, newCluster, i, j)
-		log.Printf("Merged clusters %d and %d into new cluster with size %d", i, j, newCluster.Size)
+		logger.Debugf("Merged clusters %d and %d into new cluster with size %d", i, j, newCluster.Size)
 	}
 
 	// After initial clustering, handle any clusters exceeding maxSize
@@ -250,10 +354,10 @@ func PerformClusteringWithConstraints(embeddings [][]float32, productReferenceID
 	for _, cluster := range clusters {
 		if cluster.Size > maxSize {
 			// Split the oversized cluster
-			subClusters, success := splitCluster(cluster, embeddings, maxSize)
+			subClusters, success := splitCluster(cluster, embeddings, maxSize, centroidUpdate)
 			if !success {
-				log.Printf("Failed to split cluster of size %d into smaller clusters.", cluster.Size)
-				return nil, false
+				logger.Errorf("Failed to split cluster of size %d into smaller clusters.", cluster.Size)
+				return nil, nil, false
 			}
 			finalClusters = append(finalClusters, subClusters...)
 		} else {
@@ -263,10 +367,11 @@ func PerformClusteringWithConstraints(embeddings [][]float32, productReferenceID
 
 	// Convert clusters to map with product reference IDs
 	clusterMap := make(map[int][]string)
+	centroids := make(map[int][]float32)
 	clusterID := 0
 	for _, cluster := range finalClusters {
 		if cluster.Size < minSize {
-			log.Printf("Skipping cluster %d with size %d (less than minSize %d)", clusterID, cluster.Size, minSize)
+			logger.Infof("Skipping cluster %d with size %d (less than minSize %d)", clusterID, cluster.Size, minSize)
 			continue
 		}
 
@@ -276,23 +381,198 @@ func PerformClusteringWithConstraints(embeddings [][]float32, productReferenceID
 			refs[i] = productReferenceIDs[idx]
 		}
 		clusterMap[clusterID] = refs
+		if centroidUpdate == CentroidFinal {
+			cluster.Centroid = MemberMean(cluster.Indices, embeddings)
+		}
+		centroids[clusterID] = cluster.Centroid
 		clusterID++
 	}
 
-	log.Printf("Clustering successful. Formed %d valid clusters.", len(clusterMap))
+	logger.Infof("Clustering successful. Formed %d valid clusters.", len(clusterMap))
+	return clusterMap, centroids, true
+}
+
+// PerformTwoStageClustering clusters on the primary vectors first and then refines each group on the secondary vectors.
+// Stage one groups items by primary similarity using coarseMinSize and coarseMaxSize, which are normally looser
+// than the final constraints. Stage two re-clusters every group larger than maxSize on its secondary vectors
+// using minSize and maxSize. Groups that fit maxSize or cannot be refined are kept whole.
+// Returns the clusters keyed from 0 and whether stage one succeeded.
+func PerformTwoStageClustering(primary, secondary [][]float32, productReferenceIDs []string, coarseMinSize, coarseMaxSize, minSize, maxSize int, centroidUpdate string) (map[int][]string, bool) {
+	coarse, success := PerformClusteringWithConstraints(primary, productReferenceIDs, coarseMinSize, coarseMaxSize, centroidUpdate)
+	if !success {
+		return nil, false
+	}
+
+	indexByID := make(map[string]int, len(productReferenceIDs))
+	for i, id := range productReferenceIDs {
+		indexByID[id] = i
+	}
+
+	coarseIDs := make([]int, 0, len(coarse))
+	for clusterID := range coarse {
+		coarseIDs = append(coarseIDs, clusterID)
+	}
+	sort.Ints(coarseIDs)
+
+	clusterMap := make(map[int][]string)
+	clusterID := 0
+	for _, coarseID := range coarseIDs {
+		refs := coarse[coarseID]
+		if len(refs) <= maxSize {
+			clusterMap[clusterID] = refs
+			clusterID++
+			continue
+		}
+
+		subEmbeddings := make([][]float32, len(refs))
+		for i, ref := range refs {
+			subEmbeddings[i] = secondary[indexByID[ref]]
+		}
+		refined, success := PerformClusteringWithConstraints(subEmbeddings, refs, minSize, maxSize, centroidUpdate)
+		if !success || len(refined) == 0 {
+			logger.Warnf("Keeping stage one cluster %d of size %d unrefined", coarseID, len(refs))
+			clusterMap[clusterID] = refs
+			clusterID++
+			continue
+		}
+
+		for subID := 0; subID < len(refined); subID++ {
+			clusterMap[clusterID] = refined[subID]
+			clusterID++
+		}
+	}
+
+	logger.Infof("Two-stage clustering formed %d clusters from %d stage one groups.", len(clusterMap), len(coarse))
+	return clusterMap, true
+}
+
+// SliceEmbeddings returns the dimensions [start, end) of every embedding, so clustering
+// can be restricted to part of the feature space without recomputing the embeddings.
+func SliceEmbeddings(embeddings [][]float32, start, end int) [][]float32 {
+	sliced := make([][]float32, len(embeddings))
+	for i, embedding := range embeddings {
+		sliced[i] = embedding[start:end]
+	}
+	return sliced
+}
+
+// AspectBucket returns the index of the bucket an aspect ratio falls into,
+// given ascending boundaries: ratios below the first boundary land in bucket 0.
+func AspectBucket(ratio float64, boundaries []float64) int {
+	return sort.Search(len(boundaries), func(i int) bool { return boundaries[i] > ratio })
+}
+
+// PerformBucketedClustering clusters each bucket of items independently and merges the results.
+// Cluster IDs are prefixed by their bucket: bucket b's clusters are numbered from b times a power
+// of ten of at least 1000. A bucket whose size cannot satisfy the constraints has them relaxed with
+// the fallback strategy when one is given, as RelaxConstraints does for the whole run. A bucket that
+// still cannot be clustered is split into pieces of at most maxSize, dropping pieces below minSize.
+func PerformBucketedClustering(embeddings [][]float32, productReferenceIDs []string, buckets []int, minSize, maxSize int, centroidUpdate, fallback string) (map[int][]string, bool) {
+	bucketIndices := make(map[int][]int)
+	for i, bucket := range buckets {
+		bucketIndices[bucket] = append(bucketIndices[bucket], i)
+	}
+
+	bucketIDs := make([]int, 0, len(bucketIndices))
+	for bucket := range bucketIndices {
+		bucketIDs = append(bucketIDs, bucket)
+	}
+	sort.Ints(bucketIDs)
+
+	bucketClusters := make(map[int]map[int][]string, len(bucketIDs))
+	stride := 1000
+	for _, bucket := range bucketIDs {
+		indices := bucketIndices[bucket]
+		subEmbeddings := make([][]float32, len(indices))
+		subIDs := make([]string, len(indices))
+		for i, idx := range indices {
+			subEmbeddings[i] = embeddings[idx]
+			subIDs[i] = productReferenceIDs[idx]
+		}
+
+		bucketMin, bucketMax := minSize, maxSize
+		if fallback != "" {
+			relaxedMin, relaxedMax, err := RelaxConstraints(len(indices), minSize, maxSize, fallback)
+			if err != nil {
+				logger.Errorf("Failed to relax size constraints for aspect ratio bucket %d: %v", bucket, err)
+				return nil, false
+			}
+			if relaxedMin != minSize || relaxedMax != maxSize {
+				logger.Warnf("Cluster size constraints %d-%d are infeasible for aspect ratio bucket %d of size %d, relaxed to %d-%d",
+					minSize, maxSize, bucket, len(indices), relaxedMin, relaxedMax)
+			}
+			bucketMin, bucketMax = relaxedMin, relaxedMax
+		}
+
+		clusters, success := PerformClusteringWithConstraints(subEmbeddings, subIDs, bucketMin, bucketMax, centroidUpdate)
+		if !success {
+			logger.Warnf("Splitting aspect ratio bucket %d of size %d into clusters of at most %d", bucket, len(indices), bucketMax)
+			clusters = splitBucket(subEmbeddings, subIDs, bucketMin, bucketMax, centroidUpdate)
+		}
+		bucketClusters[bucket] = clusters
+
+		for clusterID := range clusters {
+			for clusterID >= stride {
+				stride *= 10
+			}
+		}
+	}
+
+	clusterMap := make(map[int][]string)
+	for _, bucket := range bucketIDs {
+		for clusterID, refs := range bucketClusters[bucket] {
+			clusterMap[bucket*stride+clusterID] = refs
+		}
+	}
+
+	logger.Infof("Bucketed clustering formed %d clusters across %d aspect ratio buckets.", len(clusterMap), len(bucketIDs))
 	return clusterMap, true
 }
 
+// splitBucket splits items that cannot be clustered within the size constraints into clusters of at most
+// maxSize, keyed from 0. Clusters below minSize are dropped, as constrained clustering drops them.
+func splitBucket(embeddings [][]float32, productReferenceIDs []string, minSize, maxSize int, centroidUpdate string) map[int][]string {
+	clusterMap := make(map[int][]string)
+	if maxSize < 1 || len(embeddings) == 0 {
+		return clusterMap
+	}
+
+	whole := Cluster{Indices: make([]int, len(embeddings)), Size: len(embeddings)}
+	for i := range whole.Indices {
+		whole.Indices[i] = i
+	}
+	pieces, success := splitCluster(whole, embeddings, maxSize, centroidUpdate)
+	if !success {
+		return clusterMap
+	}
+
+	clusterID := 0
+	for _, piece := range pieces {
+		if piece.Size < minSize {
+			logger.Infof("Skipping split cluster of size %d (less than minSize %d)", piece.Size, minSize)
+			continue
+		}
+		refs := make([]string, len(piece.Indices))
+		for i, idx := range piece.Indices {
+			refs[i] = productReferenceIDs[idx]
+		}
+		clusterMap[clusterID] = refs
+		clusterID++
+	}
+	return clusterMap
+}
+
 // splitCluster splits an oversized cluster into smaller clusters respecting maxSize.
 // It uses the same hierarchical clustering approach recursively.
 // Parameters:
 // - cluster: The oversized cluster to split.
 // - embeddings: Slice of all embedding vectors.
 // - maxSize: Maximum number of items per cluster.
+// - centroidUpdate: How centroids are maintained across merges.
 // Returns:
-// - A slice of new clusters resulting from the split.
+// - A slice of new clusters resulting from the split, indexing into embeddings.
 // - A boolean indicating whether the split was successful.
-func splitCluster(cluster Cluster, embeddings [][]float32, maxSize int) ([]Cluster, bool) {
+func splitCluster(cluster Cluster, embeddings [][]float32, maxSize int, centroidUpdate string) ([]Cluster, bool) {
 	subEmbeddings := make([][]float32, len(cluster.Indices))
 	for i, idx := range cluster.Indices {
 		subEmbeddings[i] = embeddings[idx]
@@ -302,10 +582,10 @@ func splitCluster(cluster Cluster, embeddings [][]float32, maxSize int) ([]Clust
 	subTotalItems := len(subEmbeddings)
 	nSubClusters, err := CalculateOptimalClusters(subTotalItems, 1, maxSize) // Assuming minSize=1 for sub-clusters
 	if err != nil {
-		log.Printf("Error calculating sub-clusters: %v", err)
+		logger.Errorf("Error calculating sub-clusters: %v", err)
 		return nil, false
 	}
-	log.Printf("Splitting cluster into %d sub-clusters.", nSubClusters)
+	logger.Infof("Splitting cluster into %d sub-clusters.", nSubClusters)
 
 	// Initialize sub-clusters
 	subClusters := make([]Cluster, subTotalItems)
@@ -320,7 +600,7 @@ func splitCluster(cluster Cluster, embeddings [][]float32, maxSize int) ([]Clust
 	for len(subClusters) > nSubClusters {
 		i, j := FindClosestClusters(subDistanceMatrix)
 		if i == -1 || j == -1 {
-			log.Println("No more sub-clusters to merge.")
+			logger.Debugf("No more sub-clusters to merge.")
 			break
 		}
 
@@ -329,12 +609,12 @@ func splitCluster(cluster Cluster, embeddings [][]float32, maxSize int) ([]Clust
 			// Mark this pair as non-mergeable by setting their distance to infinity
 			subDistanceMatrix[i][j] = math.MaxFloat32
 			subDistanceMatrix[j][i] = math.MaxFloat32
-			log.Printf("Skipping merge of sub-clusters %d and %d to avoid exceeding maxSize (%d)", i, j, maxSize)
+			logger.Debugf("Skipping merge of sub-clusters %d and %d to avoid exceeding maxSize (%d)", i, j, maxSize)
 			continue
 		}
 
 		// Merge subClusters[i] and subClusters[j]
-		newSubCluster := MergeClusters(subClusters[i], subClusters[j])
+		newSubCluster := mergeClustersWith(subClusters[i], subClusters[j], subEmbeddings, centroidUpdate)
 
 		// Remove old sub-clusters and add the new merged sub-cluster
 		subClusters = RemoveClusters(subClusters, i, j)
@@ -342,8 +622,434 @@ func splitCluster(cluster Cluster, embeddings [][]float32, maxSize int) ([]Clust
 
 		// Update the distance matrix with the new sub-cluster
 		subDistanceMatrix = UpdateDistanceMatrix(subDistanceMatrix, subClusters, newSubCluster, i, j)
-		log.Printf("Merged sub-clusters %d and %d into new sub-cluster with size %d", i, j, newSubCluster.Size)
+		logger.Debugf("Merged sub-clusters %d and %d into new sub-cluster with size %d", i, j, newSubCluster.Size)
 	}
 
+	// Sub-cluster indices point into subEmbeddings; map them back to the full embedding list
+	for _, subCluster := range subClusters {
+		for k, idx := range subCluster.Indices {
+			subCluster.Indices[k] = cluster.Indices[idx]
+		}
+	}
 	return subClusters, true
 }
+
+// MergeSimilarClusters merges clusters whose centroids lie closer than threshold, as long as the merged
+// cluster does not exceed maxSize. The closest eligible pair is merged first, repeating until no pair qualifies.
+// Returns the clusters renumbered from 0 in the order of their original IDs.
+func MergeSimilarClusters(clusters map[int][]string, embeddings [][]float32, productReferenceIDs []string, threshold float32, maxSize int) map[int][]string {
+	merged := rebuildClusters(clusters, embeddings, productReferenceIDs)
+
+	for {
+		bestI, bestJ := -1, -1
+		bestDistance := threshold
+		for i := 0; i < len(merged); i++ {
+			for j := i + 1; j < len(merged); j++ {
+				if merged[i].Size+merged[j].Size > maxSize {
+					continue
+				}
+				distance := centroidDistance(merged[i], merged[j])
+				if distance < bestDistance {
+					bestDistance = distance
+					bestI, bestJ = i, j
+				}
+			}
+		}
+		if bestI == -1 {
+			break
+		}
+
+		logger.Infof("Merging similar clusters of size %d and %d (centroid distance %.4f)", merged[bestI].Size, merged[bestJ].Size, bestDistance)
+		merged[bestI] = MergeClusters(merged[bestI], merged[bestJ])
+		merged = append(merged[:bestJ], merged[bestJ+1:]...)
+	}
+
+	return clusterRefs(merged, productReferenceIDs)
+}
+
+// CapClusterCount merges the clusters with the closest centroids until at most maxClusters remain.
+// Pairs whose merged size stays within maxSize are preferred; when no such pair exists, the closest
+// pair is merged regardless, since the cap takes precedence over the size limit.
+// A non-positive maxClusters leaves the clusters unchanged. Returns the clusters renumbered from 0.
+func CapClusterCount(clusters map[int][]string, embeddings [][]float32, productReferenceIDs []string, maxClusters, maxSize int) map[int][]string {
+	if maxClusters <= 0 || len(clusters) <= maxClusters {
+		return clusters
+	}
+
+	merged := rebuildClusters(clusters, embeddings, productReferenceIDs)
+	for len(merged) > maxClusters {
+		bestI, bestJ, bestFits := -1, -1, false
+		bestDistance := float32(math.MaxFloat32)
+		for i := 0; i < len(merged); i++ {
+			for j := i + 1; j < len(merged); j++ {
+				fits := merged[i].Size+merged[j].Size <= maxSize
+				if bestFits && !fits {
+					continue
+				}
+				distance := centroidDistance(merged[i], merged[j])
+				if (fits && !bestFits) || distance < bestDistance {
+					bestDistance = distance
+					bestI, bestJ, bestFits = i, j, fits
+				}
+			}
+		}
+		if bestI == -1 {
+			break
+		}
+
+		if !bestFits {
+			logger.Warnf("Exceeding the maximum cluster size to stay within %d clusters", maxClusters)
+		}
+		logger.Infof("Merging clusters of size %d and %d to respect the cluster cap (centroid distance %.4f)", merged[bestI].Size, merged[bestJ].Size, bestDistance)
+		merged[bestI] = MergeClusters(merged[bestI], merged[bestJ])
+		merged = append(merged[:bestJ], merged[bestJ+1:]...)
+	}
+
+	return clusterRefs(merged, productReferenceIDs)
+}
+
+// centroidDistance returns the Euclidean distance between the centroids of two clusters
+func centroidDistance(a, b Cluster) float32 {
+	var sum float32
+	for k := range a.Centroid {
+		diff := a.Centroid[k] - b.Centroid[k]
+		sum += diff * diff
+	}
+	return float32(math.Sqrt(float64(sum)))
+}
+
+// rebuildClusters recreates each cluster with its centroid from member IDs, in the order of the cluster IDs.
+// Members without an embedding are skipped, and clusters left empty are dropped.
+func rebuildClusters(clusters map[int][]string, embeddings [][]float32, productReferenceIDs []string) []Cluster {
+	indexByID := make(map[string]int, len(productReferenceIDs))
+	for i, id := range productReferenceIDs {
+		indexByID[id] = i
+	}
+
+	clusterIDs := make([]int, 0, len(clusters))
+	for clusterID := range clusters {
+		clusterIDs = append(clusterIDs, clusterID)
+	}
+	sort.Ints(clusterIDs)
+
+	// Rebuild each cluster with its centroid
+	merged := make([]Cluster, 0, len(clusters))
+	for _, clusterID := range clusterIDs {
+		var cluster Cluster
+		for _, ref := range clusters[clusterID] {
+			idx, exists := indexByID[ref]
+			if !exists {
+				continue
+			}
+			if cluster.Size == 0 {
+				cluster = NewCluster(idx, embeddings[idx])
+			} else {
+				cluster = MergeClusters(cluster, NewCluster(idx, embeddings[idx]))
+			}
+		}
+		if cluster.Size > 0 {
+			merged = append(merged, cluster)
+		}
+	}
+	return merged
+}
+
+// clusterRefs converts clusters back into member IDs keyed by their position
+func clusterRefs(merged []Cluster, productReferenceIDs []string) map[int][]string {
+	result := make(map[int][]string, len(merged))
+	for clusterID, cluster := range merged {
+		refs := make([]string, len(cluster.Indices))
+		for i, idx := range cluster.Indices {
+			refs[i] = productReferenceIDs[idx]
+		}
+		result[clusterID] = refs
+	}
+	return result
+}
+
+// ComputeCentroids returns the mean embedding of every cluster, keyed by cluster ID
+func ComputeCentroids(clusters map[int][]string, embeddings [][]float32, productReferenceIDs []string) map[int][]float32 {
+	embeddingByID := make(map[string][]float32, len(productReferenceIDs))
+	for i, id := range productReferenceIDs {
+		embeddingByID[id] = embeddings[i]
+	}
+
+	centroids := make(map[int][]float32, len(clusters))
+	for clusterID, refs := range clusters {
+		var members [][]float32
+		for _, ref := range refs {
+			if embedding, exists := embeddingByID[ref]; exists {
+				members = append(members, embedding)
+			}
+		}
+		centroids[clusterID] = meanOf(members)
+	}
+	return centroids
+}
+
+// GroupSimilarClusters assigns every cluster a representative whose centroid lies within threshold of its own,
+// so work done for the representative can be reused for the whole group. Clusters are visited largest first,
+// ties broken by ID, and each joins the nearest representative in range or becomes one itself.
+// Every member therefore lies within threshold of its representative. Returns the representative of each cluster ID.
+func GroupSimilarClusters(clusters map[int][]string, centroids map[int][]float32, threshold float32) map[int]int {
+	ids := make([]int, 0, len(clusters))
+	for clusterID := range clusters {
+		ids = append(ids, clusterID)
+	}
+	sort.Slice(ids, func(i, j int) bool {
+		if len(clusters[ids[i]]) != len(clusters[ids[j]]) {
+			return len(clusters[ids[i]]) > len(clusters[ids[j]])
+		}
+		return ids[i] < ids[j]
+	})
+
+	representatives := make(map[int]int, len(ids))
+	var leaders []int
+	for _, clusterID := range ids {
+		best := -1
+		bestDistance := threshold
+		for _, leader := range leaders {
+			distance, err := EuclideanDistance.Distance(centroids[clusterID], centroids[leader])
+			if err == nil && distance <= bestDistance {
+				best, bestDistance = leader, distance
+			}
+		}
+		if best == -1 {
+			leaders = append(leaders, clusterID)
+			best = clusterID
+		}
+		representatives[clusterID] = best
+	}
+	return representatives
+}
+
+// DimensionContribution is one dimension's share of the squared distance between two embeddings
+type DimensionContribution struct {
+	Dimension    int     `json:"dimension"`
+	Contribution float32 `json:"contribution"` // Squared difference in this dimension
+	Share        float32 `json:"share"`        // Fraction of the total squared distance
+}
+
+// ExplainDistance returns the Euclidean distance between two embeddings and the topN dimensions
+// contributing most to it, largest first. A non-positive topN returns every dimension.
+func ExplainDistance(a, b []float32, topN int) (float32, []DimensionContribution, error) {
+	if len(a) != len(b) {
+		return 0, nil, fmt.Errorf("embeddings have different lengths: %d and %d", len(a), len(b))
+	}
+
+	contributions := make([]DimensionContribution, len(a))
+	var total float32
+	for i := range a {
+		diff := a[i] - b[i]
+		contributions[i] = DimensionContribution{Dimension: i, Contribution: diff * diff}
+		total += diff * diff
+	}
+	if total > 0 {
+		for i := range contributions {
+			contributions[i].Share = contributions[i].Contribution / total
+		}
+	}
+
+	sort.SliceStable(contributions, func(i, j int) bool {
+		return contributions[i].Contribution > contributions[j].Contribution
+	})
+	if topN > 0 && topN < len(contributions) {
+		contributions = contributions[:topN]
+	}
+	return float32(math.Sqrt(float64(total))), contributions, nil
+}
+
+// ClusterCohesion calculates the intra-cluster cohesion as the mean Euclidean distance of the members to their centroid.
+// Lower values indicate a tighter cluster.
+func ClusterCohesion(members [][]float32) float32 {
+	if len(members) == 0 {
+		return 0
+	}
+
+	// Compute the centroid of the members
+	centroid := make([]float32, len(members[0]))
+	for _, member := range members {
+		for i, value := range member {
+			centroid[i] += value
+		}
+	}
+	for i := range centroid {
+		centroid[i] /= float32(len(members))
+	}
+
+	// Average the distance of every member to the centroid
+	var total float64
+	diff := make([]float32, len(centroid))
+	for _, member := range members {
+		for i := range diff {
+			diff[i] = member[i] - centroid[i]
+		}
+		total += math.Sqrt(float64(DotFloat32(diff, diff)))
+	}
+	return float32(total / float64(len(members)))
+}
+
+// FilterLooseClusters computes the cohesion of every cluster and removes clusters looser than maxCohesion.
+// Parameters:
+// - clusters: Map of cluster IDs to product reference IDs, as returned by PerformClusteringWithConstraints.
+// - embeddings: Slice of embedding vectors.
+// - productReferenceIDs: Slice of product reference IDs corresponding to embeddings.
+// - maxCohesion: Maximum allowed cohesion. A value of 0 or less keeps every cluster.
+// Returns:
+// - The clusters that passed the filter, keyed by their original cluster IDs.
+// - The cohesion of every input cluster, keyed by cluster ID.
+// - The product reference IDs of the members of the removed clusters.
+func FilterLooseClusters(clusters map[int][]string, embeddings [][]float32, productReferenceIDs []string, maxCohesion float32) (map[int][]string, map[int]float32, []string) {
+	embeddingByID := make(map[string][]float32, len(productReferenceIDs))
+	for i, id := range productReferenceIDs {
+		embeddingByID[id] = embeddings[i]
+	}
+
+	kept := make(map[int][]string, len(clusters))
+	cohesion := make(map[int]float32, len(clusters))
+	var misc []string
+
+	// Visit clusters in ID order so the misc bucket is ordered the same on every run
+	clusterIDs := make([]int, 0, len(clusters))
+	for clusterID := range clusters {
+		clusterIDs = append(clusterIDs, clusterID)
+	}
+	sort.Ints(clusterIDs)
+
+	for _, clusterID := range clusterIDs {
+		refs := clusters[clusterID]
+		members := make([][]float32, 0, len(refs))
+		for _, ref := range refs {
+			if embedding, exists := embeddingByID[ref]; exists {
+				members = append(members, embedding)
+			}
+		}
+		cohesion[clusterID] = ClusterCohesion(members)
+
+		if maxCohesion > 0 && cohesion[clusterID] > maxCohesion {
+			logger.Warnf("Moving cluster %d to misc bucket: cohesion %.4f exceeds threshold %.4f", clusterID, cohesion[clusterID], maxCohesion)
+			misc = append(misc, refs...)
+			continue
+		}
+		kept[clusterID] = refs
+	}
+
+	return kept, cohesion, misc
+}
+
+// DistanceMetric selects how the distance between two embeddings is measured
+type DistanceMetric string
+
+const (
+	EuclideanDistance DistanceMetric = "euclidean"
+	CosineDistance    DistanceMetric = "cosine" // One minus the cosine similarity
+)
+
+// Distance returns the distance between two embeddings of equal length under the metric
+func (m DistanceMetric) Distance(a, b []float32) (float32, error) {
+	if len(a) != len(b) {
+		return 0, fmt.Errorf("embeddings have different lengths: %d and %d", len(a), len(b))
+	}
+
+	switch m {
+	case EuclideanDistance:
+		var sum float32
+		for i := range a {
+			diff := a[i] - b[i]
+			sum += diff * diff
+		}
+		return float32(math.Sqrt(float64(sum))), nil
+	case CosineDistance:
+		normA := math.Sqrt(float64(DotFloat32(a, a)))
+		normB := math.Sqrt(float64(DotFloat32(b, b)))
+		if normA == 0 || normB == 0 {
+			return 1, nil
+		}
+		return float32(1 - float64(DotFloat32(a, b))/(normA*normB)), nil
+	default:
+		return 0, fmt.Errorf("unknown distance metric %q", m)
+	}
+}
+
+// KNNEdge is a directed edge from a node to one of its nearest neighbors, indexed by embedding position
+type KNNEdge struct {
+	Source   int     `json:"source"`
+	Target   int     `json:"target"`
+	Distance float32 `json:"distance"`
+}
+
+// BuildKNNGraph links every embedding to its k nearest neighbors under the metric, independent of any clustering.
+// Each node gets min(k, n-1) outgoing edges, nearest first; ties are broken by the lower index so the graph is deterministic.
+func BuildKNNGraph(embeddings [][]float32, k int, metric DistanceMetric) ([]KNNEdge, error) {
+	if metric != EuclideanDistance && metric != CosineDistance {
+		return nil, fmt.Errorf("unknown distance metric %q", metric)
+	}
+
+	n := len(embeddings)
+	if k > n-1 {
+		k = n - 1
+	}
+	if k <= 0 {
+		return []KNNEdge{}, nil
+	}
+
+	// Distances are symmetric, so compute each pair once
+	distances := make([][]float32, n)
+	for i := range distances {
+		distances[i] = make([]float32, n)
+	}
+	for i := 0; i < n; i++ {
+		for j := i + 1; j < n; j++ {
+			distance, err := metric.Distance(embeddings[i], embeddings[j])
+			if err != nil {
+				return nil, err
+			}
+			distances[i][j] = distance
+			distances[j][i] = distance
+		}
+	}
+
+	edges := make([]KNNEdge, 0, n*k)
+	neighbors := make([]int, 0, n-1)
+	for i := 0; i < n; i++ {
+		neighbors = neighbors[:0]
+		for j := 0; j < n; j++ {
+			if j != i {
+				neighbors = append(neighbors, j)
+			}
+		}
+		sort.SliceStable(neighbors, func(a, b int) bool {
+			return distances[i][neighbors[a]] < distances[i][neighbors[b]]
+		})
+		for _, j := range neighbors[:k] {
+			edges = append(edges, KNNEdge{Source: i, Target: j, Distance: distances[i][j]})
+		}
+	}
+	return edges, nil
+}
+
+// DetectOutliers scores every embedding by its mean Euclidean distance to its k nearest neighbors
+// and returns the indices of those scoring above threshold, in ascending order, along with all scores.
+// With fewer than two embeddings nothing can be compared, so no embedding is an outlier.
+func DetectOutliers(embeddings [][]float32, k int, threshold float32) ([]int, []float32) {
+	scores := make([]float32, len(embeddings))
+	edges, err := BuildKNNGraph(embeddings, k, EuclideanDistance)
+	if err != nil || len(edges) == 0 {
+		return nil, scores
+	}
+
+	counts := make([]int, len(embeddings))
+	for _, edge := range edges {
+		scores[edge.Source] += edge.Distance
+		counts[edge.Source]++
+	}
+
+	var outliers []int
+	for i := range scores {
+		scores[i] /= float32(counts[i])
+		if scores[i] > threshold {
+			outliers = append(outliers, i)
+		}
+	}
+	return outliers, scores
+}
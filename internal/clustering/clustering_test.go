@@ -0,0 +1,334 @@
+package clustering
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// lineEmbeddings places n items evenly along one axis
+func lineEmbeddings(n int) ([][]float32, []string) {
+	embeddings := make([][]float32, n)
+	ids := make([]string, n)
+	for i := range embeddings {
+		embeddings[i] = []float32{float32(i), 0}
+		ids[i] = fmt.Sprintf("item-%d", i)
+	}
+	return embeddings, ids
+}
+
+func TestRelaxConstraints(t *testing.T) {
+	tests := []struct {
+		items, minSize, maxSize int
+		strategy                string
+		wantMin, wantMax        int
+	}{
+		{items: 5, minSize: 3, maxSize: 6, strategy: RelaxGrowMax, wantMin: 3, wantMax: 6}, // already feasible
+		{items: 7, minSize: 4, maxSize: 6, strategy: RelaxGrowMax, wantMin: 4, wantMax: 7},
+		{items: 7, minSize: 4, maxSize: 6, strategy: RelaxShrinkMin, wantMin: 3, wantMax: 6},
+		{items: 2, minSize: 3, maxSize: 6, strategy: RelaxGrowMax, wantMin: 2, wantMax: 6},
+		{items: 2, minSize: 5, maxSize: 1, strategy: RelaxShrinkMin, wantMin: 2, wantMax: 2},
+		{items: 11, minSize: 6, maxSize: 6, strategy: RelaxGrowMax, wantMin: 6, wantMax: 11},
+		{items: 11, minSize: 6, maxSize: 6, strategy: RelaxShrinkMin, wantMin: 5, wantMax: 6},
+	}
+	for _, tt := range tests {
+		minSize, maxSize, err := RelaxConstraints(tt.items, tt.minSize, tt.maxSize, tt.strategy)
+		if err != nil {
+			t.Errorf("%d items, %d-%d, %s: %v", tt.items, tt.minSize, tt.maxSize, tt.strategy, err)
+			continue
+		}
+		if minSize != tt.wantMin || maxSize != tt.wantMax {
+			t.Errorf("%d items, %d-%d, %s: relaxed to %d-%d, want %d-%d",
+				tt.items, tt.minSize, tt.maxSize, tt.strategy, minSize, maxSize, tt.wantMin, tt.wantMax)
+		}
+		if _, err := CalculateOptimalClusters(tt.items, minSize, maxSize); err != nil {
+			t.Errorf("%d items: relaxed constraints %d-%d are still infeasible: %v", tt.items, minSize, maxSize, err)
+		}
+	}
+}
+
+func TestRelaxConstraintsRejectsBadInput(t *testing.T) {
+	if _, _, err := RelaxConstraints(0, 3, 6, RelaxGrowMax); err == nil {
+		t.Error("relaxed constraints for no items")
+	}
+	if _, _, err := RelaxConstraints(7, 4, 6, "guess"); err == nil {
+		t.Error("accepted an unknown strategy")
+	}
+}
+
+func TestPerformTwoStageClusteringRefinesVisualGroupsByLabels(t *testing.T) {
+	// Two visual groups of eight items, each holding two label groups of four
+	var visual, labels [][]float32
+	var ids []string
+	want := map[string]string{}
+	for i := 0; i < 16; i++ {
+		group, labelGroup := i/8, i%2
+		visual = append(visual, []float32{float32(group * 100), float32(i%8) * 0.1})
+		labels = append(labels, []float32{float32(labelGroup), float32(1 - labelGroup)})
+		id := fmt.Sprintf("item-%d", i)
+		ids = append(ids, id)
+		want[id] = fmt.Sprintf("%d/%d", group, labelGroup)
+	}
+
+	clusters, ok := PerformTwoStageClustering(visual, labels, ids, 8, 8, 4, 4, "")
+	if !ok {
+		t.Fatal("two-stage clustering failed")
+	}
+	if len(clusters) != 4 {
+		t.Fatalf("got %d clusters, want 4: %v", len(clusters), clusters)
+	}
+	for clusterID, refs := range clusters {
+		if len(refs) != 4 {
+			t.Errorf("cluster %d has %d items, want 4", clusterID, len(refs))
+		}
+		for _, ref := range refs {
+			if want[ref] != want[refs[0]] {
+				t.Errorf("cluster %d mixes %s (%s) with %s (%s)", clusterID, ref, want[ref], refs[0], want[refs[0]])
+			}
+		}
+	}
+}
+
+func TestMergeSimilarClustersRemergesASplitGroup(t *testing.T) {
+	// Cluster 0 and 1 are halves of one tight group near the origin; cluster 2 is far away
+	embeddings := [][]float32{{0, 0}, {0.1, 0}, {0, 0.1}, {0.1, 0.1}, {10, 10}, {10.1, 10}}
+	ids := []string{"a", "b", "c", "d", "e", "f"}
+	clusters := map[int][]string{0: {"a", "b"}, 1: {"c", "d"}, 2: {"e", "f"}}
+
+	merged := MergeSimilarClusters(clusters, embeddings, ids, 1, 6)
+	if len(merged) != 2 {
+		t.Fatalf("got %d clusters, want 2: %v", len(merged), merged)
+	}
+	groups := map[string]bool{}
+	for _, refs := range merged {
+		sorted := slices.Clone(refs)
+		slices.Sort(sorted)
+		groups[strings.Join(sorted, "")] = true
+	}
+	if !groups["abcd"] || !groups["ef"] {
+		t.Errorf("merged clusters = %v, want {a b c d} and {e f}", merged)
+	}
+
+	// The merged cluster would exceed maxSize, so the halves stay apart
+	if kept := MergeSimilarClusters(clusters, embeddings, ids, 1, 3); len(kept) != 3 {
+		t.Errorf("got %d clusters with maxSize 3, want the 3 clusters unchanged", len(kept))
+	}
+}
+
+func TestPerformClusteringWithCentroidsReturnsMemberMeans(t *testing.T) {
+	embeddings := [][]float32{{0, 0}, {0.3, 0.1}, {0.2, 0.5}, {9, 9}, {9.4, 9.2}, {9.1, 9.9}}
+	ids := []string{"a", "b", "c", "d", "e", "f"}
+	index := map[string]int{}
+	for i, id := range ids {
+		index[id] = i
+	}
+
+	for _, update := range []string{CentroidIncremental, CentroidEachMerge, CentroidFinal} {
+		clusters, centroids, ok := PerformClusteringWithCentroids(embeddings, ids, 3, 3, update)
+		if !ok {
+			t.Fatalf("%q: clustering failed", update)
+		}
+		if len(centroids) != len(clusters) {
+			t.Fatalf("%q: got %d centroids for %d clusters", update, len(centroids), len(clusters))
+		}
+		for clusterID, refs := range clusters {
+			indices := make([]int, len(refs))
+			for i, ref := range refs {
+				indices[i] = index[ref]
+			}
+			want := MemberMean(indices, embeddings)
+			got := centroids[clusterID]
+			if len(got) != len(want) {
+				t.Fatalf("%q: cluster %d centroid %v, want %v", update, clusterID, got, want)
+			}
+			for d := range want {
+				if diff := got[d] - want[d]; diff > 1e-5 || diff < -1e-5 {
+					t.Errorf("%q: cluster %d centroid %v, want the member mean %v", update, clusterID, got, want)
+					break
+				}
+			}
+		}
+	}
+}
+
+func TestPerformBucketedClusteringRespectsMaxSize(t *testing.T) {
+	// Five items cannot form clusters of 3 to 4, so the bucket must not come back whole
+	embeddings, ids := lineEmbeddings(5)
+	buckets := make([]int, len(ids))
+
+	clusters, ok := PerformBucketedClustering(embeddings, ids, buckets, 3, 4, CentroidIncremental, "")
+	if !ok {
+		t.Fatal("bucketed clustering failed")
+	}
+	for id, refs := range clusters {
+		if len(refs) > 4 || len(refs) < 3 {
+			t.Errorf("cluster %d has %d items, want 3 to 4", id, len(refs))
+		}
+	}
+}
+
+func TestPerformBucketedClusteringRelaxesPerBucket(t *testing.T) {
+	embeddings, ids := lineEmbeddings(5)
+	buckets := make([]int, len(ids))
+
+	clusters, ok := PerformBucketedClustering(embeddings, ids, buckets, 3, 4, CentroidIncremental, RelaxShrinkMin)
+	if !ok {
+		t.Fatal("bucketed clustering failed")
+	}
+	total := 0
+	for id, refs := range clusters {
+		if len(refs) > 4 {
+			t.Errorf("cluster %d has %d items, more than the maximum of 4", id, len(refs))
+		}
+		total += len(refs)
+	}
+	if total != len(ids) {
+		t.Errorf("clustered %d items, want all %d after relaxing the minimum", total, len(ids))
+	}
+}
+
+func TestFilterLooseClusters(t *testing.T) {
+	embeddings := [][]float32{
+		{0, 0}, {0.1, 0}, {0, 0.1}, // Tight cluster around the origin
+		{10, 0}, {-10, 0}, {0, 10}, // Loose cluster spread far apart
+	}
+	ids := []string{"t1", "t2", "t3", "l1", "l2", "l3"}
+	clusters := map[int][]string{0: {"t1", "t2", "t3"}, 1: {"l1", "l2", "l3"}}
+
+	kept, cohesion, misc := FilterLooseClusters(clusters, embeddings, ids, 1)
+	if _, ok := kept[0]; !ok || len(kept) != 1 {
+		t.Errorf("kept %v, want only the tight cluster", kept)
+	}
+	if len(misc) != 3 || misc[0] != "l1" {
+		t.Errorf("misc = %v, want the loose cluster's members", misc)
+	}
+	if cohesion[0] >= cohesion[1] {
+		t.Errorf("tight cohesion %.3f is not below loose cohesion %.3f", cohesion[0], cohesion[1])
+	}
+
+	// A threshold of 0 keeps every cluster but still reports cohesion
+	kept, cohesion, misc = FilterLooseClusters(clusters, embeddings, ids, 0)
+	if len(kept) != 2 || len(misc) != 0 || len(cohesion) != 2 {
+		t.Errorf("threshold 0 kept %d clusters and moved %d items", len(kept), len(misc))
+	}
+}
+
+func TestBuildKNNGraphGivesEveryNodeKEdges(t *testing.T) {
+	embeddings, _ := lineEmbeddings(6)
+
+	for _, metric := range []DistanceMetric{EuclideanDistance, CosineDistance} {
+		for _, k := range []int{1, 3, 10} {
+			edges, err := BuildKNNGraph(embeddings, k, metric)
+			if err != nil {
+				t.Fatalf("%s, k=%d: %v", metric, k, err)
+			}
+			want := min(k, len(embeddings)-1)
+			outgoing := make(map[int]int)
+			for _, edge := range edges {
+				if edge.Source == edge.Target {
+					t.Errorf("%s, k=%d: node %d links to itself", metric, k, edge.Source)
+				}
+				outgoing[edge.Source]++
+			}
+			for node := range embeddings {
+				if outgoing[node] != want {
+					t.Errorf("%s, k=%d: node %d has %d edges, want %d", metric, k, node, outgoing[node], want)
+				}
+			}
+		}
+	}
+
+	// On a line the nearest neighbors of an inner point are the adjacent ones
+	edges, _ := BuildKNNGraph(embeddings, 2, EuclideanDistance)
+	var targets []int
+	for _, edge := range edges {
+		if edge.Source == 3 {
+			targets = append(targets, edge.Target)
+		}
+	}
+	if !slices.Equal(targets, []int{2, 4}) {
+		t.Errorf("neighbors of node 3 = %v, want [2 4]", targets)
+	}
+
+	if _, err := BuildKNNGraph(embeddings, 2, "manhattan"); err == nil {
+		t.Error("accepted an unknown metric")
+	}
+}
+
+func TestCapClusterCountNeverExceedsTheCap(t *testing.T) {
+	embeddings, ids := lineEmbeddings(12)
+	clusters, ok := PerformClusteringWithConstraints(embeddings, ids, 2, 2, "")
+	if !ok || len(clusters) != 6 {
+		t.Fatalf("got %d clusters (ok %v), want 6 pairs to cap", len(clusters), ok)
+	}
+
+	for _, maxClusters := range []int{1, 2, 4, 6, 8} {
+		// A maxSize of 2 cannot be kept below 6 clusters, so the cap must win over the size limit
+		capped := CapClusterCount(clusters, embeddings, ids, maxClusters, 2)
+		if len(capped) > maxClusters {
+			t.Errorf("cap %d: got %d clusters", maxClusters, len(capped))
+		}
+		total := 0
+		for _, refs := range capped {
+			total += len(refs)
+		}
+		if total != len(ids) {
+			t.Errorf("cap %d: kept %d of %d items", maxClusters, total, len(ids))
+		}
+	}
+
+	if kept := CapClusterCount(clusters, embeddings, ids, 0, 2); len(kept) != len(clusters) {
+		t.Errorf("a cap of 0 changed the clusters to %v", kept)
+	}
+}
+
+func TestRecomputedCentroidIsTheTrueMean(t *testing.T) {
+	// Merge many single points one at a time, the pattern that lets incremental updates drift
+	const n = 2000
+	embeddings := make([][]float32, n)
+	for i := range embeddings {
+		embeddings[i] = []float32{10000 + float32(i%7)*0.1, float32(i) * 0.001}
+	}
+	var sums [2]float64
+	for _, e := range embeddings {
+		sums[0] += float64(e[0])
+		sums[1] += float64(e[1])
+	}
+	want := []float32{float32(sums[0] / n), float32(sums[1] / n)}
+
+	incremental := NewCluster(0, embeddings[0])
+	recomputed := NewCluster(0, embeddings[0])
+	for i := 1; i < n; i++ {
+		incremental = mergeClustersWith(incremental, NewCluster(i, embeddings[i]), embeddings, CentroidIncremental)
+		recomputed = mergeClustersWith(recomputed, NewCluster(i, embeddings[i]), embeddings, CentroidEachMerge)
+	}
+
+	if !slices.Equal(recomputed.Centroid, want) {
+		t.Errorf("recomputed centroid %v, want the true mean %v", recomputed.Centroid, want)
+	}
+	if slices.Equal(incremental.Centroid, want) {
+		t.Errorf("incremental centroid %v has no drift from the true mean; the test no longer exercises recomputation", incremental.Centroid)
+	}
+	t.Logf("incremental centroid %v drifted from the true mean %v", incremental.Centroid, want)
+}
+
+func TestDetectOutliersFlagsAFarAwayVector(t *testing.T) {
+	embeddings := [][]float32{{0, 0}, {0.1, 0}, {0, 0.1}, {0.1, 0.1}, {0.05, 0.05}, {50, 50}}
+	outliers, scores := DetectOutliers(embeddings, 3, 5)
+	if !slices.Equal(outliers, []int{5}) {
+		t.Fatalf("outliers = %v, want only the injected vector 5", outliers)
+	}
+	if len(scores) != len(embeddings) {
+		t.Fatalf("got %d scores for %d embeddings", len(scores), len(embeddings))
+	}
+	for i, score := range scores[:5] {
+		if score >= scores[5] {
+			t.Errorf("item %d scored %v, not below the outlier's %v", i, score, scores[5])
+		}
+	}
+
+	if outliers, _ := DetectOutliers(embeddings, 3, 1000); len(outliers) != 0 {
+		t.Errorf("a threshold above every distance flagged %v", outliers)
+	}
+}
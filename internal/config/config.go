@@ -3,24 +3,166 @@ package config
 import (
 	"fmt"
 	"net/http"
+	"os"
+	"sort"
 	"strconv"
+	"strings"
+	"time"
 )
 
 // AppConfig holds the configuration extracted from the request.
 type AppConfig struct {
-	ProfileID         string
-	AuthToken         string
-	NumberOfDaysLimit int
-	ModelPath         string
-	Host              string
-	Port              int
-	MinClusterSize    int
-	MaxClusterSize    int
+	ProfileID             string
+	AuthToken             string
+	NumberOfDaysLimit     int
+	ModelPath             string
+	Host                  string
+	Port                  int
+	MinClusterSize        int
+	MaxClusterSize        int
+	CohesionThreshold     float32            // Clusters looser than this are moved to the misc bucket (0 disables)
+	OutlierThreshold      float32            // Mean distance to the nearest neighbors above which an image is an outlier (0 disables)
+	OutlierNeighbors      int                // Number of nearest neighbors the outlier distance is averaged over
+	OutlierAction         string             // What happens to outliers ("flag" reports them, "exclude" also moves them to the misc bucket)
+	ReportOutputDir       string             // Persistent directory for archived HTML reports (empty disables)
+	ClusterJSONDir        string             // Persistent directory for per-cluster JSON files (empty disables)
+	LabelCacheDir         string             // Persistent Rekognition cache shared across sessions (empty caches per session)
+	StandardizeEmbeddings bool               // Z-score standardize each embedding dimension across the batch before clustering
+	Interpolation         string             // Interpolation method used when resizing images
+	FlattenTransparency   bool               // Composite transparent images over BackgroundColor before embedding instead of dropping alpha
+	BackgroundColor       string             // Background transparent pixels are flattened against, as #rrggbb
+	ResizeMode            string             // How non-square images reach the network's square input ("distort" or "pad")
+	PadColor              string             // Letterbox color used by the "pad" resize mode, as #rrggbb
+	PreprocessPipeline    []string           // Ordered preprocessing steps (empty uses the default order)
+	LabelsOnly            bool               // Cluster on label vectors alone, skipping ResNet inference
+	UseRekognition        bool               // Detect Rekognition labels; when false images are clustered on ResNet embeddings alone
+	EmbeddingFallback     bool               // Cluster images whose ResNet inference fails on their labels alone instead of failing the run
+	ImageTimeout          time.Duration      // Longest one image may take to download or embed before it counts as failed (0 waits indefinitely)
+	MaxFailedImages       int                // Images whose embedding may fail before the run fails; the rest are clustered without them
+	MaxFailedPercent      float64            // Share of images, in percent, whose embedding may fail before the run fails
+	MaxImagesPerCluster   int                // Maximum thumbnails shown per cluster in the HTML report (0 shows all)
+	MinImageWidth         int                // Uploads narrower than this many pixels are rejected (0 disables)
+	MinImageHeight        int                // Uploads shorter than this many pixels are rejected (0 disables)
+	ImageURLFailure       string             // What a failed image_urls download does ("fail" the request or "skip" the URL)
+	ImageURLToken         string             // Bearer token sent when downloading image_urls, overriding any configured Authorization header
+	AIClusterWorkers      int                // Number of clusters titled concurrently
+	LabelWorkers          int                // Number of images whose labels are detected concurrently
+	TitleStrategy         string             // Consensus strategy for the default cluster title (empty keeps the per-service default)
+	TitleOverflow         string             // What to do with empty or over-length model titles (empty truncates them)
+	TitleSimilarity       float32            // Similarity from 0 to 1 at which titles of different clusters count as duplicates (0 disables disambiguation)
+	TitleGroupDistance    float32            // Centroid distance within which clusters share one AI title (0 titles every cluster)
+	UntitledDisplay       string             // How outputs of failed AI services are shown in the report
+	EmbeddingLayer        string             // Model layer embeddings are extracted from ("dense" logits or "pool" features)
+	EmbeddingModels       []string           // "name:weight" entries of models whose embeddings are blended with ResNet50 (empty uses ResNet50 alone)
+	EmbeddingPostprocess  string             // Transformation of the network output ("softmax" or "l2", empty keeps it raw)
+	ModerationAction      string             // What to do with images carrying moderation labels ("flag", "reject", or empty to skip screening)
+	DedupHash             string             // Perceptual hash used to drop near-duplicate uploads (empty disables deduplication)
+	DedupThreshold        int                // Hamming distance up to which two hashes count as duplicates (-1 uses the algorithm's default)
+	ModerationConfidence  float32            // Minimum confidence for a moderation label to count
+	NetPoolSize           int                // Number of ResNet50 copies loaded so images are embedded in parallel
+	ConstraintFallback    string             // How infeasible cluster size constraints are relaxed (empty fails the run)
+	EmptyResult           string             // What a run that forms no valid cluster returns ("misc", or empty to fail with an explanation)
+	MinLabels             int                // Fewest Rekognition labels an image should get (0 disables the check)
+	MinLabelsAction       string             // What happens to images with fewer labels ("retry" at a lower confidence, or "flag" only)
+	Deterministic         bool               // Produce identical output for identical input by skipping AI titling
+	AIMinClusterSize      int                // Smallest cluster titled by the AI services; smaller ones use their labels
+	TwoStage              bool               // Cluster on one feature type, then refine each group on the other
+	TwoStageOrder         string             // Feature type clustered first ("visual_first" or "labels_first")
+	TwoStageCoarseMaxSize int                // Maximum group size of the first stage
+	SortOrder             string             // Order clusters are listed in ("size", "cohesion", "label", or empty for key order)
+	MergeThreshold        float32            // Centroid distance below which clusters are merged (0 disables merging)
+	CentroidUpdate        string             // How centroids are kept during hierarchical merges ("merge", "final", or empty for incremental)
+	MaxClusters           int                // Most clusters a run may produce; closest clusters are merged beyond it (0 disables the cap)
+	AspectBuckets         []float64          // Ascending width/height ratios separating aspect-ratio buckets (empty disables bucketing)
+	CategoryConfidence    map[string]float32 // Minimum label confidence per Rekognition label category
+	FeatureMask           string             // Embedding dimensions clustered on: "image", "labels", "start:end", or empty for all
+	CropToSubject         bool               // Crop images to the largest object Rekognition located before embedding them
+	LabelDetails          bool               // Return the full Rekognition label objects of every image, not just their names
+	OriginalFilenames     bool               // Show the names images were uploaded with next to their stored names
+	EXIFFields            []string           // EXIF fields appended to the embedding as categorical features (empty disables)
+	DetectText            bool               // Append words Rekognition reads in the images, such as brand names, as categorical features
+	ViewAggregation       string             // How views of one product are combined ("mean" or "max", empty clusters every image alone)
+	TitleMaxChars         int                // Longest title kept from the models; longer ones are truncated
+	PhraseMaxChars        int                // Longest catchy phrase kept from the models; longer ones are truncated
+	AICategory            bool               // Ask the models for a short category label alongside the title and phrase
+	CollectionSummary     bool               // Ask the default model for a paragraph describing the whole collection
+}
+
+// TitleStrategies lists the accepted values for the title_strategy field
+var TitleStrategies = []string{"first", "shortest", "majority"}
+
+// TitleOverflowPolicies lists the accepted values for the title_overflow field
+var TitleOverflowPolicies = []string{"relax", "labels", "untitled"}
+
+// EXIFFields lists the accepted entries of the exif_fields field
+var EXIFFields = []string{"make", "model", "lens", "software", "date"}
+
+// ResizeModes lists the accepted values for the resize_mode field
+var ResizeModes = []string{"distort", "pad"}
+
+// ViewAggregations lists the accepted values for the view_aggregation field
+var ViewAggregations = []string{"mean", "max"}
+
+// ImageURLFailureModes lists the accepted values for the image_url_failure field
+var ImageURLFailureModes = []string{"fail", "skip"}
+
+// OutlierActions lists the accepted values for the outlier_action field
+var OutlierActions = []string{"flag", "exclude"}
+
+// CentroidUpdates lists the accepted values for the centroid_update field besides "incremental"
+var CentroidUpdates = []string{"merge", "final"}
+
+// UntitledDisplayModes lists the accepted values for the untitled_display field
+var UntitledDisplayModes = []string{"labels", "hide", "literal"}
+
+// EmbeddingLayers lists the accepted values for the embedding_layer field
+var EmbeddingLayers = []string{"dense", "pool"}
+
+// EmbeddingPostprocessMethods lists the accepted values for the embedding_postprocess field besides "none"
+var EmbeddingPostprocessMethods = []string{"softmax", "l2"}
+
+// ModerationActions lists the accepted values for the moderation field
+var ModerationActions = []string{"flag", "reject"}
+
+// DedupHashes lists the accepted values for the dedup_hash field
+var DedupHashes = []string{"phash", "ahash", "blockmean", "marrhildreth"}
+
+// ConstraintFallbacks lists the accepted values for the constraint_fallback field
+var ConstraintFallbacks = []string{"grow_max", "shrink_min"}
+
+// EmptyResultModes lists the accepted values for the empty_result field
+var EmptyResultModes = []string{"fail", "misc"}
+
+// MinLabelsActions lists the accepted values for the min_labels_action field
+var MinLabelsActions = []string{"retry", "flag"}
+
+// TwoStageOrders lists the accepted values for the two_stage_order field
+var TwoStageOrders = []string{"visual_first", "labels_first"}
+
+// SortOrders lists the accepted values for the sort_clusters field
+var SortOrders = []string{"size", "cohesion", "label"}
+
+// InterpolationMethods lists the accepted values for the interpolation field
+var InterpolationMethods = []string{"linear", "area", "cubic", "nearest", "lanczos"}
+
+// ProductSetterFields lists the fields only the ProductSetter flow reads. The image upload flow
+// has no product catalog to fetch from, so it reports these as ignored rather than applying them.
+var ProductSetterFields = []string{"profile_id", "auth_token", "number_of_days_limit"}
+
+// IgnoredFields returns the ProductSetter-only fields present in the request, in ProductSetterFields order
+func IgnoredFields(r *http.Request) []string {
+	ignored := []string{}
+	for _, field := range ProductSetterFields {
+		if _, ok := r.Form[field]; ok {
+			ignored = append(ignored, field)
+		}
+	}
+	return ignored
 }
 
 // ExtractConfigurations parses the configuration data from the request.
 func ExtractConfigurations(r *http.Request) (*AppConfig, error) {
-	appCtx := &AppConfig{}
+	appCtx := ExtractClusterConfigurations(r)
 
 	// Extract ProfileID
 	profileID := r.FormValue("profile_id")
@@ -45,8 +187,504 @@ func ExtractConfigurations(r *http.Request) (*AppConfig, error) {
 		appCtx.NumberOfDaysLimit = numberOfDaysLimit
 	}
 
+	return appCtx, nil
+}
+
+// ExtractClusterConfigurations parses the clustering options from the request.
+// Unlike ExtractConfigurations it requires no credentials, so it is used by the image upload flow.
+func ExtractClusterConfigurations(r *http.Request) *AppConfig {
+	appCtx := &AppConfig{}
+
 	appCtx.MaxClusterSize = 6
 	appCtx.MinClusterSize = 3
 
-	return appCtx, nil
+	// Extract CohesionThreshold
+	cohesionThreshold, err := strconv.ParseFloat(r.FormValue("cohesion_threshold"), 32)
+	if err != nil || cohesionThreshold < 0 {
+		appCtx.CohesionThreshold = 0 // Default value: keep every cluster
+	} else {
+		appCtx.CohesionThreshold = float32(cohesionThreshold)
+	}
+
+	// Extract OutlierThreshold
+	outlierThreshold, err := strconv.ParseFloat(r.FormValue("outlier_threshold"), 32)
+	if err != nil || outlierThreshold < 0 {
+		appCtx.OutlierThreshold = 0 // Default value: no outlier detection
+	} else {
+		appCtx.OutlierThreshold = float32(outlierThreshold)
+	}
+
+	// Extract OutlierNeighbors
+	outlierNeighbors, err := strconv.Atoi(r.FormValue("outlier_neighbors"))
+	if err != nil || outlierNeighbors < 1 {
+		appCtx.OutlierNeighbors = 5 // Default value
+	} else {
+		appCtx.OutlierNeighbors = outlierNeighbors
+	}
+
+	// Extract OutlierAction
+	appCtx.OutlierAction = "flag" // Default value
+	outlierAction := r.FormValue("outlier_action")
+	for _, action := range OutlierActions {
+		if outlierAction == action {
+			appCtx.OutlierAction = outlierAction
+		}
+	}
+
+	// Extract MergeThreshold
+	mergeThreshold, err := strconv.ParseFloat(r.FormValue("merge_threshold"), 32)
+	if err != nil || mergeThreshold < 0 {
+		appCtx.MergeThreshold = 0 // Default value: never merge
+	} else {
+		appCtx.MergeThreshold = float32(mergeThreshold)
+	}
+
+	// Extract CentroidUpdate
+	appCtx.CentroidUpdate = "" // Default value: incremental updates
+	centroidUpdate := r.FormValue("centroid_update")
+	for _, update := range CentroidUpdates {
+		if centroidUpdate == update {
+			appCtx.CentroidUpdate = centroidUpdate
+		}
+	}
+
+	// Extract MaxClusters
+	maxClusters, err := strconv.Atoi(r.FormValue("max_clusters"))
+	if err != nil || maxClusters < 0 {
+		appCtx.MaxClusters = 0 // Default value: no cap
+	} else {
+		appCtx.MaxClusters = maxClusters
+	}
+
+	// Extract TitleSimilarity
+	titleSimilarity, err := strconv.ParseFloat(r.FormValue("title_similarity"), 32)
+	if err != nil || titleSimilarity <= 0 || titleSimilarity > 1 {
+		appCtx.TitleSimilarity = 0 // Default value: keep duplicate titles
+	} else {
+		appCtx.TitleSimilarity = float32(titleSimilarity)
+	}
+
+	// Extract TitleGroupDistance
+	titleGroupDistance, err := strconv.ParseFloat(r.FormValue("title_group_distance"), 32)
+	if err != nil || titleGroupDistance < 0 {
+		appCtx.TitleGroupDistance = 0 // Default value: title every cluster
+	} else {
+		appCtx.TitleGroupDistance = float32(titleGroupDistance)
+	}
+
+	// Extract AspectBuckets
+	appCtx.AspectBuckets = parseAspectBuckets(r.FormValue("aspect_buckets"))
+
+	// Extract CategoryConfidence
+	appCtx.CategoryConfidence = parseCategoryConfidence(r.FormValue("label_category_confidence"))
+
+	// Extract EXIFFields, dropping unknown and repeated entries
+	for _, field := range strings.Split(r.FormValue("exif_fields"), ",") {
+		field = strings.ToLower(strings.TrimSpace(field))
+		for _, known := range EXIFFields {
+			if field == known && !containsString(appCtx.EXIFFields, field) {
+				appCtx.EXIFFields = append(appCtx.EXIFFields, field)
+			}
+		}
+	}
+
+	// Extract DetectText
+	detectText, err := strconv.ParseBool(r.FormValue("detect_text"))
+	appCtx.DetectText = err == nil && detectText
+
+	// Extract FeatureMask
+	appCtx.FeatureMask = strings.TrimSpace(r.FormValue("feature_mask"))
+
+	// Extract StandardizeEmbeddings
+	standardizeEmbeddings, err := strconv.ParseBool(r.FormValue("standardize_embeddings"))
+	appCtx.StandardizeEmbeddings = err == nil && standardizeEmbeddings
+
+	// Extract Deterministic
+	deterministic, err := strconv.ParseBool(r.FormValue("deterministic"))
+	appCtx.Deterministic = err == nil && deterministic
+
+	// Extract LabelsOnly
+	labelsOnly, err := strconv.ParseBool(r.FormValue("labels_only"))
+	appCtx.LabelsOnly = err == nil && labelsOnly
+
+	// Extract UseRekognition
+	useRekognition, err := strconv.ParseBool(r.FormValue("use_rekognition"))
+	appCtx.UseRekognition = err != nil || useRekognition // Default value: detect labels
+
+	// Extract CropToSubject
+	cropToSubject, err := strconv.ParseBool(r.FormValue("crop_to_subject"))
+	appCtx.CropToSubject = err == nil && cropToSubject
+
+	// Extract LabelDetails
+	labelDetails, err := strconv.ParseBool(r.FormValue("label_details"))
+	appCtx.LabelDetails = err == nil && labelDetails
+
+	// Extract OriginalFilenames
+	originalFilenames, err := strconv.ParseBool(r.FormValue("original_filenames"))
+	appCtx.OriginalFilenames = err == nil && originalFilenames
+
+	// Extract EmbeddingFallback
+	embeddingFallback, err := strconv.ParseBool(r.FormValue("embedding_fallback"))
+	appCtx.EmbeddingFallback = err == nil && embeddingFallback
+
+	// Extract ImageTimeout, given in seconds
+	imageTimeout, err := strconv.ParseFloat(r.FormValue("image_timeout"), 64)
+	if err != nil || imageTimeout <= 0 {
+		appCtx.ImageTimeout = 0 // Default value: no per-image timeout
+	} else {
+		appCtx.ImageTimeout = time.Duration(imageTimeout * float64(time.Second))
+	}
+
+	// Extract MaxFailedImages
+	maxFailedImages, err := strconv.Atoi(r.FormValue("max_failed_images"))
+	if err != nil || maxFailedImages < 0 {
+		appCtx.MaxFailedImages = 0 // Default value: any failure fails the run
+	} else {
+		appCtx.MaxFailedImages = maxFailedImages
+	}
+
+	// Extract MaxFailedPercent
+	maxFailedPercent, err := strconv.ParseFloat(r.FormValue("max_failed_percent"), 64)
+	if err != nil || maxFailedPercent < 0 || maxFailedPercent > 100 {
+		appCtx.MaxFailedPercent = 0 // Default value: any failure fails the run
+	} else {
+		appCtx.MaxFailedPercent = maxFailedPercent
+	}
+
+	// Extract MinImageWidth and MinImageHeight
+	minImageWidth, err := strconv.Atoi(r.FormValue("min_image_width"))
+	if err != nil || minImageWidth < 0 {
+		appCtx.MinImageWidth = 0 // Default value: accept any width
+	} else {
+		appCtx.MinImageWidth = minImageWidth
+	}
+	minImageHeight, err := strconv.Atoi(r.FormValue("min_image_height"))
+	if err != nil || minImageHeight < 0 {
+		appCtx.MinImageHeight = 0 // Default value: accept any height
+	} else {
+		appCtx.MinImageHeight = minImageHeight
+	}
+
+	// Extract ImageURLToken
+	appCtx.ImageURLToken = strings.TrimSpace(r.FormValue("image_url_token"))
+
+	// Extract ImageURLFailure
+	appCtx.ImageURLFailure = "fail" // Default value
+	imageURLFailure := r.FormValue("image_url_failure")
+	for _, mode := range ImageURLFailureModes {
+		if imageURLFailure == mode {
+			appCtx.ImageURLFailure = imageURLFailure
+		}
+	}
+
+	// Extract MaxImagesPerCluster
+	maxImagesPerCluster, err := strconv.Atoi(r.FormValue("max_images_per_cluster"))
+	if err != nil || maxImagesPerCluster < 0 {
+		appCtx.MaxImagesPerCluster = 0 // Default value: show every image
+	} else {
+		appCtx.MaxImagesPerCluster = maxImagesPerCluster
+	}
+
+	// Extract AIClusterWorkers
+	aiClusterWorkers, err := strconv.Atoi(r.FormValue("ai_cluster_workers"))
+	if err != nil || aiClusterWorkers <= 0 {
+		appCtx.AIClusterWorkers = 4 // Default value
+	} else {
+		appCtx.AIClusterWorkers = aiClusterWorkers
+	}
+
+	// Extract LabelWorkers
+	labelWorkers, err := strconv.Atoi(r.FormValue("label_workers"))
+	if err != nil || labelWorkers <= 0 {
+		appCtx.LabelWorkers = 4 // Default value
+	} else {
+		appCtx.LabelWorkers = labelWorkers
+	}
+
+	// Extract AIMinClusterSize
+	aiMinClusterSize, err := strconv.Atoi(r.FormValue("ai_min_cluster_size"))
+	if err != nil || aiMinClusterSize < 0 {
+		appCtx.AIMinClusterSize = 0 // Default value: title every cluster with AI
+	} else {
+		appCtx.AIMinClusterSize = aiMinClusterSize
+	}
+
+	// Extract TitleMaxChars
+	titleMaxChars, err := strconv.Atoi(r.FormValue("title_max_chars"))
+	if err != nil || titleMaxChars <= 0 {
+		appCtx.TitleMaxChars = 25 // Default value, matching the prompt
+	} else {
+		appCtx.TitleMaxChars = titleMaxChars
+	}
+
+	// Extract PhraseMaxChars
+	phraseMaxChars, err := strconv.Atoi(r.FormValue("phrase_max_chars"))
+	if err != nil || phraseMaxChars <= 0 {
+		appCtx.PhraseMaxChars = 100 // Default value, matching the prompt
+	} else {
+		appCtx.PhraseMaxChars = phraseMaxChars
+	}
+
+	// Extract AICategory
+	aiCategory, err := strconv.ParseBool(r.FormValue("ai_category"))
+	appCtx.AICategory = err == nil && aiCategory
+
+	// Extract CollectionSummary
+	collectionSummary, err := strconv.ParseBool(r.FormValue("collection_summary"))
+	appCtx.CollectionSummary = err == nil && collectionSummary
+
+	// Extract TitleStrategy
+	titleStrategy := r.FormValue("title_strategy")
+	for _, strategy := range TitleStrategies {
+		if titleStrategy == strategy {
+			appCtx.TitleStrategy = titleStrategy
+		}
+	}
+
+	// Extract ViewAggregation
+	viewAggregation := r.FormValue("view_aggregation")
+	for _, method := range ViewAggregations {
+		if viewAggregation == method {
+			appCtx.ViewAggregation = viewAggregation
+		}
+	}
+
+	// Extract TitleOverflow
+	titleOverflow := r.FormValue("title_overflow")
+	for _, policy := range TitleOverflowPolicies {
+		if titleOverflow == policy {
+			appCtx.TitleOverflow = titleOverflow
+		}
+	}
+
+	// Extract UntitledDisplay
+	appCtx.UntitledDisplay = "labels" // Default value
+	untitledDisplay := r.FormValue("untitled_display")
+	for _, mode := range UntitledDisplayModes {
+		if untitledDisplay == mode {
+			appCtx.UntitledDisplay = untitledDisplay
+		}
+	}
+
+	// Extract EmbeddingLayer
+	appCtx.EmbeddingLayer = "dense" // Default value
+	embeddingLayer := r.FormValue("embedding_layer")
+	for _, layer := range EmbeddingLayers {
+		if embeddingLayer == layer {
+			appCtx.EmbeddingLayer = embeddingLayer
+		}
+	}
+
+	// Extract EmbeddingPostprocess; "none" and unknown values keep the raw network output
+	embeddingPostprocess := r.FormValue("embedding_postprocess")
+	for _, method := range EmbeddingPostprocessMethods {
+		if embeddingPostprocess == method {
+			appCtx.EmbeddingPostprocess = embeddingPostprocess
+		}
+	}
+
+	// Extract ModerationAction
+	moderationAction := r.FormValue("moderation")
+	for _, action := range ModerationActions {
+		if moderationAction == action {
+			appCtx.ModerationAction = moderationAction
+		}
+	}
+
+	// Extract DedupHash
+	dedupHash := r.FormValue("dedup_hash")
+	for _, hash := range DedupHashes {
+		if dedupHash == hash {
+			appCtx.DedupHash = dedupHash
+		}
+	}
+
+	// Extract DedupThreshold
+	dedupThreshold, err := strconv.Atoi(r.FormValue("dedup_threshold"))
+	if err != nil || dedupThreshold < 0 {
+		appCtx.DedupThreshold = -1 // Default value: the hash algorithm's own threshold
+	} else {
+		appCtx.DedupThreshold = dedupThreshold
+	}
+
+	// Extract ModerationConfidence
+	moderationConfidence, err := strconv.ParseFloat(r.FormValue("moderation_min_confidence"), 32)
+	if err != nil || moderationConfidence < 0 || moderationConfidence > 100 {
+		appCtx.ModerationConfidence = 80 // Default value
+	} else {
+		appCtx.ModerationConfidence = float32(moderationConfidence)
+	}
+
+	// Extract ConstraintFallback
+	constraintFallback := r.FormValue("constraint_fallback")
+	for _, fallback := range ConstraintFallbacks {
+		if constraintFallback == fallback {
+			appCtx.ConstraintFallback = constraintFallback
+		}
+	}
+
+	// Extract EmptyResult
+	emptyResult := r.FormValue("empty_result")
+	for _, mode := range EmptyResultModes {
+		if emptyResult == mode {
+			appCtx.EmptyResult = emptyResult
+		}
+	}
+
+	// Extract MinLabels
+	minLabels, err := strconv.Atoi(r.FormValue("min_labels"))
+	if err != nil || minLabels < 0 {
+		appCtx.MinLabels = 0 // Default value: no minimum
+	} else {
+		appCtx.MinLabels = minLabels
+	}
+
+	// Extract MinLabelsAction
+	appCtx.MinLabelsAction = "retry" // Default value
+	minLabelsAction := r.FormValue("min_labels_action")
+	for _, action := range MinLabelsActions {
+		if minLabelsAction == action {
+			appCtx.MinLabelsAction = minLabelsAction
+		}
+	}
+
+	// Extract TwoStage
+	twoStage, err := strconv.ParseBool(r.FormValue("two_stage"))
+	appCtx.TwoStage = err == nil && twoStage
+
+	// Extract TwoStageOrder
+	appCtx.TwoStageOrder = "visual_first" // Default value
+	twoStageOrder := r.FormValue("two_stage_order")
+	for _, order := range TwoStageOrders {
+		if twoStageOrder == order {
+			appCtx.TwoStageOrder = twoStageOrder
+		}
+	}
+
+	// Extract TwoStageCoarseMaxSize
+	twoStageCoarseMaxSize, err := strconv.Atoi(r.FormValue("two_stage_max_size"))
+	if err != nil || twoStageCoarseMaxSize < appCtx.MaxClusterSize {
+		appCtx.TwoStageCoarseMaxSize = 2 * appCtx.MaxClusterSize // Default value
+	} else {
+		appCtx.TwoStageCoarseMaxSize = twoStageCoarseMaxSize
+	}
+
+	// Extract SortOrder
+	sortOrder := r.FormValue("sort_clusters")
+	for _, order := range SortOrders {
+		if sortOrder == order {
+			appCtx.SortOrder = sortOrder
+		}
+	}
+
+	// Extract Interpolation
+	appCtx.Interpolation = "linear" // Default value
+	interpolation := r.FormValue("interpolation")
+	for _, method := range InterpolationMethods {
+		if interpolation == method {
+			appCtx.Interpolation = interpolation
+		}
+	}
+
+	// Extract FlattenTransparency
+	flattenTransparency, err := strconv.ParseBool(r.FormValue("flatten_transparency"))
+	appCtx.FlattenTransparency = err == nil && flattenTransparency
+
+	// Extract BackgroundColor
+	appCtx.BackgroundColor = "#ffffff" // Default value
+	if backgroundColor := strings.TrimSpace(r.FormValue("background_color")); backgroundColor != "" {
+		appCtx.BackgroundColor = backgroundColor
+	}
+
+	// Extract ResizeMode
+	appCtx.ResizeMode = "distort" // Default value
+	resizeMode := r.FormValue("resize_mode")
+	for _, mode := range ResizeModes {
+		if resizeMode == mode {
+			appCtx.ResizeMode = resizeMode
+		}
+	}
+
+	// Extract PadColor
+	appCtx.PadColor = "#000000" // Default value
+	if padColor := strings.TrimSpace(r.FormValue("pad_color")); padColor != "" {
+		appCtx.PadColor = padColor
+	}
+
+	// Extract PreprocessPipeline; the steps are validated when the pipeline is used
+	for _, step := range strings.Split(r.FormValue("preprocess_pipeline"), ",") {
+		if step = strings.ToLower(strings.TrimSpace(step)); step != "" {
+			appCtx.PreprocessPipeline = append(appCtx.PreprocessPipeline, step)
+		}
+	}
+
+	// Extract EmbeddingModels; the names and weights are validated when the models are loaded
+	for _, entry := range strings.Split(r.FormValue("embedding_models"), ",") {
+		if entry = strings.TrimSpace(entry); entry != "" {
+			appCtx.EmbeddingModels = append(appCtx.EmbeddingModels, entry)
+		}
+	}
+
+	// The report directory is a server-side path, so it is only configurable through the environment
+	appCtx.ReportOutputDir = os.Getenv("REPORT_OUTPUT_DIR")
+	appCtx.ClusterJSONDir = os.Getenv("CLUSTER_JSON_OUTPUT_DIR")
+	appCtx.LabelCacheDir = os.Getenv("LABEL_CACHE_DIR")
+
+	// Each pooled network holds a full copy of the model, so the pool size is bounded by server memory
+	netPoolSize, err := strconv.Atoi(os.Getenv("NET_POOL_SIZE"))
+	if err != nil || netPoolSize <= 0 {
+		appCtx.NetPoolSize = 1 // Default value
+	} else {
+		appCtx.NetPoolSize = netPoolSize
+	}
+
+	return appCtx
+}
+
+// parseCategoryConfidence parses comma-separated "category:confidence" pairs, such as
+// "Apparel and Accessories:90". Malformed pairs are skipped.
+func parseCategoryConfidence(value string) map[string]float32 {
+	thresholds := make(map[string]float32)
+	for _, pair := range strings.Split(value, ",") {
+		separator := strings.LastIndex(pair, ":")
+		if separator < 0 {
+			continue
+		}
+		category := strings.TrimSpace(pair[:separator])
+		confidence, err := strconv.ParseFloat(strings.TrimSpace(pair[separator+1:]), 32)
+		if category == "" || err != nil || confidence < 0 || confidence > 100 {
+			continue
+		}
+		thresholds[category] = float32(confidence)
+	}
+	return thresholds
+}
+
+// containsString reports whether values includes value
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// parseAspectBuckets parses a comma-separated list of positive aspect ratio boundaries.
+// Any invalid entry disables bucketing rather than silently producing different buckets.
+func parseAspectBuckets(value string) []float64 {
+	if strings.TrimSpace(value) == "" {
+		return nil
+	}
+
+	var boundaries []float64
+	for _, field := range strings.Split(value, ",") {
+		boundary, err := strconv.ParseFloat(strings.TrimSpace(field), 64)
+		if err != nil || boundary <= 0 {
+			return nil
+		}
+		boundaries = append(boundaries, boundary)
+	}
+	sort.Float64s(boundaries)
+	return boundaries
 }
@@ -0,0 +1,43 @@
+package config
+
+import (
+	"maps"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"slices"
+	"testing"
+)
+
+// formRequest returns a request carrying the given form fields in its query
+func formRequest(fields map[string]string) *http.Request {
+	values := url.Values{}
+	for key, value := range fields {
+		values.Set(key, value)
+	}
+	return httptest.NewRequest(http.MethodPost, "/api/cluster?"+values.Encode(), nil)
+}
+
+func TestExtractClusterConfigurationsParsesCategoryConfidence(t *testing.T) {
+	cfg := ExtractClusterConfigurations(formRequest(map[string]string{
+		"label_category_confidence": "Apparel and Accessories:90, Footwear:75,broken,Toys:120,:50",
+	}))
+	want := map[string]float32{"Apparel and Accessories": 90, "Footwear": 75}
+	if !maps.Equal(cfg.CategoryConfidence, want) {
+		t.Errorf("category confidence = %v, want %v with the malformed pairs skipped", cfg.CategoryConfidence, want)
+	}
+}
+
+func TestIgnoredFieldsListsProductSetterFields(t *testing.T) {
+	r := formRequest(map[string]string{"number_of_days_limit": "7", "profile_id": "p1", "min_cluster_size": "3"})
+	r.ParseForm()
+	if got := IgnoredFields(r); !slices.Equal(got, []string{"profile_id", "number_of_days_limit"}) {
+		t.Errorf("ignored fields = %v, want profile_id and number_of_days_limit", got)
+	}
+
+	r = formRequest(map[string]string{"min_cluster_size": "3"})
+	r.ParseForm()
+	if got := IgnoredFields(r); got == nil || len(got) != 0 {
+		t.Errorf("ignored fields = %#v, want an empty list", got)
+	}
+}
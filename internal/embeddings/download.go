@@ -0,0 +1,85 @@
+package embeddings
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"imageclust/internal/logger"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// modelDownloadClient fetches model files, which are around 100MB
+var modelDownloadClient = &http.Client{Timeout: 10 * time.Minute}
+
+// EnsureModel downloads the named model to its configured path when the file is missing.
+// url overrides the model's DownloadURL, and checksum is the required hex SHA-256 of the file.
+func EnsureModel(name, url, checksum string) error {
+	model, ok := ModelRegistry[name]
+	if !ok {
+		return fmt.Errorf("unknown model %q", name)
+	}
+	if _, err := os.Stat(model.Path); err == nil {
+		return nil
+	}
+
+	if url == "" {
+		url = model.DownloadURL
+	}
+	if checksum == "" {
+		return fmt.Errorf("a SHA-256 checksum is required to download %s", name)
+	}
+
+	logger.Infof("Downloading %s model from %s", name, url)
+	if err := DownloadModel(url, model.Path, checksum); err != nil {
+		return err
+	}
+	logger.Infof("Saved %s model to %s", name, model.Path)
+	return nil
+}
+
+// DownloadModel fetches a file to path, verifying its SHA-256 before moving it into place.
+// The file is written to a temporary name first, so a failed download never leaves a partial model behind.
+func DownloadModel(url, path, checksum string) error {
+	resp, err := modelDownloadClient.Get(url)
+	if err != nil {
+		return fmt.Errorf("failed to download model from %s: %v", url, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("failed to download model from %s: status %d", url, resp.StatusCode)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return fmt.Errorf("failed to create model directory: %v", err)
+	}
+	file, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".download_*")
+	if err != nil {
+		return fmt.Errorf("failed to create model file: %v", err)
+	}
+	defer os.Remove(file.Name())
+
+	hash := sha256.New()
+	_, err = io.Copy(io.MultiWriter(file, hash), resp.Body)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("failed to write model file: %v", err)
+	}
+
+	sum := hex.EncodeToString(hash.Sum(nil))
+	if !strings.EqualFold(sum, strings.TrimSpace(checksum)) {
+		return fmt.Errorf("model checksum mismatch: expected %s, got %s", checksum, sum)
+	}
+
+	if err := os.Rename(file.Name(), path); err != nil {
+		return fmt.Errorf("failed to move model into place: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,69 @@
+package embeddings
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// modelServer serves content as a model file
+func modelServer(t *testing.T, content []byte) *httptest.Server {
+	t.Helper()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(content)
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestDownloadModelVerifiesTheChecksum(t *testing.T) {
+	content := []byte("not really an onnx model")
+	sum := sha256.Sum256(content)
+	server := modelServer(t, content)
+	dir := t.TempDir()
+
+	path := filepath.Join(dir, "model.onnx")
+	if err := DownloadModel(server.URL, path, hex.EncodeToString(sum[:])); err != nil {
+		t.Fatal(err)
+	}
+	if saved, err := os.ReadFile(path); err != nil || string(saved) != string(content) {
+		t.Errorf("saved %q (%v), want the served model", saved, err)
+	}
+
+	rejected := filepath.Join(dir, "rejected.onnx")
+	err := DownloadModel(server.URL, rejected, strings.Repeat("0", 64))
+	if err == nil || !strings.Contains(err.Error(), "checksum mismatch") {
+		t.Fatalf("err = %v, want a checksum mismatch", err)
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Errorf("directory holds %d files after the rejected download, want only the first model", len(entries))
+	}
+}
+
+func TestEnsureModelKeepsAnExistingFile(t *testing.T) {
+	original := ModelRegistry["resnet50"]
+	t.Cleanup(func() { ModelRegistry["resnet50"] = original })
+	path := filepath.Join(t.TempDir(), "model.onnx")
+	if err := os.WriteFile(path, []byte("existing"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	SetModelPath("resnet50", path)
+
+	// The server would fail the checksum, so any download would be reported
+	server := modelServer(t, []byte("replacement"))
+	if err := EnsureModel("resnet50", server.URL, strings.Repeat("0", 64)); err != nil {
+		t.Fatalf("EnsureModel downloaded over an existing file: %v", err)
+	}
+	if saved, _ := os.ReadFile(path); string(saved) != "existing" {
+		t.Errorf("model file holds %q, want it untouched", saved)
+	}
+}
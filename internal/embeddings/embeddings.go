@@ -2,12 +2,24 @@
 package embeddings
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"image"
+	"image/color"
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
+	"imageclust/internal/logger"
 	"imageclust/internal/rekognition"
-	"log"
+	"imageclust/internal/utils"
+	"math"
 	"os"
 	"path/filepath"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
 
 	"gocv.io/x/gocv"
@@ -15,13 +27,177 @@ import (
 
 // AppContext holds application-wide shared resources
 type AppContext struct {
-	ImageDir      string              // Directory for image files
-	CacheDir      string              // Cache directory for storing embeddings
-	LabelSet      map[string]int      // Set of all possible labels for encoding
-	Mutex         sync.Mutex          // To handle concurrent access to shared resources
-	LabelsMapping map[string][]string // Map of image -> labels
-	Net           gocv.Net            // OpenCV DNN network for ResNet50
-	NetMutex      sync.Mutex
+	ImageDir      string                  // Directory for image files
+	CacheDir      string                  // Cache directory for storing embeddings
+	LabelSet      map[string]int          // Set of all possible labels for encoding
+	MetadataSet   map[string]int          // Set of all "field=value" EXIF features for encoding, appended after the labels
+	Mutex         sync.Mutex              // To handle concurrent access to shared resources
+	LabelsMapping map[string][]string     // Map of image -> labels
+	Nets          *NetPool                // Loaded OpenCV DNN networks for ResNet50
+	Interpolation gocv.InterpolationFlags // Interpolation used when resizing images for the network
+	EmbeddingDim  int                     // Expected embedding length (0 skips the check)
+	OutputLayer   string                  // Network layer the embedding is read from
+	SwapRB        bool                    // Whether the network expects RGB rather than OpenCV's BGR channel order
+	Background    *color.RGBA             // Color transparent pixels are flattened against (nil drops the alpha channel)
+	Padding       *color.RGBA             // Color non-square images are letterboxed with before resizing (nil stretches them)
+	Postprocess   string                  // Transformation applied to each network output ("softmax", "l2", or empty for none)
+	Pipeline      []string                // Ordered preprocessing steps (nil uses DefaultPreprocessPipeline)
+	Weight        float32                 // Factor the primary embedding is scaled by when models are blended
+	Blend         []BlendedModel          // Networks whose embeddings are appended to the primary one, in order
+}
+
+// BlendedModel is a loaded network whose embedding is appended to the primary model's
+type BlendedModel struct {
+	Name         string
+	Nets         *NetPool
+	OutputLayer  string
+	SwapRB       bool
+	EmbeddingDim int
+	Weight       float32 // Factor the model's postprocessed embedding is scaled by
+}
+
+// ImageEmbeddingDim returns the length of the image part of the embedding, across every blended model
+func (a *AppContext) ImageEmbeddingDim() int {
+	dim := a.EmbeddingDim
+	for _, model := range a.Blend {
+		dim += model.EmbeddingDim
+	}
+	return dim
+}
+
+// ModelWeight is a model named for blending, with the factor its embedding is scaled by
+type ModelWeight struct {
+	Name   string
+	Weight float32
+}
+
+// ParseModelWeights parses "name" or "name:weight" entries, defaulting the weight to 1.
+// Every name must be in the ModelRegistry and appear once.
+func ParseModelWeights(entries []string) ([]ModelWeight, error) {
+	var weights []ModelWeight
+	seen := make(map[string]bool, len(entries))
+	for _, entry := range entries {
+		name, weightText, hasWeight := strings.Cut(entry, ":")
+		weight := float32(1)
+		if hasWeight {
+			parsed, err := strconv.ParseFloat(weightText, 32)
+			if err != nil || parsed < 0 {
+				return nil, fmt.Errorf("invalid weight in %q: expected a non-negative number", entry)
+			}
+			weight = float32(parsed)
+		}
+		if _, ok := ModelRegistry[name]; !ok {
+			return nil, fmt.Errorf("unknown model %q", name)
+		}
+		if seen[name] {
+			return nil, fmt.Errorf("model %q is listed more than once", name)
+		}
+		seen[name] = true
+		weights = append(weights, ModelWeight{Name: name, Weight: weight})
+	}
+	return weights, nil
+}
+
+// LayerSpec describes a network layer embeddings can be extracted from
+type LayerSpec struct {
+	Name         string // Layer name in the ONNX graph
+	EmbeddingDim int    // Length of the embedding produced by the layer
+}
+
+// ModelSpec describes a supported ONNX embedding model
+type ModelSpec struct {
+	Path         string               // Location of the ONNX file
+	DownloadURL  string               // Where the ONNX file can be obtained
+	DefaultLayer string               // Key of the layer used when none is configured
+	Layers       map[string]LayerSpec // Selectable output layers by name
+	SwapRB       bool                 // Whether the model was trained on RGB input
+}
+
+// ModelRegistry lists the supported embedding models by name.
+// For ResNet50 the "dense" layer yields the 1000 ImageNet class logits, which tie similarity
+// to the ImageNet categories, while the "pool" layer yields the 2048 pre-classification
+// features, which usually separate visually similar items better at twice the memory cost.
+var ModelRegistry = map[string]ModelSpec{
+	"resnet50": {
+		Path:         "resnet50-v1-7.onnx",
+		DownloadURL:  "https://github.com/onnx/models/raw/main/validated/vision/classification/resnet/model/resnet50-v1-7.onnx",
+		DefaultLayer: "dense",
+		SwapRB:       true,
+		Layers: map[string]LayerSpec{
+			"dense": {Name: "resnetv17_dense0_fwd", EmbeddingDim: 1000},
+			"pool":  {Name: "resnetv17_pool1_fwd", EmbeddingDim: 2048},
+		},
+	},
+}
+
+// RegisterModel adds an ONNX model that can be blended with ResNet50. Its output is read from layer,
+// which must produce dim values (0 skips the check). Models take the same 224x224 input as ResNet50.
+// It must be called before serving requests.
+func RegisterModel(name, path, layer string, dim int, swapRB bool) error {
+	if _, exists := ModelRegistry[name]; exists {
+		return fmt.Errorf("model %q is already registered", name)
+	}
+	if path == "" || layer == "" {
+		return fmt.Errorf("model %q needs a path and an output layer", name)
+	}
+	ModelRegistry[name] = ModelSpec{
+		Path:         path,
+		DefaultLayer: "output",
+		Layers:       map[string]LayerSpec{"output": {Name: layer, EmbeddingDim: dim}},
+		SwapRB:       swapRB,
+	}
+	return nil
+}
+
+// SetModelPath overrides where the named model's ONNX file is loaded from; it must be called before serving requests.
+func SetModelPath(name, path string) {
+	if model, ok := ModelRegistry[name]; ok && path != "" {
+		model.Path = path
+		ModelRegistry[name] = model
+	}
+}
+
+// CheckFile reports an actionable error when the model's ONNX file is missing or unreadable
+func (m ModelSpec) CheckFile() error {
+	info, err := os.Stat(m.Path)
+	if os.IsNotExist(err) {
+		path, absErr := filepath.Abs(m.Path)
+		if absErr != nil {
+			path = m.Path
+		}
+		return fmt.Errorf("model file not found at %s; download it from %s and set MODEL_PATH to its location", path, m.DownloadURL)
+	}
+	if err != nil {
+		return fmt.Errorf("cannot access model file %s: %v", m.Path, err)
+	}
+	if info.IsDir() {
+		return fmt.Errorf("model path %s is a directory, not an ONNX file", m.Path)
+	}
+	return nil
+}
+
+// Layer returns the named output layer, falling back to the model's default layer
+func (m ModelSpec) Layer(name string) LayerSpec {
+	if layer, ok := m.Layers[name]; ok {
+		return layer
+	}
+	return m.Layers[m.DefaultLayer]
+}
+
+// InterpolationFromName maps a configured interpolation name to the gocv flag, defaulting to linear
+func InterpolationFromName(name string) gocv.InterpolationFlags {
+	switch name {
+	case "area":
+		return gocv.InterpolationArea
+	case "cubic":
+		return gocv.InterpolationCubic
+	case "nearest":
+		return gocv.InterpolationNearestNeighbor
+	case "lanczos":
+		return gocv.InterpolationLanczos4
+	default:
+		return gocv.InterpolationLinear
+	}
 }
 
 // LoadPretrainedModelONNX loads the pre-trained ResNet50 model in ONNX format using GoCV
@@ -29,12 +205,14 @@ func LoadPretrainedModelONNX(modelPath string) (gocv.Net, error) {
 	// Read the network using the ResNet50 ONNX model
 	net := gocv.ReadNetFromONNX(modelPath)
 	if net.Empty() {
-		return net, fmt.Errorf("failed to load ResNet50 ONNX model from: %s", modelPath)
+		net.Close()
+		return gocv.Net{}, fmt.Errorf("failed to load ResNet50 ONNX model from: %s", modelPath)
 	}
 
 	// Set preferable backend and target to CPU
 	err := net.SetPreferableBackend(gocv.NetBackendDefault)
 	if err != nil {
+		net.Close()
 		return gocv.Net{}, err
 	}
 	net.SetPreferableTarget(gocv.NetTargetCPU)
@@ -42,126 +220,612 @@ func LoadPretrainedModelONNX(modelPath string) (gocv.Net, error) {
 	return net, nil
 }
 
-// PreprocessImage resizes and normalizes the image to match ResNet50 input requirements
-func PreprocessImage(imagePath string) (gocv.Mat, error) {
-	log.Printf("Preprocessing image: %s", imagePath)
+// NetPool holds several loaded copies of a network so images can be embedded in parallel.
+// A gocv.Net is not safe for concurrent use, so each copy is used by one caller at a time.
+type NetPool struct {
+	mu     sync.Mutex
+	nets   chan *gocv.Net
+	done   chan struct{} // Closed by Close, waking callers still waiting for a network
+	closed bool
+}
 
-	// Load the image using GoCV
-	img := gocv.IMRead(imagePath, gocv.IMReadColor)
-	if img.Empty() {
-		return gocv.NewMat(), fmt.Errorf("failed to read image: %s. The image file might be corrupt or unreadable", imagePath)
+// ErrNetPoolClosed is returned by Acquire once the pool has been closed
+var ErrNetPoolClosed = errors.New("network pool is closed")
+
+// NewNetPool loads size copies of the ONNX model, closing any already loaded on failure
+func NewNetPool(modelPath string, size int) (*NetPool, error) {
+	if size < 1 {
+		size = 1
 	}
-	defer func(img *gocv.Mat) {
-		err := img.Close()
+
+	pool := &NetPool{nets: make(chan *gocv.Net, size), done: make(chan struct{})}
+	for i := 0; i < size; i++ {
+		net, err := LoadPretrainedModelONNX(modelPath)
 		if err != nil {
+			pool.Close()
+			return nil, err
 		}
-	}(&img)
+		pool.nets <- &net
+	}
+	return pool, nil
+}
 
-	// Resize to 224x224 (standard for ResNet50)
-	resized := gocv.NewMat()
-	defer func(resized *gocv.Mat) {
-		err := resized.Close()
-		if err != nil {
+// Acquire waits for a free network, failing once the pool is closed. The network must be handed back with Release.
+func (p *NetPool) Acquire() (*gocv.Net, error) {
+	select {
+	case net := <-p.nets:
+		return net, nil
+	case <-p.done:
+		return nil, ErrNetPoolClosed
+	}
+}
 
-		}
-	}(&resized)
+// Release returns a network acquired from the pool, freeing it instead if the pool was closed meanwhile
+func (p *NetPool) Release(net *gocv.Net) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed {
+		net.Close()
+		return
+	}
+	p.nets <- net
+}
 
-	gocv.Resize(img, &resized, image.Pt(224, 224), 0, 0, gocv.InterpolationLinear)
-	if resized.Empty() {
-		return gocv.NewMat(), fmt.Errorf("failed to resize image: %s. There might be an issue with the image content", imagePath)
+// Close frees the idle networks without waiting for the others. A forward pass whose caller stopped
+// waiting for it may still be running, and its network is freed when that pass releases it.
+func (p *NetPool) Close() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed {
+		return
+	}
+	p.closed = true
+	close(p.done)
+	for {
+		select {
+		case net := <-p.nets:
+			net.Close()
+		default:
+			return
+		}
 	}
+}
 
-	// Convert image to RGB
-	rgb := gocv.NewMat()
-	defer func(rgb *gocv.Mat) {
-		err := rgb.Close()
-		if err != nil {
+// resize is gocv.Resize, swapped in tests to observe how images are scaled
+var resize = gocv.Resize
+
+// PreprocessImage resizes and normalizes the image to match ResNet50 input requirements.
+// Images are loaded as BGR; swapRB converts them to RGB as part of blob creation, which
+// is the only place the channel order is changed.
+func PreprocessImage(imagePath string, interpolation gocv.InterpolationFlags, swapRB bool) (gocv.Mat, error) {
+	return PreprocessImageRegion(imagePath, interpolation, swapRB, nil, nil, nil, nil)
+}
+
+// Preprocessing steps that can be ordered in a pipeline
+const (
+	StepResize       = "resize"        // Scale to the 224x224 input, or the shorter side to 256 when a center crop follows
+	StepCenterCrop   = "center-crop"   // Keep the centered square covering 224/256 of the shorter side
+	StepNormalize    = "normalize"     // Convert to floats in [0, 1]; without it the network sees values in [0, 255]
+	StepColorConvert = "color-convert" // Convert BGR to RGB when the model expects it; without it channels stay BGR
+)
+
+// PreprocessSteps lists every step a pipeline may contain
+var PreprocessSteps = []string{StepResize, StepCenterCrop, StepNormalize, StepColorConvert}
+
+// DefaultPreprocessPipeline is the order the steps have always run in
+var DefaultPreprocessPipeline = []string{StepResize, StepNormalize, StepColorConvert}
+
+// Sizes used by the resize and center-crop steps, following the usual ImageNet evaluation transform
+const (
+	inputSize      = 224
+	cropResizeSize = 256
+)
+
+// ValidatePreprocessPipeline checks that a pipeline names known steps at most once each and resizes the image
+func ValidatePreprocessPipeline(pipeline []string) error {
+	seen := make(map[string]bool)
+	for _, step := range pipeline {
+		if !slices.Contains(PreprocessSteps, step) {
+			return fmt.Errorf("unknown preprocessing step %q, expected one of %v", step, PreprocessSteps)
 		}
-	}(&rgb)
+		if seen[step] {
+			return fmt.Errorf("preprocessing step %q appears more than once", step)
+		}
+		seen[step] = true
+	}
+	if len(pipeline) > 0 && !seen[StepResize] {
+		return fmt.Errorf("preprocessing pipeline must include %q to reach the %dx%d network input", StepResize, inputSize, inputSize)
+	}
+	return nil
+}
+
+// CropBox is a region of an image in fractions of its width and height, as Rekognition reports bounding boxes.
+// It is measured on the image turned upright by its EXIF orientation, as loadBGRImage returns it.
+type CropBox struct {
+	Left, Top, Width, Height float64
+}
 
-	gocv.CvtColor(resized, &rgb, gocv.ColorBGRToRGB)
-	if rgb.Empty() {
-		return gocv.NewMat(), fmt.Errorf("failed to convert image to RGB: %s. Image data might be invalid", imagePath)
+// minCropSize is the smallest crop in pixels; smaller boxes are ignored in favour of the full frame
+const minCropSize = 16
+
+// PreprocessImageRegion behaves like PreprocessImage but first crops the image to the box.
+// A nil box, or one that covers less than minCropSize pixels in either direction, uses the full frame.
+// A non-nil background flattens transparent images onto that color, and a non-nil padding
+// letterboxes the image to a square with that color instead of stretching it.
+// The pipeline orders the remaining steps; an empty one runs DefaultPreprocessPipeline.
+func PreprocessImageRegion(imagePath string, interpolation gocv.InterpolationFlags, swapRB bool, crop *CropBox, background, padding *color.RGBA, pipeline []string) (gocv.Mat, error) {
+	if err := ValidatePreprocessPipeline(pipeline); err != nil {
+		return gocv.Mat{}, err
+	}
+	if len(pipeline) == 0 {
+		pipeline = DefaultPreprocessPipeline
 	}
 
-	// Create a blob from the image
-	blob := gocv.NewMat()
-	defer func(blob *gocv.Mat) {
-		err := blob.Close()
-		if err != nil {
+	logger.Debugf("Preprocessing image: %s", imagePath)
+
+	// Load the image using GoCV as 3-channel BGR
+	img, err := loadBGRImage(imagePath, background)
+	if err != nil {
+		return gocv.Mat{}, err
+	}
+	defer img.Close()
+
+	source := img
+	if crop != nil {
+		region := cropRectangle(*crop, img.Cols(), img.Rows())
+		if region.Dx() >= minCropSize && region.Dy() >= minCropSize {
+			source = img.Region(region)
+			defer source.Close()
+		}
+	}
 
+	// Pad to a square first so extreme aspect ratios keep their proportions instead of being squashed
+	if padding != nil {
+		top, bottom, left, right := letterboxBorders(source.Cols(), source.Rows())
+		if top+bottom+left+right > 0 {
+			padded := gocv.NewMat()
+			defer padded.Close()
+			gocv.CopyMakeBorder(source, &padded, top, bottom, left, right, gocv.BorderConstant, *padding)
+			source = padded
 		}
-	}(&blob)
+	}
 
-	blob = gocv.BlobFromImage(rgb, 1.0/255.0, image.Pt(224, 224), gocv.NewScalar(0, 0, 0, 0), false, false)
+	// Run the steps in order; each one replaces source with its output
+	for i, step := range pipeline {
+		output := gocv.NewMat()
+		defer output.Close()
+
+		switch step {
+		case StepResize:
+			// A later center crop trims the resized image, so only the shorter side is fixed here
+			size := image.Pt(inputSize, inputSize)
+			if slices.Contains(pipeline[i+1:], StepCenterCrop) {
+				scale := float64(cropResizeSize) / float64(min(source.Cols(), source.Rows()))
+				size = image.Pt(int(math.Round(float64(source.Cols())*scale)), int(math.Round(float64(source.Rows())*scale)))
+			}
+			resize(source, &output, size, 0, 0, interpolation)
+			if output.Empty() {
+				return gocv.Mat{}, fmt.Errorf("failed to resize image: %s. There might be an issue with the image content", imagePath)
+			}
+		case StepCenterCrop:
+			side := int(math.Round(float64(min(source.Cols(), source.Rows())) * inputSize / cropResizeSize))
+			left, top := (source.Cols()-side)/2, (source.Rows()-side)/2
+			region := source.Region(image.Rect(left, top, left+side, top+side))
+			region.CopyTo(&output)
+			region.Close()
+		case StepNormalize:
+			source.ConvertToWithParams(&output, gocv.MatTypeCV32FC3, 1.0/255.0, 0)
+		case StepColorConvert:
+			if !swapRB {
+				continue
+			}
+			gocv.CvtColor(source, &output, gocv.ColorBGRToRGB)
+		}
+		source = output
+	}
+
+	// Create a blob from the preprocessed image; scaling and channel order were handled by the pipeline
+	blob := gocv.BlobFromImage(source, 1.0, image.Pt(inputSize, inputSize), gocv.NewScalar(0, 0, 0, 0), false, false)
+	defer blob.Close()
 	if blob.Empty() {
-		return gocv.NewMat(), fmt.Errorf("failed to create blob from image: %s. Blob generation failed", imagePath)
+		return gocv.Mat{}, fmt.Errorf("failed to create blob from image: %s. Blob generation failed", imagePath)
 	}
 
 	// Check the shape of the blob
 	blobSize := blob.Size()
 	if len(blobSize) != 4 || blobSize[0] != 1 || blobSize[1] != 3 || blobSize[2] != 224 || blobSize[3] != 224 {
-		return gocv.NewMat(), fmt.Errorf("invalid blob shape for image %s: expected (1, 3, 224, 224), got %v", imagePath, blobSize)
+		return gocv.Mat{}, fmt.Errorf("invalid blob shape for image %s: expected (1, 3, 224, 224), got %v", imagePath, blobSize)
 	}
 
 	// Return a clone of the blob to ensure it's not closed prematurely
 	finalBlob := blob.Clone()
 
 	if finalBlob.Empty() {
-		return gocv.NewMat(), fmt.Errorf("final blob is empty after processing image: %s. This might indicate a deeper issue with image preprocessing", imagePath)
+		finalBlob.Close()
+		return gocv.Mat{}, fmt.Errorf("final blob is empty after processing image: %s. This might indicate a deeper issue with image preprocessing", imagePath)
 	}
 
-	log.Printf("Successfully preprocessed image: %s", imagePath)
+	logger.Debugf("Successfully preprocessed image: %s", imagePath)
 	return finalBlob, nil
 }
 
-// GetImageEmbedding generates an image embedding using ResNet50
-func GetImageEmbedding(appCtx *AppContext, imagePath string) ([]float32, error) {
-	// Preprocess the image to create a blob
-	blob, err := PreprocessImage(imagePath)
+// letterboxBorders returns the borders that center an image of the given size in a square.
+// Odd differences put the extra pixel on the bottom or right.
+func letterboxBorders(width, height int) (top, bottom, left, right int) {
+	if width > height {
+		top = (width - height) / 2
+		bottom = width - height - top
+	} else {
+		left = (height - width) / 2
+		right = height - width - left
+	}
+	return top, bottom, left, right
+}
+
+// cropRectangle converts a fractional box into pixel coordinates clamped to the image
+func cropRectangle(crop CropBox, width, height int) image.Rectangle {
+	region := image.Rect(
+		int(crop.Left*float64(width)),
+		int(crop.Top*float64(height)),
+		int((crop.Left+crop.Width)*float64(width)+0.5),
+		int((crop.Top+crop.Height)*float64(height)+0.5),
+	)
+	return region.Intersect(image.Rect(0, 0, width, height))
+}
+
+// RenderPreprocessedImage runs PreprocessImageRegion and converts the resulting blob back into an image.
+// Blob channels are written to R, G and B in order, so the preview shows the colors exactly as an RGB model sees them.
+func RenderPreprocessedImage(imagePath string, interpolation gocv.InterpolationFlags, swapRB bool, background, padding *color.RGBA, pipeline []string) (*image.RGBA, error) {
+	blob, err := PreprocessImageRegion(imagePath, interpolation, swapRB, nil, background, padding, pipeline)
 	if err != nil {
 		return nil, err
 	}
-	defer func(blob *gocv.Mat) {
-		err := blob.Close()
-		if err != nil {
+	defer blob.Close()
+
+	data, err := blob.DataPtrFloat32()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read blob data: %v", err)
+	}
+
+	const size = 224
+	plane := size * size
+	if len(data) != 3*plane {
+		return nil, fmt.Errorf("unexpected blob length %d for image %s", len(data), imagePath)
+	}
+
+	// Without the normalize step the blob already holds values in [0, 255]
+	scale := 255.0
+	if len(pipeline) > 0 && !slices.Contains(pipeline, StepNormalize) {
+		scale = 1
+	}
+
+	img := image.NewRGBA(image.Rect(0, 0, size, size))
+	for i := 0; i < plane; i++ {
+		for c := 0; c < 3; c++ {
+			value := math.Round(float64(data[c*plane+i]) * scale)
+			img.Pix[i*4+c] = uint8(math.Max(0, math.Min(255, value)))
+		}
+		img.Pix[i*4+3] = 255
+	}
+	return img, nil
+}
+
+// ImageAspectRatio returns the width/height ratio of an image as displayed, reading only the header
+// for formats the standard library decodes and loading the image with OpenCV otherwise.
+func ImageAspectRatio(imagePath string) (float64, error) {
+	file, err := os.Open(imagePath)
+	if err != nil {
+		return 0, fmt.Errorf("failed to open image %s: %v", imagePath, err)
+	}
+	width, height, ok := utils.ImageDimensions(file)
+	file.Close()
+	if ok && height > 0 {
+		return float64(width) / float64(height), nil
+	}
 
+	// Unlike IMReadUnchanged, these flags keep OpenCV's EXIF auto-orientation
+	img := gocv.IMRead(imagePath, gocv.IMReadAnyColor|gocv.IMReadAnyDepth)
+	defer img.Close()
+	if img.Empty() || img.Rows() == 0 {
+		return 0, fmt.Errorf("failed to read dimensions of image %s", imagePath)
+	}
+	return float64(img.Cols()) / float64(img.Rows()), nil
+}
+
+// loadBGRImage reads an image and normalizes it to 3-channel BGR, turned upright by its EXIF orientation.
+// Grayscale images are expanded to three channels. Alpha channels are composited over the
+// background when one is given and dropped otherwise, leaving hidden pixels to show through.
+func loadBGRImage(imagePath string, background *color.RGBA) (gocv.Mat, error) {
+	img := gocv.IMRead(imagePath, gocv.IMReadUnchanged)
+	if img.Empty() {
+		img.Close()
+		return gocv.Mat{}, fmt.Errorf("failed to read image: %s. The image file might be corrupt or unreadable", imagePath)
+	}
+	// IMReadUnchanged skips the auto-orientation the other read flags apply
+	img = orientImage(img, utils.ImageOrientation(imagePath))
+
+	var conversion gocv.ColorConversionCode
+	switch img.Type() {
+	case gocv.MatTypeCV8UC3:
+		return img, nil
+	case gocv.MatTypeCV8UC1:
+		conversion = gocv.ColorGrayToBGR
+	case gocv.MatTypeCV8UC4:
+		if background != nil {
+			defer img.Close()
+			return flattenAlpha(img, *background, imagePath)
+		}
+		conversion = gocv.ColorBGRAToBGR
+	case gocv.MatTypeCV16UC4:
+		if background != nil {
+			// Scale 16-bit channels to 8 bits before compositing
+			bgra := gocv.NewMat()
+			defer bgra.Close()
+			img.ConvertToWithParams(&bgra, gocv.MatTypeCV8UC4, 1.0/257.0, 0)
+			img.Close()
+			return flattenAlpha(bgra, *background, imagePath)
+		}
+		img.Close()
+		return readColorImage(imagePath)
+	default:
+		channels := img.Channels()
+		img.Close()
+		if channels != 1 && channels != 3 && channels != 4 {
+			return gocv.Mat{}, fmt.Errorf("unsupported image %s: expected 1, 3 or 4 channels, got %d", imagePath, channels)
 		}
-	}(&blob)
 
-	// Lock the Net object
-	appCtx.NetMutex.Lock()
-	defer appCtx.NetMutex.Unlock()
+		return readColorImage(imagePath)
+	}
+
+	bgr := gocv.NewMat()
+	gocv.CvtColor(img, &bgr, conversion)
+	img.Close()
+	if bgr.Empty() {
+		bgr.Close()
+		return gocv.Mat{}, fmt.Errorf("failed to convert image %s to BGR", imagePath)
+	}
+	return bgr, nil
+}
+
+// orientImage turns an image upright according to its EXIF orientation, closing the original
+// when a new Mat is made. The steps follow OpenCV's own handling of the tag.
+func orientImage(img gocv.Mat, orientation int) gocv.Mat {
+	if orientation <= 1 || orientation > 8 {
+		return img
+	}
+
+	oriented := gocv.NewMat()
+	switch orientation {
+	case 2:
+		gocv.Flip(img, &oriented, 1)
+	case 3:
+		gocv.Rotate(img, &oriented, gocv.Rotate180Clockwise)
+	case 4:
+		gocv.Flip(img, &oriented, 0)
+	case 5:
+		gocv.Transpose(img, &oriented)
+	case 6:
+		gocv.Rotate(img, &oriented, gocv.Rotate90Clockwise)
+	case 7:
+		transposed := gocv.NewMat()
+		gocv.Transpose(img, &transposed)
+		gocv.Flip(transposed, &oriented, -1)
+		transposed.Close()
+	case 8:
+		gocv.Rotate(img, &oriented, gocv.Rotate90CounterClockwise)
+	}
+	img.Close()
+	return oriented
+}
+
+// readColorImage loads an image through OpenCV's color loader, which scales images deeper
+// than 8 bits per channel down and drops any alpha channel
+func readColorImage(imagePath string) (gocv.Mat, error) {
+	img := gocv.IMRead(imagePath, gocv.IMReadColor)
+	if img.Empty() {
+		img.Close()
+		return gocv.Mat{}, fmt.Errorf("failed to read image: %s. The image file might be corrupt or unreadable", imagePath)
+	}
+	return img, nil
+}
+
+// flattenAlpha composites an 8-bit BGRA image over a solid background and returns it as BGR
+func flattenAlpha(bgra gocv.Mat, background color.RGBA, imagePath string) (gocv.Mat, error) {
+	if !bgra.IsContinuous() {
+		continuous := bgra.Clone()
+		defer continuous.Close()
+		bgra = continuous
+	}
+	pixels, err := bgra.DataPtrUint8()
+	if err != nil {
+		return gocv.Mat{}, fmt.Errorf("failed to read pixels of image %s: %v", imagePath, err)
+	}
+
+	bgr, err := gocv.NewMatFromBytes(bgra.Rows(), bgra.Cols(), gocv.MatTypeCV8UC3, FlattenBGRA(pixels, background))
+	if err != nil {
+		return gocv.Mat{}, fmt.Errorf("failed to flatten transparency of image %s: %v", imagePath, err)
+	}
+	return bgr, nil
+}
+
+// FlattenBGRA composites interleaved BGRA pixels over a solid background, returning interleaved BGR pixels.
+// Each channel becomes value*alpha + background*(1-alpha), rounded to the nearest integer.
+func FlattenBGRA(pixels []byte, background color.RGBA) []byte {
+	bgr := make([]byte, len(pixels)/4*3)
+	fill := [3]uint32{uint32(background.B), uint32(background.G), uint32(background.R)}
+	for i, j := 0, 0; i+3 < len(pixels); i, j = i+4, j+3 {
+		alpha := uint32(pixels[i+3])
+		for c := 0; c < 3; c++ {
+			bgr[j+c] = byte((uint32(pixels[i+c])*alpha + fill[c]*(255-alpha) + 127) / 255)
+		}
+	}
+	return bgr
+}
+
+// ParseHexColor parses a color written as #rrggbb, with or without the leading #
+func ParseHexColor(value string) (color.RGBA, error) {
+	value = strings.TrimPrefix(strings.TrimSpace(value), "#")
+	if len(value) != 6 {
+		return color.RGBA{}, fmt.Errorf("invalid color %q: expected #rrggbb", value)
+	}
+	rgb, err := strconv.ParseUint(value, 16, 32)
+	if err != nil {
+		return color.RGBA{}, fmt.Errorf("invalid color %q: expected #rrggbb", value)
+	}
+	return color.RGBA{R: uint8(rgb >> 16), G: uint8(rgb >> 8), B: uint8(rgb), A: 255}, nil
+}
+
+// GetImageEmbedding generates an image embedding using ResNet50, cropped to the box when one is given.
+// When models are blended, each one's postprocessed embedding is scaled by its weight and appended in order.
+func GetImageEmbedding(appCtx *AppContext, imagePath string, crop *CropBox) ([]float32, error) {
+	outputLayer := appCtx.OutputLayer
+	if outputLayer == "" {
+		outputLayer = ModelRegistry["resnet50"].Layer("").Name
+	}
+	embedding, err := runNetwork(appCtx, appCtx.Nets, outputLayer, appCtx.SwapRB, appCtx.EmbeddingDim, imagePath, crop)
+	if err != nil {
+		return nil, err
+	}
+	embedding = PostprocessEmbedding(embedding, appCtx.Postprocess)
+	if len(appCtx.Blend) == 0 {
+		return embedding, nil
+	}
+
+	scaleEmbedding(embedding, appCtx.Weight)
+	for _, model := range appCtx.Blend {
+		extra, err := runNetwork(appCtx, model.Nets, model.OutputLayer, model.SwapRB, model.EmbeddingDim, imagePath, crop)
+		if err != nil {
+			return nil, fmt.Errorf("model %s: %v", model.Name, err)
+		}
+		extra = PostprocessEmbedding(extra, appCtx.Postprocess)
+		scaleEmbedding(extra, model.Weight)
+		embedding = CombineEmbeddings(embedding, extra)
+	}
+	return embedding, nil
+}
+
+// runNetwork preprocesses the image and returns the raw output of the layer, checking its length against dim when set
+func runNetwork(appCtx *AppContext, nets *NetPool, outputLayer string, swapRB bool, dim int, imagePath string, crop *CropBox) ([]float32, error) {
+	// Preprocess the image to create a blob
+	blob, err := PreprocessImageRegion(imagePath, appCtx.Interpolation, swapRB, crop, appCtx.Background, appCtx.Padding, appCtx.Pipeline)
+	if err != nil {
+		return nil, err
+	}
+	defer blob.Close()
+
+	// Take a network from the pool for the duration of the forward pass
+	net, err := nets.Acquire()
+	if err != nil {
+		return nil, err
+	}
+	defer nets.Release(net)
 
 	// Set the input to the network
-	appCtx.Net.SetInput(blob, "")
+	net.SetInput(blob, "")
 
 	// Forward pass to get the output from the desired layer
-	outputLayer := "resnetv17_dense0_fwd"
-	embeddingMat := appCtx.Net.Forward(outputLayer)
+	embeddingMat := forwardWithRetry(func() gocv.Mat { return net.Forward(outputLayer) }, forwardRetries, imagePath)
+	defer embeddingMat.Close()
 	if embeddingMat.Empty() {
 		return nil, fmt.Errorf("failed to generate embedding for image: %s", imagePath)
 	}
-	defer func(embeddingMat *gocv.Mat) {
-		err := embeddingMat.Close()
-		if err != nil {
-		}
-	}(&embeddingMat)
 
-	// Extract the data as a float32 slice
-	embedding, err := embeddingMat.DataPtrFloat32()
+	// Extract the data as a float32 slice. The slice aliases the Mat's memory,
+	// so it is copied before the Mat is closed.
+	embeddingData, err := embeddingMat.DataPtrFloat32()
 	if err != nil {
 		return nil, fmt.Errorf("failed to retrieve embedding data: %v", err)
 	}
+	embedding := make([]float32, len(embeddingData))
+	copy(embedding, embeddingData)
 
 	// Verify that the embedding is not empty
 	if len(embedding) == 0 {
 		return nil, fmt.Errorf("embedding is empty for image: %s", imagePath)
 	}
 
+	// Verify that the model produced the expected number of dimensions
+	if dim > 0 && len(embedding) != dim {
+		return nil, fmt.Errorf("embedding for image %s has %d dimensions, expected %d; check that the ONNX model matches the configured model", imagePath, len(embedding), dim)
+	}
 	return embedding, nil
 }
 
+// forwardRetries is the number of extra forward passes attempted when the network returns an empty output.
+// Empty outputs are usually transient, so they are retried once unless configured otherwise.
+var forwardRetries = 1
+
+// SetForwardRetries sets how many times an empty forward pass is rerun before the image fails; 0 fails it at once.
+// Negative values are ignored. It must be called before serving requests.
+func SetForwardRetries(n int) {
+	if n >= 0 {
+		forwardRetries = n
+	}
+}
+
+// forwardWithRetry runs forward, running it up to retries more times while it returns an empty Mat.
+// Forward occasionally comes back empty transiently, such as on a network's first call, and the input
+// blob stays set on the network, so it can be rerun without preprocessing the image again.
+func forwardWithRetry(forward func() gocv.Mat, retries int, imagePath string) gocv.Mat {
+	output := forward()
+	for attempt := 1; attempt <= retries && output.Empty(); attempt++ {
+		logger.Warnf("Forward pass returned no output for %s, retrying (%d/%d)", imagePath, attempt, retries)
+		output.Close()
+		output = forward()
+	}
+	return output
+}
+
+// scaleEmbedding multiplies the embedding in place by weight
+func scaleEmbedding(embedding []float32, weight float32) {
+	for i := range embedding {
+		embedding[i] *= weight
+	}
+}
+
+// Transformations applied to the network output before it is used as an embedding
+const (
+	PostprocessSoftmax = "softmax" // Turn logits into probabilities summing to 1
+	PostprocessL2      = "l2"      // Scale to unit Euclidean length
+)
+
+// PostprocessEmbedding transforms the embedding in place and returns it. Unknown methods leave it unchanged,
+// as does L2 normalization of an all-zero embedding.
+func PostprocessEmbedding(embedding []float32, method string) []float32 {
+	if len(embedding) == 0 {
+		return embedding
+	}
+
+	switch method {
+	case PostprocessSoftmax:
+		// Subtract the maximum before exponentiating so large logits do not overflow
+		maxValue := float64(embedding[0])
+		for _, value := range embedding {
+			maxValue = math.Max(maxValue, float64(value))
+		}
+		var sum float64
+		exps := make([]float64, len(embedding))
+		for i, value := range embedding {
+			exps[i] = math.Exp(float64(value) - maxValue)
+			sum += exps[i]
+		}
+		for i := range embedding {
+			embedding[i] = float32(exps[i] / sum)
+		}
+	case PostprocessL2:
+		var sumSquares float64
+		for _, value := range embedding {
+			sumSquares += float64(value) * float64(value)
+		}
+		if norm := math.Sqrt(sumSquares); norm > 0 {
+			for i := range embedding {
+				embedding[i] = float32(float64(embedding[i]) / norm)
+			}
+		}
+	}
+	return embedding
+}
+
 // GenerateLabelVector converts labels into a one-hot encoded vector based on the full label set
 func GenerateLabelVector(labels []string, labelSet map[string]int) []float32 {
 	labelVector := make([]float32, len(labelSet))
@@ -182,13 +846,91 @@ func CombineEmbeddings(embedding []float32, labelVector []float32) []float32 {
 	return combined
 }
 
+// Ways of combining the embeddings of several views of one product
+const (
+	AggregateMean = "mean" // Average every dimension across the views
+	AggregateMax  = "max"  // Keep the largest value of every dimension across the views
+)
+
+// AggregateEmbeddings combines equally sized embeddings into one using the given method, defaulting to the mean
+func AggregateEmbeddings(vectors [][]float32, method string) []float32 {
+	if len(vectors) == 0 {
+		return nil
+	}
+
+	aggregated := make([]float32, len(vectors[0]))
+	copy(aggregated, vectors[0])
+	for _, vector := range vectors[1:] {
+		for d, value := range vector {
+			if method == AggregateMax {
+				if value > aggregated[d] {
+					aggregated[d] = value
+				}
+			} else {
+				aggregated[d] += value
+			}
+		}
+	}
+
+	if method != AggregateMax {
+		for d := range aggregated {
+			aggregated[d] /= float32(len(vectors))
+		}
+	}
+	return aggregated
+}
+
+// StandardizeEmbeddings z-score standardizes each dimension across the batch of embeddings.
+// Dimensions with zero variance carry no information for clustering, so they are set to zero instead of dividing by zero.
+func StandardizeEmbeddings(embeddings [][]float32) [][]float32 {
+	if len(embeddings) == 0 {
+		return embeddings
+	}
+
+	dims := len(embeddings[0])
+	count := float64(len(embeddings))
+
+	// Compute the per-dimension mean
+	mean := make([]float64, dims)
+	for _, embedding := range embeddings {
+		for d, value := range embedding {
+			mean[d] += float64(value)
+		}
+	}
+	for d := range mean {
+		mean[d] /= count
+	}
+
+	// Compute the per-dimension standard deviation
+	std := make([]float64, dims)
+	for _, embedding := range embeddings {
+		for d, value := range embedding {
+			diff := float64(value) - mean[d]
+			std[d] += diff * diff
+		}
+	}
+	for d := range std {
+		std[d] = math.Sqrt(std[d] / count)
+	}
+
+	standardized := make([][]float32, len(embeddings))
+	for i, embedding := range embeddings {
+		standardized[i] = make([]float32, dims)
+		for d, value := range embedding {
+			if std[d] < 1e-12 {
+				continue
+			}
+			standardized[i][d] = float32((float64(value) - mean[d]) / std[d])
+		}
+	}
+	return standardized
+}
+
 // BuildLabelSet constructs a set of all possible labels from the dataset
 // In embeddings.go, update the BuildLabelSet function:
 
-func BuildLabelSet(productRefIDs []string, rekognitionSvc *rekognition.RekognitionService, appCtx *AppContext) error {
-	log.Println("Building label set from product images")
-	labelSet := make(map[string]int)
-	index := 0
+func BuildLabelSet(ctx context.Context, productRefIDs []string, rekognitionSvc *rekognition.RekognitionService, appCtx *AppContext, workers int) error {
+	logger.Infof("Building label set from product images")
 
 	// Get list of files in the images directory
 	files, err := os.ReadDir(appCtx.ImageDir)
@@ -196,41 +938,76 @@ func BuildLabelSet(productRefIDs []string, rekognitionSvc *rekognition.Rekogniti
 		return fmt.Errorf("failed to read image directory: %v", err)
 	}
 
+	if workers < 1 {
+		workers = 1
+	}
+	jobs := make(chan string)
+	errChan := make(chan error, len(files))
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for fileName := range jobs {
+				imagePath := filepath.Join(appCtx.ImageDir, fileName)
+
+				// Detect labels (cached)
+				labels, err := rekognitionSvc.DetectLabels(ctx, imagePath, 10, 80)
+				if err != nil {
+					errChan <- fmt.Errorf("failed to detect labels for image %s: %v", fileName, err)
+					continue
+				}
+
+				// Store the labels for this image
+				var labelNames []string
+				for _, label := range labels {
+					labelNames = append(labelNames, *label.Name)
+				}
+				appCtx.Mutex.Lock()
+				appCtx.LabelsMapping[fileName] = labelNames
+				appCtx.Mutex.Unlock()
+			}
+		}()
+	}
+
 	// Process each file in the directory
 	for _, file := range files {
 		if file.IsDir() {
 			continue
 		}
+		jobs <- file.Name()
+	}
+	close(jobs)
+	wg.Wait()
+	close(errChan)
 
-		imagePath := filepath.Join(appCtx.ImageDir, file.Name())
+	if err := <-errChan; err != nil {
+		return err
+	}
 
-		// Detect labels (cached)
-		labels, err := rekognitionSvc.DetectLabels(imagePath, 10, 80)
-		if err != nil {
-			return fmt.Errorf("failed to detect labels for image %s: %v", file.Name(), err)
-		}
+	// Assign indices in sorted order so the encoding doesn't depend on worker scheduling
+	appCtx.LabelSet = IndexLabels(appCtx.LabelsMapping)
+	logger.Infof("Label set built with %d unique labels", len(appCtx.LabelSet))
+	return nil
+}
 
-		// Collect labels into the label set
+// IndexLabels assigns every distinct label across the mapping a stable index by sorted label name
+func IndexLabels(labelsMapping map[string][]string) map[string]int {
+	var names []string
+	seen := make(map[string]bool)
+	for _, labels := range labelsMapping {
 		for _, label := range labels {
-			labelName := *label.Name
-			if _, exists := labelSet[labelName]; !exists {
-				labelSet[labelName] = index
-				index++
+			if !seen[label] {
+				seen[label] = true
+				names = append(names, label)
 			}
 		}
-
-		// Store the labels for this image
-		var labelNames []string
-		for _, label := range labels {
-			labelNames = append(labelNames, *label.Name)
-		}
-		appCtx.Mutex.Lock()
-		appCtx.LabelsMapping[file.Name()] = labelNames
-		appCtx.Mutex.Unlock()
 	}
+	sort.Strings(names)
 
-	// Assign the built label set to the app context
-	appCtx.LabelSet = labelSet
-	log.Printf("Label set built with %d unique labels", len(labelSet))
-	return nil
+	labelSet := make(map[string]int, len(names))
+	for i, name := range names {
+		labelSet[name] = i
+	}
+	return labelSet
 }
@@ -0,0 +1,230 @@
+package embeddings
+
+import (
+	"context"
+	"maps"
+	"math"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awsrekognition "github.com/aws/aws-sdk-go-v2/service/rekognition"
+	"github.com/aws/aws-sdk-go-v2/service/rekognition/types"
+
+	"imageclust/internal/rekognition"
+)
+
+func TestStandardizeEmbeddings(t *testing.T) {
+	embeddings := [][]float32{
+		{1, 10, 5},
+		{2, 30, 5},
+		{3, 20, 5},
+		{6, 40, 5},
+	}
+
+	standardized := StandardizeEmbeddings(embeddings)
+	if len(standardized) != len(embeddings) {
+		t.Fatalf("got %d embeddings, want %d", len(standardized), len(embeddings))
+	}
+	for d := 0; d < 2; d++ {
+		var mean, variance float64
+		for _, embedding := range standardized {
+			mean += float64(embedding[d])
+		}
+		mean /= float64(len(standardized))
+		for _, embedding := range standardized {
+			diff := float64(embedding[d]) - mean
+			variance += diff * diff
+		}
+		std := math.Sqrt(variance / float64(len(standardized)))
+		if math.Abs(mean) > 1e-6 || math.Abs(std-1) > 1e-6 {
+			t.Errorf("dimension %d has mean %.6f and std %.6f, want 0 and 1", d, mean, std)
+		}
+	}
+	// The constant dimension has no variance and must not turn into NaN or Inf
+	for i, embedding := range standardized {
+		if embedding[2] != 0 {
+			t.Errorf("embedding %d: zero-variance dimension = %v, want 0", i, embedding[2])
+		}
+	}
+}
+
+func TestSetForwardRetries(t *testing.T) {
+	defer SetForwardRetries(forwardRetries)
+
+	SetForwardRetries(0)
+	if forwardRetries != 0 {
+		t.Errorf("forwardRetries = %d, want 0", forwardRetries)
+	}
+	SetForwardRetries(-1)
+	if forwardRetries != 0 {
+		t.Errorf("a negative value changed forwardRetries to %d", forwardRetries)
+	}
+}
+
+// slowRekognition answers label requests after a random delay with the comma-separated labels
+// stored as the image content, so workers finish in a different order on every run
+type slowRekognition struct {
+	rekognition.RekognitionAPI
+}
+
+func (slowRekognition) DetectLabels(ctx context.Context, params *awsrekognition.DetectLabelsInput, optFns ...func(*awsrekognition.Options)) (*awsrekognition.DetectLabelsOutput, error) {
+	time.Sleep(time.Duration(rand.Intn(5)) * time.Millisecond)
+	var labels []types.Label
+	for _, name := range strings.Split(string(params.Image.Bytes), ",") {
+		labels = append(labels, types.Label{Name: aws.String(name), Confidence: aws.Float32(90)})
+	}
+	return &awsrekognition.DetectLabelsOutput{Labels: labels}, nil
+}
+
+func TestBuildLabelSetIsIndependentOfWorkerScheduling(t *testing.T) {
+	imageDir := t.TempDir()
+	images := map[string]string{
+		"1.jpg": "Shoe,Sneaker", "2.jpg": "Hat,Wool", "3.jpg": "Bag,Leather,Shoe",
+		"4.jpg": "Dress", "5.jpg": "Apparel,Hat", "6.jpg": "Boot,Leather",
+	}
+	for name, labels := range images {
+		if err := os.WriteFile(filepath.Join(imageDir, name), []byte(labels), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var first map[string]int
+	for run := 0; run < 5; run++ {
+		// Each run starts without a cache, so every image goes through the workers
+		service := &rekognition.RekognitionService{Client: slowRekognition{}, CacheDir: t.TempDir()}
+		appCtx := &AppContext{ImageDir: imageDir, LabelsMapping: make(map[string][]string)}
+		if err := BuildLabelSet(context.Background(), nil, service, appCtx, 4); err != nil {
+			t.Fatal(err)
+		}
+		if run == 0 {
+			first = appCtx.LabelSet
+			continue
+		}
+		if !maps.Equal(appCtx.LabelSet, first) {
+			t.Fatalf("run %d assigned %v, the first run %v", run, appCtx.LabelSet, first)
+		}
+	}
+
+	want := map[string]int{"Apparel": 0, "Bag": 1, "Boot": 2, "Dress": 3, "Hat": 4, "Leather": 5, "Shoe": 6, "Sneaker": 7, "Wool": 8}
+	if !maps.Equal(first, want) {
+		t.Errorf("label set = %v, want indices in sorted label order %v", first, want)
+	}
+}
+
+func TestLabelVectorsIgnoreLabelOrder(t *testing.T) {
+	forward := map[string][]string{"a.jpg": {"Shoe", "Leather", "Brown"}, "b.jpg": {"Hat", "Wool"}}
+	reversed := map[string][]string{"b.jpg": {"Wool", "Hat"}, "a.jpg": {"Brown", "Leather", "Shoe"}}
+
+	first, second := IndexLabels(forward), IndexLabels(reversed)
+	if !maps.Equal(first, second) {
+		t.Fatalf("label sets differ: %v and %v", first, second)
+	}
+	for image := range forward {
+		a := GenerateLabelVector(forward[image], first)
+		b := GenerateLabelVector(reversed[image], second)
+		if !slices.Equal(a, b) {
+			t.Errorf("%s: vectors %v and %v differ for the same labels in another order", image, a, b)
+		}
+	}
+}
+
+func TestPostprocessEmbedding(t *testing.T) {
+	// Large logits would overflow a naive softmax
+	softmax := PostprocessEmbedding([]float32{1000, 999, -5, 3.5}, PostprocessSoftmax)
+	var sum float64
+	for _, value := range softmax {
+		if value < 0 || math.IsNaN(float64(value)) {
+			t.Fatalf("softmax = %v, want probabilities", softmax)
+		}
+		sum += float64(value)
+	}
+	if math.Abs(sum-1) > 1e-5 {
+		t.Errorf("softmax sums to %v, want 1", sum)
+	}
+	if softmax[0] <= softmax[1] {
+		t.Errorf("softmax = %v does not keep the largest logit on top", softmax)
+	}
+
+	l2 := PostprocessEmbedding([]float32{3, 4}, PostprocessL2)
+	if math.Abs(float64(l2[0])-0.6) > 1e-6 || math.Abs(float64(l2[1])-0.8) > 1e-6 {
+		t.Errorf("l2 = %v, want [0.6 0.8]", l2)
+	}
+
+	if none := PostprocessEmbedding([]float32{3, 4}, ""); !slices.Equal(none, []float32{3, 4}) {
+		t.Errorf("no postprocessing changed the embedding to %v", none)
+	}
+}
+
+func TestValidatePreprocessPipeline(t *testing.T) {
+	tests := []struct {
+		pipeline []string
+		wantErr  string
+	}{
+		{pipeline: nil},
+		{pipeline: DefaultPreprocessPipeline},
+		{pipeline: []string{StepResize, StepCenterCrop, StepNormalize, StepColorConvert}},
+		{pipeline: []string{StepColorConvert, StepNormalize, StepResize}},
+		{pipeline: []string{StepResize, "sharpen"}, wantErr: "unknown preprocessing step"},
+		{pipeline: []string{StepResize, StepNormalize, StepNormalize}, wantErr: "more than once"},
+		{pipeline: []string{StepNormalize, StepColorConvert}, wantErr: "must include"},
+	}
+	for _, tt := range tests {
+		err := ValidatePreprocessPipeline(tt.pipeline)
+		switch {
+		case tt.wantErr == "" && err != nil:
+			t.Errorf("%v: unexpected error %v", tt.pipeline, err)
+		case tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)):
+			t.Errorf("%v: error %v, want one containing %q", tt.pipeline, err, tt.wantErr)
+		}
+	}
+}
+
+func TestNewDeduplicatorUsesTheAlgorithmDefaultThreshold(t *testing.T) {
+	for _, algorithm := range HashAlgorithms {
+		dedup, err := NewDeduplicator(algorithm, -1)
+		if err != nil {
+			t.Fatalf("%s: %v", algorithm, err)
+		}
+		if dedup.threshold != float64(DefaultHashThresholds[algorithm]) {
+			t.Errorf("%s: threshold = %v, want the default %d", algorithm, dedup.threshold, DefaultHashThresholds[algorithm])
+		}
+	}
+	if dedup, _ := NewDeduplicator(HashPHash, 3); dedup.threshold != 3 {
+		t.Errorf("threshold = %v, want the configured 3", dedup.threshold)
+	}
+	if _, err := NewImageHash("dhash"); err == nil {
+		t.Error("an unknown hash algorithm was accepted")
+	}
+}
+
+func TestParseModelWeights(t *testing.T) {
+	weights, err := ParseModelWeights([]string{"resnet50:0.5"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(weights, []ModelWeight{{Name: "resnet50", Weight: 0.5}}) {
+		t.Errorf("weights = %v, want resnet50 at 0.5", weights)
+	}
+	if weights, _ := ParseModelWeights([]string{"resnet50"}); len(weights) != 1 || weights[0].Weight != 1 {
+		t.Errorf("weights = %v, want the default weight of 1", weights)
+	}
+
+	for _, entries := range [][]string{{"unknown"}, {"resnet50:-1"}, {"resnet50:heavy"}, {"resnet50", "resnet50:2"}} {
+		if _, err := ParseModelWeights(entries); err == nil {
+			t.Errorf("%v was accepted", entries)
+		}
+	}
+}
+
+func TestImageEmbeddingDimCountsBlendedModels(t *testing.T) {
+	appCtx := &AppContext{EmbeddingDim: 1000, Blend: []BlendedModel{{Name: "a", EmbeddingDim: 512}, {Name: "b", EmbeddingDim: 64}}}
+	if dim := appCtx.ImageEmbeddingDim(); dim != 1576 {
+		t.Errorf("dimension = %d, want 1576 across the three models", dim)
+	}
+}
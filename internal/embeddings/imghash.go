@@ -0,0 +1,114 @@
+package embeddings
+
+import (
+	"fmt"
+
+	"gocv.io/x/gocv"
+	"gocv.io/x/gocv/contrib"
+)
+
+// Perceptual hash algorithms from OpenCV's img_hash module whose hashes are compared by Hamming distance
+const (
+	HashPHash        = "phash"        // DCT-based; robust to resizing, compression and small edits
+	HashAverage      = "ahash"        // Mean of an 8x8 thumbnail; fastest but sensitive to contrast changes
+	HashBlockMean    = "blockmean"    // Block means of a 256-bit grid; finer than ahash at a similar cost
+	HashMarrHildreth = "marrhildreth" // Edge-based and 576 bits; most robust and slowest
+)
+
+// HashAlgorithms lists the algorithms accepted by NewImageHash
+var HashAlgorithms = []string{HashPHash, HashAverage, HashBlockMean, HashMarrHildreth}
+
+// DefaultHashThresholds is the Hamming distance up to which two images count as duplicates,
+// about an eighth of each algorithm's hash length
+var DefaultHashThresholds = map[string]int{
+	HashPHash:        8,
+	HashAverage:      8,
+	HashBlockMean:    32,
+	HashMarrHildreth: 72,
+}
+
+// NewImageHash returns the named perceptual hash algorithm
+func NewImageHash(algorithm string) (contrib.ImgHashBase, error) {
+	switch algorithm {
+	case HashPHash:
+		return contrib.PHash{}, nil
+	case HashAverage:
+		return contrib.AverageHash{}, nil
+	case HashBlockMean:
+		return contrib.BlockMeanHash{Mode: contrib.BlockMeanHashModeDefault}, nil
+	case HashMarrHildreth:
+		return contrib.NewMarrHildrethHash(), nil
+	}
+	return nil, fmt.Errorf("unknown hash algorithm %q", algorithm)
+}
+
+// ComputeImageHash hashes the image at imagePath. The returned Mat must be closed by the caller.
+func ComputeImageHash(hash contrib.ImgHashBase, imagePath string) (gocv.Mat, error) {
+	img, err := readColorImage(imagePath)
+	if err != nil {
+		return gocv.Mat{}, err
+	}
+	defer img.Close()
+
+	output := gocv.NewMat()
+	hash.Compute(img, &output)
+	if output.Empty() {
+		output.Close()
+		return gocv.Mat{}, fmt.Errorf("failed to hash image %s", imagePath)
+	}
+	return output, nil
+}
+
+// Deduplicator finds near-duplicate images by comparing their perceptual hash with those of the images kept before them
+type Deduplicator struct {
+	hash      contrib.ImgHashBase
+	threshold float64
+	hashes    []gocv.Mat
+	names     []string
+}
+
+// NewDeduplicator returns a Deduplicator using the named algorithm. A negative threshold uses
+// the algorithm's entry in DefaultHashThresholds. It must be closed to free the stored hashes.
+func NewDeduplicator(algorithm string, threshold int) (*Deduplicator, error) {
+	hash, err := NewImageHash(algorithm)
+	if err != nil {
+		return nil, err
+	}
+	if threshold < 0 {
+		threshold = DefaultHashThresholds[algorithm]
+	}
+	return &Deduplicator{hash: hash, threshold: float64(threshold)}, nil
+}
+
+// Check hashes the image and returns the name of the closest kept image within the threshold, with
+// the Hamming distance between them. When there is none, ok is false and the image is kept under name.
+func (d *Deduplicator) Check(imagePath, name string) (duplicateOf string, distance int, ok bool, err error) {
+	hashed, err := ComputeImageHash(d.hash, imagePath)
+	if err != nil {
+		return "", 0, false, err
+	}
+
+	best := -1
+	bestDistance := 0.0
+	for i, kept := range d.hashes {
+		if dist := d.hash.Compare(hashed, kept); dist <= d.threshold && (best < 0 || dist < bestDistance) {
+			best, bestDistance = i, dist
+		}
+	}
+	if best >= 0 {
+		hashed.Close()
+		return d.names[best], int(bestDistance), true, nil
+	}
+
+	d.hashes = append(d.hashes, hashed)
+	d.names = append(d.names, name)
+	return "", 0, false, nil
+}
+
+// Close frees the stored hashes
+func (d *Deduplicator) Close() {
+	for i := range d.hashes {
+		d.hashes[i].Close()
+	}
+	d.hashes, d.names = nil, nil
+}
@@ -0,0 +1,69 @@
+package embeddings
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"gocv.io/x/gocv"
+)
+
+// newTestPool builds a pool of empty networks, which can be closed without a model
+func newTestPool(size int) *NetPool {
+	pool := &NetPool{nets: make(chan *gocv.Net, size), done: make(chan struct{})}
+	for i := 0; i < size; i++ {
+		pool.nets <- &gocv.Net{}
+	}
+	return pool
+}
+
+func TestNetPoolCloseDoesNotWaitForBusyNetworks(t *testing.T) {
+	pool := newTestPool(2)
+	busy, err := pool.Acquire()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A hung forward pass keeps its network; closing must still return at once
+	closed := make(chan struct{})
+	go func() {
+		pool.Close()
+		close(closed)
+	}()
+	select {
+	case <-closed:
+	case <-time.After(time.Second):
+		t.Fatal("Close blocked on a network that was not released")
+	}
+
+	// The late release frees the network rather than returning it to the pool
+	pool.Release(busy)
+	if len(pool.nets) != 0 {
+		t.Errorf("%d networks returned to a closed pool", len(pool.nets))
+	}
+}
+
+func TestNetPoolAcquireFailsOnceClosed(t *testing.T) {
+	pool := newTestPool(1)
+	held, err := pool.Acquire()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A caller waiting for a network is woken by Close instead of waiting forever
+	acquired := make(chan error, 1)
+	go func() {
+		_, err := pool.Acquire()
+		acquired <- err
+	}()
+	pool.Close()
+	select {
+	case err := <-acquired:
+		if !errors.Is(err, ErrNetPoolClosed) {
+			t.Errorf("Acquire after Close: err = %v, want ErrNetPoolClosed", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Acquire still waiting after Close")
+	}
+	pool.Release(held)
+}
@@ -0,0 +1,10 @@
+//go:build opencv && !matprofile
+
+package embeddings
+
+import "testing"
+
+// checkMatLeaks runs work; without the matprofile tag gocv does not count Mats, so leaks go unchecked
+func checkMatLeaks(t *testing.T, work func()) {
+	work()
+}
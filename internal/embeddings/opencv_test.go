@@ -0,0 +1,520 @@
+//go:build opencv
+
+package embeddings
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"math"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+
+	"gocv.io/x/gocv"
+)
+
+// These tests need OpenCV and run with go test -tags opencv
+
+// writeTestImage encodes img as a PNG file in dir and returns its path
+func writeTestImage(t *testing.T, dir, name string, img image.Image) string {
+	t.Helper()
+	path := filepath.Join(dir, name)
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if err := png.Encode(f, img); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// solidImage returns an opaque RGBA image of the given size and color
+func solidImage(width, height int, c color.RGBA) *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			img.SetRGBA(x, y, c)
+		}
+	}
+	return img
+}
+
+func TestPreprocessImageRegionClosesItsMats(t *testing.T) {
+	dir := t.TempDir()
+	path := writeTestImage(t, dir, "wide.png", solidImage(320, 120, color.RGBA{40, 120, 200, 255}))
+	white := &color.RGBA{255, 255, 255, 255}
+
+	tests := []struct {
+		name     string
+		path     string
+		crop     *CropBox
+		padding  *color.RGBA
+		pipeline []string
+		wantErr  bool
+	}{
+		{name: "full frame", path: path},
+		{name: "crop", path: path, crop: &CropBox{Left: 0.25, Top: 0.25, Width: 0.5, Height: 0.5}},
+		{name: "letterbox", path: path, padding: white},
+		{name: "center crop", path: path, pipeline: []string{StepResize, StepCenterCrop, StepNormalize, StepColorConvert}},
+		{name: "missing file", path: filepath.Join(dir, "missing.png"), wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			checkMatLeaks(t, func() {
+				blob, err := PreprocessImageRegion(tt.path, gocv.InterpolationLinear, true, tt.crop, nil, tt.padding, tt.pipeline)
+				if (err != nil) != tt.wantErr {
+					t.Fatalf("err = %v, want error %v", err, tt.wantErr)
+				}
+				blob.Close()
+			})
+		})
+	}
+}
+
+func TestPreprocessImageHandlesGrayscaleAndAlpha(t *testing.T) {
+	dir := t.TempDir()
+	gray := image.NewGray(image.Rect(0, 0, 64, 48))
+	for i := range gray.Pix {
+		gray.Pix[i] = uint8(i)
+	}
+	// Half transparent, so the alpha channel has to be dropped or flattened
+	rgba := image.NewNRGBA(image.Rect(0, 0, 64, 48))
+	for i := 0; i < len(rgba.Pix); i += 4 {
+		rgba.Pix[i], rgba.Pix[i+1], rgba.Pix[i+2], rgba.Pix[i+3] = 200, 40, 40, uint8(i%2*255)
+	}
+	images := map[string]string{
+		"grayscale": writeTestImage(t, dir, "gray.png", gray),
+		"rgba":      writeTestImage(t, dir, "rgba.png", rgba),
+	}
+
+	for name, path := range images {
+		for _, background := range []*color.RGBA{nil, {R: 255, G: 255, B: 255, A: 255}} {
+			checkMatLeaks(t, func() {
+				blob, err := PreprocessImageRegion(path, gocv.InterpolationLinear, true, nil, background, nil, nil)
+				if err != nil {
+					t.Fatalf("%s: %v", name, err)
+				}
+				defer blob.Close()
+				if size := blob.Size(); len(size) != 4 || size[1] != 3 || size[2] != inputSize || size[3] != inputSize {
+					t.Errorf("%s: blob shape %v, want [1 3 %d %d]", name, size, inputSize, inputSize)
+				}
+			})
+		}
+	}
+}
+
+func TestPreprocessImageChannelOrder(t *testing.T) {
+	path := writeTestImage(t, t.TempDir(), "red.png", solidImage(64, 64, color.RGBA{255, 0, 0, 255}))
+	const plane = inputSize * inputSize
+
+	// The blob is laid out as planes of channels, so the first and last planes hold red and blue in some order
+	for _, swapRB := range []bool{true, false} {
+		blob, err := PreprocessImage(path, gocv.InterpolationLinear, swapRB)
+		if err != nil {
+			t.Fatal(err)
+		}
+		values, err := blob.DataPtrFloat32()
+		if err != nil {
+			t.Fatal(err)
+		}
+		first, last := values[0], values[2*plane]
+		blob.Close()
+
+		wantFirst, wantLast := float32(0), float32(1)
+		if swapRB {
+			wantFirst, wantLast = 1, 0
+		}
+		if math.Abs(float64(first-wantFirst)) > 1e-3 || math.Abs(float64(last-wantLast)) > 1e-3 {
+			t.Errorf("swapRB %v: first and last channel = %v, %v, want %v, %v", swapRB, first, last, wantFirst, wantLast)
+		}
+	}
+}
+
+func TestPreprocessImageUsesConfiguredInterpolation(t *testing.T) {
+	path := writeTestImage(t, t.TempDir(), "large.png", solidImage(640, 480, color.RGBA{200, 40, 40, 255}))
+
+	var used []gocv.InterpolationFlags
+	defer func(original func(gocv.Mat, *gocv.Mat, image.Point, float64, float64, gocv.InterpolationFlags)) {
+		resize = original
+	}(resize)
+	resize = func(src gocv.Mat, dst *gocv.Mat, size image.Point, fx, fy float64, interp gocv.InterpolationFlags) {
+		used = append(used, interp)
+		gocv.Resize(src, dst, size, fx, fy, interp)
+	}
+
+	checkMatLeaks(t, func() {
+		blob, err := PreprocessImage(path, InterpolationFromName("area"), true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		blob.Close()
+	})
+
+	if len(used) == 0 {
+		t.Fatal("the image was never resized")
+	}
+	for _, interp := range used {
+		if interp != gocv.InterpolationArea {
+			t.Errorf("resized with interpolation %v, want InterpolationArea", interp)
+		}
+	}
+}
+
+// testNets loads a pool of size ResNet50 networks from MODEL_PATH, skipping the test when the model is not available
+func testNets(t *testing.T, size int) *NetPool {
+	t.Helper()
+	SetModelPath("resnet50", os.Getenv("MODEL_PATH"))
+	model := ModelRegistry["resnet50"]
+	if err := model.CheckFile(); err != nil {
+		t.Skip(err)
+	}
+	nets, err := NewNetPool(model.Path, size)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(nets.Close)
+	return nets
+}
+
+func TestGetImageEmbeddingRejectsWrongDimension(t *testing.T) {
+	nets := testNets(t, 1)
+	path := writeTestImage(t, t.TempDir(), "red.png", solidImage(64, 64, color.RGBA{200, 40, 40, 255}))
+	layer := ModelRegistry["resnet50"].Layer("dense")
+
+	// The dense layer yields 1000 values, so a context expecting the pool layer's 2048 must fail clearly
+	appCtx := &AppContext{Nets: nets, OutputLayer: layer.Name, SwapRB: true, EmbeddingDim: 2048}
+	var err error
+	checkMatLeaks(t, func() { _, err = GetImageEmbedding(appCtx, path, nil) })
+	if err == nil || !strings.Contains(err.Error(), "has 1000 dimensions, expected 2048") {
+		t.Fatalf("err = %v, want a dimension mismatch", err)
+	}
+
+	appCtx.EmbeddingDim = layer.EmbeddingDim
+	var embedding []float32
+	checkMatLeaks(t, func() { embedding, err = GetImageEmbedding(appCtx, path, nil) })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(embedding) != layer.EmbeddingDim {
+		t.Errorf("embedding has %d dimensions, want %d", len(embedding), layer.EmbeddingDim)
+	}
+}
+
+func TestGetImageEmbeddingMatchesTheChosenLayer(t *testing.T) {
+	nets := testNets(t, 1)
+	path := writeTestImage(t, t.TempDir(), "blue.png", solidImage(64, 64, color.RGBA{40, 40, 200, 255}))
+
+	for name, layer := range ModelRegistry["resnet50"].Layers {
+		appCtx := &AppContext{Nets: nets, OutputLayer: layer.Name, SwapRB: true, EmbeddingDim: layer.EmbeddingDim}
+		embedding, err := GetImageEmbedding(appCtx, path, nil)
+		if err != nil {
+			t.Fatalf("%s layer: %v", name, err)
+		}
+		if len(embedding) != layer.EmbeddingDim {
+			t.Errorf("%s layer: embedding has %d dimensions, want %d", name, len(embedding), layer.EmbeddingDim)
+		}
+	}
+}
+
+func TestConcurrentEmbeddingsMatchSerialOnes(t *testing.T) {
+	nets := testNets(t, 2)
+
+	dir := t.TempDir()
+	colors := []color.RGBA{{200, 40, 40, 255}, {40, 200, 40, 255}, {40, 40, 200, 255}, {200, 200, 40, 255}}
+	paths := make([]string, len(colors))
+	for i, c := range colors {
+		paths[i] = writeTestImage(t, dir, fmt.Sprintf("%d.png", i), solidImage(96, 96, c))
+	}
+	appCtx := &AppContext{Nets: nets, SwapRB: true}
+
+	want := make([][]float32, len(paths))
+	for i, path := range paths {
+		var err error
+		if want[i], err = GetImageEmbedding(appCtx, path, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Each image is embedded several times at once, so the pool's networks are shared between images
+	const rounds = 4
+	got := make([][]float32, len(paths)*rounds)
+	errs := make([]error, len(got))
+	var wg sync.WaitGroup
+	for i := range got {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			got[i], errs[i] = GetImageEmbedding(appCtx, paths[i%len(paths)], nil)
+		}(i)
+	}
+	wg.Wait()
+
+	for i := range got {
+		if errs[i] != nil {
+			t.Fatal(errs[i])
+		}
+		if !slices.Equal(got[i], want[i%len(paths)]) {
+			t.Errorf("concurrent embedding of %s differs from the serial one", filepath.Base(paths[i%len(paths)]))
+		}
+	}
+}
+
+// blobValues preprocesses an image with swapped channels and returns a copy of the blob, in planes of R, G and B
+func blobValues(t *testing.T, path string, crop *CropBox, background, padding *color.RGBA, pipeline []string) []float32 {
+	t.Helper()
+	blob, err := PreprocessImageRegion(path, gocv.InterpolationLinear, true, crop, background, padding, pipeline)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer blob.Close()
+	values, err := blob.DataPtrFloat32()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return slices.Clone(values)
+}
+
+func TestCropToSubjectChangesTheBlob(t *testing.T) {
+	// The subject fills the left half in red; the right half is blue
+	img := solidImage(200, 100, color.RGBA{0, 0, 255, 255})
+	for y := 0; y < 100; y++ {
+		for x := 0; x < 100; x++ {
+			img.SetRGBA(x, y, color.RGBA{255, 0, 0, 255})
+		}
+	}
+	path := writeTestImage(t, t.TempDir(), "subject.png", img)
+	const plane = inputSize * inputSize
+
+	full := blobValues(t, path, nil, nil, nil, nil)
+	cropped := blobValues(t, path, &CropBox{Left: 0, Top: 0, Width: 0.5, Height: 1}, nil, nil, nil)
+	if slices.Equal(full, cropped) {
+		t.Fatal("the cropped blob equals the full-frame blob")
+	}
+
+	// The crop holds only the subject, so its red plane is full and its blue plane empty everywhere
+	for i := 0; i < plane; i++ {
+		if cropped[i] < 0.99 || cropped[2*plane+i] > 0.01 {
+			t.Fatalf("cropped pixel %d has red %v and blue %v, want only the red subject", i, cropped[i], cropped[2*plane+i])
+		}
+	}
+	if last := full[2*plane+plane-1]; last < 0.99 {
+		t.Errorf("full-frame blue at the right edge = %v, want the blue background kept", last)
+	}
+}
+
+func TestTransparentPixelsAreFlattenedOverTheBackground(t *testing.T) {
+	// Fully transparent except for an opaque blue top half
+	img := image.NewNRGBA(image.Rect(0, 0, 100, 100))
+	for y := 0; y < 50; y++ {
+		for x := 0; x < 100; x++ {
+			img.SetNRGBA(x, y, color.NRGBA{B: 255, A: 255})
+		}
+	}
+	path := writeTestImage(t, t.TempDir(), "transparent.png", img)
+	const plane = inputSize * inputSize
+
+	for _, background := range []color.RGBA{{R: 255, G: 255, B: 255, A: 255}, {R: 255, A: 255}} {
+		values := blobValues(t, path, nil, &background, nil, nil)
+		top, bottom := 10*inputSize+inputSize/2, (inputSize-10)*inputSize+inputSize/2
+		wantTop := []float32{0, 0, 1}
+		wantBottom := []float32{float32(background.R) / 255, float32(background.G) / 255, float32(background.B) / 255}
+		for c := 0; c < 3; c++ {
+			if got := values[c*plane+top]; math.Abs(float64(got-wantTop[c])) > 0.01 {
+				t.Errorf("background %v: opaque channel %d = %v, want %v", background, c, got, wantTop[c])
+			}
+			if got := values[c*plane+bottom]; math.Abs(float64(got-wantBottom[c])) > 0.01 {
+				t.Errorf("background %v: transparent channel %d = %v, want the background %v", background, c, got, wantBottom[c])
+			}
+		}
+	}
+}
+
+func TestLetterboxPadsAPanoramaToASquare(t *testing.T) {
+	path := writeTestImage(t, t.TempDir(), "panorama.png", solidImage(300, 100, color.RGBA{0, 0, 255, 255}))
+	white := &color.RGBA{R: 255, G: 255, B: 255, A: 255}
+	const plane = inputSize * inputSize
+
+	values := blobValues(t, path, nil, nil, white, nil)
+	if len(values) != 3*plane {
+		t.Fatalf("blob has %d values, want a %dx%d input", len(values), inputSize, inputSize)
+	}
+
+	// The 3:1 image keeps its shape as a band a third of the height, with padding above and below
+	red := func(row int) float32 { return values[row*inputSize+inputSize/2] }
+	bandTop, bandBottom := inputSize/3, 2*inputSize/3
+	for row := 0; row < inputSize; row++ {
+		switch {
+		case row < bandTop-2 || row > bandBottom+2:
+			if red(row) < 0.99 {
+				t.Fatalf("row %d has red %v, want the white padding", row, red(row))
+			}
+		case row > bandTop+2 && row < bandBottom-2:
+			if red(row) > 0.01 {
+				t.Fatalf("row %d has red %v, want the blue image", row, red(row))
+			}
+		}
+	}
+}
+
+func TestPipelineOrderChangesTheBlob(t *testing.T) {
+	// A blue image with a thin red stripe down its left edge, which a center crop trims away
+	img := solidImage(300, 100, color.RGBA{0, 0, 255, 255})
+	for y := 0; y < 100; y++ {
+		for x := 0; x < 20; x++ {
+			img.SetRGBA(x, y, color.RGBA{255, 0, 0, 255})
+		}
+	}
+	path := writeTestImage(t, t.TempDir(), "stripe.png", img)
+	const plane = inputSize * inputSize
+	leftEdge := (inputSize/2)*inputSize + 1
+
+	stretched := blobValues(t, path, nil, nil, nil, nil)
+	cropped := blobValues(t, path, nil, nil, nil, []string{StepResize, StepCenterCrop, StepNormalize, StepColorConvert})
+	if slices.Equal(stretched, cropped) {
+		t.Fatal("resize then center-crop produced the same blob as the default pipeline")
+	}
+	if stretched[leftEdge] < 0.99 || cropped[leftEdge] > 0.01 {
+		t.Errorf("red at the left edge is %v stretched and %v cropped, want the stripe kept only without the crop",
+			stretched[leftEdge], cropped[leftEdge])
+	}
+
+	// Without the normalize step values stay in [0, 255], and without color-convert channels stay BGR
+	raw := blobValues(t, path, nil, nil, nil, []string{StepResize})
+	if got := raw[2*plane+leftEdge]; math.Abs(float64(got-255)) > 1 {
+		t.Errorf("third plane at the stripe = %v, want the red channel unscaled at 255", got)
+	}
+	if got := raw[leftEdge]; got > 1 {
+		t.Errorf("first plane at the stripe = %v, want the blue channel at 0", got)
+	}
+}
+
+// checkerImage returns a size x size image of cells x cells squares alternating between two colors
+func checkerImage(size, cells int, a, b color.RGBA) *image.RGBA {
+	img := solidImage(size, size, a)
+	cell := size / cells
+	for y := 0; y < size; y++ {
+		for x := 0; x < size; x++ {
+			if (x/cell+y/cell)%2 == 1 {
+				img.SetRGBA(x, y, b)
+			}
+		}
+	}
+	return img
+}
+
+func TestPHashMatchesResizedCopies(t *testing.T) {
+	dir := t.TempDir()
+	black, white := color.RGBA{A: 255}, color.RGBA{R: 255, G: 255, B: 255, A: 255}
+	large := writeTestImage(t, dir, "large.png", checkerImage(400, 4, black, white))
+	small := writeTestImage(t, dir, "small.png", checkerImage(120, 4, black, white))
+	other := writeTestImage(t, dir, "other.png", checkerImage(400, 8, white, black))
+
+	dedup, err := NewDeduplicator(HashPHash, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dedup.Close()
+
+	if _, _, duplicate, err := dedup.Check(large, "large"); err != nil || duplicate {
+		t.Fatalf("the first image was reported as a duplicate (err %v)", err)
+	}
+	duplicateOf, distance, duplicate, err := dedup.Check(small, "small")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !duplicate || duplicateOf != "large" || distance > DefaultHashThresholds[HashPHash] {
+		t.Errorf("resized copy: duplicate of %q at distance %d (%v), want large within %d",
+			duplicateOf, distance, duplicate, DefaultHashThresholds[HashPHash])
+	}
+	if duplicateOf, _, duplicate, _ := dedup.Check(other, "other"); duplicate {
+		t.Errorf("a different pattern was reported as a duplicate of %q", duplicateOf)
+	}
+}
+
+func TestBlendedEmbeddingConcatenatesWeightedModels(t *testing.T) {
+	// Two networks from the same file stand in for two models, reading different layers
+	primary, extra := testNets(t, 1), testNets(t, 1)
+	dense, pool := ModelRegistry["resnet50"].Layer("dense"), ModelRegistry["resnet50"].Layer("pool")
+	path := writeTestImage(t, t.TempDir(), "green.png", solidImage(64, 64, color.RGBA{40, 200, 40, 255}))
+
+	single := func(nets *NetPool, layer LayerSpec) []float32 {
+		embedding, err := GetImageEmbedding(&AppContext{Nets: nets, OutputLayer: layer.Name, SwapRB: true, EmbeddingDim: layer.EmbeddingDim}, path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return embedding
+	}
+	wantDense, wantPool := single(primary, dense), single(extra, pool)
+
+	appCtx := &AppContext{
+		Nets: primary, OutputLayer: dense.Name, SwapRB: true, EmbeddingDim: dense.EmbeddingDim, Weight: 2,
+		Blend: []BlendedModel{{Name: "pool", Nets: extra, OutputLayer: pool.Name, SwapRB: true, EmbeddingDim: pool.EmbeddingDim, Weight: 0.5}},
+	}
+	blended, err := GetImageEmbedding(appCtx, path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(blended) != appCtx.ImageEmbeddingDim() || len(blended) != dense.EmbeddingDim+pool.EmbeddingDim {
+		t.Fatalf("blended embedding has %d dimensions, want %d", len(blended), dense.EmbeddingDim+pool.EmbeddingDim)
+	}
+	for i, want := range wantDense {
+		if math.Abs(float64(blended[i]-2*want)) > 1e-4 {
+			t.Fatalf("dimension %d = %v, want the primary value %v scaled by 2", i, blended[i], want)
+		}
+	}
+	for i, want := range wantPool {
+		if got := blended[dense.EmbeddingDim+i]; math.Abs(float64(got-0.5*want)) > 1e-4 {
+			t.Fatalf("blended dimension %d = %v, want the second model's value %v scaled by 0.5", i, got, want)
+		}
+	}
+}
+
+func TestForwardWithRetryRecoversFromAnEmptyPass(t *testing.T) {
+	// forward returns a pass yielding each output in turn, repeating the last, and its call count
+	forward := func(outputs ...func() gocv.Mat) (func() gocv.Mat, *int) {
+		calls := 0
+		return func() gocv.Mat {
+			output := outputs[min(calls, len(outputs)-1)]()
+			calls++
+			return output
+		}, &calls
+	}
+	empty := gocv.NewMat
+	filled := func() gocv.Mat {
+		return gocv.NewMatWithSizeFromScalar(gocv.NewScalar(1, 0, 0, 0), 1, 4, gocv.MatTypeCV32F)
+	}
+
+	checkMatLeaks(t, func() {
+		pass, calls := forward(empty, filled)
+		output := forwardWithRetry(pass, 1, "retry.png")
+		defer output.Close()
+		if output.Empty() || *calls != 2 {
+			t.Errorf("got an empty output %v after %d passes, want the second pass's output", output.Empty(), *calls)
+		}
+	})
+
+	checkMatLeaks(t, func() {
+		pass, calls := forward(empty, filled)
+		output := forwardWithRetry(pass, 0, "noretry.png")
+		defer output.Close()
+		if !output.Empty() || *calls != 1 {
+			t.Errorf("without retries got an empty output %v after %d passes, want the single empty pass", output.Empty(), *calls)
+		}
+	})
+
+	checkMatLeaks(t, func() {
+		pass, calls := forward(empty)
+		output := forwardWithRetry(pass, 2, "empty.png")
+		defer output.Close()
+		if !output.Empty() || *calls != 3 {
+			t.Errorf("got an empty output %v after %d passes, want 3 empty passes", output.Empty(), *calls)
+		}
+	})
+}
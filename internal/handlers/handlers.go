@@ -1,16 +1,33 @@
 package handlers
 
 import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"image/png"
+	"imageclust/internal/ai"
+	"imageclust/internal/ai/prompt"
+	"imageclust/internal/clustering"
+	"imageclust/internal/config"
+	"imageclust/internal/embeddings"
+	"imageclust/internal/logger"
 	"imageclust/internal/models"
 	"io"
-	"log"
+	"mime/multipart"
 	"net/http"
+	"net/url"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"sync"
+	"time"
 
+	"github.com/aws/aws-sdk-go-v2/service/rekognition/types"
 	"github.com/gorilla/mux"
 	"imageclust/internal/utils"
 	"imageclust/internal/workflow"
@@ -22,27 +39,77 @@ type SpaHandler struct {
 	IndexPath  string
 }
 
-// Global variables to manage the current temp directory
+// runSnapshot holds what is served about the latest successful run. It is replaced as a whole once a run
+// succeeds, so one request never pairs the results of one run with the directory of another.
+type runSnapshot struct {
+	tempDir     string
+	results     []workflow.ImageResult
+	clusters    map[string]models.ClusterDetails
+	htmlOptions utils.HTMLOptions    // Report options of the run, including its collection summary
+	centroids   map[string][]float32 // Cluster centroids, so retitling can group clusters like the run did
+}
+
+// Global variables to manage the latest successful run
 var (
-	currentTempDir string
-	tempDirMutex   sync.RWMutex
+	latestRun    runSnapshot
+	resultsMutex sync.RWMutex
 )
 
+// maxUploadSize caps the total size of a clustering request body
+var maxUploadSize int64 = 1 << 30
+
+// maxArchiveUncompressedSize caps the total uncompressed size of the archives in one clustering request
+var maxArchiveUncompressedSize int64 = utils.MaxArchiveUncompressedSize
+
+// maxFormValueSize caps each non-file form field, which only ever holds a short option
+const maxFormValueSize = 1 << 20
+
+// SetMaxUploadSize sets the largest clustering request body accepted; non-positive values are ignored.
+func SetMaxUploadSize(size int64) {
+	if size > 0 {
+		maxUploadSize = size
+	}
+}
+
+// imageCacheMaxAge is how long browsers may reuse a served image without revalidating
+var imageCacheMaxAge = time.Hour
+
 func init() {
 }
 
-// SetTempDir sets the current temp directory in a thread-safe way.
-func SetTempDir(dir string) {
-	tempDirMutex.Lock()
-	defer tempDirMutex.Unlock()
-	currentTempDir = dir
+// SetImageCacheMaxAge sets how long browsers may cache served images; zero forces revalidation.
+func SetImageCacheMaxAge(maxAge time.Duration) {
+	if maxAge < 0 {
+		maxAge = 0
+	}
+	imageCacheMaxAge = maxAge
+}
+
+// setLatestRun replaces the snapshot of the latest successful run in a thread-safe way.
+func setLatestRun(run runSnapshot) {
+	resultsMutex.Lock()
+	defer resultsMutex.Unlock()
+	latestRun = run
 }
 
-// GetTempDir gets the current temp directory in a thread-safe way.
-func GetTempDir() string {
-	tempDirMutex.RLock()
-	defer tempDirMutex.RUnlock()
-	return currentTempDir
+// getLatestRun gets the snapshot of the latest successful run in a thread-safe way.
+// Its tempDir is empty until a run has succeeded.
+func getLatestRun() runSnapshot {
+	resultsMutex.RLock()
+	defer resultsMutex.RUnlock()
+	return latestRun
+}
+
+// replaceLatestClusters swaps the clusters of the latest run for retitled ones, keeping the rest of the
+// snapshot. It reports false, and changes nothing, when the latest run is no longer the one in tempDir.
+func replaceLatestClusters(tempDir string, clusters map[string]models.ClusterDetails) bool {
+	resultsMutex.Lock()
+	defer resultsMutex.Unlock()
+	if latestRun.tempDir != tempDir {
+		return false
+	}
+	latestRun.clusters = clusters
+	return true
 }
 
 // EnableCORS adds the necessary headers to allow cross-origin requests
@@ -50,7 +117,7 @@ func EnableCORS(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Access-Control-Allow-Origin", "*")
 		w.Header().Set("Access-Control-Allow-Methods", "POST, GET, OPTIONS, PUT, DELETE")
-		w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
+		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
 
 		if r.Method == "OPTIONS" {
 			w.WriteHeader(http.StatusOK)
@@ -68,7 +135,10 @@ func ClusterAndGenerateHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	err := r.ParseMultipartForm(32 << 20)
+	// Stream the body part by part so large batches are written straight to disk instead of buffered
+	body := &countingBody{ReadCloser: r.Body}
+	r.Body = http.MaxBytesReader(w, body, maxUploadSize)
+	reader, err := r.MultipartReader()
 	if err != nil {
 		respondWithError(w, http.StatusBadRequest, "Failed to parse form data")
 		return
@@ -80,56 +150,832 @@ func ClusterAndGenerateHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	SetTempDir(tempDir)
+	// Every return before the run succeeds leaves the session marked failed. Its files are never
+	// served, so they are removed rather than left for eviction.
+	session := sessionID(tempDir)
+	sessions.start(session, tempDir)
+	status, clusterCount := SessionFailed, 0
+	defer func() {
+		if status == SessionFailed {
+			if err := os.RemoveAll(tempDir); err != nil {
+				logger.Warnf("Failed to remove temp directory of failed session %s: %v", session, err)
+			}
+		}
+		sessions.update(session, func(info *SessionInfo) {
+			info.Status = status
+			info.Clusters = clusterCount
+		})
+	}()
+
+	imagesDir := filepath.Join(tempDir, "images")
+	if err := os.MkdirAll(imagesDir, 0755); err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to create image directory")
+		return
+	}
 
 	uploadedImages := []models.UploadedImage{}
-	files := r.MultipartForm.File["images"]
-	for _, fileHeader := range files {
-		file, err := fileHeader.Open()
+	seenFilenames := make(map[string]bool)
+	addUploadAs := func(originalFilename, storedName string, data []byte) error {
+		// Convert HEIC images to JPEG up front so the rest of the pipeline only sees formats OpenCV can decode
+		if utils.IsHEIC(data) {
+			jpegData, err := utils.ConvertHEICToJPEG(data)
+			if err != nil {
+				return fmt.Errorf("failed to process HEIC image %s: %v", originalFilename, err)
+			}
+			data = jpegData
+			storedName = strings.TrimSuffix(storedName, filepath.Ext(storedName)) + ".jpg"
+		}
+
+		// Store images under a content hash so distinct uploads never collide and duplicates are dropped
+		storedFilename := utils.ContentHashFilename(data, storedName)
+		if seenFilenames[storedFilename] {
+			logger.Warnf("Skipping duplicate upload %s", originalFilename)
+			return nil
+		}
+		seenFilenames[storedFilename] = true
+
+		uploadedImages = append(uploadedImages, models.UploadedImage{
+			Filename:         storedFilename,
+			OriginalFilename: originalFilename,
+			Data:             data,
+		})
+		return nil
+	}
+
+	// Archives share one allowance for their uncompressed contents, however many the request carries
+	archiveBudget := utils.NewByteBudget(maxArchiveUncompressedSize)
+	formValues := url.Values{}
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			break
+		}
 		if err != nil {
-			continue
+			respondWithUploadError(w, err)
+			return
 		}
-		defer file.Close()
 
-		data, err := io.ReadAll(file)
+		switch part.FormName() {
+		case "images":
+			err = storeImagePart(part, imagesDir, seenFilenames, &uploadedImages)
+		case "archive":
+			// Treat every image inside an uploaded .zip or .tar.gz archive as an individual upload
+			err = extractArchivePart(part, tempDir, imagesDir, archiveBudget, seenFilenames, &uploadedImages)
+			var invalid *utils.ArchiveError
+			if errors.As(err, &invalid) {
+				part.Close()
+				respondWithError(w, http.StatusBadRequest, fmt.Sprintf("Invalid archive %s: %v", part.FileName(), invalid))
+				return
+			}
+		default:
+			var value []byte
+			value, err = io.ReadAll(io.LimitReader(part, maxFormValueSize))
+			formValues.Add(part.FormName(), string(value))
+		}
+		part.Close()
 		if err != nil {
-			continue
+			respondWithUploadError(w, err)
+			return
 		}
+	}
 
-		sanitizedFilename := utils.SanitizeFilename(fileHeader.Filename)
-		uploadedImages = append(uploadedImages, models.UploadedImage{
-			Filename: sanitizedFilename,
-			Data:     data,
+	// Query parameters follow the body values, matching the precedence of ParseForm
+	for key, values := range r.URL.Query() {
+		formValues[key] = append(formValues[key], values...)
+	}
+	r.Form = formValues
+	cfg := config.ExtractClusterConfigurations(r)
+
+	// Images listed in image_urls join the uploaded files. Failed downloads fail the request
+	// unless image_url_failure=skip, in which case they are reported alongside other rejections.
+	// The downloads share what the body left of the upload limit.
+	imageURLs := parseImageURLs(formValues["image_urls"])
+	if len(imageURLs) > maxImageURLs {
+		respondWithError(w, http.StatusBadRequest, fmt.Sprintf("Too many image_urls: %d, at most %d are allowed", len(imageURLs), maxImageURLs))
+		return
+	}
+	budget := utils.NewByteBudget(maxUploadSize - body.n)
+	rejectedImages := []RejectedUpload{}
+	var urlFailures []RejectedUpload
+	urlHeader := http.Header{}
+	if cfg.ImageURLToken != "" {
+		urlHeader.Set("Authorization", "Bearer "+cfg.ImageURLToken)
+	}
+	for _, download := range downloadImageURLs(r.Context(), imageURLs, budget, urlHeader, cfg.ImageTimeout) {
+		if download.err == nil {
+			before := len(uploadedImages)
+			download.err = addUploadAs(download.url, download.name, download.data)
+			if len(uploadedImages) > before {
+				uploadedImages[before].SourceURL = download.url
+			}
+		}
+		if download.err != nil {
+			logger.Warnf("Failed to fetch image URL %s: %v", download.url, download.err)
+			urlFailures = append(urlFailures, RejectedUpload{Filename: download.url, Source: "url", Error: download.err.Error()})
+		}
+	}
+	if r.Context().Err() != nil {
+		logger.Warnf("Clustering cancelled while downloading image URLs")
+		return
+	}
+	if len(urlFailures) > 0 && cfg.ImageURLFailure != "skip" {
+		respondWithJSON(w, http.StatusUnprocessableEntity, map[string]interface{}{
+			"success":        false,
+			"error":          fmt.Sprintf("Failed to fetch %d image URL(s)", len(urlFailures)),
+			"rejectedImages": urlFailures,
 		})
+		return
+	}
+	rejectedImages = append(rejectedImages, urlFailures...)
+
+	// product_map assigns uploads to products by their original filename, so views of one product cluster together
+	if productMap := formValues.Get("product_map"); productMap != "" {
+		var productIDs map[string]string
+		if err := json.Unmarshal([]byte(productMap), &productIDs); err != nil {
+			respondWithError(w, http.StatusBadRequest, fmt.Sprintf("Invalid product_map: %v", err))
+			return
+		}
+		for i := range uploadedImages {
+			uploadedImages[i].ProductID = productIDs[uploadedImages[i].OriginalFilename]
+		}
 	}
 
+	// Form fields may follow the files, so sizes are checked once the whole body has been read
+	uploadedImages, undersized := rejectUndersizedImages(uploadedImages, imagesDir, cfg.MinImageWidth, cfg.MinImageHeight)
+	rejectedImages = append(rejectedImages, undersized...)
+
 	if len(uploadedImages) == 0 {
-		respondWithError(w, http.StatusBadRequest, "No valid images uploaded")
+		respondWithJSON(w, http.StatusBadRequest, map[string]interface{}{
+			"success":        false,
+			"error":          "No valid images uploaded",
+			"rejectedImages": rejectedImages,
+		})
 		return
 	}
+	sessions.update(session, func(info *SessionInfo) {
+		info.ImageCount = len(uploadedImages)
+	})
+	ignoredFields := config.IgnoredFields(r)
+	if len(ignoredFields) > 0 {
+		logger.Warnf("Ignoring fields that only apply to the ProductSetter flow: %s", strings.Join(ignoredFields, ", "))
+	}
 
-	imagecluster, err := workflow.NewImageCluster(3, 6, tempDir)
+	imagecluster, err := workflow.NewImageCluster(cfg, tempDir)
 	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Failed to initialize application")
+		logger.Errorf("Failed to initialize application: %v", err)
+		respondWithError(w, http.StatusInternalServerError, fmt.Sprintf("Failed to initialize application: %v", err))
 		return
 	}
+	defer imagecluster.Close()
 
-	_, _, err = imagecluster.Run(uploadedImages)
+	clusterDetails, _, err := imagecluster.Run(r.Context(), uploadedImages)
 	if err != nil {
+		if r.Context().Err() != nil {
+			logger.Warnf("Clustering cancelled: %v", err)
+			return
+		}
+		if errors.Is(err, workflow.ErrNoValidClusters) {
+			respondWithError(w, http.StatusUnprocessableEntity, err.Error())
+			return
+		}
 		respondWithError(w, http.StatusInternalServerError, err.Error())
 		return
 	}
+	setLatestRun(runSnapshot{
+		tempDir:     tempDir,
+		results:     imagecluster.Results,
+		clusters:    clusterDetails,
+		centroids:   imagecluster.Centroids,
+		htmlOptions: imagecluster.HTMLOptions,
+	})
+	status, clusterCount = SessionDone, len(clusterDetails)
+
+	// JSON objects are unordered, so the cluster keys are also listed in the configured order
+	clusterOrder := []string{}
+	for _, entry := range utils.SortClusters(clusterDetails, cfg.SortOrder) {
+		clusterOrder = append(clusterOrder, entry.ID)
+	}
+
+	response := map[string]interface{}{
+		"status":            "success",
+		"filePath":          filepath.Join(tempDir, "clusters.html"),
+		"flaggedImages":     imagecluster.Flagged,
+		"duplicateImages":   imagecluster.Duplicates,
+		"lowLabelImages":    imagecluster.LowLabels,
+		"failedImages":      imagecluster.Failed,
+		"outliers":          imagecluster.Outliers,
+		"noValidClusters":   imagecluster.NoValidClusters,
+		"collectionSummary": imagecluster.Summary,
+		"rejectedImages":    rejectedImages,
+		"clusterOrder":      clusterOrder,
+		"timings":           imagecluster.Timings,
+		"ignoredFields":     ignoredFields,
+	}
+
+	if r.URL.Query().Get("include_centroids") == "true" {
+		response["centroids"] = imagecluster.Centroids
+	}
+
+	// Full label objects are keyed by stored filename, like the images in the clusters
+	if cfg.LabelDetails {
+		labelDetails := make(map[string][]types.Label, len(imagecluster.Results))
+		for _, result := range imagecluster.Results {
+			labelDetails[result.Filename] = result.LabelDetails
+		}
+		response["labelDetails"] = labelDetails
+	}
+
+	// Inlining the images bloats the payload, so it is only done on request
+	if r.URL.Query().Get("inline_images") == "true" {
+		inlined, err := utils.InlineClusterImages(clusterDetails, filepath.Join(tempDir, "images"))
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Failed to inline images")
+			return
+		}
+		response["clusters"] = inlined
+	}
 
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(map[string]interface{}{
-		"status":   "success",
-		"filePath": filepath.Join(tempDir, "clusters.html"),
+	json.NewEncoder(w).Encode(response)
+}
+
+// storeImagePart streams an uploaded image into the images directory under its content hash
+func storeImagePart(part *multipart.Part, imagesDir string, seenFilenames map[string]bool, uploadedImages *[]models.UploadedImage) error {
+	return storeImage(part, part.FileName(), imagesDir, seenFilenames, uploadedImages)
+}
+
+// storeImage streams an image into the images directory under its content hash, so it is never held
+// in memory whole. HEIC images are converted to JPEG on disk and stored under the hash of the JPEG.
+func storeImage(r io.Reader, originalFilename, imagesDir string, seenFilenames map[string]bool, uploadedImages *[]models.UploadedImage) error {
+	buffered := bufio.NewReader(r)
+	header, _ := buffered.Peek(12)
+	isHEIC := utils.IsHEIC(header)
+
+	file, err := os.CreateTemp(imagesDir, "upload_*")
+	if err != nil {
+		return fmt.Errorf("failed to create upload file: %v", err)
+	}
+	hash := sha256.New()
+	_, err = io.Copy(io.MultiWriter(file, hash), buffered)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(file.Name())
+		return err
+	}
+
+	uploadPath, storedName := file.Name(), originalFilename
+	if isHEIC {
+		jpegPath := uploadPath + ".jpg"
+		err := utils.ConvertHEICFile(uploadPath, jpegPath)
+		os.Remove(uploadPath)
+		if err == nil {
+			hash.Reset()
+			err = hashFile(jpegPath, hash)
+		}
+		if err != nil {
+			os.Remove(jpegPath)
+			return fmt.Errorf("failed to process HEIC image %s: %v", originalFilename, err)
+		}
+		uploadPath = jpegPath
+		storedName = strings.TrimSuffix(storedName, filepath.Ext(storedName)) + ".jpg"
+	}
+
+	storedFilename := utils.HashFilename(hash.Sum(nil), storedName)
+	if seenFilenames[storedFilename] {
+		logger.Warnf("Skipping duplicate upload %s", originalFilename)
+		return os.Remove(uploadPath)
+	}
+	seenFilenames[storedFilename] = true
+
+	if err := os.Rename(uploadPath, filepath.Join(imagesDir, storedFilename)); err != nil {
+		os.Remove(uploadPath)
+		return fmt.Errorf("failed to store upload %s: %v", originalFilename, err)
+	}
+	*uploadedImages = append(*uploadedImages, models.UploadedImage{
+		Filename:         storedFilename,
+		OriginalFilename: originalFilename,
+		Stored:           true,
+	})
+	return nil
+}
+
+// hashFile writes the contents of the file at path to hash
+func hashFile(path string, hash io.Writer) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	_, err = io.Copy(hash, file)
+	return err
+}
+
+// extractArchivePart spools an uploaded archive to a file in dir, rather than memory, and streams each of
+// its images into imagesDir as storeImage does. Their uncompressed size is charged to budget. The archive
+// file is removed once extracted. Errors reading the upload are returned as is, and problems with the
+// archive as an *utils.ArchiveError.
+func extractArchivePart(part *multipart.Part, dir, imagesDir string, budget *utils.ByteBudget, seenFilenames map[string]bool, uploadedImages *[]models.UploadedImage) error {
+	file, err := os.CreateTemp(dir, "archive_*")
+	if err != nil {
+		return fmt.Errorf("failed to create archive file: %v", err)
+	}
+	defer os.Remove(file.Name())
+	defer file.Close()
+
+	size, err := io.Copy(file, part)
+	if err != nil {
+		return err
+	}
+	return utils.WalkArchiveImages(file, size, budget, func(name string, r io.Reader) error {
+		return storeImage(r, name, imagesDir, seenFilenames, uploadedImages)
+	})
+}
+
+// RejectedUpload is an uploaded image that was left out before processing
+type RejectedUpload struct {
+	Filename string `json:"filename"` // Name the image was uploaded with, or its URL
+	Source   string `json:"source"`   // "upload" for files in the request, "url" for images from image_urls
+	Error    string `json:"error"`
+}
+
+// maxImageURLDownloads caps the image_urls downloads in flight for one request
+const maxImageURLDownloads = 4
+
+// maxImageURLs caps how many image_urls one request may list
+const maxImageURLs = 500
+
+// countingBody counts the bytes read from a request body, so downloads can share what is left of the upload limit
+type countingBody struct {
+	io.ReadCloser
+	n int64
+}
+
+func (c *countingBody) Read(p []byte) (int, error) {
+	n, err := c.ReadCloser.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// imageURLDownload is the outcome of fetching one entry of image_urls
+type imageURLDownload struct {
+	url  string
+	name string // Filename taken from the URL, used for the stored file's extension
+	data []byte
+	err  error
+}
+
+// parseImageURLs splits image_urls values on whitespace, so the field may be repeated or hold one URL per line
+func parseImageURLs(values []string) []string {
+	var urls []string
+	for _, value := range values {
+		urls = append(urls, strings.Fields(value)...)
+	}
+	return urls
+}
+
+// downloadImageURLs fetches the URLs a few at a time, returning the outcomes in input order.
+// Together the images may not exceed budget. header is added to every request.
+func downloadImageURLs(ctx context.Context, urls []string, budget *utils.ByteBudget, header http.Header, timeout time.Duration) []imageURLDownload {
+	downloads := make([]imageURLDownload, len(urls))
+	slots := make(chan struct{}, maxImageURLDownloads)
+	var wg sync.WaitGroup
+	for i, imageURL := range urls {
+		wg.Add(1)
+		go func(i int, imageURL string) {
+			defer wg.Done()
+			slots <- struct{}{}
+			defer func() { <-slots }()
+			fetchCtx := ctx
+			if timeout > 0 {
+				var cancel context.CancelFunc
+				fetchCtx, cancel = context.WithTimeout(ctx, timeout)
+				defer cancel()
+			}
+			data, name, err := utils.FetchImage(fetchCtx, imageURL, budget, header)
+			if err != nil && ctx.Err() == nil && errors.Is(fetchCtx.Err(), context.DeadlineExceeded) {
+				err = fmt.Errorf("download of %s timed out after %s", imageURL, timeout)
+			}
+			downloads[i] = imageURLDownload{url: imageURL, name: name, data: data, err: err}
+		}(i, imageURL)
+	}
+	wg.Wait()
+	return downloads
+}
+
+// rejectUndersizedImages drops images smaller than the minimum width or height, deleting any already stored.
+// Dimensions are read from the image header; formats the standard library cannot read are kept.
+func rejectUndersizedImages(images []models.UploadedImage, imagesDir string, minWidth, minHeight int) ([]models.UploadedImage, []RejectedUpload) {
+	rejected := []RejectedUpload{}
+	if minWidth <= 0 && minHeight <= 0 {
+		return images, rejected
+	}
+
+	kept := images[:0]
+	for _, img := range images {
+		imagePath := filepath.Join(imagesDir, img.Filename)
+		var width, height int
+		var ok bool
+		if img.Stored {
+			if file, err := os.Open(imagePath); err == nil {
+				width, height, ok = utils.ImageDimensions(file)
+				file.Close()
+			}
+		} else {
+			width, height, ok = utils.ImageDimensions(bytes.NewReader(img.Data))
+		}
+
+		if ok && (width < minWidth || height < minHeight) {
+			logger.Warnf("Rejecting %s: %dx%d is below the minimum of %dx%d", img.OriginalFilename, width, height, minWidth, minHeight)
+			source := "upload"
+			if img.SourceURL != "" {
+				source = "url"
+			}
+			rejected = append(rejected, RejectedUpload{
+				Filename: img.OriginalFilename,
+				Source:   source,
+				Error:    fmt.Sprintf("image is %dx%d pixels, below the minimum of %dx%d", width, height, minWidth, minHeight),
+			})
+			if img.Stored {
+				os.Remove(imagePath)
+			}
+			continue
+		}
+		kept = append(kept, img)
+	}
+	return kept, rejected
+}
+
+// respondWithUploadError reports a failure while reading the upload, using 413 when the size limit was hit
+func respondWithUploadError(w http.ResponseWriter, err error) {
+	var maxBytesErr *http.MaxBytesError
+	if errors.As(err, &maxBytesErr) {
+		respondWithError(w, http.StatusRequestEntityTooLarge, fmt.Sprintf("Upload exceeds the limit of %d bytes", maxBytesErr.Limit))
+		return
+	}
+	respondWithError(w, http.StatusBadRequest, err.Error())
+}
+
+// RenderRequest is the body accepted by RenderHandler
+type RenderRequest struct {
+	Clusters     map[string]models.ClusterDetails `json:"clusters"`
+	ImageBaseURL string                           `json:"imageBaseUrl"` // Prefix for image references (defaults to /api/image/)
+}
+
+// RenderHandler renders an externally computed clustering as the HTML comparison report,
+// without running embeddings, clustering or AI generation
+func RenderHandler(w http.ResponseWriter, r *http.Request) {
+	var req RenderRequest
+	err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 10<<20)).Decode(&req)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid JSON body")
+		return
+	}
+
+	if len(req.Clusters) == 0 {
+		respondWithError(w, http.StatusBadRequest, "No clusters provided")
+		return
+	}
+
+	// Externally computed clusterings may repeat an image, which would show it under several titles
+	if duplicates := utils.DuplicateImages(req.Clusters); len(duplicates) > 0 {
+		respondWithError(w, http.StatusBadRequest, fmt.Sprintf("Images referenced more than once: %s", strings.Join(duplicates, ", ")))
+		return
+	}
+
+	imageBaseURL := req.ImageBaseURL
+	if imageBaseURL == "" {
+		imageBaseURL = "/api/image/"
+	}
+
+	html, err := utils.RenderHTML(req.Clusters, imageBaseURL, utils.HTMLOptions{})
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Write(html)
+}
+
+// ExportNDJSONHandler streams the per-image results of the latest run as newline-delimited JSON.
+// Embeddings are only included when include_embedding=true.
+func ExportNDJSONHandler(w http.ResponseWriter, r *http.Request) {
+	results := getLatestRun().results
+	if results == nil {
+		respondWithError(w, http.StatusNotFound, "No clustering results available")
+		return
+	}
+
+	includeEmbedding := r.URL.Query().Get("include_embedding") == "true"
+	flusher, _ := w.(http.Flusher)
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	encoder := json.NewEncoder(w)
+	for _, result := range results {
+		if !includeEmbedding {
+			result.Embedding = nil
+		}
+		// Encode writes a trailing newline, so each result is one line
+		if err := encoder.Encode(result); err != nil {
+			logger.Warnf("Error streaming NDJSON export: %v", err)
+			return
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+	}
+}
+
+// ExportParquetHandler downloads the per-image results of the latest run as a Parquet file for columnar analytics.
+// Each row holds an image's metadata and its embedding as a list of floats.
+func ExportParquetHandler(w http.ResponseWriter, r *http.Request) {
+	results := getLatestRun().results
+	if results == nil {
+		respondWithError(w, http.StatusNotFound, "No clustering results available")
+		return
+	}
+
+	rows := make([]utils.ParquetRow, len(results))
+	for i, result := range results {
+		rows[i] = utils.ParquetRow{
+			Filename:  result.Filename,
+			ID:        result.ID,
+			ProductID: result.ProductID,
+			ClusterID: result.ClusterID,
+			Labels:    strings.Join(result.Labels, ", "),
+			Embedding: result.Embedding,
+		}
+	}
+
+	data, err := utils.EncodeParquet(rows)
+	if err != nil {
+		logger.Warnf("Error encoding Parquet export: %v", err)
+		respondWithError(w, http.StatusInternalServerError, "Failed to generate Parquet export")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/vnd.apache.parquet")
+	w.Header().Set("Content-Disposition", `attachment; filename="clusters.parquet"`)
+	w.Write(data)
+}
+
+// ExportHTMLBundleHandler downloads the latest report as a single HTML file with the images inlined,
+// so it remains viewable after the session's images are gone.
+func ExportHTMLBundleHandler(w http.ResponseWriter, r *http.Request) {
+	run := getLatestRun()
+	if run.clusters == nil {
+		respondWithError(w, http.StatusNotFound, "No clustering results available")
+		return
+	}
+
+	bundle, err := utils.GenerateHTMLBundle(run.clusters, filepath.Join(run.tempDir, "images"), run.htmlOptions)
+	if err != nil {
+		logger.Warnf("Error generating HTML bundle: %v", err)
+		respondWithError(w, http.StatusInternalServerError, "Failed to generate HTML bundle")
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Content-Disposition", `attachment; filename="clusters.html"`)
+	w.Write(bundle)
+}
+
+// ExportPDFHandler returns the latest clustering results as a PDF report with embedded thumbnails
+func ExportPDFHandler(w http.ResponseWriter, r *http.Request) {
+	run := getLatestRun()
+	if run.clusters == nil {
+		respondWithError(w, http.StatusNotFound, "No clustering results available")
+		return
+	}
+
+	report, err := utils.GeneratePDFReport(run.clusters, filepath.Join(run.tempDir, "images"), run.htmlOptions)
+	if err != nil {
+		logger.Warnf("Error generating PDF report: %v", err)
+		respondWithError(w, http.StatusInternalServerError, "Failed to generate PDF report")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/pdf")
+	w.Header().Set("Content-Disposition", `attachment; filename="clusters.pdf"`)
+	w.Write(report)
+}
+
+// RetitleHandler regenerates the AI titles of the latest run without reclustering. It accepts the title
+// options of /api/cluster plus services, a comma-separated list of service names to rerun, and prompt,
+// a template used for every service instead of the configured ones. session, when given, must name the
+// latest run. The retitled clusters replace the stored ones, so exports and the report pick them up.
+func RetitleHandler(w http.ResponseWriter, r *http.Request) {
+	run := getLatestRun()
+	if run.clusters == nil {
+		respondWithError(w, http.StatusNotFound, "No clustering results available")
+		return
+	}
+	session := sessionID(run.tempDir)
+	if requested := r.FormValue("session"); requested != "" && requested != session {
+		respondWithError(w, http.StatusNotFound, fmt.Sprintf("Results of session %s are no longer available; only the latest session %s can be retitled", requested, session))
+		return
+	}
+	sessions.touch(session)
+
+	var names []string
+	for _, name := range strings.Split(r.FormValue("services"), ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			names = append(names, name)
+		}
+	}
+	services, err := ai.ServicesByName(names)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	ctx := r.Context()
+	if template := r.FormValue("prompt"); template != "" {
+		if err := prompt.Validate(template); err != nil {
+			respondWithError(w, http.StatusBadRequest, fmt.Sprintf("Invalid prompt: %v", err))
+			return
+		}
+		ctx = prompt.WithTemplate(ctx, template)
+	}
+
+	cfg := config.ExtractClusterConfigurations(r)
+	retitled := workflow.RetitleClusters(ctx, cfg, run.clusters, run.centroids, services)
+	if ctx.Err() != nil {
+		logger.Warnf("Retitling cancelled: %v", ctx.Err())
+		return
+	}
+
+	// A run that finished meanwhile owns the stored results, so the retitled clusters are only returned
+	if replaceLatestClusters(run.tempDir, retitled) {
+		if _, err := utils.GenerateHTMLOutput(retitled, run.tempDir, run.htmlOptions); err != nil {
+			logger.Errorf("Failed to regenerate HTML output after retitling: %v", err)
+		}
+	}
+
+	respondWithJSON(w, http.StatusOK, map[string]interface{}{
+		"success":  true,
+		"session":  session,
+		"clusters": retitled,
 	})
 }
 
+// ExplainHandler reports why two images of the latest run were or were not clustered together:
+// their distance, shared labels and the embedding dimensions contributing most to the distance.
+func ExplainHandler(w http.ResponseWriter, r *http.Request) {
+	results := getLatestRun().results
+	if results == nil {
+		respondWithError(w, http.StatusNotFound, "No clustering results available")
+		return
+	}
+
+	query := r.URL.Query()
+	idA, idB := query.Get("a"), query.Get("b")
+	if idA == "" || idB == "" {
+		respondWithError(w, http.StatusBadRequest, "Both a and b product reference IDs are required")
+		return
+	}
+
+	var resultA, resultB *workflow.ImageResult
+	for i := range results {
+		switch results[i].ID {
+		case idA:
+			resultA = &results[i]
+		case idB:
+			resultB = &results[i]
+		}
+	}
+	if resultA == nil || resultB == nil {
+		respondWithError(w, http.StatusNotFound, "Unknown product reference ID")
+		return
+	}
+
+	top, err := strconv.Atoi(query.Get("top"))
+	if err != nil || top <= 0 {
+		top = 10
+	}
+
+	distance, contributions, err := clustering.ExplainDistance(resultA.Embedding, resultB.Embedding, top)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	labelsA := make(map[string]bool, len(resultA.Labels))
+	for _, label := range resultA.Labels {
+		labelsA[label] = true
+	}
+	sharedLabels := []string{}
+	for _, label := range resultB.Labels {
+		if labelsA[label] {
+			sharedLabels = append(sharedLabels, label)
+		}
+	}
+
+	respondWithJSON(w, http.StatusOK, map[string]interface{}{
+		"a":             resultA.ID,
+		"b":             resultB.ID,
+		"clusterA":      resultA.ClusterID,
+		"clusterB":      resultB.ClusterID,
+		"sameCluster":   resultA.ClusterID != "" && resultA.ClusterID == resultB.ClusterID,
+		"distance":      distance,
+		"sharedLabels":  sharedLabels,
+		"topDimensions": contributions,
+	})
+}
+
+// GraphHandler returns the k-nearest-neighbor graph over the embeddings of the latest run as nodes and edges.
+// The graph is independent of the cluster assignment, which is included on each node for coloring.
+func GraphHandler(w http.ResponseWriter, r *http.Request) {
+	results := getLatestRun().results
+	if results == nil {
+		respondWithError(w, http.StatusNotFound, "No clustering results available")
+		return
+	}
+
+	query := r.URL.Query()
+	k, err := strconv.Atoi(query.Get("k"))
+	if err != nil || k <= 0 {
+		k = 5
+	}
+	metric := clustering.EuclideanDistance
+	if value := query.Get("metric"); value != "" {
+		metric = clustering.DistanceMetric(value)
+	}
+
+	// Images without an embedding, such as those of a labels_only run, cannot be placed in the graph
+	nodes := []map[string]interface{}{}
+	var vectors [][]float32
+	for _, result := range results {
+		if len(result.Embedding) == 0 {
+			continue
+		}
+		nodes = append(nodes, map[string]interface{}{
+			"id":        result.ID,
+			"clusterId": result.ClusterID,
+		})
+		vectors = append(vectors, result.Embedding)
+	}
+
+	edges, err := clustering.BuildKNNGraph(vectors, k, metric)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, map[string]interface{}{
+		"k":      k,
+		"metric": metric,
+		"nodes":  nodes,
+		"edges":  edges,
+	})
+}
+
+// LabelMatrixHandler returns how many images carrying each label fell into each cluster of the latest run.
+// top keeps only the most frequent labels, and format=html renders the counts as a heatmap table instead of JSON.
+func LabelMatrixHandler(w http.ResponseWriter, r *http.Request) {
+	run := getLatestRun()
+	results := run.results
+	if results == nil {
+		respondWithError(w, http.StatusNotFound, "No clustering results available")
+		return
+	}
+
+	query := r.URL.Query()
+	top, err := strconv.Atoi(query.Get("top"))
+	if err != nil || top < 0 {
+		top = 0
+	}
+	matrix := workflow.BuildLabelClusterMatrix(results, top)
+
+	switch query.Get("format") {
+	case "", "json":
+		respondWithJSON(w, http.StatusOK, map[string]interface{}{
+			"labels":   matrix.Labels,
+			"clusters": matrix.Clusters,
+			"counts":   matrix.Counts,
+		})
+	case "html":
+		titles := make(map[string]string)
+		for key, details := range run.clusters {
+			titles[key] = details.Title
+		}
+		html, err := utils.RenderLabelClusterMatrix(matrix, titles)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Write(html)
+	default:
+		respondWithError(w, http.StatusBadRequest, "format must be json or html")
+	}
+}
+
 // ViewHandler serves the generated HTML file at /view
 func ViewHandler(w http.ResponseWriter, r *http.Request) {
-	tempDir := GetTempDir()
+	tempDir := getLatestRun().tempDir
 	if tempDir == "" {
 		http.Error(w, "No HTML file available", http.StatusNotFound)
 		return
@@ -143,7 +989,7 @@ func ImageHandler(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	imageName := utils.SanitizeFilename(vars["imageName"])
 
-	tempDir := GetTempDir()
+	tempDir := getLatestRun().tempDir
 	if tempDir == "" {
 		http.Error(w, "No images available", http.StatusNotFound)
 		return
@@ -153,26 +999,88 @@ func ImageHandler(w http.ResponseWriter, r *http.Request) {
 	imagePath := filepath.Join(imagesDir, imageName)
 
 	if _, err := os.Stat(imagePath); os.IsNotExist(err) {
-		log.Printf("Image not found: %s", imagePath)
+		logger.Warnf("Image not found: %s", imagePath)
 		http.Error(w, "Image not found", http.StatusNotFound)
 		return
 	}
 
-	ext := strings.ToLower(filepath.Ext(imageName))
-	contentType := "image/jpeg"
-	switch ext {
-	case ".png":
-		contentType = "image/png"
-	case ".gif":
-		contentType = "image/gif"
-	case ".webp":
-		contentType = "image/webp"
+	w.Header().Set("Content-Type", utils.ImageContentType(imageName))
+
+	// Uploads are stored under their content hash, so the name is a strong validator.
+	// ServeFile answers a matching If-None-Match with 304 Not Modified.
+	w.Header().Set("ETag", `"`+strings.TrimSuffix(imageName, filepath.Ext(imageName))+`"`)
+	if imageCacheMaxAge > 0 {
+		w.Header().Set("Cache-Control", fmt.Sprintf("private, max-age=%d", int(imageCacheMaxAge.Seconds())))
+	} else {
+		w.Header().Set("Cache-Control", "no-cache")
 	}
-	w.Header().Set("Content-Type", contentType)
 
 	http.ServeFile(w, r, imagePath)
 }
 
+// PreprocessPreviewHandler returns the network input for a single uploaded image as a PNG,
+// so preprocessing parameters can be checked visually before running a batch.
+func PreprocessPreviewHandler(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseMultipartForm(32 << 20); err != nil {
+		respondWithError(w, http.StatusBadRequest, "Failed to parse form data")
+		return
+	}
+
+	file, fileHeader, err := r.FormFile("image")
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "An image is required")
+		return
+	}
+	defer file.Close()
+
+	data, err := io.ReadAll(file)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Failed to read image")
+		return
+	}
+
+	tempDir, err := os.MkdirTemp("", "preview_*")
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to create temporary directory")
+		return
+	}
+	defer os.RemoveAll(tempDir)
+
+	imagePath := filepath.Join(tempDir, "input"+utils.SanitizeFilename(filepath.Ext(fileHeader.Filename)))
+	if err := os.WriteFile(imagePath, data, 0644); err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to save image")
+		return
+	}
+
+	// Preview with the same settings a clustering request with these fields would use
+	cfg := config.ExtractClusterConfigurations(r)
+	swapRB := embeddings.ModelRegistry["resnet50"].SwapRB
+	if value, err := strconv.ParseBool(r.FormValue("swap_rb")); err == nil {
+		swapRB = value
+	}
+
+	background, padding, err := workflow.PreprocessColors(cfg)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if err := embeddings.ValidatePreprocessPipeline(cfg.PreprocessPipeline); err != nil {
+		respondWithError(w, http.StatusBadRequest, fmt.Sprintf("invalid preprocess_pipeline: %v", err))
+		return
+	}
+
+	preview, err := embeddings.RenderPreprocessedImage(imagePath, embeddings.InterpolationFromName(cfg.Interpolation), swapRB, background, padding, cfg.PreprocessPipeline)
+	if err != nil {
+		respondWithError(w, http.StatusUnprocessableEntity, fmt.Sprintf("Failed to preprocess image: %v", err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "image/png")
+	if err := png.Encode(w, preview); err != nil {
+		logger.Errorf("Failed to encode preview: %v", err)
+	}
+}
+
 // respondWithError sends an error response in JSON format.
 func respondWithError(w http.ResponseWriter, code int, message string) {
 	respondWithJSON(w, code, map[string]interface{}{
@@ -185,7 +1093,7 @@ func respondWithError(w http.ResponseWriter, code int, message string) {
 func respondWithJSON(w http.ResponseWriter, code int, payload map[string]interface{}) {
 	response, err := json.Marshal(payload)
 	if err != nil {
-		log.Printf("Error marshaling response JSON: %v", err)
+		logger.Warnf("Error marshaling response JSON: %v", err)
 		http.Error(w, "Failed to marshal response", http.StatusInternalServerError)
 		return
 	}
@@ -0,0 +1,563 @@
+package handlers
+
+import (
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/png"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"imageclust/internal/models"
+	"imageclust/internal/utils"
+	"imageclust/internal/workflow"
+)
+
+func TestExportNDJSONHandlerWritesOneObjectPerLine(t *testing.T) {
+	setLatestRun(runSnapshot{
+		tempDir: t.TempDir(),
+		results: []workflow.ImageResult{
+			{Filename: "a.jpg", ID: "a", ClusterID: "Cluster-1", Labels: []string{"Shoe"}, Embedding: []float32{1, 2}},
+			{Filename: "b.jpg", ID: "b", ClusterID: "Cluster-2", Labels: []string{"Hat", "Wool"}, Embedding: []float32{3, 4}},
+		},
+	})
+	t.Cleanup(func() { setLatestRun(runSnapshot{}) })
+
+	for _, includeEmbedding := range []bool{false, true} {
+		target := "/api/cluster/export.ndjson"
+		if includeEmbedding {
+			target += "?include_embedding=true"
+		}
+		rec := httptest.NewRecorder()
+		ExportNDJSONHandler(rec, httptest.NewRequest(http.MethodGet, target, nil))
+
+		if rec.Code != http.StatusOK {
+			t.Fatalf("status = %d, want %d", rec.Code, http.StatusOK)
+		}
+		var lines []map[string]interface{}
+		scanner := bufio.NewScanner(strings.NewReader(rec.Body.String()))
+		for scanner.Scan() {
+			var line map[string]interface{}
+			if err := json.Unmarshal(scanner.Bytes(), &line); err != nil {
+				t.Fatalf("line %q does not parse on its own: %v", scanner.Text(), err)
+			}
+			lines = append(lines, line)
+		}
+		if len(lines) != 2 {
+			t.Fatalf("got %d lines, want 2", len(lines))
+		}
+		_, hasEmbedding := lines[0]["embedding"]
+		if hasEmbedding != includeEmbedding {
+			t.Errorf("include_embedding=%v: embedding present = %v", includeEmbedding, hasEmbedding)
+		}
+	}
+}
+
+func TestExportNDJSONHandlerWithoutRun(t *testing.T) {
+	setLatestRun(runSnapshot{})
+	rec := httptest.NewRecorder()
+	ExportNDJSONHandler(rec, httptest.NewRequest(http.MethodGet, "/api/cluster/export.ndjson", nil))
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("status = %d, want %d", rec.Code, http.StatusNotFound)
+	}
+}
+
+// writeTestPNG writes a small PNG into dir and returns its name
+func writeTestPNG(t *testing.T, dir, name string) string {
+	t.Helper()
+	f, err := os.Create(filepath.Join(dir, name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if err := png.Encode(f, image.NewGray(image.Rect(0, 0, 4, 4))); err != nil {
+		t.Fatal(err)
+	}
+	return name
+}
+
+func TestExportHTMLBundleHandlerUsesRunOptions(t *testing.T) {
+	tempDir := t.TempDir()
+	imagesDir := filepath.Join(tempDir, "images")
+	if err := os.Mkdir(imagesDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	images := []string{writeTestPNG(t, imagesDir, "a.png"), writeTestPNG(t, imagesDir, "b.png"), writeTestPNG(t, imagesDir, "c.png")}
+	setLatestRun(runSnapshot{
+		tempDir:     tempDir,
+		clusters:    map[string]models.ClusterDetails{"Cluster-1": {Title: "Squares", Images: images}},
+		htmlOptions: utils.HTMLOptions{MaxImagesPerCluster: 2, Summary: "A collection of squares"},
+	})
+	t.Cleanup(func() { setLatestRun(runSnapshot{}) })
+
+	rec := httptest.NewRecorder()
+	ExportHTMLBundleHandler(rec, httptest.NewRequest(http.MethodGet, "/api/cluster/export.html", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d, want %d", rec.Code, http.StatusOK)
+	}
+	body := rec.Body.String()
+	if got := strings.Count(body, `src="data:image/`); got != 2 {
+		t.Errorf("got %d inlined images, want the run's limit of 2", got)
+	}
+	if !strings.Contains(body, "A collection of squares") {
+		t.Error("bundle is missing the run's summary")
+	}
+}
+
+func TestRenderHandlerRendersPostedClusters(t *testing.T) {
+	body := `{
+		"clusters": {
+			"Cluster-0": {"Images": ["a.jpg", "b.jpg"], "ServiceOutputs": [{"ServiceName": "Claude", "Title": "Trail Runners"}]},
+			"Cluster-1": {"Images": ["c.jpg"], "ServiceOutputs": [{"ServiceName": "Claude", "Title": "Canvas Totes"}]}
+		},
+		"imageBaseUrl": "https://cdn.example.com/"
+	}`
+	req := httptest.NewRequest(http.MethodPost, "/api/render", strings.NewReader(body))
+	rec := httptest.NewRecorder()
+	RenderHandler(rec, req)
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d, want %d: %s", rec.Code, http.StatusOK, rec.Body)
+	}
+	if contentType := rec.Header().Get("Content-Type"); !strings.HasPrefix(contentType, "text/html") {
+		t.Errorf("Content-Type = %q, want HTML", contentType)
+	}
+	for _, want := range []string{"Trail Runners", "Canvas Totes", `src="https://cdn.example.com/c.jpg"`} {
+		if !strings.Contains(rec.Body.String(), want) {
+			t.Errorf("report is missing %s", want)
+		}
+	}
+}
+
+func TestReplaceLatestClustersOnlyUpdatesSameRun(t *testing.T) {
+	setLatestRun(runSnapshot{tempDir: "/tmp/run-a", clusters: map[string]models.ClusterDetails{"Cluster-1": {Title: "Old"}}})
+	t.Cleanup(func() { setLatestRun(runSnapshot{}) })
+
+	if replaceLatestClusters("/tmp/run-b", map[string]models.ClusterDetails{"Cluster-1": {Title: "Stale"}}) {
+		t.Error("replaced the clusters of a different run")
+	}
+	if !replaceLatestClusters("/tmp/run-a", map[string]models.ClusterDetails{"Cluster-1": {Title: "New"}}) {
+		t.Error("did not replace the clusters of the latest run")
+	}
+	if title := getLatestRun().clusters["Cluster-1"].Title; title != "New" {
+		t.Errorf("title = %q, want %q", title, "New")
+	}
+}
+
+// multipartBody builds a multipart form with the given image files and fields
+func multipartBody(t *testing.T, files map[string][]byte, fields map[string]string) (*bytes.Buffer, string) {
+	t.Helper()
+	var body bytes.Buffer
+	writer := multipart.NewWriter(&body)
+	for name, data := range files {
+		part, err := writer.CreateFormFile("images", name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		part.Write(data)
+	}
+	for name, value := range fields {
+		writer.WriteField(name, value)
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return &body, writer.FormDataContentType()
+}
+
+// encodePNG returns a PNG of the given size whose pixels depend on seed, so images hash differently
+func encodePNG(t *testing.T, size int, seed byte) []byte {
+	t.Helper()
+	img := image.NewGray(image.Rect(0, 0, size, size))
+	img.Pix[0] = seed
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestStoreImagePartKeepsUploadsWithCollidingSanitizedNames(t *testing.T) {
+	// Both names sanitize to a_b.png, which used to store the second upload over the first
+	files := map[string][]byte{"a b.png": encodePNG(t, 4, 1), "a_b.png": encodePNG(t, 4, 2)}
+	body, contentType := multipartBody(t, files, nil)
+	_, params, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	imagesDir := t.TempDir()
+	seen := map[string]bool{}
+	var uploaded []models.UploadedImage
+	reader := multipart.NewReader(body, params["boundary"])
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := storeImagePart(part, imagesDir, seen, &uploaded); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if len(uploaded) != 2 || uploaded[0].Filename == uploaded[1].Filename {
+		t.Fatalf("uploads = %+v, want two images stored under different names", uploaded)
+	}
+	for _, upload := range uploaded {
+		stored, err := os.ReadFile(filepath.Join(imagesDir, upload.Filename))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(stored, files[upload.OriginalFilename]) {
+			t.Errorf("%s does not hold the content of %s", upload.Filename, upload.OriginalFilename)
+		}
+	}
+}
+
+func TestStoreImageLeavesNothingBehindForAFailedHEIC(t *testing.T) {
+	// An ftyp box with a HEIC brand but no image, which no converter accepts
+	heic := append([]byte("\x00\x00\x00\x18ftypheic"), make([]byte, 1024)...)
+	imagesDir := t.TempDir()
+	var uploaded []models.UploadedImage
+	err := storeImage(bytes.NewReader(heic), "photo.heic", imagesDir, map[string]bool{}, &uploaded)
+	if err == nil || len(uploaded) != 0 {
+		t.Fatalf("err = %v, uploads = %+v; want the HEIC upload rejected", err, uploaded)
+	}
+	leftovers, _ := os.ReadDir(imagesDir)
+	for _, leftover := range leftovers {
+		t.Errorf("left behind %s", leftover.Name())
+	}
+}
+
+func TestClusterAndGenerateHandlerMixesUploadsAndURLs(t *testing.T) {
+	withSessions(t, 10)
+	utils.SetAllowPrivateImageHosts(true)
+	t.Cleanup(func() { utils.SetAllowPrivateImageHosts(false) })
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(encodePNG(t, 4, r.URL.Path[1]))
+	}))
+	defer server.Close()
+
+	// Every image is below the minimum size, so the run stops after collecting them and reports each one
+	body, contentType := multipartBody(t,
+		map[string][]byte{"one.png": encodePNG(t, 4, 1), "two.png": encodePNG(t, 4, 2)},
+		map[string]string{
+			"image_urls":      server.URL + "/3.png\n" + server.URL + "/4.png",
+			"min_image_width": "100",
+		})
+	req := httptest.NewRequest(http.MethodPost, "/api/cluster", body)
+	req.Header.Set("Content-Type", contentType)
+	rec := httptest.NewRecorder()
+	ClusterAndGenerateHandler(rec, req)
+
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("status = %d, want %d: %s", rec.Code, http.StatusBadRequest, rec.Body)
+	}
+	var response struct {
+		RejectedImages []RejectedUpload `json:"rejectedImages"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &response); err != nil {
+		t.Fatal(err)
+	}
+	sources := map[string]int{}
+	for _, rejected := range response.RejectedImages {
+		sources[rejected.Source]++
+	}
+	if sources["upload"] != 2 || sources["url"] != 2 {
+		t.Errorf("rejected sources = %v, want 2 uploads and 2 urls", sources)
+	}
+}
+
+func TestClusterAndGenerateHandlerCapsImageURLs(t *testing.T) {
+	withSessions(t, 10)
+	urls := strings.Repeat("https://example.com/a.png\n", maxImageURLs+1)
+	body, contentType := multipartBody(t, nil, map[string]string{"image_urls": urls})
+	req := httptest.NewRequest(http.MethodPost, "/api/cluster", body)
+	req.Header.Set("Content-Type", contentType)
+	rec := httptest.NewRecorder()
+	ClusterAndGenerateHandler(rec, req)
+
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("status = %d, want %d", rec.Code, http.StatusBadRequest)
+	}
+}
+
+func TestClusterAndGenerateHandlerSkipsSlowImageURL(t *testing.T) {
+	withSessions(t, 10)
+	utils.SetAllowPrivateImageHosts(true)
+	t.Cleanup(func() { utils.SetAllowPrivateImageHosts(false) })
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+	}))
+	defer server.Close()
+	defer close(release)
+
+	body, contentType := multipartBody(t, nil, map[string]string{
+		"image_urls":        server.URL + "/slow.png",
+		"image_timeout":     "0.05",
+		"image_url_failure": "skip",
+	})
+	req := httptest.NewRequest(http.MethodPost, "/api/cluster", body)
+	req.Header.Set("Content-Type", contentType)
+	rec := httptest.NewRecorder()
+	start := time.Now()
+	ClusterAndGenerateHandler(rec, req)
+
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Fatalf("request took %s despite the image timeout", elapsed)
+	}
+	var response struct {
+		RejectedImages []RejectedUpload `json:"rejectedImages"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &response); err != nil {
+		t.Fatal(err)
+	}
+	if len(response.RejectedImages) != 1 || !strings.Contains(response.RejectedImages[0].Error, "timed out") {
+		t.Errorf("rejectedImages = %+v, want the slow URL skipped as timed out", response.RejectedImages)
+	}
+}
+
+func TestClusterAndGenerateHandlerStreamsPartsWithoutLeftovers(t *testing.T) {
+	withSessions(t, 10)
+	tmp := t.TempDir()
+	t.Setenv("TMPDIR", tmp)
+
+	// Small PNG headers followed by padding, so each part is large but fails the minimum size once stored
+	const parts, padding = 64, 256 << 10
+	var body bytes.Buffer
+	writer := multipart.NewWriter(&body)
+	for i := 0; i < parts; i++ {
+		part, err := writer.CreateFormFile("images", fmt.Sprintf("%d.png", i))
+		if err != nil {
+			t.Fatal(err)
+		}
+		part.Write(encodePNG(t, 4, byte(i)))
+		part.Write(bytes.Repeat([]byte{byte(i)}, padding))
+	}
+	archive, err := writer.CreateFormFile("archive", "images.zip")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The archive entry compresses to little but expands far beyond the rest of the upload
+	const entryPadding = 32 << 20
+	zipWriter := zip.NewWriter(archive)
+	entry, _ := zipWriter.Create("nested/extra.png")
+	entry.Write(encodePNG(t, 4, 255))
+	entry.Write(make([]byte, entryPadding))
+	zipWriter.Close()
+	writer.WriteField("min_image_width", "100")
+	writer.Close()
+	uploadSize := body.Len()
+
+	req := httptest.NewRequest(http.MethodPost, "/api/cluster", &body)
+	req.Header.Set("Content-Type", writer.FormDataContentType())
+	rec := httptest.NewRecorder()
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	ClusterAndGenerateHandler(rec, req)
+	runtime.ReadMemStats(&after)
+
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("status = %d, want %d: %s", rec.Code, http.StatusBadRequest, rec.Body)
+	}
+	if !strings.Contains(rec.Body.String(), "extra.png") {
+		t.Error("the archive entry was not processed")
+	}
+	// Parts and archive entries are streamed to disk, so the handler allocates far less than it was sent
+	// and far less than the archive expands to
+	allocated := after.TotalAlloc - before.TotalAlloc
+	if allocated > uint64(uploadSize)/4 {
+		t.Errorf("allocated %d bytes for a %d byte upload", allocated, uploadSize)
+	}
+	if allocated > entryPadding/8 {
+		t.Errorf("allocated %d bytes extracting a %d byte archive entry", allocated, entryPadding)
+	}
+	leftovers, err := os.ReadDir(tmp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, leftover := range leftovers {
+		t.Errorf("left behind %s", leftover.Name())
+	}
+}
+
+func TestClusterAndGenerateHandlerSharesTheArchiveLimitAcrossArchives(t *testing.T) {
+	withSessions(t, 10)
+	previous := maxArchiveUncompressedSize
+	maxArchiveUncompressedSize = 1000
+	t.Cleanup(func() { maxArchiveUncompressedSize = previous })
+
+	// Each archive fits within the limit on its own, but not together with the other
+	var body bytes.Buffer
+	writer := multipart.NewWriter(&body)
+	for i := 0; i < 2; i++ {
+		archive, err := writer.CreateFormFile("archive", fmt.Sprintf("part%d.zip", i))
+		if err != nil {
+			t.Fatal(err)
+		}
+		zipWriter := zip.NewWriter(archive)
+		entry, _ := zipWriter.Create(fmt.Sprintf("%d.png", i))
+		entry.Write(encodePNG(t, 4, byte(i)))
+		entry.Write(make([]byte, 600))
+		zipWriter.Close()
+	}
+	writer.Close()
+
+	req := httptest.NewRequest(http.MethodPost, "/api/cluster", &body)
+	req.Header.Set("Content-Type", writer.FormDataContentType())
+	rec := httptest.NewRecorder()
+	ClusterAndGenerateHandler(rec, req)
+
+	if rec.Code != http.StatusBadRequest || !strings.Contains(rec.Body.String(), "Invalid archive part1.zip") ||
+		!strings.Contains(rec.Body.String(), "maximum uncompressed size of 1000 bytes") {
+		t.Errorf("status = %d: %s; want the second archive rejected over the shared limit", rec.Code, rec.Body)
+	}
+}
+
+func TestImageHandlerSetsCacheHeadersAndAnswersNotModified(t *testing.T) {
+	tempDir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(tempDir, "images"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(tempDir, "images", "abc123.png"), []byte("png data"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	setLatestRun(runSnapshot{tempDir: tempDir})
+	t.Cleanup(func() { setLatestRun(runSnapshot{}) })
+
+	serve := func(ifNoneMatch string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/images/abc123.png", nil)
+		req = mux.SetURLVars(req, map[string]string{"imageName": "abc123.png"})
+		if ifNoneMatch != "" {
+			req.Header.Set("If-None-Match", ifNoneMatch)
+		}
+		rec := httptest.NewRecorder()
+		ImageHandler(rec, req)
+		return rec
+	}
+
+	rec := serve("")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d, want %d", rec.Code, http.StatusOK)
+	}
+	etag := rec.Header().Get("ETag")
+	if etag != `"abc123"` {
+		t.Errorf("ETag = %q, want %q", etag, `"abc123"`)
+	}
+	if got := rec.Header().Get("Cache-Control"); got != "private, max-age=3600" {
+		t.Errorf("Cache-Control = %q, want the default one hour", got)
+	}
+
+	rec = serve(etag)
+	if rec.Code != http.StatusNotModified {
+		t.Errorf("status = %d with a matching If-None-Match, want %d", rec.Code, http.StatusNotModified)
+	}
+	if rec.Body.Len() != 0 {
+		t.Errorf("a 304 response carried %d body bytes", rec.Body.Len())
+	}
+}
+
+func TestExplainHandlerReportsDistanceAndSharedLabels(t *testing.T) {
+	setLatestRun(runSnapshot{
+		tempDir: t.TempDir(),
+		results: []workflow.ImageResult{
+			{ID: "a", ClusterID: "Cluster-1", Labels: []string{"Shoe", "Leather", "Brown"}, Embedding: []float32{0, 0, 1}},
+			{ID: "b", ClusterID: "Cluster-1", Labels: []string{"Boot", "Leather", "Brown"}, Embedding: []float32{3, 4, 1}},
+		},
+	})
+	t.Cleanup(func() { setLatestRun(runSnapshot{}) })
+
+	rec := httptest.NewRecorder()
+	ExplainHandler(rec, httptest.NewRequest(http.MethodGet, "/api/explain?a=a&b=b&top=2", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d, want %d: %s", rec.Code, http.StatusOK, rec.Body)
+	}
+	var got struct {
+		Distance      float32  `json:"distance"`
+		SameCluster   bool     `json:"sameCluster"`
+		SharedLabels  []string `json:"sharedLabels"`
+		TopDimensions []struct {
+			Dimension    int     `json:"dimension"`
+			Contribution float32 `json:"contribution"`
+		} `json:"topDimensions"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil {
+		t.Fatal(err)
+	}
+	if got.Distance != 5 {
+		t.Errorf("distance = %v, want 5", got.Distance)
+	}
+	if !got.SameCluster {
+		t.Error("sameCluster = false for two images in Cluster-1")
+	}
+	if strings.Join(got.SharedLabels, ",") != "Leather,Brown" {
+		t.Errorf("sharedLabels = %v, want [Leather Brown]", got.SharedLabels)
+	}
+	if len(got.TopDimensions) != 2 || got.TopDimensions[0].Dimension != 1 || got.TopDimensions[0].Contribution != 16 ||
+		got.TopDimensions[1].Dimension != 0 || got.TopDimensions[1].Contribution != 9 {
+		t.Errorf("topDimensions = %+v, want dimension 1 (16) then dimension 0 (9)", got.TopDimensions)
+	}
+}
+
+func TestRenderHandlerRejectsRepeatedImages(t *testing.T) {
+	for _, body := range []string{
+		`{"clusters": {"Cluster-0": {"Images": ["a.jpg", "b.jpg"]}, "Cluster-1": {"Images": ["a.jpg", "c.jpg"]}}}`,
+		`{"clusters": {"Cluster-0": {"Images": ["a.jpg", "a.jpg", "b.jpg"]}}}`,
+	} {
+		req := httptest.NewRequest(http.MethodPost, "/api/render", strings.NewReader(body))
+		rec := httptest.NewRecorder()
+		RenderHandler(rec, req)
+
+		if rec.Code != http.StatusBadRequest || !strings.Contains(rec.Body.String(), "a.jpg") || strings.Contains(rec.Body.String(), "b.jpg") {
+			t.Errorf("%s: status = %d, body = %s; want a 400 naming only a.jpg", body, rec.Code, rec.Body)
+		}
+	}
+}
+
+func TestRejectUndersizedImages(t *testing.T) {
+	imagesDir := t.TempDir()
+	stored := filepath.Join(imagesDir, "tiny-stored.png")
+	if err := os.WriteFile(stored, encodePNG(t, 40, 1), 0644); err != nil {
+		t.Fatal(err)
+	}
+	images := []models.UploadedImage{
+		{Filename: "tiny.png", OriginalFilename: "thumb.png", Data: encodePNG(t, 40, 2)},
+		{Filename: "large.png", OriginalFilename: "photo.png", Data: encodePNG(t, 200, 3)},
+		{Filename: "tiny-stored.png", OriginalFilename: "icon.png", Stored: true},
+	}
+
+	kept, rejected := rejectUndersizedImages(images, imagesDir, 100, 100)
+	if len(kept) != 1 || kept[0].OriginalFilename != "photo.png" {
+		t.Errorf("kept %v, want only photo.png", kept)
+	}
+	if len(rejected) != 2 || rejected[0].Filename != "thumb.png" || rejected[1].Filename != "icon.png" {
+		t.Fatalf("rejected %+v, want thumb.png and icon.png", rejected)
+	}
+	if !strings.Contains(rejected[0].Error, "40x40 pixels, below the minimum of 100x100") {
+		t.Errorf("error = %q, want the sizes named", rejected[0].Error)
+	}
+	if _, err := os.Stat(stored); !os.IsNotExist(err) {
+		t.Error("the rejected stored image was left on disk")
+	}
+}
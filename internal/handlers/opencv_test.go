@@ -0,0 +1,52 @@
+//go:build opencv
+
+package handlers
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/png"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestPreprocessPreviewHandlerReturnsTheNetworkInputSize(t *testing.T) {
+	img := image.NewRGBA(image.Rect(0, 0, 320, 200))
+	for y := 0; y < 200; y++ {
+		for x := 0; x < 320; x++ {
+			img.Set(x, y, color.RGBA{R: uint8(x), G: uint8(y), B: 90, A: 255})
+		}
+	}
+	var body bytes.Buffer
+	writer := multipart.NewWriter(&body)
+	part, err := writer.CreateFormFile("image", "wide.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := png.Encode(part, img); err != nil {
+		t.Fatal(err)
+	}
+	writer.Close()
+
+	req := httptest.NewRequest(http.MethodPost, "/api/preprocess/preview", &body)
+	req.Header.Set("Content-Type", writer.FormDataContentType())
+	rec := httptest.NewRecorder()
+	PreprocessPreviewHandler(rec, req)
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d, want %d: %s", rec.Code, http.StatusOK, rec.Body)
+	}
+	if got := rec.Header().Get("Content-Type"); got != "image/png" {
+		t.Errorf("Content-Type = %q, want image/png", got)
+	}
+	preview, err := png.Decode(rec.Body)
+	if err != nil {
+		t.Fatalf("the response is not a PNG: %v", err)
+	}
+	if size := preview.Bounds().Size(); size.X != 224 || size.Y != 224 {
+		t.Errorf("preview is %dx%d, want 224x224", size.X, size.Y)
+	}
+}
@@ -0,0 +1,127 @@
+package handlers
+
+import (
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// rateLimitIdle is how long a client's bucket is kept after its last request
+const rateLimitIdle = 10 * time.Minute
+
+// tokenBucket tracks the requests a single client may still make
+type tokenBucket struct {
+	tokens   float64
+	lastSeen time.Time
+}
+
+// rateLimiter hands out tokens per client key, refilling at a fixed rate up to the burst size
+type rateLimiter struct {
+	mu             sync.Mutex
+	rate           float64 // Tokens added per second; zero disables limiting
+	burst          float64
+	keyHeader      string
+	trustedProxies int // Proxies in front of the server that append to X-Forwarded-For
+	buckets        map[string]*tokenBucket
+	lastSweep      time.Time
+}
+
+var limiter = &rateLimiter{buckets: make(map[string]*tokenBucket)}
+
+// SetRateLimit limits each client to perMinute requests with bursts of up to burst requests.
+// A non-positive perMinute disables limiting; a non-positive burst allows one request at a time.
+func SetRateLimit(perMinute float64, burst int) {
+	limiter.mu.Lock()
+	defer limiter.mu.Unlock()
+	limiter.rate = math.Max(perMinute, 0) / 60
+	limiter.burst = math.Max(float64(burst), 1)
+	limiter.buckets = make(map[string]*tokenBucket)
+}
+
+// SetRateLimitKey sets how clients are identified. When header is set and present on a request,
+// its value (such as an API key added by a gateway) is the key. Otherwise the client IP is used.
+// With trustedProxies above zero, it is taken from X-Forwarded-For, counting that many entries from
+// the right, since those were appended by the proxies while anything further left comes from the client.
+func SetRateLimitKey(header string, trustedProxies int) {
+	limiter.mu.Lock()
+	defer limiter.mu.Unlock()
+	limiter.keyHeader = header
+	limiter.trustedProxies = max(trustedProxies, 0)
+}
+
+// RateLimit rejects requests with 429 and a Retry-After header once the client's bucket is empty
+func RateLimit(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if wait, ok := limiter.allow(limiter.clientKey(r), time.Now()); !ok {
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+			respondWithError(w, http.StatusTooManyRequests, "Rate limit exceeded, retry later")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// clientKey identifies the client a request is counted against
+func (l *rateLimiter) clientKey(r *http.Request) string {
+	l.mu.Lock()
+	keyHeader, trustedProxies := l.keyHeader, l.trustedProxies
+	l.mu.Unlock()
+
+	if keyHeader != "" {
+		if key := r.Header.Get(keyHeader); key != "" {
+			return "key:" + key
+		}
+	}
+	if trustedProxies > 0 {
+		// A request with fewer entries did not pass through every proxy, so its peer address is used
+		forwarded := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+		if len(forwarded) >= trustedProxies {
+			if ip := strings.TrimSpace(forwarded[len(forwarded)-trustedProxies]); ip != "" {
+				return "ip:" + ip
+			}
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	return "ip:" + host
+}
+
+// allow takes a token from the client's bucket, or reports how long until one is available
+func (l *rateLimiter) allow(key string, now time.Time) (time.Duration, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.rate <= 0 {
+		return 0, true
+	}
+
+	// Drop idle clients now and then so the map does not grow without bound
+	if now.Sub(l.lastSweep) > rateLimitIdle {
+		for k, bucket := range l.buckets {
+			if now.Sub(bucket.lastSeen) > rateLimitIdle {
+				delete(l.buckets, k)
+			}
+		}
+		l.lastSweep = now
+	}
+
+	bucket, ok := l.buckets[key]
+	if !ok {
+		bucket = &tokenBucket{tokens: l.burst, lastSeen: now}
+		l.buckets[key] = bucket
+	}
+	bucket.tokens = math.Min(l.burst, bucket.tokens+now.Sub(bucket.lastSeen).Seconds()*l.rate)
+	bucket.lastSeen = now
+
+	if bucket.tokens < 1 {
+		return time.Duration((1 - bucket.tokens) / l.rate * float64(time.Second)), false
+	}
+	bucket.tokens--
+	return 0, true
+}
@@ -0,0 +1,78 @@
+package handlers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// withRateLimit swaps in a fresh limiter for the duration of a test
+func withRateLimit(t *testing.T, perMinute float64, burst int, header string, trustedProxies int) {
+	t.Helper()
+	previous := limiter
+	limiter = &rateLimiter{buckets: make(map[string]*tokenBucket)}
+	SetRateLimit(perMinute, burst)
+	SetRateLimitKey(header, trustedProxies)
+	t.Cleanup(func() { limiter = previous })
+}
+
+func TestRateLimitRejectsBurstWithRetryAfter(t *testing.T) {
+	withRateLimit(t, 1, 2, "", 0)
+	handler := RateLimit(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	codes := []int{}
+	var retryAfter string
+	for i := 0; i < 4; i++ {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/api/cluster", nil))
+		codes = append(codes, rec.Code)
+		if rec.Code == http.StatusTooManyRequests {
+			retryAfter = rec.Header().Get("Retry-After")
+		}
+	}
+	want := []int{http.StatusOK, http.StatusOK, http.StatusTooManyRequests, http.StatusTooManyRequests}
+	for i := range want {
+		if codes[i] != want[i] {
+			t.Fatalf("status codes = %v, want %v", codes, want)
+		}
+	}
+	if retryAfter == "" || retryAfter == "0" {
+		t.Errorf("Retry-After = %q, want a positive number of seconds", retryAfter)
+	}
+}
+
+func TestRateLimitClientKey(t *testing.T) {
+	tests := []struct {
+		name           string
+		trustedProxies int
+		forwarded      []string
+		want           string
+	}{
+		{"ignores the header without trusted proxies", 0, []string{"1.1.1.1"}, "ip:192.0.2.1"},
+		{"takes the entry appended by the proxy", 1, []string{"6.6.6.6, 1.1.1.1"}, "ip:1.1.1.1"},
+		{"counts entries across repeated headers", 2, []string{"6.6.6.6, 1.1.1.1", "10.0.0.2"}, "ip:1.1.1.1"},
+		{"falls back to the peer when a proxy was skipped", 2, []string{"1.1.1.1"}, "ip:192.0.2.1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withRateLimit(t, 60, 1, "", tt.trustedProxies)
+			req := httptest.NewRequest(http.MethodPost, "/api/cluster", nil)
+			req.RemoteAddr = "192.0.2.1:1234"
+			for _, value := range tt.forwarded {
+				req.Header.Add("X-Forwarded-For", value)
+			}
+			if got := limiter.clientKey(req); got != tt.want {
+				t.Errorf("clientKey = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRateLimitClientKeyHeader(t *testing.T) {
+	withRateLimit(t, 60, 1, "X-API-Key", 0)
+	req := httptest.NewRequest(http.MethodPost, "/api/cluster", nil)
+	req.Header.Set("X-API-Key", "team-a")
+	if got := limiter.clientKey(req); got != "key:team-a" {
+		t.Errorf("clientKey = %q, want %q", got, "key:team-a")
+	}
+}
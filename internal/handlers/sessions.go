@@ -0,0 +1,177 @@
+package handlers
+
+import (
+	"crypto/subtle"
+	"imageclust/internal/logger"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Session states reported by /api/sessions
+const (
+	SessionRunning = "running"
+	SessionDone    = "done"
+	SessionFailed  = "failed"
+)
+
+// maxSessions caps how many finished sessions are retained; running ones are always kept
+var maxSessions = 100
+
+// SetMaxSessions sets how many finished sessions are retained before the least recently used one is
+// evicted and its temp directory removed; non-positive values are ignored. It must be called before serving requests.
+func SetMaxSessions(n int) {
+	if n > 0 {
+		maxSessions = n
+	}
+}
+
+// SessionInfo describes one clustering request and the temp directory it created
+type SessionInfo struct {
+	ID         string    `json:"id"`
+	CreatedAt  time.Time `json:"createdAt"`
+	ImageCount int       `json:"imageCount"`
+	Clusters   int       `json:"clusterCount"`
+	Status     string    `json:"status"`
+	LastUsed   time.Time `json:"lastUsed"` // When the session was last created, finished or retitled; the oldest is evicted first
+	Current    bool      `json:"current"`  // Whether this session's results are the ones being served
+
+	tempDir string // Directory holding the session's images and report, removed on eviction
+}
+
+// sessionRegistry records the sessions started since the server came up
+type sessionRegistry struct {
+	mu       sync.Mutex
+	sessions map[string]*SessionInfo
+}
+
+var sessions = &sessionRegistry{sessions: make(map[string]*SessionInfo)}
+
+// adminToken guards the admin endpoints; they are disabled while it is empty
+var adminToken string
+
+// SetAdminToken sets the bearer token required by the admin endpoints. An empty token disables them.
+func SetAdminToken(token string) {
+	adminToken = token
+}
+
+// sessionID names a session after its temp directory, which is unique per request
+func sessionID(tempDir string) string {
+	return filepath.Base(tempDir)
+}
+
+// start registers a new running session stored in tempDir
+func (s *sessionRegistry) start(id, tempDir string) {
+	now := time.Now()
+	s.mu.Lock()
+	s.sessions[id] = &SessionInfo{ID: id, CreatedAt: now, LastUsed: now, Status: SessionRunning, tempDir: tempDir}
+	s.mu.Unlock()
+}
+
+// update applies fn to the session, if it is still registered, and marks it used.
+// Finishing a session can push the registry over its capacity, so this evicts as needed.
+func (s *sessionRegistry) update(id string, fn func(*SessionInfo)) {
+	s.mu.Lock()
+	if session, ok := s.sessions[id]; ok {
+		fn(session)
+		session.LastUsed = time.Now()
+	}
+	// The served session is the latest successful one, which a newer run only replaces once it succeeds.
+	// It is read under the lock: a run is served before its session finishes, and finishing takes the lock,
+	// so every finished session that may be served is seen here.
+	current := ""
+	if tempDir := getLatestRun().tempDir; tempDir != "" {
+		current = sessionID(tempDir)
+	}
+	evicted := s.evict(current)
+	s.mu.Unlock()
+
+	for _, session := range evicted {
+		logger.Infof("Evicting session %s and removing %s", session.ID, session.tempDir)
+		if err := os.RemoveAll(session.tempDir); err != nil {
+			logger.Warnf("Failed to remove temp directory of session %s: %v", session.ID, err)
+		}
+	}
+}
+
+// touch marks the session used so it is evicted later
+func (s *sessionRegistry) touch(id string) {
+	s.update(id, func(*SessionInfo) {})
+}
+
+// evict unregisters the least recently used finished sessions beyond maxSessions and returns them.
+// The session being served is never evicted. The caller must hold the lock.
+func (s *sessionRegistry) evict(current string) []*SessionInfo {
+	finished := 0
+	var candidates []*SessionInfo
+	for _, session := range s.sessions {
+		if session.Status == SessionRunning {
+			continue
+		}
+		finished++
+		if session.ID != current {
+			candidates = append(candidates, session)
+		}
+	}
+	excess := min(finished-maxSessions, len(candidates))
+	if excess <= 0 {
+		return nil
+	}
+
+	sort.Slice(candidates, func(i, j int) bool {
+		return candidates[i].LastUsed.Before(candidates[j].LastUsed)
+	})
+	for _, session := range candidates[:excess] {
+		delete(s.sessions, session.ID)
+	}
+	return candidates[:excess]
+}
+
+// list returns copies of the sessions, newest first
+func (s *sessionRegistry) list(currentID string) []SessionInfo {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	list := make([]SessionInfo, 0, len(s.sessions))
+	for _, session := range s.sessions {
+		info := *session
+		info.Current = info.ID == currentID
+		list = append(list, info)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].CreatedAt.After(list[j].CreatedAt)
+	})
+	return list
+}
+
+// RequireAdminToken rejects requests without the configured bearer token, and every request when no token is set
+func RequireAdminToken(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if adminToken == "" {
+			respondWithError(w, http.StatusForbidden, "Admin endpoints are disabled; set ADMIN_API_TOKEN to enable them")
+			return
+		}
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(adminToken)) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			respondWithError(w, http.StatusUnauthorized, "Missing or invalid admin token")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// SessionsHandler lists the clustering sessions started since the server came up, newest first
+func SessionsHandler(w http.ResponseWriter, r *http.Request) {
+	current := ""
+	if tempDir := getLatestRun().tempDir; tempDir != "" {
+		current = sessionID(tempDir)
+	}
+	respondWithJSON(w, http.StatusOK, map[string]interface{}{
+		"success":  true,
+		"sessions": sessions.list(current),
+	})
+}
@@ -0,0 +1,171 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/json"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"imageclust/internal/logger"
+)
+
+// withSessions swaps in an empty registry and capacity for the duration of a test
+func withSessions(t *testing.T, capacity int) {
+	t.Helper()
+	previous, previousMax := sessions, maxSessions
+	sessions = &sessionRegistry{sessions: make(map[string]*SessionInfo)}
+	maxSessions = capacity
+	t.Cleanup(func() {
+		sessions, maxSessions = previous, previousMax
+		setLatestRun(runSnapshot{})
+	})
+}
+
+// finishSession starts a session in a new temp directory and marks it done
+func finishSession(t *testing.T) (string, string) {
+	t.Helper()
+	tempDir := t.TempDir()
+	id := sessionID(tempDir)
+	sessions.start(id, tempDir)
+	sessions.update(id, func(info *SessionInfo) { info.Status = SessionDone })
+	// LastUsed must differ between sessions for the eviction order to be defined
+	time.Sleep(time.Millisecond)
+	return id, tempDir
+}
+
+func TestSessionsHandlerListsCreatedSession(t *testing.T) {
+	withSessions(t, 10)
+	id, tempDir := finishSession(t)
+	setLatestRun(runSnapshot{tempDir: tempDir})
+
+	rec := httptest.NewRecorder()
+	SessionsHandler(rec, httptest.NewRequest(http.MethodGet, "/api/sessions", nil))
+
+	var response struct {
+		Sessions []SessionInfo `json:"sessions"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &response); err != nil {
+		t.Fatal(err)
+	}
+	if len(response.Sessions) != 1 || response.Sessions[0].ID != id {
+		t.Fatalf("sessions = %+v, want only %s", response.Sessions, id)
+	}
+	if got := response.Sessions[0]; got.Status != SessionDone || !got.Current {
+		t.Errorf("session = %+v, want a current done session", got)
+	}
+}
+
+func TestSessionRegistryEvictsOldestBeyondCapacity(t *testing.T) {
+	withSessions(t, 2)
+	oldest, oldestDir := finishSession(t)
+	finishSession(t)
+	finishSession(t)
+
+	if _, err := os.Stat(oldestDir); !os.IsNotExist(err) {
+		t.Errorf("temp directory of evicted session still exists: %v", err)
+	}
+	list := sessions.list("")
+	if len(list) != 2 {
+		t.Fatalf("got %d sessions, want 2", len(list))
+	}
+	for _, info := range list {
+		if info.ID == oldest {
+			t.Errorf("oldest session %s was not evicted", oldest)
+		}
+	}
+}
+
+func TestSessionRegistryKeepsServedSession(t *testing.T) {
+	withSessions(t, 1)
+	served, servedDir := finishSession(t)
+	if err := os.WriteFile(filepath.Join(servedDir, "clusters.html"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	setLatestRun(runSnapshot{tempDir: servedDir})
+
+	// A newer run that fails leaves the served results in place, so they must survive eviction
+	failedDir := t.TempDir()
+	failed := sessionID(failedDir)
+	sessions.start(failed, failedDir)
+	sessions.update(failed, func(info *SessionInfo) { info.Status = SessionFailed })
+
+	if _, err := os.Stat(filepath.Join(servedDir, "clusters.html")); err != nil {
+		t.Errorf("served session %s lost its report: %v", served, err)
+	}
+	if _, err := os.Stat(failedDir); !os.IsNotExist(err) {
+		t.Errorf("failed session was not evicted: %v", err)
+	}
+}
+
+func TestSessionRegistryKeepsARunServedDuringEviction(t *testing.T) {
+	withSessions(t, 1)
+	_, oldDir := finishSession(t)
+	setLatestRun(runSnapshot{tempDir: oldDir})
+	newDir := t.TempDir()
+	newID := sessionID(newDir)
+	sessions.start(newID, newDir)
+
+	// Touch the old session while the registry is locked, so the update waits for the lock. In the
+	// meantime the new run becomes the served one and finishes, as a request does once clustering succeeds.
+	sessions.mu.Lock()
+	touched := make(chan struct{})
+	go func() {
+		sessions.touch(sessionID(oldDir))
+		close(touched)
+	}()
+	time.Sleep(20 * time.Millisecond)
+	setLatestRun(runSnapshot{tempDir: newDir})
+	sessions.sessions[newID].Status = SessionDone
+	sessions.sessions[newID].LastUsed = time.Now().Add(-time.Hour)
+	sessions.mu.Unlock()
+	<-touched
+
+	if _, err := os.Stat(newDir); err != nil {
+		t.Errorf("the served session's temp directory was removed: %v", err)
+	}
+	if _, err := os.Stat(oldDir); !os.IsNotExist(err) {
+		t.Errorf("the session no longer served was not evicted: %v", err)
+	}
+}
+
+func TestCredentialsNeverAppearInLogs(t *testing.T) {
+	withSessions(t, 10)
+	const authToken, adminSecret, guessed = "auth-0123456789abcdef", "admin-0123456789abcdef", "guess-0123456789abcdef"
+	var logs bytes.Buffer
+	writer := log.Writer()
+	log.SetOutput(&logs)
+	logger.SetLevel(logger.LevelDebug)
+	t.Cleanup(func() {
+		log.SetOutput(writer)
+		logger.SetLevel(logger.LevelInfo)
+	})
+
+	// A ProductSetter token sent to the upload flow is ignored, and must not be logged either
+	body, contentType := multipartBody(t,
+		map[string][]byte{"one.png": encodePNG(t, 4, 1)},
+		map[string]string{"profile_id": "42", "auth_token": authToken, "min_image_width": "100"})
+	req := httptest.NewRequest(http.MethodPost, "/api/cluster", body)
+	req.Header.Set("Content-Type", contentType)
+	ClusterAndGenerateHandler(httptest.NewRecorder(), req)
+
+	SetAdminToken(adminSecret)
+	t.Cleanup(func() { SetAdminToken("") })
+	admin := RequireAdminToken(http.HandlerFunc(SessionsHandler))
+	for _, token := range []string{guessed, adminSecret} {
+		req := httptest.NewRequest(http.MethodGet, "/api/sessions", nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		admin.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	for _, secret := range []string{authToken, adminSecret, guessed} {
+		if strings.Contains(logs.String(), secret) {
+			t.Errorf("logs contain the credential %s", secret)
+		}
+	}
+}
@@ -0,0 +1,76 @@
+// Package logger provides leveled logging on top of the standard log package
+package logger
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"sync/atomic"
+)
+
+// Level is the severity of a log line
+type Level int32
+
+const (
+	LevelDebug Level = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+// currentLevel is the minimum level that is written; lines below it are dropped
+var currentLevel = int32(LevelInfo)
+
+// ParseLevel converts a level name (debug, info, warn, error or quiet) to a Level.
+// Quiet mode only writes errors.
+func ParseLevel(name string) (Level, error) {
+	switch strings.ToLower(strings.TrimSpace(name)) {
+	case "debug":
+		return LevelDebug, nil
+	case "info":
+		return LevelInfo, nil
+	case "warn", "warning":
+		return LevelWarn, nil
+	case "error", "quiet":
+		return LevelError, nil
+	default:
+		return LevelInfo, fmt.Errorf("unknown log level %q", name)
+	}
+}
+
+// SetLevel sets the minimum level that is written
+func SetLevel(level Level) {
+	atomic.StoreInt32(&currentLevel, int32(level))
+}
+
+// Enabled reports whether lines at the given level are written
+func Enabled(level Level) bool {
+	return int32(level) >= atomic.LoadInt32(&currentLevel)
+}
+
+// Debugf logs verbose diagnostics such as full request and response bodies
+func Debugf(format string, args ...interface{}) {
+	logf(LevelDebug, "DEBUG ", format, args...)
+}
+
+// Infof logs normal progress messages
+func Infof(format string, args ...interface{}) {
+	logf(LevelInfo, "INFO ", format, args...)
+}
+
+// Warnf logs recoverable problems
+func Warnf(format string, args ...interface{}) {
+	logf(LevelWarn, "WARN ", format, args...)
+}
+
+// Errorf logs failures
+func Errorf(format string, args ...interface{}) {
+	logf(LevelError, "ERROR ", format, args...)
+}
+
+func logf(level Level, prefix, format string, args ...interface{}) {
+	if !Enabled(level) {
+		return
+	}
+	log.Output(3, prefix+fmt.Sprintf(format, args...))
+}
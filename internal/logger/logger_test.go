@@ -0,0 +1,59 @@
+package logger
+
+import (
+	"bytes"
+	"log"
+	"strings"
+	"testing"
+)
+
+// captureLog redirects the standard logger to a buffer for the duration of the test
+func captureLog(t *testing.T) *bytes.Buffer {
+	t.Helper()
+	var buf bytes.Buffer
+	writer, flags := log.Writer(), log.Flags()
+	log.SetOutput(&buf)
+	log.SetFlags(0)
+	t.Cleanup(func() {
+		log.SetOutput(writer)
+		log.SetFlags(flags)
+	})
+	return &buf
+}
+
+func TestInfoLevelSuppressesDebugLines(t *testing.T) {
+	buf := captureLog(t)
+	defer SetLevel(Level(currentLevel))
+	SetLevel(LevelInfo)
+
+	Debugf("request body %s", "secret prompt")
+	Infof("clustered %d images", 3)
+	Warnf("slow response")
+
+	output := buf.String()
+	if strings.Contains(output, "secret prompt") {
+		t.Errorf("debug line written at info level: %q", output)
+	}
+	for _, want := range []string{"INFO clustered 3 images", "WARN slow response"} {
+		if !strings.Contains(output, want) {
+			t.Errorf("output %q is missing %q", output, want)
+		}
+	}
+}
+
+func TestQuietLevelOnlyWritesErrors(t *testing.T) {
+	buf := captureLog(t)
+	defer SetLevel(Level(currentLevel))
+	level, err := ParseLevel("quiet")
+	if err != nil {
+		t.Fatal(err)
+	}
+	SetLevel(level)
+
+	Warnf("slow response")
+	Errorf("model failed")
+
+	if output := buf.String(); output != "ERROR model failed\n" {
+		t.Errorf("output = %q, want only the error line", output)
+	}
+}
@@ -5,20 +5,32 @@ type ServiceOutput struct {
 	ServiceName  string
 	Title        string
 	CatchyPhrase string
+	Category     string // Short category label, when requested with ai_category
+	Untitled     bool   // Whether the service failed and returned the placeholder title
 }
 
 type UploadedImage struct {
-	Filename string
-	Data     []byte
+	Filename         string // Content-hash derived name the image is stored under
+	OriginalFilename string // Name the image was uploaded with
+	Data             []byte
+	Stored           bool   // Already written to the images directory while streaming, so Data is empty
+	ProductID        string // Product the image shows, so several views can be clustered as one product
+	SourceURL        string // URL the image was downloaded from, empty for uploaded files
 }
 
 // ClusterDetails represents the details of a single cluster.
 type ClusterDetails struct {
 	Title          string
 	CatchyPhrase   string
+	Category       string // Category label of the output the title was taken from, when requested
 	Labels         string
 	Images         []string
 	ServiceOutputs []ServiceOutput // New field for multiple service outputs
+	Cohesion       float32         // Mean distance of the members to the cluster centroid
+	IsMisc         bool            // Whether this is the bucket collecting members of loose clusters
+	DominantLabel  string          // Label shared by the most images in the cluster
+
+	OriginalFilenames map[string]string // Name each image was uploaded with, keyed by stored filename; set with original_filenames
 }
 
 func (c *ClusterDetails) Init() ClusterDetails {
@@ -50,3 +62,11 @@ func (c *ClusterDetails) SetServiceOutput(output ServiceOutput) {
 	// Add new output if not found
 	c.ServiceOutputs = append(c.ServiceOutputs, output)
 }
+
+// LabelClusterMatrix counts how many images carrying each label fell into each cluster.
+// Counts[i][j] is the count for Labels[i] in Clusters[j].
+type LabelClusterMatrix struct {
+	Labels   []string
+	Clusters []string
+	Counts   [][]int
+}
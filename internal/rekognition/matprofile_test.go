@@ -0,0 +1,20 @@
+//go:build opencv && matprofile
+
+package rekognition
+
+import (
+	"testing"
+
+	"gocv.io/x/gocv"
+)
+
+// checkMatLeaks runs work and fails the test when it leaves more gocv Mats open than it found.
+// gocv only counts Mats when built with the matprofile tag: go test -tags opencv,matprofile ./...
+func checkMatLeaks(t *testing.T, work func()) {
+	t.Helper()
+	before := gocv.MatProfile.Count()
+	work()
+	if after := gocv.MatProfile.Count(); after != before {
+		t.Errorf("%d gocv Mats left open", after-before)
+	}
+}
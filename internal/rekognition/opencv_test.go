@@ -0,0 +1,70 @@
+//go:build opencv
+
+package rekognition
+
+import (
+	"image"
+	"image/color"
+	"image/png"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"gocv.io/x/gocv"
+)
+
+// These tests need OpenCV and run with go test -tags opencv
+
+// writeNoisePNG writes a PNG of random pixels, which does not compress, so it ends up larger than MaxImageSize
+func writeNoisePNG(t *testing.T, dir string, width, height int) string {
+	t.Helper()
+	random := rand.New(rand.NewSource(1))
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			img.SetRGBA(x, y, color.RGBA{uint8(random.Intn(256)), uint8(random.Intn(256)), uint8(random.Intn(256)), 255})
+		}
+	}
+	path := filepath.Join(dir, "noise.png")
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if err := png.Encode(f, img); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestResizeImageIfNeededUsesConfiguredInterpolation(t *testing.T) {
+	path := writeNoisePNG(t, t.TempDir(), 1600, 1600)
+	if info, err := os.Stat(path); err != nil || info.Size() <= MaxImageSize {
+		t.Fatalf("test image is not larger than MaxImageSize: %v", err)
+	}
+
+	var used []gocv.InterpolationFlags
+	defer func(original func(gocv.Mat, *gocv.Mat, image.Point, float64, float64, gocv.InterpolationFlags)) {
+		resize = original
+	}(resize)
+	resize = func(src gocv.Mat, dst *gocv.Mat, size image.Point, fx, fy float64, interp gocv.InterpolationFlags) {
+		used = append(used, interp)
+		gocv.Resize(src, dst, size, fx, fy, interp)
+	}
+
+	checkMatLeaks(t, func() {
+		if _, err := resizeImageIfNeeded(path, gocv.InterpolationArea); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	if len(used) == 0 {
+		t.Fatal("the image was never resized")
+	}
+	for _, interp := range used {
+		if interp != gocv.InterpolationArea {
+			t.Errorf("resized with interpolation %v, want InterpolationArea", interp)
+		}
+	}
+}
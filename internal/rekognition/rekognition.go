@@ -3,12 +3,15 @@ package rekognition
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"github.com/aws/aws-sdk-go-v2/credentials"
 	"gocv.io/x/gocv"
 	"image"
-	"log"
+	"imageclust/internal/logger"
+	"io"
 	"os"
 	"path/filepath"
 
@@ -20,10 +23,22 @@ import (
 
 const MaxImageSize = 5 * 1024 * 1024 // 5MB in bytes
 
+// RekognitionAPI is the subset of the Rekognition client used by the service
+type RekognitionAPI interface {
+	DetectLabels(ctx context.Context, params *rekognition.DetectLabelsInput, optFns ...func(*rekognition.Options)) (*rekognition.DetectLabelsOutput, error)
+	DetectModerationLabels(ctx context.Context, params *rekognition.DetectModerationLabelsInput, optFns ...func(*rekognition.Options)) (*rekognition.DetectModerationLabelsOutput, error)
+	DetectText(ctx context.Context, params *rekognition.DetectTextInput, optFns ...func(*rekognition.Options)) (*rekognition.DetectTextOutput, error)
+}
+
 // RekognitionService interacts with AWS Rekognition to detect labels in images.
 type RekognitionService struct {
-	Client   *rekognition.Client
-	CacheDir string // Directory for storing cached labels
+	Client        RekognitionAPI
+	CacheDir      string                  // Directory for storing cached labels, keyed by image content so it can be shared
+	Interpolation gocv.InterpolationFlags // Interpolation used when downscaling oversized images
+
+	// CategoryConfidence sets a minimum confidence per label category, such as "Apparel and Accessories".
+	// A label is dropped when it falls below the threshold of any of its categories.
+	CategoryConfidence map[string]float32
 }
 
 // NewRekognitionService initializes the Rekognition client and cache directory.
@@ -72,8 +87,9 @@ func NewRekognitionService(region, cacheDir string) (*RekognitionService, error)
 	}
 
 	return &RekognitionService{
-		Client:   client,
-		CacheDir: cacheDir,
+		Client:        client,
+		CacheDir:      cacheDir,
+		Interpolation: gocv.InterpolationLinear,
 	}, nil
 }
 
@@ -87,17 +103,23 @@ func NewRekognitionService(region, cacheDir string) (*RekognitionService, error)
 // - A slice of detected labels.
 // - An error if detection fails.
 // DetectLabels detects labels from an image stored at the specified path using AWS Rekognition.
-func (rs *RekognitionService) DetectLabels(imagePath string, maxLabels int32, minConfidence float32) ([]types.Label, error) {
-	// Generate cache file path based on the image name
-	cacheFilePath := rs.getCacheFilePath(imagePath)
+// The API call is bound to ctx, so cancelling the request aborts it.
+func (rs *RekognitionService) DetectLabels(ctx context.Context, imagePath string, maxLabels int32, minConfidence float32) ([]types.Label, error) {
+	// Generate cache file path based on the image content and request parameters
+	cacheFilePath, err := rs.getCacheFilePath(imagePath, maxLabels, minConfidence)
+	if err != nil {
+		return nil, err
+	}
 
 	// Check if the cache file exists
-	if labels, err := rs.loadLabelsFromCache(cacheFilePath); err == nil {
-		return labels, nil
+	// The cache holds the unfiltered labels, so category thresholds can change between runs
+	var labels []types.Label
+	if err := rs.loadFromCache(cacheFilePath, &labels); err == nil {
+		return FilterLabelsByCategory(labels, rs.CategoryConfidence), nil
 	}
 
 	// If no cache, resize if needed and proceed to call Rekognition API
-	imageBytes, err := resizeImageIfNeeded(imagePath)
+	imageBytes, err := resizeImageIfNeeded(imagePath, rs.Interpolation)
 	if err != nil {
 		return nil, fmt.Errorf("failed to process image file '%s': %v", imagePath, err)
 	}
@@ -110,59 +132,233 @@ func (rs *RekognitionService) DetectLabels(imagePath string, maxLabels int32, mi
 		MinConfidence: aws.Float32(minConfidence),
 	}
 
-	result, err := rs.Client.DetectLabels(context.TODO(), input)
+	result, err := rs.Client.DetectLabels(ctx, input)
 	if err != nil {
 		return nil, fmt.Errorf("failed to detect labels for image '%s': %v", imagePath, err)
 	}
 
 	// Cache the detected labels
-	if err := rs.storeLabelsInCache(cacheFilePath, result.Labels); err != nil {
-		fmt.Printf("Warning: failed to cache labels for '%s': %v\n", imagePath, err)
+	if err := rs.storeInCache(cacheFilePath, result.Labels); err != nil {
+		logger.Warnf("Failed to cache labels for '%s': %v", imagePath, err)
+	}
+
+	return FilterLabelsByCategory(result.Labels, rs.CategoryConfidence), nil
+}
+
+// PrimaryBoundingBox returns the largest object instance box among the labels, or nil when
+// no label was localized. Rekognition only reports instances for object labels, such as "Shoe".
+func PrimaryBoundingBox(labels []types.Label) *types.BoundingBox {
+	var primary *types.BoundingBox
+	var primaryArea float32
+	for _, label := range labels {
+		for _, instance := range label.Instances {
+			box := instance.BoundingBox
+			if box == nil {
+				continue
+			}
+			area := aws.ToFloat32(box.Width) * aws.ToFloat32(box.Height)
+			if area > primaryArea {
+				primary, primaryArea = box, area
+			}
+		}
+	}
+	return primary
+}
+
+// FilterLabelsByCategory drops labels whose confidence is below the threshold of any of their categories.
+// Labels without a configured category are kept.
+func FilterLabelsByCategory(labels []types.Label, thresholds map[string]float32) []types.Label {
+	if len(thresholds) == 0 {
+		return labels
+	}
+
+	filtered := make([]types.Label, 0, len(labels))
+	for _, label := range labels {
+		keep := true
+		for _, category := range label.Categories {
+			if category.Name == nil {
+				continue
+			}
+			threshold, exists := thresholds[*category.Name]
+			if exists && aws.ToFloat32(label.Confidence) < threshold {
+				keep = false
+				break
+			}
+		}
+		if keep {
+			filtered = append(filtered, label)
+		}
+	}
+	return filtered
+}
+
+// DetectModerationLabels detects inappropriate content in an image using AWS Rekognition.
+// Results are cached alongside the regular labels, and the API call is bound to ctx.
+func (rs *RekognitionService) DetectModerationLabels(ctx context.Context, imagePath string, minConfidence float32) ([]types.ModerationLabel, error) {
+	cacheFilePath, err := rs.getModerationCacheFilePath(imagePath, minConfidence)
+	if err != nil {
+		return nil, err
+	}
+
+	var labels []types.ModerationLabel
+	if err := rs.loadFromCache(cacheFilePath, &labels); err == nil {
+		return labels, nil
+	}
+
+	imageBytes, err := resizeImageIfNeeded(imagePath, rs.Interpolation)
+	if err != nil {
+		return nil, fmt.Errorf("failed to process image file '%s': %v", imagePath, err)
+	}
+
+	input := &rekognition.DetectModerationLabelsInput{
+		Image: &types.Image{
+			Bytes: imageBytes,
+		},
+		MinConfidence: aws.Float32(minConfidence),
+	}
+
+	result, err := rs.Client.DetectModerationLabels(ctx, input)
+	if err != nil {
+		return nil, fmt.Errorf("failed to detect moderation labels for image '%s': %v", imagePath, err)
+	}
+
+	if err := rs.storeInCache(cacheFilePath, result.ModerationLabels); err != nil {
+		logger.Warnf("Failed to cache moderation labels for '%s': %v", imagePath, err)
+	}
+
+	return result.ModerationLabels, nil
+}
+
+// DetectText detects the words printed in an image, such as brand names or sizes, using AWS Rekognition.
+// Every detection is cached, so the confidence threshold is applied afterwards and can change between runs.
+// The API call is bound to ctx.
+func (rs *RekognitionService) DetectText(ctx context.Context, imagePath string, minConfidence float32) ([]string, error) {
+	cacheFilePath, err := rs.getTextCacheFilePath(imagePath)
+	if err != nil {
+		return nil, err
+	}
+
+	var detections []types.TextDetection
+	if err := rs.loadFromCache(cacheFilePath, &detections); err != nil {
+		imageBytes, err := resizeImageIfNeeded(imagePath, rs.Interpolation)
+		if err != nil {
+			return nil, fmt.Errorf("failed to process image file '%s': %v", imagePath, err)
+		}
+
+		result, err := rs.Client.DetectText(ctx, &rekognition.DetectTextInput{
+			Image: &types.Image{
+				Bytes: imageBytes,
+			},
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to detect text for image '%s': %v", imagePath, err)
+		}
+		detections = result.TextDetections
+
+		if err := rs.storeInCache(cacheFilePath, detections); err != nil {
+			logger.Warnf("Failed to cache text for '%s': %v", imagePath, err)
+		}
+	}
+
+	// Lines repeat the words they contain, so only words are returned
+	var words []string
+	for _, detection := range detections {
+		if detection.Type == types.TextTypesWord && aws.ToFloat32(detection.Confidence) >= minConfidence {
+			words = append(words, aws.ToString(detection.DetectedText))
+		}
+	}
+	return words, nil
+}
+
+// getCacheFilePath generates the path for the cache file based on the image content.
+// The parameters are part of the name since they change what Rekognition returns.
+func (rs *RekognitionService) getCacheFilePath(imagePath string, maxLabels int32, minConfidence float32) (string, error) {
+	hash, err := contentHash(imagePath)
+	if err != nil {
+		return "", err
+	}
+	fileName := fmt.Sprintf("%s_%d_%g_labels.json", hash, maxLabels, minConfidence)
+	return filepath.Join(rs.CacheDir, fileName), nil
+}
+
+// getModerationCacheFilePath generates the path for the moderation cache file based on the image content.
+func (rs *RekognitionService) getModerationCacheFilePath(imagePath string, minConfidence float32) (string, error) {
+	hash, err := contentHash(imagePath)
+	if err != nil {
+		return "", err
 	}
+	fileName := fmt.Sprintf("%s_%g_moderation.json", hash, minConfidence)
+	return filepath.Join(rs.CacheDir, fileName), nil
+}
 
-	return result.Labels, nil
+// getTextCacheFilePath generates the path for the text detection cache file based on the image content.
+func (rs *RekognitionService) getTextCacheFilePath(imagePath string) (string, error) {
+	hash, err := contentHash(imagePath)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(rs.CacheDir, hash+"_text.json"), nil
 }
 
-// getCacheFilePath generates the path for the cache file based on the image name.
-func (rs *RekognitionService) getCacheFilePath(imagePath string) string {
-	// Create a unique file name for the cache based on the image file name
-	fileName := filepath.Base(imagePath) + "_labels.json"
-	return filepath.Join(rs.CacheDir, fileName)
+// contentHash returns the hex SHA-256 of the file, so identical images share cache entries whatever their name
+func contentHash(imagePath string) (string, error) {
+	file, err := os.Open(imagePath)
+	if err != nil {
+		return "", fmt.Errorf("failed to open image file '%s': %v", imagePath, err)
+	}
+	defer file.Close()
+
+	hash := sha256.New()
+	if _, err := io.Copy(hash, file); err != nil {
+		return "", fmt.Errorf("failed to hash image file '%s': %v", imagePath, err)
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
 }
 
-// loadLabelsFromCache attempts to load labels from a cached JSON file.
-// Returns the labels if successful, otherwise returns an error.
-func (rs *RekognitionService) loadLabelsFromCache(cacheFilePath string) ([]types.Label, error) {
+// loadFromCache attempts to load cached results from a JSON file into v.
+// Returns an error if the cache file is missing or unreadable.
+func (rs *RekognitionService) loadFromCache(cacheFilePath string, v interface{}) error {
 	// Check if cache file exists
 	if _, err := os.Stat(cacheFilePath); os.IsNotExist(err) {
-		return nil, fmt.Errorf("cache file does not exist: %s", cacheFilePath)
+		return fmt.Errorf("cache file does not exist: %s", cacheFilePath)
 	}
 
 	// Read the cached file
 	cacheData, err := os.ReadFile(cacheFilePath)
 	if err != nil {
-		return nil, fmt.Errorf("failed to read cache file '%s': %v", cacheFilePath, err)
+		return fmt.Errorf("failed to read cache file '%s': %v", cacheFilePath, err)
 	}
 
 	// Parse the cached JSON file
-	var labels []types.Label
-	if err := json.Unmarshal(cacheData, &labels); err != nil {
-		return nil, fmt.Errorf("failed to unmarshal cache file '%s': %v", cacheFilePath, err)
+	if err := json.Unmarshal(cacheData, v); err != nil {
+		return fmt.Errorf("failed to unmarshal cache file '%s': %v", cacheFilePath, err)
 	}
 
-	return labels, nil
+	return nil
 }
 
-// storeLabelsInCache stores the detected labels in a JSON file in the cache directory.
-func (rs *RekognitionService) storeLabelsInCache(cacheFilePath string, labels []types.Label) error {
-	// Convert labels to JSON
-	cacheData, err := json.Marshal(labels)
+// storeInCache stores detection results in a JSON file in the cache directory.
+func (rs *RekognitionService) storeInCache(cacheFilePath string, v interface{}) error {
+	// Convert results to JSON
+	cacheData, err := json.Marshal(v)
 	if err != nil {
-		return fmt.Errorf("failed to marshal labels for cache file '%s': %v", cacheFilePath, err)
+		return fmt.Errorf("failed to marshal results for cache file '%s': %v", cacheFilePath, err)
+	}
+
+	// Write to a temporary file and rename it, so concurrent sessions sharing the cache never read a partial file
+	tmpFile, err := os.CreateTemp(filepath.Dir(cacheFilePath), filepath.Base(cacheFilePath)+".tmp_*")
+	if err != nil {
+		return fmt.Errorf("failed to write cache file '%s': %v", cacheFilePath, err)
 	}
+	defer os.Remove(tmpFile.Name())
 
-	// Write the JSON data to a file
-	err = os.WriteFile(cacheFilePath, cacheData, 0644)
+	_, err = tmpFile.Write(cacheData)
+	if closeErr := tmpFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmpFile.Name(), cacheFilePath)
+	}
 	if err != nil {
 		return fmt.Errorf("failed to write cache file '%s': %v", cacheFilePath, err)
 	}
@@ -170,8 +366,11 @@ func (rs *RekognitionService) storeLabelsInCache(cacheFilePath string, labels []
 	return nil
 }
 
+// resize is gocv.Resize, swapped in tests to observe how images are scaled
+var resize = gocv.Resize
+
 // resizeImageIfNeeded resizes the image if it's larger than MaxImageSize
-func resizeImageIfNeeded(imagePath string) ([]byte, error) {
+func resizeImageIfNeeded(imagePath string, interpolation gocv.InterpolationFlags) ([]byte, error) {
 	// Read the file
 	fileInfo, err := os.Stat(imagePath)
 	if err != nil {
@@ -183,14 +382,14 @@ func resizeImageIfNeeded(imagePath string) ([]byte, error) {
 		return os.ReadFile(imagePath)
 	}
 
-	log.Printf("Image %s is too large (%d bytes), resizing...", imagePath, fileInfo.Size())
+	logger.Infof("Image %s is too large (%d bytes), resizing...", imagePath, fileInfo.Size())
 
 	// Read image using gocv
 	img := gocv.IMRead(imagePath, gocv.IMReadColor)
+	defer img.Close()
 	if img.Empty() {
 		return nil, fmt.Errorf("failed to read image for resizing")
 	}
-	defer img.Close()
 
 	// Calculate new dimensions while maintaining aspect ratio
 	originalSize := img.Size()
@@ -212,7 +411,7 @@ func resizeImageIfNeeded(imagePath string) ([]byte, error) {
 	defer resized.Close()
 
 	// Resize the image
-	gocv.Resize(img, &resized, image.Point{X: newWidth, Y: newHeight}, 0, 0, gocv.InterpolationLinear)
+	resize(img, &resized, image.Point{X: newWidth, Y: newHeight}, 0, 0, interpolation)
 
 	// Create a temporary file for the resized image
 	tempFile, err := os.CreateTemp("", "resize_*.jpg")
@@ -237,12 +436,12 @@ func resizeImageIfNeeded(imagePath string) ([]byte, error) {
 
 	// If still too large, try again with more aggressive resizing
 	if len(resizedData) > MaxImageSize {
-		log.Printf("Image still too large after initial resize (%d bytes), reducing dimensions further", len(resizedData))
+		logger.Warnf("Image still too large after initial resize (%d bytes), reducing dimensions further", len(resizedData))
 
 		// Try with smaller dimensions
 		newWidth = newWidth / 2
 		newHeight = newHeight / 2
-		gocv.Resize(img, &resized, image.Point{X: newWidth, Y: newHeight}, 0, 0, gocv.InterpolationLinear)
+		resize(img, &resized, image.Point{X: newWidth, Y: newHeight}, 0, 0, interpolation)
 
 		success = gocv.IMWrite(tempPath, resized)
 		if !success {
@@ -255,6 +454,6 @@ func resizeImageIfNeeded(imagePath string) ([]byte, error) {
 		}
 	}
 
-	log.Printf("Successfully resized image from %d bytes to %d bytes", fileInfo.Size(), len(resizedData))
+	logger.Infof("Successfully resized image from %d bytes to %d bytes", fileInfo.Size(), len(resizedData))
 	return resizedData, nil
 }
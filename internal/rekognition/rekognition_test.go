@@ -0,0 +1,136 @@
+package rekognition
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/rekognition"
+	"github.com/aws/aws-sdk-go-v2/service/rekognition/types"
+)
+
+// writeTestFile writes data to name in dir and returns its path
+func writeTestFile(t *testing.T, dir, name string, data []byte) string {
+	t.Helper()
+	path := filepath.Join(dir, name)
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestDetectLabelsStopsWhenTheContextIsCancelled(t *testing.T) {
+	// The endpoint does not answer until the test ends, so only cancellation can end the call
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+	}))
+	defer server.Close()
+	defer close(release)
+
+	service := &RekognitionService{
+		Client: rekognition.New(rekognition.Options{
+			Region:       "us-east-1",
+			BaseEndpoint: aws.String(server.URL),
+			Credentials:  aws.AnonymousCredentials{},
+		}),
+		CacheDir: t.TempDir(),
+	}
+	path := writeTestFile(t, t.TempDir(), "shoe.jpg", []byte("not really a jpeg"))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+	start := time.Now()
+	_, err := service.DetectLabels(ctx, path, 10, 75)
+
+	if err == nil || !strings.Contains(err.Error(), context.Canceled.Error()) {
+		t.Errorf("err = %v, want the cancellation reported", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("cancelled call took %s to return", elapsed)
+	}
+}
+
+// categorizedLabel returns a label with the given confidence in the given categories
+func categorizedLabel(name string, confidence float32, categories ...string) types.Label {
+	label := types.Label{Name: aws.String(name), Confidence: aws.Float32(confidence)}
+	for _, category := range categories {
+		label.Categories = append(label.Categories, types.LabelCategory{Name: aws.String(category)})
+	}
+	return label
+}
+
+func TestFilterLabelsByCategory(t *testing.T) {
+	labels := []types.Label{
+		categorizedLabel("Sneaker", 80, "Footwear"),
+		categorizedLabel("Clothing", 85, "Apparel and Accessories"),
+		categorizedLabel("Apparel", 95, "Apparel and Accessories"),
+		categorizedLabel("Shoe", 78, "Footwear", "Apparel and Accessories"),
+		categorizedLabel("Outdoors", 60, "Nature and Outdoors"),
+	}
+	thresholds := map[string]float32{"Apparel and Accessories": 90, "Footwear": 75}
+
+	var kept []string
+	for _, label := range FilterLabelsByCategory(labels, thresholds) {
+		kept = append(kept, *label.Name)
+	}
+	// Generic apparel labels need 90, footwear 75, and uncategorized thresholds keep everything
+	if want := "Sneaker,Apparel,Outdoors"; strings.Join(kept, ",") != want {
+		t.Errorf("kept %v, want %s", kept, want)
+	}
+
+	if got := FilterLabelsByCategory(labels, nil); len(got) != len(labels) {
+		t.Errorf("kept %d of %d labels without thresholds", len(got), len(labels))
+	}
+}
+
+// countingRekognition answers label requests with a single label and counts them
+type countingRekognition struct {
+	RekognitionAPI
+	calls int
+}
+
+func (c *countingRekognition) DetectLabels(ctx context.Context, params *rekognition.DetectLabelsInput, optFns ...func(*rekognition.Options)) (*rekognition.DetectLabelsOutput, error) {
+	c.calls++
+	return &rekognition.DetectLabelsOutput{Labels: []types.Label{categorizedLabel("Shoe", 95)}}, nil
+}
+
+func TestSharedCacheServesTheSameImageAcrossSessions(t *testing.T) {
+	client := &countingRekognition{}
+	sharedCache := t.TempDir()
+	image := []byte("the same product photo")
+
+	// Each session stores the upload under its own directory and name
+	for session, name := range []string{"first.jpg", "second.jpg"} {
+		service := &RekognitionService{Client: client, CacheDir: sharedCache}
+		path := writeTestFile(t, t.TempDir(), name, image)
+		labels, err := service.DetectLabels(context.Background(), path, 10, 75)
+		if err != nil {
+			t.Fatalf("session %d: %v", session, err)
+		}
+		if len(labels) != 1 || *labels[0].Name != "Shoe" {
+			t.Errorf("session %d: labels = %v, want Shoe", session, labels)
+		}
+	}
+	if client.calls != 1 {
+		t.Errorf("Rekognition was called %d times, want once with the second session served from the cache", client.calls)
+	}
+
+	// Different content is not served from the cache
+	service := &RekognitionService{Client: client, CacheDir: sharedCache}
+	if _, err := service.DetectLabels(context.Background(), writeTestFile(t, t.TempDir(), "first.jpg", []byte("another photo")), 10, 75); err != nil {
+		t.Fatal(err)
+	}
+	if client.calls != 2 {
+		t.Errorf("Rekognition was called %d times, want a second call for new content", client.calls)
+	}
+}
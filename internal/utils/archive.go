@@ -0,0 +1,225 @@
+package utils
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// MaxArchiveUncompressedSize caps the total uncompressed size of the archives uploaded in one request
+const MaxArchiveUncompressedSize = 512 << 20
+
+// imageExtensions lists the file extensions treated as images inside archives
+var imageExtensions = map[string]bool{
+	".jpg":  true,
+	".jpeg": true,
+	".png":  true,
+	".gif":  true,
+	".webp": true,
+	".bmp":  true,
+	".heic": true,
+	".heif": true,
+}
+
+// Magic bytes identifying the supported archive formats
+var (
+	zipMagic  = []byte("PK\x03\x04")
+	gzipMagic = []byte{0x1f, 0x8b}
+)
+
+// ArchiveEntry is an image extracted from an uploaded archive
+type ArchiveEntry struct {
+	Name string
+	Data []byte
+}
+
+// ArchiveError reports an archive that cannot be extracted: an unsupported or malformed archive, an entry
+// escaping the archive root, or contents over the size limit
+type ArchiveError struct {
+	Err error
+}
+
+func (e *ArchiveError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *ArchiveError) Unwrap() error {
+	return e.Err
+}
+
+// IsImageFilename reports whether the filename has a supported image extension
+func IsImageFilename(name string) bool {
+	return imageExtensions[strings.ToLower(filepath.Ext(name))]
+}
+
+// WalkArchiveImages calls visit with the base name and contents of every image in a ZIP or gzip-compressed
+// tar archive of the given size, detecting the format from its leading magic bytes. The archive is read in
+// place and each entry is streamed, so neither has to fit in memory. The uncompressed bytes are charged to
+// budget, which the archives of one request share. Problems with the archive itself, including an exhausted
+// budget, are returned as an *ArchiveError, even when they surface while visit reads an entry; errors of
+// visit are returned as they are.
+func WalkArchiveImages(archive io.ReaderAt, size int64, budget *ByteBudget, visit func(name string, r io.Reader) error) error {
+	magic := make([]byte, len(zipMagic))
+	n, _ := archive.ReadAt(magic, 0)
+	magic = magic[:n]
+	switch {
+	case bytes.HasPrefix(magic, zipMagic):
+		return walkZipImages(archive, size, budget, visit)
+	case bytes.HasPrefix(magic, gzipMagic):
+		return walkTarGzImages(io.NewSectionReader(archive, 0, size), budget, visit)
+	default:
+		return &ArchiveError{fmt.Errorf("unsupported archive format; expected .zip or .tar.gz")}
+	}
+}
+
+// ExtractArchiveImages reads every image from a ZIP or gzip-compressed tar archive into memory,
+// as WalkArchiveImages visits them
+func ExtractArchiveImages(archive io.ReaderAt, size int64, maxTotalSize int64) ([]ArchiveEntry, error) {
+	var entries []ArchiveEntry
+	err := WalkArchiveImages(archive, size, NewByteBudget(maxTotalSize), collectArchiveEntries(&entries))
+	return entries, err
+}
+
+// ExtractZipImages reads every image entry from a ZIP archive of the given size into memory.
+// Non-image entries are skipped; entries escaping the archive root or a total
+// uncompressed size above maxTotalSize reject the whole archive.
+func ExtractZipImages(archive io.ReaderAt, size int64, maxTotalSize int64) ([]ArchiveEntry, error) {
+	var entries []ArchiveEntry
+	err := walkZipImages(archive, size, NewByteBudget(maxTotalSize), collectArchiveEntries(&entries))
+	return entries, err
+}
+
+// ExtractTarGzImages reads every image entry from a gzip-compressed tar stream into memory,
+// applying the same protections as ExtractZipImages. Links and other special entries are skipped.
+func ExtractTarGzImages(archive io.Reader, maxTotalSize int64) ([]ArchiveEntry, error) {
+	var entries []ArchiveEntry
+	err := walkTarGzImages(archive, NewByteBudget(maxTotalSize), collectArchiveEntries(&entries))
+	return entries, err
+}
+
+// collectArchiveEntries returns a visitor appending every entry it is given to entries
+func collectArchiveEntries(entries *[]ArchiveEntry) func(string, io.Reader) error {
+	return func(name string, r io.Reader) error {
+		data, err := io.ReadAll(r)
+		if err != nil {
+			return err
+		}
+		*entries = append(*entries, ArchiveEntry{Name: name, Data: data})
+		return nil
+	}
+}
+
+// walkZipImages visits every image entry of a ZIP archive of the given size
+func walkZipImages(archive io.ReaderAt, size int64, budget *ByteBudget, visit func(string, io.Reader) error) error {
+	reader, err := zip.NewReader(archive, size)
+	if err != nil {
+		return &ArchiveError{fmt.Errorf("failed to open zip archive: %v", err)}
+	}
+
+	for _, file := range reader.File {
+		if !isSafeArchivePath(file.Name) {
+			return &ArchiveError{fmt.Errorf("archive entry %q escapes the archive root", file.Name)}
+		}
+		if file.FileInfo().IsDir() || !IsImageFilename(file.Name) {
+			continue
+		}
+
+		rc, err := file.Open()
+		if err != nil {
+			return &ArchiveError{fmt.Errorf("failed to open archive entry %s: %v", file.Name, err)}
+		}
+		err = visitArchiveEntry(rc, file.Name, budget, visit)
+		rc.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// walkTarGzImages visits every image entry of a gzip-compressed tar stream
+func walkTarGzImages(archive io.Reader, budget *ByteBudget, visit func(string, io.Reader) error) error {
+	gz, err := gzip.NewReader(archive)
+	if err != nil {
+		return &ArchiveError{fmt.Errorf("failed to open gzip stream: %v", err)}
+	}
+	defer gz.Close()
+
+	reader := tar.NewReader(gz)
+	for {
+		header, err := reader.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return &ArchiveError{fmt.Errorf("failed to read tar archive: %v", err)}
+		}
+
+		if !isSafeArchivePath(header.Name) {
+			return &ArchiveError{fmt.Errorf("archive entry %q escapes the archive root", header.Name)}
+		}
+		if header.Typeflag != tar.TypeReg || !IsImageFilename(header.Name) {
+			continue
+		}
+
+		if err := visitArchiveEntry(reader, header.Name, budget, visit); err != nil {
+			return err
+		}
+	}
+}
+
+// visitArchiveEntry passes one entry to visit while keeping the uncompressed bytes within the budget.
+// The budget is charged as visit reads, so oversized entries are detected regardless of the size declared
+// in the archive header. Any read or size error is returned in place of the error visit reports for it.
+func visitArchiveEntry(r io.Reader, name string, budget *ByteBudget, visit func(string, io.Reader) error) error {
+	entry := &archiveEntryReader{r: r, name: name, budget: budget}
+	err := visit(path.Base(name), entry)
+	if entry.err != nil {
+		return entry.err
+	}
+	return err
+}
+
+// archiveEntryReader reads an archive entry, charging its bytes to the uncompressed size budget
+type archiveEntryReader struct {
+	r      io.Reader
+	name   string
+	budget *ByteBudget
+	err    *ArchiveError // First read or size error, kept so it is reported as an archive problem
+}
+
+func (e *archiveEntryReader) Read(p []byte) (int, error) {
+	if e.err != nil {
+		return 0, e.err
+	}
+	n, err := e.r.Read(p)
+	switch {
+	case e.budget.remaining.Add(-int64(n)) < 0:
+		e.err = &ArchiveError{fmt.Errorf("archives exceed the maximum uncompressed size of %d bytes", e.budget.size)}
+	case err != nil && err != io.EOF:
+		e.err = &ArchiveError{fmt.Errorf("failed to read archive entry %s: %v", e.name, err)}
+	default:
+		return n, err
+	}
+	return n, e.err
+}
+
+// isSafeArchivePath rejects absolute paths and entries containing parent directory references
+func isSafeArchivePath(name string) bool {
+	name = strings.ReplaceAll(name, "\\", "/")
+	if strings.HasPrefix(name, "/") || filepath.IsAbs(name) {
+		return false
+	}
+	for _, part := range strings.Split(name, "/") {
+		if part == ".." {
+			return false
+		}
+	}
+	return true
+}
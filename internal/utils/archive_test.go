@@ -0,0 +1,144 @@
+package utils
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+)
+
+// zipArchive builds a ZIP archive holding the named files
+func zipArchive(t *testing.T, files map[string][]byte) *bytes.Reader {
+	t.Helper()
+	var buf bytes.Buffer
+	writer := zip.NewWriter(&buf)
+	for name, data := range files {
+		entry, err := writer.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		entry.Write(data)
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return bytes.NewReader(buf.Bytes())
+}
+
+// tarGzArchive builds a gzip-compressed tar archive holding the named files in order
+func tarGzArchive(t *testing.T, names []string, files map[string][]byte) *bytes.Reader {
+	t.Helper()
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	writer := tar.NewWriter(gz)
+	for _, name := range names {
+		data := files[name]
+		if err := writer.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(data)), Typeflag: tar.TypeReg}); err != nil {
+			t.Fatal(err)
+		}
+		writer.Write(data)
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := gz.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return bytes.NewReader(buf.Bytes())
+}
+
+func TestExtractZipImagesKeepsImagesOnly(t *testing.T) {
+	archive := zipArchive(t, map[string][]byte{
+		"shoes/red.jpg":  []byte("red"),
+		"shoes/blue.PNG": []byte("blue"),
+		"readme.txt":     []byte("not an image"),
+	})
+
+	entries, err := ExtractZipImages(archive, archive.Size(), MaxArchiveUncompressedSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := map[string]string{}
+	for _, entry := range entries {
+		got[entry.Name] = string(entry.Data)
+	}
+	if len(got) != 2 || got["red.jpg"] != "red" || got["blue.PNG"] != "blue" {
+		t.Errorf("extracted %v, want red.jpg and blue.PNG under their base names", got)
+	}
+}
+
+func TestExtractZipImagesRejectsZipSlip(t *testing.T) {
+	for _, name := range []string{"../evil.jpg", "images/../../evil.jpg", "/etc/evil.jpg", `..\evil.jpg`} {
+		archive := zipArchive(t, map[string][]byte{"ok.jpg": []byte("ok"), name: []byte("evil")})
+		_, err := ExtractZipImages(archive, archive.Size(), MaxArchiveUncompressedSize)
+		if err == nil || !strings.Contains(err.Error(), "escapes the archive root") {
+			t.Errorf("%s: err = %v, want the archive rejected", name, err)
+		}
+	}
+}
+
+func TestExtractZipImagesLimitsUncompressedSize(t *testing.T) {
+	// Highly compressible entries stand in for a decompression bomb
+	archive := zipArchive(t, map[string][]byte{
+		"a.jpg": bytes.Repeat([]byte{0}, 600),
+		"b.jpg": bytes.Repeat([]byte{0}, 600),
+	})
+	_, err := ExtractZipImages(archive, archive.Size(), 1000)
+	if err == nil || !strings.Contains(err.Error(), "maximum uncompressed size") {
+		t.Errorf("err = %v, want the size limit enforced", err)
+	}
+}
+
+func TestExtractArchiveImagesReadsTarGz(t *testing.T) {
+	files := map[string][]byte{
+		"bundle/red.jpg": []byte("red"),
+		"bundle/notes":   []byte("not an image"),
+		"blue.png":       []byte("blue"),
+	}
+	archive := tarGzArchive(t, []string{"bundle/red.jpg", "bundle/notes", "blue.png"}, files)
+
+	entries, err := ExtractArchiveImages(archive, archive.Size(), MaxArchiveUncompressedSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := map[string]string{}
+	for _, entry := range entries {
+		got[entry.Name] = string(entry.Data)
+	}
+	if len(got) != 2 || got["red.jpg"] != "red" || got["blue.png"] != "blue" {
+		t.Errorf("extracted %v, want red.jpg and blue.png under their base names", got)
+	}
+}
+
+func TestExtractArchiveImagesRejectsTarGzPathEscape(t *testing.T) {
+	files := map[string][]byte{"ok.jpg": []byte("ok"), "../../evil.jpg": []byte("evil")}
+	archive := tarGzArchive(t, []string{"ok.jpg", "../../evil.jpg"}, files)
+
+	_, err := ExtractArchiveImages(archive, archive.Size(), MaxArchiveUncompressedSize)
+	if err == nil || !strings.Contains(err.Error(), "escapes the archive root") {
+		t.Errorf("err = %v, want the archive rejected", err)
+	}
+}
+
+func TestWalkArchiveImagesSharesTheBudgetAcrossArchives(t *testing.T) {
+	budget := NewByteBudget(1000)
+	visit := func(name string, r io.Reader) error {
+		_, err := io.Copy(io.Discard, r)
+		return err
+	}
+
+	first := zipArchive(t, map[string][]byte{"a.jpg": bytes.Repeat([]byte{0}, 600)})
+	if err := WalkArchiveImages(first, first.Size(), budget, visit); err != nil {
+		t.Fatalf("the first archive is within the budget: %v", err)
+	}
+	second := tarGzArchive(t, []string{"b.jpg"}, map[string][]byte{"b.jpg": bytes.Repeat([]byte{0}, 600)})
+	err := WalkArchiveImages(second, second.Size(), budget, visit)
+	var archiveErr *ArchiveError
+	if !errors.As(err, &archiveErr) || !strings.Contains(err.Error(), "maximum uncompressed size of 1000 bytes") {
+		t.Errorf("err = %v, want the second archive rejected over the shared budget", err)
+	}
+}
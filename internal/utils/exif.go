@@ -0,0 +1,208 @@
+package utils
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// EXIF tags read by ReadEXIF
+const (
+	exifTagMake             = 0x010f
+	exifTagModel            = 0x0110
+	exifTagOrientation      = 0x0112
+	exifTagSoftware         = 0x0131
+	exifTagDateTime         = 0x0132
+	exifTagExifIFD          = 0x8769
+	exifTagDateTimeOriginal = 0x9003
+	exifTagLensModel        = 0xa434
+)
+
+// ReadEXIF returns the camera make, model, lens, software and capture date of a JPEG as
+// "make", "model", "lens", "software" and "date" entries. The date is the day the photo was
+// taken, formatted YYYY-MM-DD. Tags that are absent are left out, and files without EXIF data,
+// including non-JPEG images, yield an empty map rather than an error.
+func ReadEXIF(imagePath string) (map[string]string, error) {
+	file, err := os.Open(imagePath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open image %s: %v", imagePath, err)
+	}
+	defer file.Close()
+
+	segment, err := findEXIFSegment(bufio.NewReader(file))
+	if err != nil || segment == nil {
+		return map[string]string{}, nil
+	}
+	return parseEXIF(segment), nil
+}
+
+// ImageOrientation returns the EXIF orientation of a JPEG, from 1 (upright) to 8. Images without
+// the tag, or that cannot be read, are reported as upright. Orientations 5 to 8 turn the image a
+// quarter turn, so its displayed width and height are the stored ones swapped.
+func ImageOrientation(imagePath string) int {
+	file, err := os.Open(imagePath)
+	if err != nil {
+		return 1
+	}
+	defer file.Close()
+	return readOrientation(file)
+}
+
+// readOrientation returns the EXIF orientation of the JPEG read from r, or 1 when it has none
+func readOrientation(r io.Reader) int {
+	segment, err := findEXIFSegment(bufio.NewReader(r))
+	if err != nil || len(segment) < 8 {
+		return 1
+	}
+
+	var order binary.ByteOrder
+	switch string(segment[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return 1
+	}
+	value := readIFD(segment, order, order.Uint32(segment[4:8]))[exifTagOrientation]
+	if len(value) < 2 {
+		return 1
+	}
+	if orientation := int(order.Uint16(value)); orientation >= 1 && orientation <= 8 {
+		return orientation
+	}
+	return 1
+}
+
+// findEXIFSegment walks the JPEG markers up to the image data and returns the TIFF payload of the EXIF APP1 segment
+func findEXIFSegment(r *bufio.Reader) ([]byte, error) {
+	var soi [2]byte
+	if _, err := io.ReadFull(r, soi[:]); err != nil || soi != [2]byte{0xff, 0xd8} {
+		return nil, fmt.Errorf("not a JPEG file")
+	}
+
+	for {
+		var header [4]byte
+		if _, err := io.ReadFull(r, header[:2]); err != nil {
+			return nil, err
+		}
+		if header[0] != 0xff {
+			return nil, fmt.Errorf("invalid JPEG marker")
+		}
+		marker := header[1]
+		// Start of scan or end of image: metadata segments always come before
+		if marker == 0xda || marker == 0xd9 {
+			return nil, nil
+		}
+		// Standalone markers carry no length
+		if marker == 0x01 || (marker >= 0xd0 && marker <= 0xd7) || marker == 0xff {
+			continue
+		}
+
+		if _, err := io.ReadFull(r, header[2:]); err != nil {
+			return nil, err
+		}
+		length := int(binary.BigEndian.Uint16(header[2:])) - 2
+		if length < 0 {
+			return nil, fmt.Errorf("invalid JPEG segment length")
+		}
+		payload := make([]byte, length)
+		if _, err := io.ReadFull(r, payload); err != nil {
+			return nil, err
+		}
+		if marker == 0xe1 && bytes.HasPrefix(payload, []byte("Exif\x00\x00")) {
+			return payload[6:], nil
+		}
+	}
+}
+
+// parseEXIF reads the supported tags from a TIFF structure, ignoring anything malformed
+func parseEXIF(tiff []byte) map[string]string {
+	fields := map[string]string{}
+	if len(tiff) < 8 {
+		return fields
+	}
+
+	var order binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return fields
+	}
+
+	ifd0 := readIFD(tiff, order, order.Uint32(tiff[4:8]))
+	exifIFD := map[uint16][]byte{}
+	if pointer, ok := ifd0[exifTagExifIFD]; ok && len(pointer) >= 4 {
+		exifIFD = readIFD(tiff, order, order.Uint32(pointer))
+	}
+
+	text := func(value []byte) string {
+		return strings.TrimSpace(strings.TrimRight(string(value), "\x00"))
+	}
+	for name, tag := range map[string]uint16{"make": exifTagMake, "model": exifTagModel, "software": exifTagSoftware} {
+		if value := text(ifd0[tag]); value != "" {
+			fields[name] = value
+		}
+	}
+	if value := text(exifIFD[exifTagLensModel]); value != "" {
+		fields["lens"] = value
+	}
+
+	// Dates are written "YYYY:MM:DD HH:MM:SS"; only the day is kept so a photoshoot shares one value
+	date := text(exifIFD[exifTagDateTimeOriginal])
+	if date == "" {
+		date = text(ifd0[exifTagDateTime])
+	}
+	if len(date) >= 10 && date[:4] != "0000" {
+		fields["date"] = strings.ReplaceAll(date[:10], ":", "-")
+	}
+	return fields
+}
+
+// readIFD returns the raw values of the ASCII, SHORT and LONG entries of the IFD at offset, keyed by tag
+func readIFD(tiff []byte, order binary.ByteOrder, offset uint32) map[uint16][]byte {
+	entries := map[uint16][]byte{}
+	if int64(offset)+2 > int64(len(tiff)) {
+		return entries
+	}
+	count := int(order.Uint16(tiff[offset:]))
+	for i := 0; i < count; i++ {
+		start := int(offset) + 2 + i*12
+		if start+12 > len(tiff) {
+			break
+		}
+		entry := tiff[start : start+12]
+		tag, valueType, valueCount := order.Uint16(entry), order.Uint16(entry[2:]), order.Uint32(entry[4:])
+
+		var size uint64
+		switch valueType {
+		case 2: // ASCII
+			size = uint64(valueCount)
+		case 3: // SHORT
+			size = 2 * uint64(valueCount)
+		case 4: // LONG
+			size = 4 * uint64(valueCount)
+		default:
+			continue
+		}
+
+		// Values of up to four bytes are stored in the entry itself, longer ones at an offset
+		if size <= 4 {
+			entries[tag] = entry[8 : 8+size]
+			continue
+		}
+		valueOffset := uint64(order.Uint32(entry[8:]))
+		if valueOffset+size > uint64(len(tiff)) {
+			continue
+		}
+		entries[tag] = tiff[valueOffset : valueOffset+size]
+	}
+	return entries
+}
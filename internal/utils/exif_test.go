@@ -0,0 +1,75 @@
+package utils
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/jpeg"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// orientedJPEG encodes a width × height JPEG with an EXIF APP1 segment carrying the orientation
+func orientedJPEG(t *testing.T, width, height, orientation int) []byte {
+	t.Helper()
+	var encoded bytes.Buffer
+	if err := jpeg.Encode(&encoded, image.NewGray(image.Rect(0, 0, width, height)), nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// Big-endian TIFF header, then IFD0 with a single SHORT orientation entry
+	tiff := []byte("MM\x00\x2a\x00\x00\x00\x08")
+	tiff = binary.BigEndian.AppendUint16(tiff, 1)
+	tiff = binary.BigEndian.AppendUint16(tiff, exifTagOrientation)
+	tiff = binary.BigEndian.AppendUint16(tiff, 3)
+	tiff = binary.BigEndian.AppendUint32(tiff, 1)
+	tiff = binary.BigEndian.AppendUint16(tiff, uint16(orientation))
+	tiff = append(tiff, 0, 0, 0, 0, 0, 0)
+	payload := append([]byte("Exif\x00\x00"), tiff...)
+
+	segment := []byte{0xff, 0xe1}
+	segment = binary.BigEndian.AppendUint16(segment, uint16(len(payload)+2))
+	segment = append(segment, payload...)
+
+	data := encoded.Bytes()
+	return append(append(append([]byte{}, data[:2]...), segment...), data[2:]...)
+}
+
+func TestImageOrientation(t *testing.T) {
+	dir := t.TempDir()
+	for _, orientation := range []int{1, 3, 6, 8} {
+		path := filepath.Join(dir, "oriented.jpg")
+		if err := os.WriteFile(path, orientedJPEG(t, 4, 2, orientation), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if got := ImageOrientation(path); got != orientation {
+			t.Errorf("orientation %d: got %d", orientation, got)
+		}
+	}
+
+	// Images without the tag are upright
+	path := writeTestPNG(t, dir, "plain.png")
+	if got := ImageOrientation(filepath.Join(dir, path)); got != 1 {
+		t.Errorf("PNG orientation = %d, want 1", got)
+	}
+}
+
+func TestImageDimensionsAppliesOrientation(t *testing.T) {
+	tests := []struct {
+		orientation   int
+		width, height int
+	}{
+		{1, 40, 20},
+		{3, 40, 20},
+		{5, 20, 40},
+		{6, 20, 40},
+		{8, 20, 40},
+	}
+	for _, tt := range tests {
+		width, height, ok := ImageDimensions(bytes.NewReader(orientedJPEG(t, 40, 20, tt.orientation)))
+		if !ok || width != tt.width || height != tt.height {
+			t.Errorf("orientation %d: got %dx%d (ok=%v), want %dx%d", tt.orientation, width, height, ok, tt.width, tt.height)
+		}
+	}
+}
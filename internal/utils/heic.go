@@ -0,0 +1,29 @@
+package utils
+
+import (
+	"bytes"
+	"errors"
+)
+
+// ErrHEICUnsupported is returned for HEIC uploads when HEIC conversion is not compiled in
+var ErrHEICUnsupported = errors.New("HEIC images are not supported by this build; rebuild with -tags heic")
+
+// heicBrands lists the ISO base media file brands used by HEIC and HEIF images
+var heicBrands = [][]byte{
+	[]byte("heic"), []byte("heix"), []byte("heim"), []byte("heis"),
+	[]byte("hevc"), []byte("hevx"), []byte("mif1"), []byte("msf1"),
+}
+
+// IsHEIC reports whether data starts with an ftyp box carrying a HEIC or HEIF brand
+func IsHEIC(data []byte) bool {
+	if len(data) < 12 || !bytes.Equal(data[4:8], []byte("ftyp")) {
+		return false
+	}
+	brand := data[8:12]
+	for _, heicBrand := range heicBrands {
+		if bytes.Equal(brand, heicBrand) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,51 @@
+//go:build heic
+
+package utils
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// ConvertHEICToJPEG converts HEIC image data to JPEG using the heif-convert tool from libheif.
+// HEIC_CONVERTER overrides the path to the tool.
+func ConvertHEICToJPEG(data []byte) ([]byte, error) {
+	dir, err := os.MkdirTemp("", "heic_*")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create HEIC conversion directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	inputPath := filepath.Join(dir, "input.heic")
+	outputPath := filepath.Join(dir, "output.jpg")
+	if err := os.WriteFile(inputPath, data, 0644); err != nil {
+		return nil, fmt.Errorf("failed to write HEIC image: %v", err)
+	}
+
+	if err := ConvertHEICFile(inputPath, outputPath); err != nil {
+		return nil, err
+	}
+
+	jpegData, err := os.ReadFile(outputPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read converted HEIC image: %v", err)
+	}
+	return jpegData, nil
+}
+
+// ConvertHEICFile converts the HEIC image at inputPath to a JPEG at outputPath without reading either into memory
+func ConvertHEICFile(inputPath, outputPath string) error {
+	converter := os.Getenv("HEIC_CONVERTER")
+	if converter == "" {
+		converter = "heif-convert"
+	}
+
+	output, err := exec.Command(converter, "-q", "90", inputPath, outputPath).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("failed to convert HEIC image: %v: %s", err, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
@@ -0,0 +1,71 @@
+//go:build heic
+
+package utils
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+)
+
+// sampleHEIC encodes a small solid image as HEIC with heif-enc from libheif, skipping the test without it
+func sampleHEIC(t *testing.T, width, height int) []byte {
+	t.Helper()
+	encoder, err := exec.LookPath("heif-enc")
+	if err != nil {
+		t.Skip("heif-enc is not installed")
+	}
+
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			img.Set(x, y, color.RGBA{R: 200, G: 40, B: 40, A: 255})
+		}
+	}
+	dir := t.TempDir()
+	pngPath := filepath.Join(dir, "sample.png")
+	heicPath := filepath.Join(dir, "sample.heic")
+	var encoded bytes.Buffer
+	if err := png.Encode(&encoded, img); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(pngPath, encoded.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if output, err := exec.Command(encoder, "-o", heicPath, pngPath).CombinedOutput(); err != nil {
+		t.Fatalf("failed to encode the sample HEIC: %v: %s", err, output)
+	}
+	data, err := os.ReadFile(heicPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestConvertHEICToJPEG(t *testing.T) {
+	if _, err := exec.LookPath("heif-convert"); err != nil && os.Getenv("HEIC_CONVERTER") == "" {
+		t.Skip("heif-convert is not installed")
+	}
+	data := sampleHEIC(t, 64, 48)
+	if !IsHEIC(data) {
+		t.Fatal("the sample is not recognized as HEIC")
+	}
+
+	converted, err := ConvertHEICToJPEG(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	img, err := jpeg.Decode(bytes.NewReader(converted))
+	if err != nil {
+		t.Fatalf("the converted image is not a JPEG: %v", err)
+	}
+	if size := img.Bounds().Size(); size.X != 64 || size.Y != 48 {
+		t.Errorf("converted image is %dx%d, want 64x48", size.X, size.Y)
+	}
+}
@@ -0,0 +1,22 @@
+package utils
+
+import "testing"
+
+func TestIsHEIC(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+		want bool
+	}{
+		{"heic brand", []byte("\x00\x00\x00\x18ftypheic\x00\x00\x00\x00"), true},
+		{"heif brand", []byte("\x00\x00\x00\x18ftypmif1\x00\x00\x00\x00"), true},
+		{"mp4 brand", []byte("\x00\x00\x00\x18ftypisom\x00\x00\x00\x00"), false},
+		{"png", []byte("\x89PNG\r\n\x1a\n\x00\x00\x00\x0dIHDR"), false},
+		{"too short", []byte("ftyp"), false},
+	}
+	for _, tt := range tests {
+		if got := IsHEIC(tt.data); got != tt.want {
+			t.Errorf("%s: IsHEIC = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
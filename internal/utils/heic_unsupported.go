@@ -0,0 +1,13 @@
+//go:build !heic
+
+package utils
+
+// ConvertHEICToJPEG always fails when the binary is built without the heic tag
+func ConvertHEICToJPEG(data []byte) ([]byte, error) {
+	return nil, ErrHEICUnsupported
+}
+
+// ConvertHEICFile always fails when the binary is built without the heic tag
+func ConvertHEICFile(inputPath, outputPath string) error {
+	return ErrHEICUnsupported
+}
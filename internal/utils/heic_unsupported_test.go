@@ -0,0 +1,14 @@
+//go:build !heic
+
+package utils
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestConvertHEICToJPEGWithoutTheHeicTag(t *testing.T) {
+	if _, err := ConvertHEICToJPEG([]byte("\x00\x00\x00\x18ftypheic")); !errors.Is(err, ErrHEICUnsupported) {
+		t.Errorf("err = %v, want ErrHEICUnsupported", err)
+	}
+}
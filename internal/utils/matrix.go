@@ -0,0 +1,125 @@
+package utils
+
+import (
+	"bytes"
+	"fmt"
+	"html/template"
+	"imageclust/internal/models"
+)
+
+// RenderLabelClusterMatrix renders the label × cluster counts as an HTML heatmap table. Cells are shaded
+// relative to the largest count, and columns are headed by the cluster titles, falling back to their keys.
+func RenderLabelClusterMatrix(matrix models.LabelClusterMatrix, titles map[string]string) ([]byte, error) {
+	const tmpl = `
+<!DOCTYPE html>
+<html lang="en">
+<head>
+    <meta charset="UTF-8">
+    <title>Labels by Cluster</title>
+    <style>
+        body {
+            font-family: sans-serif;
+        }
+        .matrix {
+            border-collapse: collapse;
+            margin: 20px;
+        }
+        .matrix th, .matrix td {
+            border: 1px solid #dee2e6;
+            padding: 6px 10px;
+            text-align: center;
+        }
+        .matrix th {
+            background: #f8f9fa;
+            color: #2c3e50;
+        }
+        .matrix th.label {
+            text-align: left;
+        }
+        .matrix td.zero {
+            color: #bbb;
+        }
+    </style>
+</head>
+<body>
+    <h1>Labels by Cluster</h1>
+    <table class="matrix">
+        <thead>
+            <tr>
+                <th class="label">Label</th>
+                {{range .Clusters}}
+                    <th title="{{.Key}}">{{.Title}}</th>
+                {{end}}
+            </tr>
+        </thead>
+        <tbody>
+            {{range .Rows}}
+                <tr>
+                    <th class="label">{{.Label}}</th>
+                    {{range .Cells}}
+                        <td style="{{.Style}}"{{if eq .Count 0}} class="zero"{{end}}>{{.Count}}</td>
+                    {{end}}
+                </tr>
+            {{end}}
+        </tbody>
+    </table>
+</body>
+</html>`
+
+	type column struct {
+		Key   string
+		Title string
+	}
+	type cell struct {
+		Count int
+		Style template.CSS
+	}
+	type row struct {
+		Label string
+		Cells []cell
+	}
+
+	maxCount := 0
+	for _, counts := range matrix.Counts {
+		for _, count := range counts {
+			maxCount = max(maxCount, count)
+		}
+	}
+
+	columns := make([]column, len(matrix.Clusters))
+	for j, key := range matrix.Clusters {
+		title := titles[key]
+		if title == "" {
+			title = key
+		}
+		columns[j] = column{Key: key, Title: title}
+	}
+	rows := make([]row, len(matrix.Labels))
+	for i, label := range matrix.Labels {
+		rows[i] = row{Label: label, Cells: make([]cell, len(matrix.Counts[i]))}
+		for j, count := range matrix.Counts[i] {
+			opacity := 0.0
+			if maxCount > 0 {
+				opacity = float64(count) / float64(maxCount)
+			}
+			// The style is built from a number only, so it is safe to mark as trusted CSS
+			rows[i].Cells[j] = cell{
+				Count: count,
+				Style: template.CSS(fmt.Sprintf("background-color: rgba(76, 175, 80, %.2f)", opacity)),
+			}
+		}
+	}
+
+	t, err := template.New("matrix").Parse(tmpl)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse matrix template: %v", err)
+	}
+	var buf bytes.Buffer
+	if err := t.Execute(&buf, struct {
+		Clusters []column
+		Rows     []row
+	}{columns, rows}); err != nil {
+		return nil, fmt.Errorf("failed to execute matrix template: %v", err)
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,32 @@
+package utils
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/parquet-go/parquet-go"
+)
+
+// ParquetRow is one image in the Parquet export. The embedding is a LIST column, so the file has the
+// same few columns whatever the embedding size.
+type ParquetRow struct {
+	Filename  string    `parquet:"filename"`
+	ID        string    `parquet:"product_reference_id"`
+	ProductID string    `parquet:"product_id"`
+	ClusterID string    `parquet:"cluster_id"`
+	Labels    string    `parquet:"labels"` // Comma-separated
+	Embedding []float32 `parquet:"embedding,list"`
+}
+
+// EncodeParquet writes the rows as a Parquet file with Snappy-compressed columns
+func EncodeParquet(rows []ParquetRow) ([]byte, error) {
+	var buf bytes.Buffer
+	writer := parquet.NewGenericWriter[ParquetRow](&buf, parquet.Compression(&parquet.Snappy))
+	if _, err := writer.Write(rows); err != nil {
+		return nil, fmt.Errorf("failed to write Parquet rows: %v", err)
+	}
+	if err := writer.Close(); err != nil {
+		return nil, fmt.Errorf("failed to finish Parquet file: %v", err)
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,50 @@
+package utils
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/parquet-go/parquet-go"
+)
+
+func TestEncodeParquetRoundTrip(t *testing.T) {
+	embedding := make([]float32, 2048)
+	for i := range embedding {
+		embedding[i] = float32(i) / 10
+	}
+	rows := []ParquetRow{
+		{Filename: "a.jpg", ID: "a", ProductID: "p1", ClusterID: "Cluster-1", Labels: "Shoe, Leather", Embedding: embedding},
+		{Filename: "b.jpg", ID: "b", ClusterID: "", Labels: "", Embedding: nil},
+	}
+
+	data, err := EncodeParquet(rows)
+	if err != nil {
+		t.Fatalf("EncodeParquet: %v", err)
+	}
+
+	file, err := parquet.OpenFile(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		t.Fatalf("output is not a readable Parquet file: %v", err)
+	}
+	if got := file.NumRows(); got != int64(len(rows)) {
+		t.Errorf("got %d rows, want %d", got, len(rows))
+	}
+	// The embedding is one nested column rather than one column per dimension
+	if got := len(file.Schema().Fields()); got != 6 {
+		t.Errorf("got %d top-level columns, want 6", got)
+	}
+
+	read, err := parquet.Read[ParquetRow](bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		t.Fatalf("reading rows back: %v", err)
+	}
+	if read[0].ClusterID != "Cluster-1" || read[0].Labels != "Shoe, Leather" {
+		t.Errorf("first row = %+v", read[0])
+	}
+	if len(read[0].Embedding) != len(embedding) || read[0].Embedding[1234] != embedding[1234] {
+		t.Errorf("embedding value 1234 = %v, want %v", read[0].Embedding[1234], embedding[1234])
+	}
+	if len(read[1].Embedding) != 0 {
+		t.Errorf("second row has %d embedding values, want none", len(read[1].Embedding))
+	}
+}
@@ -0,0 +1,136 @@
+package utils
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"imageclust/internal/models"
+	"os"
+	"path/filepath"
+
+	"github.com/go-pdf/fpdf"
+)
+
+// PDF page layout in points, for an A4 portrait page
+const (
+	pdfMargin      = 40.0
+	pdfColumns     = 3
+	pdfCellSize    = 165.0
+	pdfCellGap     = 10.0
+	pdfThumbnailPx = 330
+)
+
+// GeneratePDFReport renders the clusters as a PDF with one section per cluster, honoring the
+// sort order, untitled display and image limit of opts. Every section starts on a new page, and
+// text or thumbnails that do not fit continue onto further pages.
+// Images that cannot be decoded are listed by name instead of being embedded.
+func GeneratePDFReport(clusters map[string]models.ClusterDetails, imagesDir string, opts HTMLOptions) ([]byte, error) {
+	pdf := fpdf.New("P", "pt", "A4", "")
+	pdf.SetMargins(pdfMargin, pdfMargin, pdfMargin)
+	pdf.SetAutoPageBreak(true, pdfMargin)
+	// The core fonts use cp1252, which covers the punctuation the models commonly produce
+	translate := pdf.UnicodeTranslatorFromDescriptor("")
+	_, pageHeight := pdf.GetPageSize()
+
+	text := func(style string, size float64, s string) {
+		pdf.SetFont("Helvetica", style, size)
+		pdf.MultiCell(0, size*1.3, translate(s), "", "L", false)
+	}
+
+	entries := SortClusters(clusters, opts.SortOrder)
+	if len(entries) == 0 {
+		// A PDF needs at least one page
+		pdf.AddPage()
+		text("", 12, "No clusters")
+	}
+
+	for _, entry := range entries {
+		details := entry.Details
+		pdf.AddPage()
+
+		title := details.Title
+		if title == "" {
+			title = entry.ID
+		}
+		text("B", 18, title)
+		if details.CatchyPhrase != "" {
+			text("", 12, details.CatchyPhrase)
+		}
+		if details.Labels != "" {
+			text("", 9, "Labels: "+details.Labels)
+		}
+		for _, output := range displayOutputs(details, opts.UntitledDisplay) {
+			text("", 9, fmt.Sprintf("%s: %s - %s", output.ServiceName, output.Title, output.CatchyPhrase))
+		}
+		pdf.Ln(pdfCellGap)
+
+		images := details.Images
+		if opts.MaxImagesPerCluster > 0 && len(images) > opts.MaxImagesPerCluster {
+			images = images[:opts.MaxImagesPerCluster]
+		}
+		for i, name := range images {
+			column := i % pdfColumns
+			if column == 0 && pdf.GetY()+pdfCellSize > pageHeight-pdfMargin {
+				pdf.AddPage()
+				text("B", 12, title+" (continued)")
+				pdf.Ln(pdfCellGap)
+			}
+
+			x, y := pdfMargin+float64(column)*(pdfCellSize+pdfCellGap), pdf.GetY()
+			width, height, err := registerPDFImage(pdf, name, filepath.Join(imagesDir, SanitizeFilename(name)))
+			if err != nil {
+				pdf.SetFont("Helvetica", "", 8)
+				pdf.SetXY(x, y+pdfCellSize/2)
+				pdf.CellFormat(pdfCellSize, 10, translate(name), "", 0, "C", false, 0, "")
+			} else {
+				// Fit the thumbnail into its square cell, preserving the aspect ratio
+				scale := pdfCellSize / width
+				if height > width {
+					scale = pdfCellSize / height
+				}
+				drawWidth, drawHeight := width*scale, height*scale
+				pdf.ImageOptions(name, x+(pdfCellSize-drawWidth)/2, y+(pdfCellSize-drawHeight)/2, drawWidth, drawHeight,
+					false, fpdf.ImageOptions{ImageType: "JPG"}, 0, "")
+			}
+
+			if column == pdfColumns-1 || i == len(images)-1 {
+				pdf.SetY(y + pdfCellSize + pdfCellGap)
+			} else {
+				pdf.SetY(y)
+			}
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := pdf.Output(&buf); err != nil {
+		return nil, fmt.Errorf("failed to generate PDF report: %v", err)
+	}
+	return buf.Bytes(), nil
+}
+
+// registerPDFImage embeds a JPEG thumbnail of the image under name and returns its pixel size.
+// The image is decoded first, since a registration error would fail the whole document.
+func registerPDFImage(pdf *fpdf.Fpdf, name, imagePath string) (float64, float64, error) {
+	if info := pdf.GetImageInfo(name); info != nil {
+		return info.Width(), info.Height(), nil
+	}
+
+	data, err := os.ReadFile(imagePath)
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to read image %s: %v", imagePath, err)
+	}
+	src, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to decode image %s: %v", imagePath, err)
+	}
+	thumbnail, err := thumbnailJPEG(src, pdfThumbnailPx)
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to encode thumbnail for %s: %v", imagePath, err)
+	}
+
+	info := pdf.RegisterImageOptionsReader(name, fpdf.ImageOptions{ImageType: "JPG"}, bytes.NewReader(thumbnail))
+	if info == nil {
+		return 0, 0, fmt.Errorf("failed to embed thumbnail for %s: %v", imagePath, pdf.Error())
+	}
+	return info.Width(), info.Height(), nil
+}
@@ -0,0 +1,98 @@
+package utils
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"imageclust/internal/models"
+
+	"rsc.io/pdf"
+)
+
+// pdfPages parses a PDF and returns the text of each page and the number of images in the document
+func pdfPages(t *testing.T, data []byte) ([]string, int) {
+	t.Helper()
+	reader, err := pdf.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		t.Fatalf("output is not a readable PDF: %v", err)
+	}
+	texts := make([]string, reader.NumPage())
+	images := 0
+	for i := range texts {
+		page := reader.Page(i + 1)
+		var text strings.Builder
+		for _, glyph := range page.Content().Text {
+			text.WriteString(glyph.S)
+		}
+		texts[i] = text.String()
+		// The pages share one resource dictionary listing every image
+		images = max(images, len(page.Resources().Key("XObject").Keys()))
+	}
+	return texts, images
+}
+
+func TestGeneratePDFReportHonorsOptions(t *testing.T) {
+	imagesDir := t.TempDir()
+	var images []string
+	for _, name := range []string{"a.png", "b.png", "c.png", "d.png"} {
+		images = append(images, writeTestPNG(t, imagesDir, name))
+	}
+	clusters := map[string]models.ClusterDetails{
+		"Cluster-1": {Title: "Small", Images: images[3:]},
+		"Cluster-2": {Title: "Large", Images: images},
+	}
+
+	data, err := GeneratePDFReport(clusters, imagesDir, HTMLOptions{SortOrder: SortBySize, MaxImagesPerCluster: 2})
+	if err != nil {
+		t.Fatalf("GeneratePDFReport: %v", err)
+	}
+	texts, imageCount := pdfPages(t, data)
+	if len(texts) != 2 {
+		t.Fatalf("got %d pages, want one per cluster", len(texts))
+	}
+	if !strings.Contains(texts[0], "Large") || !strings.Contains(texts[1], "Small") {
+		t.Errorf("pages are not in size order: %q", texts)
+	}
+	// Two images of the large cluster and the one of the small cluster
+	if imageCount != 3 {
+		t.Errorf("got %d images, want 3", imageCount)
+	}
+}
+
+func TestGeneratePDFReportBreaksLongTextAcrossPages(t *testing.T) {
+	outputs := make([]models.ServiceOutput, 120)
+	for i := range outputs {
+		outputs[i] = models.ServiceOutput{ServiceName: "Service", Title: "Title", CatchyPhrase: strings.Repeat("phrase ", 30)}
+	}
+	outputs[len(outputs)-1].ServiceName = "LastService"
+	clusters := map[string]models.ClusterDetails{
+		"Cluster-1": {Title: strings.Repeat("Long Title ", 40), ServiceOutputs: outputs},
+	}
+
+	data, err := GeneratePDFReport(clusters, t.TempDir(), HTMLOptions{})
+	if err != nil {
+		t.Fatalf("GeneratePDFReport: %v", err)
+	}
+	texts, _ := pdfPages(t, data)
+	if len(texts) < 2 {
+		t.Fatalf("got %d pages, want the text to continue onto further pages", len(texts))
+	}
+	if !strings.Contains(texts[len(texts)-1], "LastService") {
+		t.Error("the last service output is missing from the last page")
+	}
+}
+
+func TestGeneratePDFReportListsUndecodableImages(t *testing.T) {
+	clusters := map[string]models.ClusterDetails{
+		"Cluster-1": {Title: "Missing", Images: []string{"missing.webp"}},
+	}
+	data, err := GeneratePDFReport(clusters, t.TempDir(), HTMLOptions{})
+	if err != nil {
+		t.Fatalf("GeneratePDFReport: %v", err)
+	}
+	texts, _ := pdfPages(t, data)
+	if !strings.Contains(texts[0], "missing.webp") {
+		t.Errorf("page text %q does not list the image", texts[0])
+	}
+}
@@ -0,0 +1,220 @@
+package utils
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"path"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// imageURLClient downloads images listed in image_urls. Every connection, including those made for
+// redirects, is checked by the dialer, so clients cannot reach internal services through the server.
+// Proxies from the environment are not used, since the check would then only see the proxy address.
+var imageURLClient = &http.Client{
+	Timeout:       30 * time.Second,
+	CheckRedirect: checkImageRedirect,
+	Transport: &http.Transport{
+		DialContext: (&net.Dialer{
+			Timeout: 10 * time.Second,
+			Control: checkImageURLAddress,
+		}).DialContext,
+		TLSHandshakeTimeout: 10 * time.Second,
+		MaxIdleConns:        10,
+		IdleConnTimeout:     90 * time.Second,
+	},
+}
+
+// allowPrivateImageHosts lets image_urls reach loopback, private and link-local addresses
+var allowPrivateImageHosts bool
+
+// SetAllowPrivateImageHosts lets image_urls downloads reach loopback, private and link-local addresses,
+// for deployments that fetch from an internal CDN. It must be called before serving requests.
+func SetAllowPrivateImageHosts(allow bool) {
+	allowPrivateImageHosts = allow
+}
+
+// ErrForbiddenImageHost is returned for image URLs that resolve to an address the server does not fetch from
+var ErrForbiddenImageHost = errors.New("image URL resolves to a private, loopback or link-local address")
+
+// checkImageURLAddress rejects connections to addresses internal to the server's network. It runs after
+// DNS resolution, so a public name pointing at an internal address is rejected too.
+func checkImageURLAddress(network, address string, _ syscall.RawConn) error {
+	if allowPrivateImageHosts {
+		return nil
+	}
+	addrPort, err := netip.ParseAddrPort(address)
+	if err != nil {
+		return fmt.Errorf("unexpected dial address %s: %v", address, err)
+	}
+	addr := addrPort.Addr().Unmap()
+	if addr.IsLoopback() || addr.IsPrivate() || addr.IsLinkLocalUnicast() || addr.IsLinkLocalMulticast() ||
+		addr.IsUnspecified() || addr.IsMulticast() {
+		return fmt.Errorf("%w: %s", ErrForbiddenImageHost, addr)
+	}
+	return nil
+}
+
+// addedHeadersKey is the context key under which FetchImage records the headers it added to a download
+type addedHeadersKey struct{}
+
+// checkImageRedirect follows up to 10 redirects. Headers added to the download are only kept while the
+// redirects stay on the original host; elsewhere only the configured headers allowed for the new host are sent.
+func checkImageRedirect(req *http.Request, via []*http.Request) error {
+	if len(via) >= 10 {
+		return errors.New("stopped after 10 redirects")
+	}
+	if strings.EqualFold(req.URL.Hostname(), via[0].URL.Hostname()) {
+		return nil
+	}
+	added, _ := req.Context().Value(addedHeadersKey{}).(http.Header)
+	for name := range added {
+		req.Header.Del(name)
+	}
+	if sendsDownloadHeaders(req.URL.Hostname()) {
+		for name, values := range imageDownloadHeaders {
+			req.Header[name] = values
+		}
+	}
+	return nil
+}
+
+// ByteBudget is a byte allowance shared by the downloads of one request, so together they stay
+// within the request's upload limit. It is safe for concurrent use.
+type ByteBudget struct {
+	size      int64
+	remaining atomic.Int64
+}
+
+// NewByteBudget returns a budget of n bytes
+func NewByteBudget(n int64) *ByteBudget {
+	budget := &ByteBudget{size: n}
+	budget.remaining.Store(n)
+	return budget
+}
+
+// Remaining returns the bytes left in the budget, which is negative once it was overdrawn
+func (b *ByteBudget) Remaining() int64 {
+	return b.remaining.Load()
+}
+
+// ErrBudgetExceeded is returned when a download would go over the request's upload limit
+var ErrBudgetExceeded = errors.New("downloads exceed the request's upload limit")
+
+// budgetReader charges every byte read to a ByteBudget and fails once it is exhausted
+type budgetReader struct {
+	r      io.Reader
+	budget *ByteBudget
+}
+
+func (br *budgetReader) Read(p []byte) (int, error) {
+	n, err := br.r.Read(p)
+	if br.budget.remaining.Add(-int64(n)) < 0 {
+		return n, ErrBudgetExceeded
+	}
+	return n, err
+}
+
+// Headers added to every image download, such as credentials for a protected CDN, and the hosts they are sent to
+var (
+	imageDownloadHeaders http.Header
+	imageDownloadHosts   []string
+)
+
+// SetImageDownloadHeaders sets headers sent with image downloads from the listed hosts, so credentials
+// do not leak to arbitrary URLs. No headers are sent while hosts is empty. It must be called before serving requests.
+func SetImageDownloadHeaders(headers http.Header, hosts []string) {
+	imageDownloadHeaders = headers
+	imageDownloadHosts = hosts
+}
+
+// sendsDownloadHeaders reports whether the configured download headers apply to the host
+func sendsDownloadHeaders(host string) bool {
+	for _, allowed := range imageDownloadHosts {
+		if strings.EqualFold(host, allowed) {
+			return true
+		}
+	}
+	return false
+}
+
+// sniffedImageExtensions maps sniffed image content types to the extension stored files get
+var sniffedImageExtensions = map[string]string{
+	"image/jpeg": ".jpg",
+	"image/png":  ".png",
+	"image/gif":  ".gif",
+	"image/webp": ".webp",
+	"image/bmp":  ".bmp",
+}
+
+// FetchImage downloads the image at an http or https URL, charging the bytes read to budget.
+// It returns the content and a filename taken from the URL path, with an extension added
+// from the sniffed content type when the path has none. Responses that are not images are rejected.
+// header is sent with the request on top of the configured download headers, replacing any of the same name.
+func FetchImage(ctx context.Context, rawURL string, budget *ByteBudget, header http.Header) ([]byte, string, error) {
+	parsed, err := url.Parse(rawURL)
+	if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+		return nil, "", fmt.Errorf("invalid image URL %q: expected an absolute http or https URL", rawURL)
+	}
+
+	added := http.Header{}
+	if sendsDownloadHeaders(parsed.Hostname()) {
+		for name, values := range imageDownloadHeaders {
+			added[name] = values
+		}
+	}
+	for name, values := range header {
+		added[name] = values
+	}
+	ctx = context.WithValue(ctx, addedHeadersKey{}, added)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, parsed.String(), nil)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to create request for %s: %v", rawURL, err)
+	}
+	for name, values := range added {
+		req.Header[name] = values
+	}
+	resp, err := imageURLClient.Do(req)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to download %s: %v", rawURL, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, "", fmt.Errorf("failed to download %s: status %d", rawURL, resp.StatusCode)
+	}
+
+	// A declared length over the budget fails before anything is read
+	if resp.ContentLength > budget.Remaining() {
+		return nil, "", fmt.Errorf("image at %s: %w", rawURL, ErrBudgetExceeded)
+	}
+	data, err := io.ReadAll(&budgetReader{r: resp.Body, budget: budget})
+	if errors.Is(err, ErrBudgetExceeded) {
+		return nil, "", fmt.Errorf("image at %s: %w", rawURL, err)
+	}
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to download %s: %v", rawURL, err)
+	}
+
+	contentType := http.DetectContentType(data)
+	if !strings.HasPrefix(contentType, "image/") && !IsHEIC(data) {
+		return nil, "", fmt.Errorf("%s is not an image (content type %s)", rawURL, contentType)
+	}
+
+	name := path.Base(parsed.Path)
+	if name == "." || name == "/" {
+		name = "image"
+	}
+	if path.Ext(name) == "" {
+		name += sniffedImageExtensions[contentType]
+	}
+	return data, name, nil
+}
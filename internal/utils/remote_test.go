@@ -0,0 +1,152 @@
+package utils
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"image"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// testPNG returns an encoded PNG of the given size
+func testPNG(t *testing.T, size int) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, image.NewGray(image.Rect(0, 0, size, size))); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// allowPrivateHosts lets a test download from its local httptest servers
+func allowPrivateHosts(t *testing.T) {
+	t.Helper()
+	SetAllowPrivateImageHosts(true)
+	t.Cleanup(func() { SetAllowPrivateImageHosts(false) })
+}
+
+func TestCheckImageURLAddress(t *testing.T) {
+	for _, address := range []string{
+		"127.0.0.1:80", "10.1.2.3:443", "172.16.0.1:80", "192.168.1.1:80", "169.254.169.254:80",
+		"0.0.0.0:80", "[::1]:80", "[fe80::1]:80", "[fc00::1]:80", "[::ffff:127.0.0.1]:80",
+	} {
+		if err := checkImageURLAddress("tcp", address, nil); !errors.Is(err, ErrForbiddenImageHost) {
+			t.Errorf("%s: err = %v, want ErrForbiddenImageHost", address, err)
+		}
+	}
+	for _, address := range []string{"93.184.216.34:443", "[2606:2800:220:1:248:1893:25c8:1946]:443"} {
+		if err := checkImageURLAddress("tcp", address, nil); err != nil {
+			t.Errorf("%s: unexpected error %v", address, err)
+		}
+	}
+}
+
+func TestFetchImageRefusesLoopback(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Error("request reached the loopback server")
+	}))
+	defer server.Close()
+
+	_, _, err := FetchImage(context.Background(), server.URL+"/a.png", NewByteBudget(1<<20), nil)
+	if err == nil {
+		t.Fatal("expected the loopback download to be refused")
+	}
+}
+
+func TestFetchImageChargesSharedBudget(t *testing.T) {
+	allowPrivateHosts(t)
+	data := testPNG(t, 16)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(data)
+	}))
+	defer server.Close()
+
+	budget := NewByteBudget(int64(len(data))*2 - 1)
+	if _, name, err := FetchImage(context.Background(), server.URL+"/a", budget, nil); err != nil || name != "a.png" {
+		t.Fatalf("first download: name %q, err %v", name, err)
+	}
+	if _, _, err := FetchImage(context.Background(), server.URL+"/b.png", budget, nil); !errors.Is(err, ErrBudgetExceeded) {
+		t.Errorf("second download: err = %v, want ErrBudgetExceeded", err)
+	}
+}
+
+// withDownloadHeaders configures download headers for the duration of a test
+func withDownloadHeaders(t *testing.T, headers http.Header, hosts []string) {
+	t.Helper()
+	SetImageDownloadHeaders(headers, hosts)
+	t.Cleanup(func() { SetImageDownloadHeaders(nil, nil) })
+}
+
+func TestFetchImageSendsConfiguredHeaders(t *testing.T) {
+	allowPrivateHosts(t)
+	data := testPNG(t, 4)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Api-Key") != "secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.Write(data)
+	}))
+	defer server.Close()
+	headers := http.Header{"X-Api-Key": {"secret"}}
+
+	// Without hosts the headers are never sent
+	withDownloadHeaders(t, headers, nil)
+	if _, _, err := FetchImage(context.Background(), server.URL+"/a.png", NewByteBudget(1<<20), nil); err == nil {
+		t.Error("headers were sent without an allowed host")
+	}
+
+	withDownloadHeaders(t, headers, []string{"127.0.0.1"})
+	if _, _, err := FetchImage(context.Background(), server.URL+"/a.png", NewByteBudget(1<<20), nil); err != nil {
+		t.Errorf("download with headers failed: %v", err)
+	}
+}
+
+func TestFetchImageSendsRequestToken(t *testing.T) {
+	allowPrivateHosts(t)
+	data := testPNG(t, 4)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.Write(data)
+	}))
+	defer server.Close()
+
+	if _, _, err := FetchImage(context.Background(), server.URL+"/a.png", NewByteBudget(1<<20), nil); err == nil {
+		t.Error("download without the token succeeded")
+	}
+	header := http.Header{"Authorization": {"Bearer token"}}
+	if _, _, err := FetchImage(context.Background(), server.URL+"/a.png", NewByteBudget(1<<20), header); err != nil {
+		t.Errorf("download with the token failed: %v", err)
+	}
+}
+
+func TestFetchImageDropsHeadersOnCrossHostRedirect(t *testing.T) {
+	allowPrivateHosts(t)
+	data := testPNG(t, 4)
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if key, auth := r.Header.Get("X-Api-Key"), r.Header.Get("Authorization"); key != "" || auth != "" {
+			t.Errorf("redirect target received X-Api-Key %q and Authorization %q", key, auth)
+		}
+		w.Write(data)
+	}))
+	defer target.Close()
+	// The target is reached as localhost, a different host from the 127.0.0.1 of the origin
+	targetURL := strings.Replace(target.URL, "127.0.0.1", "localhost", 1)
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, targetURL+"/a.png", http.StatusFound)
+	}))
+	defer origin.Close()
+
+	withDownloadHeaders(t, http.Header{"X-Api-Key": {"secret"}}, []string{"127.0.0.1"})
+	header := http.Header{"Authorization": {"Bearer token"}}
+	if _, _, err := FetchImage(context.Background(), origin.URL+"/a.png", NewByteBudget(1<<20), header); err != nil {
+		t.Fatalf("FetchImage: %v", err)
+	}
+}
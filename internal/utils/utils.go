@@ -3,24 +3,259 @@ package utils
 
 import (
 	"bytes"
+	"cmp"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"html/template"
+	"image"
+	_ "image/gif"
+	"image/jpeg"
+	_ "image/png"
 	"imageclust/internal/models"
+	"io"
 	"os"
 	"path/filepath"
+	"sort"
+	"strconv"
 	"strings"
+	"time"
 )
 
 type ClusterDownload struct {
 	Title        string   `json:"title"`
 	CatchyPhrase string   `json:"catchyPhrase"`
+	Category     string   `json:"category,omitempty"`
 	Images       []string `json:"images"`
 	Labels       string   `json:"labels"`
+	ProductIDs   []string `json:"productIds,omitempty"` // Product reference ID of each image, in the same order
+
+	OriginalFilenames []string `json:"originalFilenames,omitempty"` // Name each image was uploaded with, in the same order
+}
+
+// Ways of displaying service outputs whose title generation failed
+const (
+	UntitledLabels  = "labels"  // Show the cluster's top labels as the title
+	UntitledHide    = "hide"    // Omit the service's row from the report
+	UntitledLiteral = "literal" // Show the placeholder text as returned
+)
+
+// HTMLOptions controls how the cluster report is rendered.
+type HTMLOptions struct {
+	MaxImagesPerCluster int    // Maximum thumbnails shown per cluster (0 shows all)
+	UntitledDisplay     string // How failed service outputs are displayed (defaults to UntitledLabels)
+	InlineImagesDir     string // When set, images are read from this directory and inlined as thumbnails
+	SortOrder           string // Order clusters are listed in (see SortClusters)
+	Summary             string // Paragraph describing the whole collection, shown above the clusters when set
+}
+
+// Cluster sort orders
+const (
+	SortBySize     = "size"     // Largest clusters first
+	SortByCohesion = "cohesion" // Tightest clusters first
+	SortByLabel    = "label"    // Alphabetically by dominant label
+)
+
+// ClusterEntry is a cluster paired with its key, used where clusters are listed in order
+type ClusterEntry struct {
+	ID      string
+	Details models.ClusterDetails
+}
+
+// CompareClusterKeys orders cluster keys by their numeric ID, so "Cluster-2" comes before "Cluster-10".
+// Keys without a number, such as the misc bucket's, come after the numbered ones in string order.
+func CompareClusterKeys(a, b string) int {
+	idA, errA := strconv.Atoi(strings.TrimPrefix(a, "Cluster-"))
+	idB, errB := strconv.Atoi(strings.TrimPrefix(b, "Cluster-"))
+	switch {
+	case errA == nil && errB == nil:
+		if idA != idB {
+			return cmp.Compare(idA, idB)
+		}
+	case errA == nil:
+		return -1
+	case errB == nil:
+		return 1
+	}
+	return strings.Compare(a, b)
+}
+
+// SortClusters lists the clusters in the requested order, breaking ties by key (see CompareClusterKeys).
+// Unknown or empty orders list clusters by key. The misc bucket is always listed last.
+func SortClusters(clusters map[string]models.ClusterDetails, order string) []ClusterEntry {
+	entries := make([]ClusterEntry, 0, len(clusters))
+	for id, details := range clusters {
+		entries = append(entries, ClusterEntry{ID: id, Details: details})
+	}
+
+	sort.SliceStable(entries, func(i, j int) bool {
+		a, b := entries[i], entries[j]
+		if a.Details.IsMisc != b.Details.IsMisc {
+			return b.Details.IsMisc
+		}
+		switch order {
+		case SortBySize:
+			if len(a.Details.Images) != len(b.Details.Images) {
+				return len(a.Details.Images) > len(b.Details.Images)
+			}
+		case SortByCohesion:
+			if a.Details.Cohesion != b.Details.Cohesion {
+				return a.Details.Cohesion < b.Details.Cohesion
+			}
+		case SortByLabel:
+			if a.Details.DominantLabel != b.Details.DominantLabel {
+				return a.Details.DominantLabel < b.Details.DominantLabel
+			}
+		}
+		return CompareClusterKeys(a.ID, b.ID) < 0
+	})
+	return entries
 }
 
+// BundleThumbnailSize is the longest side, in pixels, of images inlined into an HTML bundle
+const BundleThumbnailSize = 400
+
 // GenerateHTMLOutput generates an HTML file based on cluster details.
-func GenerateHTMLOutput(clusters map[string]models.ClusterDetails, tempDir string) (string, error) {
+func GenerateHTMLOutput(clusters map[string]models.ClusterDetails, tempDir string, opts HTMLOptions) (string, error) {
+	html, err := RenderHTML(clusters, "/api/image/", opts)
+	if err != nil {
+		return "", err
+	}
+
+	// Define the output HTML file path
+	outputFile := filepath.Join(tempDir, "clusters.html")
+
+	// Write the buffer to the HTML file
+	err = os.WriteFile(outputFile, html, 0644)
+	if err != nil {
+		return "", fmt.Errorf("failed to write HTML file: %v", err)
+	}
+
+	return outputFile, nil
+}
+
+// ArchiveHTMLReport writes a timestamped copy of the HTML report to outputDir.
+// The cluster images are copied from imagesDir into a sibling directory so the report
+// keeps working after the session temp directory is cleaned up.
+func ArchiveHTMLReport(clusters map[string]models.ClusterDetails, imagesDir, outputDir string, opts HTMLOptions) (string, error) {
+	// The images directory reserves the report's name, so the HTML file next to it is unique too
+	reportImagesDir, err := makeTimestampedDir(outputDir, "_images")
+	if err != nil {
+		return "", fmt.Errorf("failed to create report directory: %v", err)
+	}
+	reportName := strings.TrimSuffix(filepath.Base(reportImagesDir), "_images")
+
+	// Copy every image referenced by the report
+	for _, cluster := range clusters {
+		for _, image := range cluster.Images {
+			data, err := os.ReadFile(filepath.Join(imagesDir, image))
+			if err != nil {
+				return "", fmt.Errorf("failed to read image %s: %v", image, err)
+			}
+			if err := os.WriteFile(filepath.Join(reportImagesDir, image), data, 0644); err != nil {
+				return "", fmt.Errorf("failed to copy image %s: %v", image, err)
+			}
+		}
+	}
+
+	html, err := RenderHTML(clusters, reportName+"_images/", opts)
+	if err != nil {
+		return "", err
+	}
+
+	outputFile := filepath.Join(outputDir, reportName+".html")
+	if err := os.WriteFile(outputFile, html, 0644); err != nil {
+		return "", fmt.Errorf("failed to write HTML file: %v", err)
+	}
+
+	return outputFile, nil
+}
+
+// makeTimestampedDir creates a directory under outputDir named "clusters-", the current time, a random
+// part and suffix. The random part keeps runs that finish within the same second apart.
+func makeTimestampedDir(outputDir, suffix string) (string, error) {
+	if err := os.MkdirAll(outputDir, 0755); err != nil {
+		return "", err
+	}
+	dir, err := os.MkdirTemp(outputDir, "clusters-"+time.Now().Format("20060102-150405")+"-*"+suffix)
+	if err != nil {
+		return "", err
+	}
+	// MkdirTemp creates private directories, but reports are meant to be shared
+	if err := os.Chmod(dir, 0755); err != nil {
+		return "", err
+	}
+	return dir, nil
+}
+
+// WriteClusterJSONFiles writes every cluster as its own JSON file, named after the cluster key,
+// into a new timestamped directory under outputDir, and returns that directory. Runs finishing
+// within the same second get separate directories.
+// productIDs maps image filenames to their product reference IDs.
+func WriteClusterJSONFiles(clusters map[string]models.ClusterDetails, productIDs map[string]string, outputDir string) (string, error) {
+	clusterDir, err := makeTimestampedDir(outputDir, "")
+	if err != nil {
+		return "", fmt.Errorf("failed to create cluster JSON directory: %v", err)
+	}
+
+	for key, details := range clusters {
+		download := ClusterDownload{
+			Title:        details.Title,
+			CatchyPhrase: details.CatchyPhrase,
+			Category:     details.Category,
+			Images:       details.Images,
+			Labels:       details.Labels,
+		}
+		for _, image := range details.Images {
+			download.ProductIDs = append(download.ProductIDs, productIDs[image])
+			if details.OriginalFilenames != nil {
+				download.OriginalFilenames = append(download.OriginalFilenames, details.OriginalFilenames[image])
+			}
+		}
+
+		data, err := json.MarshalIndent(download, "", "  ")
+		if err != nil {
+			return "", fmt.Errorf("failed to encode cluster %s: %v", key, err)
+		}
+		if err := os.WriteFile(filepath.Join(clusterDir, SanitizeFilename(key)+".json"), data, 0644); err != nil {
+			return "", fmt.Errorf("failed to write cluster %s: %v", key, err)
+		}
+	}
+
+	return clusterDir, nil
+}
+
+// GenerateHTMLBundle renders a self-contained report with every displayed image inlined as a
+// base64 thumbnail, so it stays viewable after the session's images are removed.
+func GenerateHTMLBundle(clusters map[string]models.ClusterDetails, imagesDir string, opts HTMLOptions) ([]byte, error) {
+	opts.InlineImagesDir = imagesDir
+	return RenderHTML(clusters, "", opts)
+}
+
+// DuplicateImages returns every image referenced more than once across the clusters, sorted.
+// Each image belongs to exactly one cluster, so a repeated reference means the input is inconsistent.
+func DuplicateImages(clusters map[string]models.ClusterDetails) []string {
+	counts := make(map[string]int)
+	for _, details := range clusters {
+		for _, image := range details.Images {
+			counts[image]++
+		}
+	}
+
+	var duplicates []string
+	for image, count := range counts {
+		if count > 1 {
+			duplicates = append(duplicates, image)
+		}
+	}
+	sort.Strings(duplicates)
+	return duplicates
+}
+
+// RenderHTML renders the cluster details, resolving images relative to imageBaseURL.
+func RenderHTML(clusters map[string]models.ClusterDetails, imageBaseURL string, opts HTMLOptions) ([]byte, error) {
 	const tmpl = `
 <!DOCTYPE html>
 <html lang="en">
@@ -76,6 +311,19 @@ func GenerateHTMLOutput(clusters map[string]models.ClusterDetails, tempDir strin
             height: auto;
             border-radius: 4px;
         }
+        .image .filename {
+            font-size: 0.8em;
+            color: #666;
+            word-break: break-all;
+        }
+        .more-images {
+            flex: 0 0 200px;
+            display: flex;
+            align-items: center;
+            justify-content: center;
+            color: #666;
+            font-size: 1.2em;
+        }
         .download-button {
             background-color: #4CAF50;
             color: white;
@@ -96,6 +344,11 @@ func GenerateHTMLOutput(clusters map[string]models.ClusterDetails, tempDir strin
             margin-bottom: 15px;
             font-size: 0.9em;
         }
+        .cohesion {
+            font-size: 0.9em;
+            color: #666;
+            margin-bottom: 15px;
+        }
         .product-id {
             font-size: 0.8em;
             color: #666;
@@ -105,6 +358,12 @@ func GenerateHTMLOutput(clusters map[string]models.ClusterDetails, tempDir strin
             font-weight: 500;
             color: #2c3e50;
         }
+        .collection-summary {
+            font-size: 1.05em;
+            line-height: 1.5;
+            color: #2c3e50;
+            margin-bottom: 30px;
+        }
     </style>
     <script>
         async function downloadCluster(clusterId, title, catchyPhrase, images, labels) {
@@ -130,11 +389,24 @@ func GenerateHTMLOutput(clusters map[string]models.ClusterDetails, tempDir strin
 <body>
     <div class="container">
         <h1>Model Comparison</h1>
-        {{range $cluster_id, $cluster_info := .Clusters}}
+        {{with .Summary}}
+            <p class="collection-summary">{{.}}</p>
+        {{end}}
+        {{range $entry := .Clusters}}
+            {{$cluster_id := $entry.ID}}
+            {{$cluster_info := $entry.Details}}
             <div class="cluster">
+                {{if $cluster_info.IsMisc}}
+                    <h2>{{ $cluster_info.Title }}</h2>
+                    <p>{{ $cluster_info.CatchyPhrase }}</p>
+                {{end}}
                 <div class="labels">
                     <strong>Labels:</strong> {{ $cluster_info.Labels }}
                 </div>
+                {{if not $cluster_info.IsMisc}}
+                    <div class="cohesion">
+                        <strong>Cohesion:</strong> {{ printf "%.4f" $cluster_info.Cohesion }}
+                    </div>
                 
                 <table class="comparison-table">
                     <thead>
@@ -146,10 +418,10 @@ func GenerateHTMLOutput(clusters map[string]models.ClusterDetails, tempDir strin
                         </tr>
                     </thead>
                     <tbody>
-                        {{range $output := $cluster_info.ServiceOutputs}}
+                        {{range $output := displayOutputs $cluster_info}}
                             <tr>
                                 <td class="model-name">{{ $output.ServiceName }}</td>
-                                <td>{{ $output.Title }}</td>
+                                <td>{{ $output.Title }}{{if $output.Category}}<br><small>{{ $output.Category }}</small>{{end}}</td>
                                 <td>{{ $output.CatchyPhrase }}</td>
                                 <td>
                                     <button onclick="downloadCluster('{{ $cluster_id }}', '{{ escapeJS $output.Title }}', '{{ escapeJS $output.CatchyPhrase }}', {{escapeJS (toJSON $cluster_info.Images)}}, '{{ escapeJS $cluster_info.Labels }}')" class="download-button">
@@ -160,13 +432,24 @@ func GenerateHTMLOutput(clusters map[string]models.ClusterDetails, tempDir strin
                         {{end}}
                     </tbody>
                 </table>
+                {{end}}
 
 				 <div class="image-container">
-                    {{range $image := $cluster_info.Images}}
+                    {{range $image := displayImages $cluster_info.Images}}
                         <div class="image">
-                            <img src="/api/image/{{$image}}" alt="Cluster image">
+                            {{if $.InlineImages}}
+                            <img src="{{inlineImage $image}}" alt="Cluster image">
+                            {{else}}
+                            <img src="{{$.ImageBaseURL}}{{$image}}" alt="Cluster image">
+                            {{end}}
+                            {{with index $cluster_info.OriginalFilenames $image}}
+                            <div class="filename">{{.}}</div>
+                            {{end}}
                         </div>
                     {{end}}
+                    {{with hiddenImageCount $cluster_info.Images}}
+                        <div class="more-images">+{{.}} more</div>
+                    {{end}}
                 </div>
 			</div>
         {{end}}
@@ -179,38 +462,91 @@ func GenerateHTMLOutput(clusters map[string]models.ClusterDetails, tempDir strin
 		"escapeJS": escapeJS,
 		"add":      add,
 		"toJSON":   toJSON,
+		// Thumbnails are capped per cluster, while the download payload keeps every image
+		"displayImages": func(images []string) []string {
+			if opts.MaxImagesPerCluster > 0 && len(images) > opts.MaxImagesPerCluster {
+				return images[:opts.MaxImagesPerCluster]
+			}
+			return images
+		},
+		"hiddenImageCount": func(images []string) int {
+			if opts.MaxImagesPerCluster > 0 && len(images) > opts.MaxImagesPerCluster {
+				return len(images) - opts.MaxImagesPerCluster
+			}
+			return 0
+		},
+		"displayOutputs": func(details models.ClusterDetails) []models.ServiceOutput {
+			return displayOutputs(details, opts.UntitledDisplay)
+		},
+		// Data URIs are rejected by the template's URL sanitizer, so they are marked as trusted
+		"inlineImage": func(image string) (template.URL, error) {
+			uri, err := ImageThumbnailDataURI(filepath.Join(opts.InlineImagesDir, SanitizeFilename(image)), BundleThumbnailSize)
+			return template.URL(uri), err
+		},
 	}
 
 	// Parse the template with the custom functions
 	t, err := template.New("clusters").Funcs(funcMap).Parse(tmpl)
 	if err != nil {
-		return "", fmt.Errorf("failed to parse HTML template: %v", err)
+		return nil, fmt.Errorf("failed to parse HTML template: %v", err)
 	}
 
 	// Prepare data for the template
 	data := struct {
-		Clusters map[string]models.ClusterDetails
+		Clusters     []ClusterEntry
+		ImageBaseURL string
+		InlineImages bool
+		Summary      string
 	}{
-		Clusters: clusters,
+		Clusters:     SortClusters(clusters, opts.SortOrder),
+		ImageBaseURL: imageBaseURL,
+		InlineImages: opts.InlineImagesDir != "",
+		Summary:      opts.Summary,
 	}
 
 	// Execute the template into a buffer
 	var buf bytes.Buffer
 	err = t.Execute(&buf, data)
 	if err != nil {
-		return "", fmt.Errorf("failed to execute HTML template: %v", err)
+		return nil, fmt.Errorf("failed to execute HTML template: %v", err)
 	}
 
-	// Define the output HTML file path
-	outputFile := filepath.Join(tempDir, "clusters.html")
+	return buf.Bytes(), nil
+}
 
-	// Write the buffer to the HTML file
-	err = os.WriteFile(outputFile, buf.Bytes(), 0644)
-	if err != nil {
-		return "", fmt.Errorf("failed to write HTML file: %v", err)
+// displayOutputs applies the untitled display mode to the service outputs of a cluster
+func displayOutputs(details models.ClusterDetails, mode string) []models.ServiceOutput {
+	if mode == UntitledLiteral {
+		return details.ServiceOutputs
 	}
 
-	return outputFile, nil
+	outputs := make([]models.ServiceOutput, 0, len(details.ServiceOutputs))
+	for _, output := range details.ServiceOutputs {
+		if output.Untitled {
+			if mode == UntitledHide {
+				continue
+			}
+			output.Title = TopLabels(details.Labels, 3)
+			output.CatchyPhrase = ""
+		}
+		outputs = append(outputs, output)
+	}
+	return outputs
+}
+
+// TopLabels returns the first n labels of a comma separated label list
+func TopLabels(labels string, n int) string {
+	parts := strings.Split(labels, ",")
+	top := make([]string, 0, n)
+	for _, part := range parts {
+		if part = strings.TrimSpace(part); part != "" {
+			top = append(top, part)
+		}
+		if len(top) == n {
+			break
+		}
+	}
+	return strings.Join(top, ", ")
 }
 
 // Helper functions
@@ -249,6 +585,124 @@ func SanitizeFilename(name string) string {
 	}, name)
 }
 
+// ContentHashFilename derives a collision-free filename from the image content,
+// keeping the (sanitized) extension of the original name.
+func ContentHashFilename(data []byte, originalName string) string {
+	sum := sha256.Sum256(data)
+	return HashFilename(sum[:], originalName)
+}
+
+// HashFilename builds the stored filename from a SHA-256 digest of the content,
+// for callers that hash the image while streaming it.
+func HashFilename(sum []byte, originalName string) string {
+	ext := strings.ToLower(filepath.Ext(SanitizeFilename(originalName)))
+	return hex.EncodeToString(sum[:16]) + ext
+}
+
+// ImageDimensions reads an image's width and height from its header without decoding the pixels.
+// JPEGs are measured as displayed, so a portrait photo stored sideways with an EXIF orientation
+// reports its upright size. ok is false when the standard library cannot read the format, such as WebP.
+func ImageDimensions(r io.Reader) (width, height int, ok bool) {
+	// The EXIF segment comes before the frame header, so the bytes DecodeConfig reads include it
+	var header bytes.Buffer
+	cfg, format, err := image.DecodeConfig(io.TeeReader(r, &header))
+	if err != nil {
+		return 0, 0, false
+	}
+	if format == "jpeg" && readOrientation(&header) >= 5 {
+		return cfg.Height, cfg.Width, true
+	}
+	return cfg.Width, cfg.Height, true
+}
+
+// ImageContentType returns the MIME type for an image filename, defaulting to JPEG
+func ImageContentType(name string) string {
+	switch strings.ToLower(filepath.Ext(name)) {
+	case ".png":
+		return "image/png"
+	case ".gif":
+		return "image/gif"
+	case ".webp":
+		return "image/webp"
+	default:
+		return "image/jpeg"
+	}
+}
+
+// ImageDataURI reads an image file and encodes it as a base64 data URI
+func ImageDataURI(imagePath string) (string, error) {
+	data, err := os.ReadFile(imagePath)
+	if err != nil {
+		return "", fmt.Errorf("failed to read image %s: %v", imagePath, err)
+	}
+	return "data:" + ImageContentType(imagePath) + ";base64," + base64.StdEncoding.EncodeToString(data), nil
+}
+
+// ImageThumbnailDataURI encodes an image as a JPEG data URI whose longest side is at most maxSize.
+// Images that are already small enough, or that cannot be decoded, are inlined unchanged.
+func ImageThumbnailDataURI(imagePath string, maxSize int) (string, error) {
+	data, err := os.ReadFile(imagePath)
+	if err != nil {
+		return "", fmt.Errorf("failed to read image %s: %v", imagePath, err)
+	}
+
+	src, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil || (src.Bounds().Dx() <= maxSize && src.Bounds().Dy() <= maxSize) {
+		return "data:" + ImageContentType(imagePath) + ";base64," + base64.StdEncoding.EncodeToString(data), nil
+	}
+
+	thumbnail, err := thumbnailJPEG(src, maxSize)
+	if err != nil {
+		return "", fmt.Errorf("failed to encode thumbnail for %s: %v", imagePath, err)
+	}
+	return "data:image/jpeg;base64," + base64.StdEncoding.EncodeToString(thumbnail), nil
+}
+
+// thumbnailJPEG encodes an image as an RGB JPEG whose longest side is at most maxSize.
+// It uses a nearest-neighbour downscale, which is adequate for report thumbnails.
+func thumbnailJPEG(src image.Image, maxSize int) ([]byte, error) {
+	bounds := src.Bounds()
+	scale := 1.0
+	if bounds.Dx() > maxSize || bounds.Dy() > maxSize {
+		scale = float64(maxSize) / float64(bounds.Dx())
+		if bounds.Dy() > bounds.Dx() {
+			scale = float64(maxSize) / float64(bounds.Dy())
+		}
+	}
+	width := int(float64(bounds.Dx())*scale + 0.5)
+	height := int(float64(bounds.Dy())*scale + 0.5)
+	thumbnail := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			thumbnail.Set(x, y, src.At(bounds.Min.X+int(float64(x)/scale), bounds.Min.Y+int(float64(y)/scale)))
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, thumbnail, &jpeg.Options{Quality: 80}); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// InlineClusterImages returns a copy of the clusters with every image replaced by its data URI
+func InlineClusterImages(clusters map[string]models.ClusterDetails, imagesDir string) (map[string]models.ClusterDetails, error) {
+	inlined := make(map[string]models.ClusterDetails, len(clusters))
+	for key, details := range clusters {
+		images := make([]string, len(details.Images))
+		for i, image := range details.Images {
+			uri, err := ImageDataURI(filepath.Join(imagesDir, image))
+			if err != nil {
+				return nil, err
+			}
+			images[i] = uri
+		}
+		details.Images = images
+		inlined[key] = details
+	}
+	return inlined, nil
+}
+
 func URLEncode(s string) string {
 	return strings.ReplaceAll(s, " ", "%20")
 }
@@ -0,0 +1,299 @@
+package utils
+
+import (
+	"bytes"
+	"encoding/base64"
+	"image"
+	"image/color"
+	"image/png"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+
+	"imageclust/internal/models"
+)
+
+// writeTestPNG writes a small solid PNG into dir and returns its name. The color depends on the name,
+// so differently named images differ in content too.
+func writeTestPNG(t *testing.T, dir, name string) string {
+	t.Helper()
+	img := image.NewRGBA(image.Rect(0, 0, 8, 8))
+	for x := 0; x < 8; x++ {
+		for y := 0; y < 8; y++ {
+			img.Set(x, y, color.RGBA{R: name[0], A: 255})
+		}
+	}
+	f, err := os.Create(filepath.Join(dir, name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if err := png.Encode(f, img); err != nil {
+		t.Fatal(err)
+	}
+	return name
+}
+
+func TestGenerateHTMLBundleHasNoExternalImages(t *testing.T) {
+	imagesDir := t.TempDir()
+	clusters := map[string]models.ClusterDetails{
+		"Cluster-1": {
+			Title:  "Red Squares",
+			Labels: "Red",
+			Images: []string{writeTestPNG(t, imagesDir, "a.png"), writeTestPNG(t, imagesDir, "b.png")},
+		},
+	}
+
+	bundle, err := GenerateHTMLBundle(clusters, imagesDir, HTMLOptions{})
+	if err != nil {
+		t.Fatalf("GenerateHTMLBundle: %v", err)
+	}
+
+	sources := regexp.MustCompile(`<img[^>]*\ssrc="([^"]*)"`).FindAllStringSubmatch(string(bundle), -1)
+	if len(sources) != 2 {
+		t.Fatalf("got %d images, want 2", len(sources))
+	}
+	for _, source := range sources {
+		if !strings.HasPrefix(source[1], "data:image/") {
+			t.Errorf("image source %q is not inlined", source[1])
+		}
+	}
+	if strings.Contains(string(bundle), "/api/image/") {
+		t.Error("bundle still references /api/image/")
+	}
+}
+
+func TestRenderHTMLCapsImagesPerCluster(t *testing.T) {
+	images := []string{"1.png", "2.png", "3.png", "4.png", "5.png"}
+	clusters := map[string]models.ClusterDetails{
+		"Cluster-0": {Images: images, ServiceOutputs: []models.ServiceOutput{{ServiceName: "Claude", Title: "Shoes"}}},
+	}
+
+	html, err := RenderHTML(clusters, "/api/image/", HTMLOptions{MaxImagesPerCluster: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	page := string(html)
+
+	if tags := regexp.MustCompile(`<img[^>]*\ssrc=`).FindAllString(page, -1); len(tags) != 3 {
+		t.Errorf("got %d img tags, want 3", len(tags))
+	}
+	if !strings.Contains(page, "+2 more") {
+		t.Error("the page does not say how many images are hidden")
+	}
+	// The download payload still carries every image, including the hidden ones
+	if !strings.Contains(page, "5.png") {
+		t.Error("a hidden image is missing from the download payload")
+	}
+}
+
+func TestRenderHTMLReplacesFailedOutputs(t *testing.T) {
+	clusters := map[string]models.ClusterDetails{
+		"Cluster-0": {
+			Images: []string{"a.png", "b.png"},
+			Labels: "Shoe, Sneaker, Footwear, Clothing",
+			ServiceOutputs: []models.ServiceOutput{
+				{ServiceName: "Claude", Title: "Everyday Sneakers", CatchyPhrase: "Walk on"},
+				{ServiceName: "Nova", Title: "No Title", CatchyPhrase: "No phrase available", Untitled: true},
+			},
+		},
+	}
+
+	tests := []struct {
+		mode        string
+		wantLiteral bool
+		wantLabels  bool
+		wantNova    bool
+	}{
+		{mode: "", wantLabels: true, wantNova: true},
+		{mode: UntitledLabels, wantLabels: true, wantNova: true},
+		{mode: UntitledHide},
+		{mode: UntitledLiteral, wantLiteral: true, wantNova: true},
+	}
+	for _, tt := range tests {
+		html, err := RenderHTML(clusters, "/api/image/", HTMLOptions{UntitledDisplay: tt.mode})
+		if err != nil {
+			t.Fatal(err)
+		}
+		page := string(html)
+		if got := strings.Contains(page, "No Title") || strings.Contains(page, "No phrase available"); got != tt.wantLiteral {
+			t.Errorf("mode %q: placeholder shown = %v, want %v", tt.mode, got, tt.wantLiteral)
+		}
+		if got := strings.Contains(page, "Shoe, Sneaker, Footwear<"); got != tt.wantLabels {
+			t.Errorf("mode %q: top labels shown = %v, want %v", tt.mode, got, tt.wantLabels)
+		}
+		if got := strings.Contains(page, "Nova"); got != tt.wantNova {
+			t.Errorf("mode %q: failed service row shown = %v, want %v", tt.mode, got, tt.wantNova)
+		}
+		if !strings.Contains(page, "Everyday Sneakers") {
+			t.Errorf("mode %q: the successful output is missing", tt.mode)
+		}
+	}
+}
+
+func TestInlineClusterImagesDecodeBack(t *testing.T) {
+	dir := t.TempDir()
+	clusters := map[string]models.ClusterDetails{
+		"Cluster-0": {Title: "Reds", Images: []string{writeTestPNG(t, dir, "a.png"), writeTestPNG(t, dir, "b.png")}},
+	}
+
+	inlined, err := InlineClusterImages(clusters, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if clusters["Cluster-0"].Images[0] != "a.png" {
+		t.Error("the original clusters were modified")
+	}
+	for _, uri := range inlined["Cluster-0"].Images {
+		encoded, ok := strings.CutPrefix(uri, "data:image/png;base64,")
+		if !ok {
+			t.Fatalf("%.40s is not a PNG data URI", uri)
+		}
+		data, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			t.Fatal(err)
+		}
+		img, err := png.Decode(bytes.NewReader(data))
+		if err != nil {
+			t.Fatalf("data URI does not decode to an image: %v", err)
+		}
+		if img.Bounds().Dx() != 8 || img.Bounds().Dy() != 8 {
+			t.Errorf("decoded image is %v, want 8x8", img.Bounds())
+		}
+	}
+}
+
+func TestSortClustersByRequestedOrder(t *testing.T) {
+	clusters := map[string]models.ClusterDetails{
+		"Cluster-0":    {Images: []string{"a", "b", "c"}, Cohesion: 0.5, DominantLabel: "Shoe"},
+		"Cluster-1":    {Images: []string{"a", "b", "c", "d", "e"}, Cohesion: 0.9, DominantLabel: "Bag"},
+		"Cluster-2":    {Images: []string{"a", "b", "c", "d"}, Cohesion: 0.1, DominantLabel: "Hat"},
+		"Cluster-3":    {Images: []string{"a", "b", "c", "d"}, Cohesion: 0.5, DominantLabel: "Bag"},
+		"Cluster-misc": {Images: []string{"a", "b", "c", "d", "e", "f"}, IsMisc: true},
+	}
+
+	tests := map[string][]string{
+		SortBySize:     {"Cluster-1", "Cluster-2", "Cluster-3", "Cluster-0", "Cluster-misc"},
+		SortByCohesion: {"Cluster-2", "Cluster-0", "Cluster-3", "Cluster-1", "Cluster-misc"},
+		SortByLabel:    {"Cluster-1", "Cluster-3", "Cluster-2", "Cluster-0", "Cluster-misc"},
+	}
+	for order, want := range tests {
+		var keys []string
+		for _, entry := range SortClusters(clusters, order) {
+			keys = append(keys, entry.ID)
+		}
+		if strings.Join(keys, ",") != strings.Join(want, ",") {
+			t.Errorf("order %q: got %v, want %v", order, keys, want)
+		}
+	}
+}
+
+func TestSortClustersOrdersKeysNumerically(t *testing.T) {
+	clusters := map[string]models.ClusterDetails{
+		"Cluster-10":   {},
+		"Cluster-misc": {IsMisc: true},
+		"Cluster-2":    {},
+		"Cluster-1001": {},
+	}
+
+	var keys []string
+	for _, entry := range SortClusters(clusters, "") {
+		keys = append(keys, entry.ID)
+	}
+	want := []string{"Cluster-2", "Cluster-10", "Cluster-1001", "Cluster-misc"}
+	if strings.Join(keys, ",") != strings.Join(want, ",") {
+		t.Errorf("got %v, want %v", keys, want)
+	}
+}
+
+func TestArchiveHTMLReportIsSelfContained(t *testing.T) {
+	imagesDir, outputDir := t.TempDir(), filepath.Join(t.TempDir(), "reports")
+	clusters := map[string]models.ClusterDetails{
+		"Cluster-0": {
+			Images:         []string{writeTestPNG(t, imagesDir, "a.png"), writeTestPNG(t, imagesDir, "b.png")},
+			ServiceOutputs: []models.ServiceOutput{{ServiceName: "Claude", Title: "Red Squares"}},
+		},
+	}
+
+	report, err := ArchiveHTMLReport(clusters, imagesDir, outputDir, HTMLOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if filepath.Dir(report) != outputDir {
+		t.Errorf("report written to %s, want a file in %s", report, outputDir)
+	}
+	html, err := os.ReadFile(report)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(html), "Red Squares") {
+		t.Error("report is missing the cluster title")
+	}
+
+	// Every image is referenced relative to the report and was copied next to it
+	sources := regexp.MustCompile(`<img[^>]*\ssrc="([^"]*)"`).FindAllStringSubmatch(string(html), -1)
+	if len(sources) != 2 {
+		t.Fatalf("got %d images, want 2", len(sources))
+	}
+	for _, source := range sources {
+		if strings.HasPrefix(source[1], "/") || strings.Contains(source[1], "://") {
+			t.Errorf("image source %q is not relative to the report", source[1])
+			continue
+		}
+		if _, err := os.Stat(filepath.Join(outputDir, filepath.FromSlash(source[1]))); err != nil {
+			t.Errorf("image source %q does not resolve: %v", source[1], err)
+		}
+	}
+}
+
+func TestArchiveHTMLReportKeepsReportsOfTheSameSecondApart(t *testing.T) {
+	imagesDir, outputDir := t.TempDir(), t.TempDir()
+	clusters := map[string]models.ClusterDetails{
+		"Cluster-0": {Title: "Shoes", Images: []string{writeTestPNG(t, imagesDir, "a.png")}},
+	}
+
+	first, err := ArchiveHTMLReport(clusters, imagesDir, outputDir, HTMLOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := ArchiveHTMLReport(clusters, imagesDir, outputDir, HTMLOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first == second {
+		t.Fatalf("both reports were written to %s", first)
+	}
+	for _, report := range []string{first, second} {
+		image := filepath.Join(strings.TrimSuffix(report, ".html")+"_images", "a.png")
+		if _, err := os.Stat(image); err != nil {
+			t.Errorf("image of %s: %v", filepath.Base(report), err)
+		}
+	}
+}
+
+func TestWriteClusterJSONFilesUsesANewDirectoryPerRun(t *testing.T) {
+	outputDir := t.TempDir()
+	clusters := map[string]models.ClusterDetails{"Cluster-0": {Title: "Shoes", Images: []string{"a.png"}}}
+
+	first, err := WriteClusterJSONFiles(clusters, map[string]string{"a.png": "a"}, outputDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clusters["Cluster-0"] = models.ClusterDetails{Title: "Boots", Images: []string{"a.png"}}
+	second, err := WriteClusterJSONFiles(clusters, map[string]string{"a.png": "a"}, outputDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first == second {
+		t.Fatalf("both runs were written to %s", first)
+	}
+	data, err := os.ReadFile(filepath.Join(first, "Cluster-0.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(data), `"Shoes"`) {
+		t.Errorf("first run's file was overwritten: %s", data)
+	}
+}
@@ -1,19 +1,31 @@
 package workflow
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"image/color"
 	"imageclust/internal/ai"
+	"imageclust/internal/ai/prompt"
 	"imageclust/internal/clustering"
+	"imageclust/internal/config"
 	"imageclust/internal/embeddings"
+	"imageclust/internal/logger"
 	"imageclust/internal/models"
 	"imageclust/internal/rekognition"
 	"imageclust/internal/utils"
-	"log"
 	"os"
 	"path/filepath"
+	"slices"
+	"sort"
 	"strings"
 	"sync"
 	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/rekognition/types"
 )
 
 type ImageCluster struct {
@@ -22,88 +34,477 @@ type ImageCluster struct {
 	EmbeddingsModel *embeddings.AppContext
 	MinClusterSize  int
 	MaxClusterSize  int
+	Config          *config.AppConfig
+	Results         []ImageResult        // Per-image outcome of the last Run
+	Flagged         []FlaggedImage       // Images that carried moderation labels in the last Run
+	Duplicates      []DuplicateImage     // Near-duplicate uploads left out of the last Run, when deduplication is on
+	LowLabels       []LowLabelImage      // Images left with fewer labels than min_labels in the last Run
+	Failed          []FailedImage        // Images left out of the last Run because their embedding failed
+	Outliers        []OutlierImage       // Items far from all others in the last Run, when outlier detection is on
+	NoValidClusters bool                 // Whether the last Run formed no cluster of the minimum size and kept every image in the misc bucket
+	Summary         string               // Paragraph describing the collection from the last Run, when requested
+	HTMLOptions     utils.HTMLOptions    // Options the last Run rendered its report with, for exports that should match it
+	Centroids       map[string][]float32 // Centroid of every cluster in the clustering space, keyed like the cluster details
+	Timings         RunTimings           // Duration of each step of the last Run
+	Services        []ai.ServiceConfig   // AI services that title the clusters (nil uses every enabled service)
 	Mutex           sync.Mutex
 }
 
+// ErrNoValidClusters is returned by Run when every cluster formed is smaller than the minimum cluster size
+var ErrNoValidClusters = errors.New("no valid clusters were formed")
+
+// RunTimings breaks the duration of a Run down by step, in milliseconds
+type RunTimings struct {
+	LabelDetectionMs float64 `json:"labelDetectionMs"` // Saving, moderating and labelling the images and building the label set
+	EmbeddingMs      float64 `json:"embeddingMs"`
+	ClusteringMs     float64 `json:"clusteringMs"` // Clustering, merging and filtering loose clusters
+	AIGenerationMs   float64 `json:"aiGenerationMs"`
+	HTMLGenerationMs float64 `json:"htmlGenerationMs"`
+	TotalMs          float64 `json:"totalMs"`
+}
+
+// millisecondsSince returns the time elapsed since start in fractional milliseconds
+func millisecondsSince(start time.Time) float64 {
+	return float64(time.Since(start)) / float64(time.Millisecond)
+}
+
+// ImageResult is the clustering outcome for a single image
+type ImageResult struct {
+	Filename  string    `json:"filename"`
+	ID        string    `json:"productReferenceId"`
+	ProductID string    `json:"productId,omitempty"`
+	ClusterID string    `json:"clusterId"` // Empty when the image was left out of every cluster
+	Labels    []string  `json:"labels"`
+	Embedding []float32 `json:"embedding,omitempty"`
+
+	LabelDetails     []types.Label `json:"labelDetails,omitempty"`     // Full Rekognition labels, when label_details is set
+	OriginalFilename string        `json:"originalFilename,omitempty"` // Name the image was uploaded with, when original_filenames is set
+}
+
+// FlaggedImage is an upload that carried moderation labels
+type FlaggedImage struct {
+	Filename         string   `json:"filename"`
+	OriginalFilename string   `json:"originalFilename"`
+	ModerationLabels []string `json:"moderationLabels"`
+	Rejected         bool     `json:"rejected"` // Whether the image was excluded from clustering
+}
+
+// LowLabelImage is an image that got fewer Rekognition labels than the configured minimum.
+// It is still clustered, but its label vector carries little or no signal.
+type LowLabelImage struct {
+	Filename         string `json:"filename"`
+	OriginalFilename string `json:"originalFilename"`
+	LabelCount       int    `json:"labelCount"`
+	Retried          bool   `json:"retried"` // Whether detection was retried at a lower confidence
+}
+
+// DuplicateImage is an upload left out because its perceptual hash matched an earlier upload
+type DuplicateImage struct {
+	Filename         string `json:"filename"`
+	OriginalFilename string `json:"originalFilename"`
+	DuplicateOf      string `json:"duplicateOf"` // Filename of the earlier upload that was kept
+	Distance         int    `json:"distance"`    // Hamming distance between the two hashes
+}
+
+// FailedImage is an upload whose embedding could not be computed, tolerated under the failure threshold
+type FailedImage struct {
+	Filename string `json:"filename"`
+	ID       string `json:"productReferenceId"`
+	Error    string `json:"error"`
+}
+
+// OutlierImage is a clustered item whose embedding lies far from all others.
+// For multi-view products the ID is that of the product's first image.
+type OutlierImage struct {
+	Filename string  `json:"filename"`
+	ID       string  `json:"productReferenceId"`
+	Distance float32 `json:"distance"` // Mean distance to the item's nearest neighbors
+	Excluded bool    `json:"excluded"` // Whether the item was moved to the misc bucket instead of being clustered
+}
+
 type ItemDetails struct {
 	ID        string
 	ImagePath string
 	Labels    []string
+	Subject   *embeddings.CropBox // Box of the primary object, set when cropping to the subject
+	ProductID string              // Product the image shows; images of one product are clustered together
+	Metadata  []string            // EXIF features as "field=value" and detected words as "text=word", set when configured
+
+	LabelDetails     []types.Label // Full Rekognition labels with confidence, parents, categories and instances, kept when label_details is set
+	OriginalFilename string        // Name the image was uploaded with, before sanitizing and content hashing
+	RetriedLabels    bool          // Whether the labels were detected at the lower retry confidence
 }
 
-func NewImageCluster(minClusterSize, maxClusterSize int, tempDir string) (*ImageCluster, error) {
-	log.Printf("Initializing ImageCluster with min=%d, max=%d clusters", minClusterSize, maxClusterSize)
+func NewImageCluster(cfg *config.AppConfig, tempDir string) (*ImageCluster, error) {
+	logger.Infof("Initializing ImageCluster with min=%d, max=%d clusters", cfg.MinClusterSize, cfg.MaxClusterSize)
 
 	appCtx := &embeddings.AppContext{
 		ImageDir:      filepath.Join(tempDir, "images"),
 		CacheDir:      filepath.Join(tempDir, "cache"),
 		LabelSet:      make(map[string]int),
 		LabelsMapping: make(map[string][]string),
+		Interpolation: embeddings.InterpolationFromName(cfg.Interpolation),
 	}
-
-	rekogSvc, err := rekognition.NewRekognitionService("us-east-1", appCtx.CacheDir)
+	background, padding, err := PreprocessColors(cfg)
 	if err != nil {
-		return nil, fmt.Errorf("failed to initialize RekognitionService: %v", err)
+		return nil, err
+	}
+	appCtx.Background = background
+	appCtx.Padding = padding
+	if err := embeddings.ValidatePreprocessPipeline(cfg.PreprocessPipeline); err != nil {
+		return nil, fmt.Errorf("invalid preprocess_pipeline: %v", err)
 	}
+	appCtx.Pipeline = cfg.PreprocessPipeline
 
-	modelPath := "resnet50-v1-7.onnx"
-	net, err := embeddings.LoadPretrainedModelONNX(modelPath)
-	if err != nil {
-		return nil, fmt.Errorf("failed to load ResNet50 ONNX model: %v", err)
+	// Without Rekognition there is nothing to cluster on in labels-only mode and nothing to moderate with
+	var rekogSvc *rekognition.RekognitionService
+	if cfg.UseRekognition {
+		// A shared cache outlives the session, so identical uploads in later sessions reuse their labels
+		cacheDir := appCtx.CacheDir
+		if cfg.LabelCacheDir != "" {
+			cacheDir = cfg.LabelCacheDir
+		}
+		svc, err := rekognition.NewRekognitionService("us-east-1", cacheDir)
+		if err != nil {
+			return nil, fmt.Errorf("failed to initialize RekognitionService: %v", err)
+		}
+		svc.Interpolation = appCtx.Interpolation
+		svc.CategoryConfidence = cfg.CategoryConfidence
+		rekogSvc = svc
+	} else if cfg.LabelsOnly {
+		return nil, fmt.Errorf("labels_only requires Rekognition to be enabled")
+	} else if cfg.ModerationAction != "" {
+		return nil, fmt.Errorf("moderation requires Rekognition to be enabled")
+	} else if cfg.DetectText {
+		return nil, fmt.Errorf("detect_text requires Rekognition to be enabled")
 	}
 
-	appCtx.Net = net
+	// The model is only needed when image embeddings are computed
+	if !cfg.LabelsOnly {
+		model := embeddings.ModelRegistry["resnet50"]
+		if err := model.CheckFile(); err != nil {
+			return nil, err
+		}
+		nets, err := embeddings.NewNetPool(model.Path, cfg.NetPoolSize)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load ResNet50 ONNX model: %v", err)
+		}
+
+		layer := model.Layer(cfg.EmbeddingLayer)
+		appCtx.Nets = nets
+		appCtx.OutputLayer = layer.Name
+		appCtx.SwapRB = model.SwapRB
+		appCtx.Postprocess = cfg.EmbeddingPostprocess
+		appCtx.EmbeddingDim = layer.EmbeddingDim
+
+		if err := loadBlendedModels(appCtx, cfg); err != nil {
+			appCtx.Nets.Close()
+			for _, blended := range appCtx.Blend {
+				blended.Nets.Close()
+			}
+			return nil, err
+		}
+	}
 
 	return &ImageCluster{
 		TempDir:         tempDir,
 		RekognitionSvc:  rekogSvc,
 		EmbeddingsModel: appCtx,
-		MinClusterSize:  minClusterSize,
-		MaxClusterSize:  maxClusterSize,
+		MinClusterSize:  cfg.MinClusterSize,
+		MaxClusterSize:  cfg.MaxClusterSize,
+		Config:          cfg,
 	}, nil
 }
 
-func (ic *ImageCluster) Run(uploadedImages []models.UploadedImage) (map[string]models.ClusterDetails, string, error) {
+// loadBlendedModels loads the models listed in embedding_models other than ResNet50, which is always run.
+// Listing resnet50 only sets its weight.
+func loadBlendedModels(appCtx *embeddings.AppContext, cfg *config.AppConfig) error {
+	weights, err := embeddings.ParseModelWeights(cfg.EmbeddingModels)
+	if err != nil {
+		return fmt.Errorf("invalid embedding_models: %v", err)
+	}
+
+	appCtx.Weight = 1
+	for _, entry := range weights {
+		if entry.Name == "resnet50" {
+			appCtx.Weight = entry.Weight
+			continue
+		}
+
+		model := embeddings.ModelRegistry[entry.Name]
+		if err := model.CheckFile(); err != nil {
+			return err
+		}
+		nets, err := embeddings.NewNetPool(model.Path, cfg.NetPoolSize)
+		if err != nil {
+			return fmt.Errorf("failed to load model %s: %v", entry.Name, err)
+		}
+		layer := model.Layer("")
+		appCtx.Blend = append(appCtx.Blend, embeddings.BlendedModel{
+			Name:         entry.Name,
+			Nets:         nets,
+			OutputLayer:  layer.Name,
+			SwapRB:       model.SwapRB,
+			EmbeddingDim: layer.EmbeddingDim,
+			Weight:       entry.Weight,
+		})
+		logger.Infof("Blending %s embeddings with weight %g", entry.Name, entry.Weight)
+	}
+	return nil
+}
+
+// PreprocessColors returns the transparency background and letterbox color configured for preprocessing.
+// Each is nil when its option is off.
+func PreprocessColors(cfg *config.AppConfig) (background, padding *color.RGBA, err error) {
+	if cfg.FlattenTransparency {
+		parsed, err := embeddings.ParseHexColor(cfg.BackgroundColor)
+		if err != nil {
+			return nil, nil, fmt.Errorf("invalid background_color: %v", err)
+		}
+		background = &parsed
+	}
+	if cfg.ResizeMode == "pad" {
+		parsed, err := embeddings.ParseHexColor(cfg.PadColor)
+		if err != nil {
+			return nil, nil, fmt.Errorf("invalid pad_color: %v", err)
+		}
+		padding = &parsed
+	}
+	return background, padding, nil
+}
+
+// Close frees the loaded networks without waiting for timed-out forward passes, whose networks are freed
+// when they finish. The ImageCluster must not be used afterwards.
+func (ic *ImageCluster) Close() {
+	if ic.EmbeddingsModel.Nets != nil {
+		ic.EmbeddingsModel.Nets.Close()
+	}
+	for _, model := range ic.EmbeddingsModel.Blend {
+		model.Nets.Close()
+	}
+}
+
+func (ic *ImageCluster) Run(ctx context.Context, uploadedImages []models.UploadedImage) (map[string]models.ClusterDetails, string, error) {
 	startTime := time.Now()
-	log.Println("Starting ImageCluster run...")
+	ic.Timings = RunTimings{}
+	logger.Infof("Starting ImageCluster run...")
 
 	if err := ic.createDirectories(); err != nil {
 		return nil, "", err
 	}
 
-	itemDetails, err := ic.processImages(uploadedImages)
+	stepStart := time.Now()
+	itemDetails, err := ic.processImages(ctx, uploadedImages)
 	if err != nil {
 		return nil, "", err
 	}
 
-	err = embeddings.BuildLabelSet(getItemIDs(itemDetails), ic.RekognitionSvc, ic.EmbeddingsModel)
-	if err != nil {
-		return nil, "", fmt.Errorf("failed to build label set: %v", err)
+	// With Rekognition disabled the label set stays empty, so label vectors add no dimensions
+	if ic.Config.UseRekognition {
+		err = embeddings.BuildLabelSet(ctx, getItemIDs(itemDetails), ic.RekognitionSvc, ic.EmbeddingsModel, ic.Config.LabelWorkers)
+		if err != nil {
+			return nil, "", fmt.Errorf("failed to build label set: %v", err)
+		}
+		ic.addRetriedLabels(itemDetails)
 	}
 
-	embeddingsList, itemIDs, err := ic.createEmbeddings(itemDetails)
-	if err != nil {
-		return nil, "", err
+	if len(ic.Config.EXIFFields) > 0 || ic.Config.DetectText {
+		metadataMapping := make(map[string][]string, len(itemDetails))
+		for _, item := range itemDetails {
+			metadataMapping[item.ID] = item.Metadata
+		}
+		ic.EmbeddingsModel.MetadataSet = embeddings.IndexLabels(metadataMapping)
+		logger.Infof("Metadata set built with %d EXIF and text features", len(ic.EmbeddingsModel.MetadataSet))
+	}
+
+	ic.Timings.LabelDetectionMs = millisecondsSince(stepStart)
+
+	stepStart = time.Now()
+	embeddingsList, itemIDs, failed := ic.createEmbeddings(itemDetails)
+	ic.Failed = failed
+	if len(failed) > 0 {
+		if !ic.withinFailureTolerance(len(failed), len(itemDetails)) || len(failed) == len(itemDetails) {
+			return nil, "", fmt.Errorf("failed to generate embeddings for %d of %d images; first error for %s: %s",
+				len(failed), len(itemDetails), failed[0].ID, failed[0].Error)
+		}
+		logger.Warnf("Continuing without %d of %d images whose embedding failed", len(failed), len(itemDetails))
+		itemDetails = survivingItems(itemDetails, failed)
 	}
 
-	clusters, success := clustering.PerformClusteringWithConstraints(
-		embeddingsList,
-		itemIDs,
-		ic.MinClusterSize,
-		ic.MaxClusterSize,
-	)
+	if ic.Config.StandardizeEmbeddings {
+		embeddingsList = embeddings.StandardizeEmbeddings(embeddingsList)
+	}
+	ic.Timings.EmbeddingMs = millisecondsSince(stepStart)
+
+	stepStart = time.Now()
+
+	if ic.Config.FeatureMask != "" && len(embeddingsList) > 0 {
+		start, end, err := ic.featureRange(len(embeddingsList[0]))
+		if err != nil {
+			return nil, "", err
+		}
+		logger.Infof("Clustering on embedding dimensions %d to %d of %d", start, end, len(embeddingsList[0]))
+		embeddingsList = clustering.SliceEmbeddings(embeddingsList, start, end)
+	}
+
+	// Multi-view products are clustered as a single item whose embedding aggregates its views
+	clusterEmbeddings, clusterIDs := embeddingsList, itemIDs
+	var views map[string][]string
+	if ic.Config.ViewAggregation != "" {
+		clusterEmbeddings, clusterIDs, views = aggregateProductViews(itemDetails, embeddingsList, itemIDs, ic.Config.ViewAggregation)
+	}
+
+	// Outliers are detected in the space that is clustered, so they can be kept out of it
+	var excludedOutliers []string
+	ic.Outliers = nil
+	if ic.Config.OutlierThreshold > 0 {
+		clusterEmbeddings, clusterIDs, excludedOutliers = ic.detectOutliers(itemDetails, clusterEmbeddings, clusterIDs)
+	}
+
+	minSize, maxSize := ic.MinClusterSize, ic.MaxClusterSize
+	if ic.Config.ConstraintFallback != "" {
+		relaxedMin, relaxedMax, err := clustering.RelaxConstraints(len(clusterEmbeddings), minSize, maxSize, ic.Config.ConstraintFallback)
+		if err != nil {
+			return nil, "", fmt.Errorf("failed to relax cluster size constraints: %v", err)
+		}
+		if relaxedMin != minSize || relaxedMax != maxSize {
+			logger.Warnf("Cluster size constraints %d-%d are infeasible for %d images, relaxed to %d-%d",
+				minSize, maxSize, len(clusterEmbeddings), relaxedMin, relaxedMax)
+		}
+		minSize, maxSize = relaxedMin, relaxedMax
+	}
+
+	var clusters map[int][]string
+	var success bool
+	if len(ic.Config.AspectBuckets) > 0 {
+		buckets, err := ic.aspectBuckets(itemDetails, clusterIDs)
+		if err != nil {
+			return nil, "", err
+		}
+		clusters, success = clustering.PerformBucketedClustering(clusterEmbeddings, clusterIDs, buckets, minSize, maxSize, ic.Config.CentroidUpdate, ic.Config.ConstraintFallback)
+	} else if ic.Config.TwoStage && !ic.Config.LabelsOnly && ic.Config.UseRekognition && ic.Config.FeatureMask == "" {
+		clusters, success = ic.performTwoStageClustering(clusterEmbeddings, clusterIDs, minSize, maxSize)
+	} else {
+		clusters, success = clustering.PerformClusteringWithConstraints(
+			clusterEmbeddings,
+			clusterIDs,
+			minSize,
+			maxSize,
+			ic.Config.CentroidUpdate,
+		)
+	}
 	if !success {
 		return nil, "", fmt.Errorf("clustering failed")
 	}
 
-	clusterDetails := ic.prepareClusterDetails(clusters, itemDetails)
+	// Clustering drops clusters below the minimum size, which can leave nothing to report
+	ic.NoValidClusters = false
+	var unclustered []string
+	if len(clusters) == 0 && len(clusterIDs) > 0 {
+		if ic.Config.EmptyResult != "misc" {
+			return nil, "", fmt.Errorf("%w: no group of at least %d similar images was found among %d items; set empty_result=misc to return them unclustered",
+				ErrNoValidClusters, minSize, len(clusterIDs))
+		}
+		logger.Warnf("No cluster reached the minimum size of %d, placing all %d items in the misc bucket", minSize, len(clusterIDs))
+		ic.NoValidClusters = true
+		unclustered = clusterIDs
+	}
+
+	if ic.Config.MergeThreshold > 0 {
+		clusters = clustering.MergeSimilarClusters(clusters, clusterEmbeddings, clusterIDs, ic.Config.MergeThreshold, maxSize)
+	}
+	if ic.Config.MaxClusters > 0 && len(clusters) > ic.Config.MaxClusters {
+		logger.Infof("Merging %d clusters down to the cap of %d", len(clusters), ic.Config.MaxClusters)
+		clusters = clustering.CapClusterCount(clusters, clusterEmbeddings, clusterIDs, ic.Config.MaxClusters, maxSize)
+	}
+
+	clusters, cohesion, misc := clustering.FilterLooseClusters(clusters, clusterEmbeddings, clusterIDs, ic.Config.CohesionThreshold)
+	misc = append(misc, excludedOutliers...)
+	misc = append(misc, unclustered...)
+	if views != nil {
+		clusters, misc = expandProductViews(clusters, misc, views)
+	}
+	ic.Timings.ClusteringMs = millisecondsSince(stepStart)
+
+	// Stop before the AI calls when the client has already gone away
+	if err := ctx.Err(); err != nil {
+		return nil, "", err
+	}
+
+	// Centroids are computed on the final clusters, after any merging and filtering
+	ic.Centroids = make(map[string][]float32, len(clusters))
+	for clusterID, centroid := range clustering.ComputeCentroids(clusters, embeddingsList, itemIDs) {
+		ic.Centroids[fmt.Sprintf("Cluster-%d", clusterID)] = centroid
+	}
+
+	stepStart = time.Now()
+	clusterDetails := ic.prepareClusterDetails(ctx, clusters, cohesion, itemDetails)
+	ic.Timings.AIGenerationMs = millisecondsSince(stepStart)
+	if err := ctx.Err(); err != nil {
+		return nil, "", err
+	}
+	if len(misc) > 0 {
+		clusterDetails["Cluster-misc"] = prepareMiscDetails(misc, itemDetails)
+	}
+	if ic.Config.OriginalFilenames {
+		attachOriginalFilenames(clusterDetails, itemDetails)
+	}
+
+	// The summary is AI output, so deterministic runs skip it like they skip AI titles
+	ic.Summary = ""
+	if ic.Config.CollectionSummary && !ic.Config.Deterministic {
+		stepStart = time.Now()
+		ic.Summary = generateSummary(ctx, collectionSummaryText(clusterDetails), 3)
+		ic.Timings.AIGenerationMs += millisecondsSince(stepStart)
+		if err := ctx.Err(); err != nil {
+			return nil, "", err
+		}
+	}
+
+	ic.Results = buildImageResults(itemDetails, embeddingsList, clusters, misc)
+	if ic.Config.OriginalFilenames {
+		for i := range ic.Results {
+			ic.Results[i].OriginalFilename = itemDetails[i].OriginalFilename
+		}
+	}
 
-	htmlOutputPath, err := utils.GenerateHTMLOutput(clusterDetails, ic.TempDir)
+	htmlOptions := utils.HTMLOptions{
+		MaxImagesPerCluster: ic.Config.MaxImagesPerCluster,
+		UntitledDisplay:     ic.Config.UntitledDisplay,
+		SortOrder:           ic.Config.SortOrder,
+		Summary:             ic.Summary,
+	}
+	ic.HTMLOptions = htmlOptions
+	stepStart = time.Now()
+	htmlOutputPath, err := utils.GenerateHTMLOutput(clusterDetails, ic.TempDir, htmlOptions)
 	if err != nil {
 		return nil, "", fmt.Errorf("failed to generate HTML output: %v", err)
 	}
 
-	log.Printf("Completed clustering in %v", time.Since(startTime))
+	if ic.Config.ReportOutputDir != "" {
+		reportPath, err := utils.ArchiveHTMLReport(clusterDetails, ic.EmbeddingsModel.ImageDir, ic.Config.ReportOutputDir, htmlOptions)
+		if err != nil {
+			return nil, "", fmt.Errorf("failed to archive HTML report: %v", err)
+		}
+		logger.Infof("Archived HTML report to %s", reportPath)
+	}
+
+	if ic.Config.ClusterJSONDir != "" {
+		productIDs := make(map[string]string, len(ic.Results))
+		for _, result := range ic.Results {
+			productIDs[result.Filename] = result.ID
+		}
+		clusterDir, err := utils.WriteClusterJSONFiles(clusterDetails, productIDs, ic.Config.ClusterJSONDir)
+		if err != nil {
+			return nil, "", fmt.Errorf("failed to write cluster JSON files: %v", err)
+		}
+		logger.Infof("Wrote cluster JSON files to %s", clusterDir)
+	}
+
+	ic.Timings.HTMLGenerationMs = millisecondsSince(stepStart)
+	ic.Timings.TotalMs = millisecondsSince(startTime)
+
+	logger.Infof("Completed clustering in %v", time.Since(startTime))
 	return clusterDetails, htmlOutputPath, nil
 }
 
@@ -117,55 +518,295 @@ func (ic *ImageCluster) createDirectories() error {
 	return nil
 }
 
-func (ic *ImageCluster) processImages(uploadedImages []models.UploadedImage) ([]ItemDetails, error) {
-	itemDetails := make([]ItemDetails, len(uploadedImages))
+func (ic *ImageCluster) processImages(ctx context.Context, uploadedImages []models.UploadedImage) ([]ItemDetails, error) {
+	itemDetails := make([]ItemDetails, 0, len(uploadedImages))
+	ic.Flagged = nil
+	ic.Duplicates = nil
+	ic.LowLabels = nil
+
+	// Duplicates are dropped before moderation and labelling so they cost no Rekognition calls
+	var dedup *embeddings.Deduplicator
+	if ic.Config.DedupHash != "" {
+		var err error
+		dedup, err = embeddings.NewDeduplicator(ic.Config.DedupHash, ic.Config.DedupThreshold)
+		if err != nil {
+			return nil, err
+		}
+		defer dedup.Close()
+	}
 
 	for i, img := range uploadedImages {
 		imagePath := filepath.Join(ic.EmbeddingsModel.ImageDir, img.Filename)
-		if err := os.WriteFile(imagePath, img.Data, 0644); err != nil {
-			return nil, fmt.Errorf("failed to save image %s: %v", img.Filename, err)
+		if !img.Stored {
+			if err := os.WriteFile(imagePath, img.Data, 0644); err != nil {
+				return nil, fmt.Errorf("failed to save image %s: %v", img.Filename, err)
+			}
 		}
 
-		labels, err := ic.RekognitionSvc.DetectLabels(imagePath, 10, 75.0)
-		if err != nil {
-			return nil, fmt.Errorf("failed to detect labels for %s: %v", img.Filename, err)
+		if dedup != nil {
+			duplicateOf, distance, ok, err := dedup.Check(imagePath, img.Filename)
+			if err != nil {
+				// Unreadable images are kept so the embedding step reports them
+				logger.Warnf("Failed to hash %s, keeping it: %v", img.Filename, err)
+			} else if ok {
+				logger.Infof("Dropping %s as a near-duplicate of %s (distance %d)", img.Filename, duplicateOf, distance)
+				ic.Duplicates = append(ic.Duplicates, DuplicateImage{
+					Filename:         img.Filename,
+					OriginalFilename: img.OriginalFilename,
+					DuplicateOf:      duplicateOf,
+					Distance:         distance,
+				})
+				continue
+			}
 		}
 
-		labelNames := make([]string, len(labels))
-		for j, label := range labels {
-			labelNames[j] = *label.Name
+		if ic.Config.ModerationAction != "" {
+			rejected, err := ic.moderateImage(ctx, img, imagePath)
+			if err != nil {
+				return nil, err
+			}
+			if rejected {
+				continue
+			}
+		}
+
+		var labelNames []string
+		var labelDetails []types.Label
+		var subject *embeddings.CropBox
+		var retriedLabels bool
+		if ic.Config.UseRekognition {
+			labels, retried, err := ic.detectLabels(ctx, img, imagePath)
+			if err != nil {
+				return nil, err
+			}
+			retriedLabels = retried
+
+			labelNames = make([]string, len(labels))
+			for j, label := range labels {
+				labelNames[j] = *label.Name
+			}
+			if ic.Config.LabelDetails {
+				labelDetails = labels
+			}
+
+			if ic.Config.CropToSubject {
+				if box := rekognition.PrimaryBoundingBox(labels); box != nil {
+					subject = &embeddings.CropBox{
+						Left:   float64(aws.ToFloat32(box.Left)),
+						Top:    float64(aws.ToFloat32(box.Top)),
+						Width:  float64(aws.ToFloat32(box.Width)),
+						Height: float64(aws.ToFloat32(box.Height)),
+					}
+				}
+			}
 		}
 
-		itemDetails[i] = ItemDetails{
+		metadata := ic.exifFeatures(imagePath)
+		if ic.Config.DetectText {
+			words, err := ic.RekognitionSvc.DetectText(ctx, imagePath, 80)
+			if err != nil {
+				return nil, fmt.Errorf("failed to detect text in %s: %v", img.Filename, err)
+			}
+			metadata = append(metadata, textFeatures(words)...)
+		}
+
+		itemDetails = append(itemDetails, ItemDetails{
 			ID:        fmt.Sprintf("img_%d", i),
 			ImagePath: imagePath,
 			Labels:    labelNames,
-		}
+			Subject:   subject,
+			ProductID: img.ProductID,
+			Metadata:  metadata,
+
+			LabelDetails:     labelDetails,
+			OriginalFilename: img.OriginalFilename,
+			RetriedLabels:    retriedLabels,
+		})
+	}
+
+	if len(itemDetails) == 0 {
+		return nil, fmt.Errorf("no images left to cluster after moderation")
 	}
 
 	return itemDetails, nil
 }
 
-func (ic *ImageCluster) createEmbeddings(items []ItemDetails) ([][]float32, []string, error) {
+// Confidence thresholds of the label detection for clustering, and of its retry for images with too few labels
+const (
+	labelConfidence      = 75.0
+	retryLabelConfidence = 50.0
+)
+
+// detectLabels detects the labels of an image. With min_labels set, an image with fewer labels is retried
+// once at a lower confidence when the action is "retry", and recorded when it is still short.
+// retried reports whether the returned labels come from the retry.
+func (ic *ImageCluster) detectLabels(ctx context.Context, img models.UploadedImage, imagePath string) (labels []types.Label, retried bool, err error) {
+	labels, err = ic.RekognitionSvc.DetectLabels(ctx, imagePath, 10, labelConfidence)
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to detect labels for %s: %v", img.Filename, err)
+	}
+	if len(labels) >= ic.Config.MinLabels {
+		return labels, false, nil
+	}
+
+	if ic.Config.MinLabelsAction == "retry" {
+		logger.Infof("%s has %d labels, fewer than %d; retrying at %.0f%% confidence", img.Filename, len(labels), ic.Config.MinLabels, retryLabelConfidence)
+		labels, err = ic.RekognitionSvc.DetectLabels(ctx, imagePath, 10, retryLabelConfidence)
+		if err != nil {
+			return nil, false, fmt.Errorf("failed to detect labels for %s: %v", img.Filename, err)
+		}
+		retried = true
+		if len(labels) >= ic.Config.MinLabels {
+			return labels, true, nil
+		}
+	}
+
+	logger.Warnf("%s has %d labels, fewer than the minimum of %d", img.Filename, len(labels), ic.Config.MinLabels)
+	ic.LowLabels = append(ic.LowLabels, LowLabelImage{
+		Filename:         img.Filename,
+		OriginalFilename: img.OriginalFilename,
+		LabelCount:       len(labels),
+		Retried:          retried,
+	})
+	return labels, retried, nil
+}
+
+// exifFeatures returns the configured EXIF fields of an image as "field=value" features.
+// Images without EXIF data, or without some of the fields, simply get fewer features.
+func (ic *ImageCluster) exifFeatures(imagePath string) []string {
+	if len(ic.Config.EXIFFields) == 0 {
+		return nil
+	}
+
+	fields, err := utils.ReadEXIF(imagePath)
+	if err != nil {
+		logger.Warnf("Failed to read EXIF data of %s: %v", filepath.Base(imagePath), err)
+		return nil
+	}
+	var features []string
+	for _, name := range ic.Config.EXIFFields {
+		if value, ok := fields[name]; ok {
+			features = append(features, name+"="+value)
+		}
+	}
+	return features
+}
+
+// textFeatures tokenizes the words detected in an image into lowercase "text=token" features.
+// Punctuation splits tokens, so "NIKE-AIR" and "Nike Air" give the same features. Single characters
+// are mostly misread marks rather than brand or size text, so they are dropped, as are repeats.
+func textFeatures(words []string) []string {
+	var features []string
+	seen := make(map[string]bool)
+	for _, word := range words {
+		tokens := strings.FieldsFunc(strings.ToLower(word), func(r rune) bool {
+			return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+		})
+		for _, token := range tokens {
+			if utf8.RuneCountInString(token) < 2 || seen[token] {
+				continue
+			}
+			seen[token] = true
+			features = append(features, "text="+token)
+		}
+	}
+	return features
+}
+
+// addRetriedLabels adds the labels found by low-confidence retries to the label set. They fall below
+// the threshold the set is built with, so they would otherwise be left out of the label vectors.
+func (ic *ImageCluster) addRetriedLabels(items []ItemDetails) {
+	mapping := make(map[string][]string, len(ic.EmbeddingsModel.LabelsMapping))
+	for name, labels := range ic.EmbeddingsModel.LabelsMapping {
+		mapping[name] = labels
+	}
+	retried := 0
+	for _, item := range items {
+		if item.RetriedLabels {
+			mapping[item.ID] = item.Labels
+			retried++
+		}
+	}
+	if retried == 0 {
+		return
+	}
+	ic.EmbeddingsModel.LabelSet = embeddings.IndexLabels(mapping)
+	logger.Infof("Label set extended to %d labels with the retried labels of %d images", len(ic.EmbeddingsModel.LabelSet), retried)
+}
+
+// categoricalDim returns the length of the label and EXIF part at the end of every embedding
+func (ic *ImageCluster) categoricalDim() int {
+	return len(ic.EmbeddingsModel.LabelSet) + len(ic.EmbeddingsModel.MetadataSet)
+}
+
+// moderateImage screens an image for inappropriate content and records it when flagged.
+// Rejected images are removed from the image directory and reported as true.
+func (ic *ImageCluster) moderateImage(ctx context.Context, img models.UploadedImage, imagePath string) (bool, error) {
+	moderationLabels, err := ic.RekognitionSvc.DetectModerationLabels(ctx, imagePath, ic.Config.ModerationConfidence)
+	if err != nil {
+		return false, fmt.Errorf("failed to moderate %s: %v", img.Filename, err)
+	}
+	if len(moderationLabels) == 0 {
+		return false, nil
+	}
+
+	labelNames := make([]string, len(moderationLabels))
+	for j, label := range moderationLabels {
+		labelNames[j] = *label.Name
+	}
+
+	rejected := ic.Config.ModerationAction == "reject"
+	ic.Flagged = append(ic.Flagged, FlaggedImage{
+		Filename:         img.Filename,
+		OriginalFilename: img.OriginalFilename,
+		ModerationLabels: labelNames,
+		Rejected:         rejected,
+	})
+
+	if rejected {
+		logger.Infof("Rejecting %s for moderation labels %v", img.Filename, labelNames)
+		if err := os.Remove(imagePath); err != nil {
+			return false, fmt.Errorf("failed to remove rejected image %s: %v", img.Filename, err)
+		}
+	}
+	return rejected, nil
+}
+
+func (ic *ImageCluster) createEmbeddings(items []ItemDetails) ([][]float32, []string, []FailedImage) {
 	embeddingsList := make([][]float32, len(items))
 	itemIDs := make([]string, len(items))
+	errs := make([]error, len(items))
 	var mu sync.Mutex
 	var wg sync.WaitGroup
-	errChan := make(chan error, len(items))
 
 	for i, item := range items {
 		wg.Add(1)
 		go func(idx int, item ItemDetails) {
 			defer wg.Done()
 
-			imageEmbedding, err := embeddings.GetImageEmbedding(ic.EmbeddingsModel, item.ImagePath)
-			if err != nil {
-				errChan <- fmt.Errorf("failed to generate embedding for %s: %v", item.ID, err)
-				return
+			labelVector := embeddings.GenerateLabelVector(item.Labels, ic.EmbeddingsModel.LabelSet)
+			if len(ic.EmbeddingsModel.MetadataSet) > 0 {
+				// EXIF features are categorical like labels, so they extend the label vector
+				metadataVector := embeddings.GenerateLabelVector(item.Metadata, ic.EmbeddingsModel.MetadataSet)
+				labelVector = embeddings.CombineEmbeddings(labelVector, metadataVector)
 			}
 
-			labelVector := embeddings.GenerateLabelVector(item.Labels, ic.EmbeddingsModel.LabelSet)
-			combinedEmbedding := embeddings.CombineEmbeddings(imageEmbedding, labelVector)
+			// In labels-only mode the label vector is the whole embedding
+			combinedEmbedding := labelVector
+			if !ic.Config.LabelsOnly {
+				imageEmbedding, err := ic.imageEmbedding(item)
+				if err != nil {
+					if !ic.Config.EmbeddingFallback {
+						logger.Warnf("Failed to generate embedding for %s: %v", item.ID, err)
+						errs[idx] = err
+						return
+					}
+					// Zero-pad the visual part so the image still clusters on its labels
+					logger.Warnf("Falling back to a label-only embedding for %s: %v", item.ID, err)
+					imageEmbedding = make([]float32, ic.EmbeddingsModel.ImageEmbeddingDim())
+				}
+				combinedEmbedding = embeddings.CombineEmbeddings(imageEmbedding, labelVector)
+			}
 
 			mu.Lock()
 			embeddingsList[idx] = combinedEmbedding
@@ -175,16 +816,227 @@ func (ic *ImageCluster) createEmbeddings(items []ItemDetails) ([][]float32, []st
 	}
 
 	wg.Wait()
-	close(errChan)
 
-	if err := <-errChan; err != nil {
-		return nil, nil, err
+	// Keep the survivors in input order so they stay aligned with the surviving items
+	var failed []FailedImage
+	survivors, survivorIDs := embeddingsList[:0], itemIDs[:0]
+	for i, item := range items {
+		if errs[i] != nil {
+			failed = append(failed, FailedImage{Filename: filepath.Base(item.ImagePath), ID: item.ID, Error: errs[i].Error()})
+			continue
+		}
+		survivors = append(survivors, embeddingsList[i])
+		survivorIDs = append(survivorIDs, itemIDs[i])
+	}
+
+	return survivors, survivorIDs, failed
+}
+
+// imageEmbedding computes the item's image embedding, failing once it takes longer than the image timeout.
+// A forward pass cannot be interrupted, so one that times out keeps its network until it finishes and its result is discarded.
+func (ic *ImageCluster) imageEmbedding(item ItemDetails) ([]float32, error) {
+	if ic.Config.ImageTimeout <= 0 {
+		return getImageEmbedding(ic.EmbeddingsModel, item.ImagePath, item.Subject)
+	}
+
+	type outcome struct {
+		embedding []float32
+		err       error
+	}
+	done := make(chan outcome, 1)
+	go func() {
+		embedding, err := getImageEmbedding(ic.EmbeddingsModel, item.ImagePath, item.Subject)
+		done <- outcome{embedding, err}
+	}()
+
+	timer := time.NewTimer(ic.Config.ImageTimeout)
+	defer timer.Stop()
+	select {
+	case result := <-done:
+		return result.embedding, result.err
+	case <-timer.C:
+		return nil, fmt.Errorf("embedding %s timed out after %s", filepath.Base(item.ImagePath), ic.Config.ImageTimeout)
+	}
+}
+
+// withinFailureTolerance reports whether a run may continue with failed of total images missing their embedding.
+// The max_failed_images count and max_failed_percent share are alternatives; meeting either one is enough.
+func (ic *ImageCluster) withinFailureTolerance(failed, total int) bool {
+	allowed := ic.Config.MaxFailedImages
+	if byPercent := int(ic.Config.MaxFailedPercent / 100 * float64(total)); byPercent > allowed {
+		allowed = byPercent
+	}
+	return failed <= allowed
+}
+
+// detectOutliers records the items whose mean distance to their nearest neighbors exceeds the outlier threshold.
+// With the "exclude" action it also returns the embeddings and IDs without them, plus the excluded IDs.
+func (ic *ImageCluster) detectOutliers(items []ItemDetails, clusterEmbeddings [][]float32, clusterIDs []string) ([][]float32, []string, []string) {
+	indices, scores := clustering.DetectOutliers(clusterEmbeddings, ic.Config.OutlierNeighbors, ic.Config.OutlierThreshold)
+	if len(indices) == 0 {
+		return clusterEmbeddings, clusterIDs, nil
+	}
+
+	paths := make(map[string]string, len(items))
+	for _, item := range items {
+		paths[item.ID] = item.ImagePath
+	}
+	exclude := ic.Config.OutlierAction == "exclude"
+	isOutlier := make(map[int]bool, len(indices))
+	for _, i := range indices {
+		isOutlier[i] = true
+		ic.Outliers = append(ic.Outliers, OutlierImage{
+			Filename: filepath.Base(paths[clusterIDs[i]]),
+			ID:       clusterIDs[i],
+			Distance: scores[i],
+			Excluded: exclude,
+		})
+	}
+	logger.Infof("Detected %d outliers among %d items", len(indices), len(clusterIDs))
+	if !exclude {
+		return clusterEmbeddings, clusterIDs, nil
+	}
+
+	kept := make([][]float32, 0, len(clusterEmbeddings)-len(indices))
+	keptIDs := make([]string, 0, len(clusterIDs)-len(indices))
+	var excluded []string
+	for i, id := range clusterIDs {
+		if isOutlier[i] {
+			excluded = append(excluded, id)
+			continue
+		}
+		kept = append(kept, clusterEmbeddings[i])
+		keptIDs = append(keptIDs, id)
+	}
+	return kept, keptIDs, excluded
+}
+
+// survivingItems returns the items without a failed embedding, in their original order
+func survivingItems(items []ItemDetails, failed []FailedImage) []ItemDetails {
+	failedIDs := make(map[string]bool, len(failed))
+	for _, image := range failed {
+		failedIDs[image.ID] = true
+	}
+	survivors := make([]ItemDetails, 0, len(items)-len(failed))
+	for _, item := range items {
+		if !failedIDs[item.ID] {
+			survivors = append(survivors, item)
+		}
+	}
+	return survivors
+}
+
+// aggregateProductViews combines the embeddings of images sharing a product ID into one embedding per product.
+// Each product is represented by the ID of its first image, and views maps that ID to every image of the product.
+// Images without a product ID stay on their own.
+func aggregateProductViews(items []ItemDetails, embeddingsList [][]float32, itemIDs []string, method string) ([][]float32, []string, map[string][]string) {
+	views := make(map[string][]string)
+	vectors := make(map[string][][]float32)
+	representatives := make(map[string]string)
+	var order []string
+	for i, item := range items {
+		representative := itemIDs[i]
+		if item.ProductID != "" {
+			if existing, ok := representatives[item.ProductID]; ok {
+				representative = existing
+			} else {
+				representatives[item.ProductID] = representative
+			}
+		}
+		if _, ok := views[representative]; !ok {
+			order = append(order, representative)
+		}
+		views[representative] = append(views[representative], itemIDs[i])
+		vectors[representative] = append(vectors[representative], embeddingsList[i])
+	}
+
+	aggregated := make([][]float32, len(order))
+	for i, representative := range order {
+		aggregated[i] = embeddings.AggregateEmbeddings(vectors[representative], method)
+	}
+	logger.Infof("Aggregated %d images into %d products", len(items), len(order))
+	return aggregated, order, views
+}
+
+// expandProductViews replaces every product representative in the clusters and misc bucket with all of its images
+func expandProductViews(clusters map[int][]string, misc []string, views map[string][]string) (map[int][]string, []string) {
+	expanded := make(map[int][]string, len(clusters))
+	for clusterID, ids := range clusters {
+		for _, id := range ids {
+			expanded[clusterID] = append(expanded[clusterID], views[id]...)
+		}
+	}
+	var expandedMisc []string
+	for _, id := range misc {
+		expandedMisc = append(expandedMisc, views[id]...)
+	}
+	return expanded, expandedMisc
+}
+
+// featureRange resolves the configured feature mask to a dimension range of the combined embedding.
+// Label vectors always occupy the last dimensions, after the image embedding.
+func (ic *ImageCluster) featureRange(dim int) (int, int, error) {
+	labelStart := dim - ic.categoricalDim()
+
+	var start, end int
+	switch mask := ic.Config.FeatureMask; mask {
+	case "image":
+		start, end = 0, labelStart
+	case "labels":
+		start, end = labelStart, dim
+	default:
+		if _, err := fmt.Sscanf(mask, "%d:%d", &start, &end); err != nil {
+			return 0, 0, fmt.Errorf("invalid feature_mask %q: expected image, labels or start:end", mask)
+		}
 	}
 
-	return embeddingsList, itemIDs, nil
+	if start < 0 || end > dim || start >= end {
+		return 0, 0, fmt.Errorf("feature_mask %q selects no dimensions of the %d-dimensional embedding", ic.Config.FeatureMask, dim)
+	}
+	return start, end, nil
 }
 
-func (ic *ImageCluster) prepareClusterDetails(clusters map[int][]string, items []ItemDetails) map[string]models.ClusterDetails {
+// aspectBuckets assigns every clustered item to its configured aspect-ratio bucket.
+// A multi-view product is bucketed by the view that represents it.
+func (ic *ImageCluster) aspectBuckets(items []ItemDetails, ids []string) ([]int, error) {
+	itemMap := makeItemMap(items)
+	buckets := make([]int, len(ids))
+	for i, id := range ids {
+		item := itemMap[id]
+		ratio, err := embeddings.ImageAspectRatio(item.ImagePath)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read aspect ratio for %s: %v", item.ID, err)
+		}
+		buckets[i] = clustering.AspectBucket(ratio, ic.Config.AspectBuckets)
+	}
+	return buckets, nil
+}
+
+// performTwoStageClustering splits the combined embeddings back into their visual and label parts
+// and clusters on one before refining on the other, as configured.
+func (ic *ImageCluster) performTwoStageClustering(embeddingsList [][]float32, itemIDs []string, minSize, maxSize int) (map[int][]string, bool) {
+	labelDim := ic.categoricalDim()
+	visual := make([][]float32, len(embeddingsList))
+	labels := make([][]float32, len(embeddingsList))
+	for i, embedding := range embeddingsList {
+		split := len(embedding) - labelDim
+		visual[i] = embedding[:split]
+		labels[i] = embedding[split:]
+	}
+
+	primary, secondary := visual, labels
+	if ic.Config.TwoStageOrder == "labels_first" {
+		primary, secondary = labels, visual
+	}
+
+	coarseMaxSize := ic.Config.TwoStageCoarseMaxSize
+	if coarseMaxSize < maxSize {
+		coarseMaxSize = maxSize
+	}
+	return clustering.PerformTwoStageClustering(primary, secondary, itemIDs, minSize, coarseMaxSize, minSize, maxSize, ic.Config.CentroidUpdate)
+}
+
+func (ic *ImageCluster) prepareClusterDetails(ctx context.Context, clusters map[int][]string, cohesion map[int]float32, items []ItemDetails) map[string]models.ClusterDetails {
 	clusterDetails := make(map[string]models.ClusterDetails)
 	itemMap := makeItemMap(items)
 
@@ -194,38 +1046,477 @@ func (ic *ImageCluster) prepareClusterDetails(clusters map[int][]string, items [
 		details = details.Init()
 
 		labelsSet := make(map[string]struct{})
+		labelCounts := make(map[string]int)
 		var images []string
 
 		for _, id := range itemIDs {
 			if item, exists := itemMap[id]; exists {
 				for _, label := range item.Labels {
 					labelsSet[label] = struct{}{}
+					labelCounts[label]++
 				}
 				images = append(images, filepath.Base(item.ImagePath))
 			}
 		}
 
 		details.Labels = formatLabels(labelsSet)
+		details.DominantLabel = dominantLabel(labelCounts)
 		details.Images = images
+		details.Cohesion = cohesion[clusterID]
+		clusterDetails[clusterKey] = details
+	}
+
+	ic.titleClusters(ctx, clusterDetails, ic.titleRepresentatives(clusterDetails, ic.Centroids))
+	return clusterDetails
+}
+
+// titleRepresentatives groups clusters close to a larger one, so they reuse its AI title instead of calling
+// the models again. It maps each grouped cluster key to the key of its representative, or returns nil when
+// title_group_distance is off. Clusters titled from their labels are left out, since their titles cost nothing,
+// as are the misc bucket and clusters without a centroid.
+func (ic *ImageCluster) titleRepresentatives(clusterDetails map[string]models.ClusterDetails, centroids map[string][]float32) map[string]string {
+	if ic.Config.TitleGroupDistance <= 0 {
+		return nil
+	}
+
+	grouped := make(map[int][]string, len(clusterDetails))
+	groupedCentroids := make(map[int][]float32, len(clusterDetails))
+	for key, details := range clusterDetails {
+		var clusterID int
+		if _, err := fmt.Sscanf(key, "Cluster-%d", &clusterID); err != nil || details.IsMisc || !ic.titledByAI(details) {
+			continue
+		}
+		if centroid, ok := centroids[key]; ok {
+			grouped[clusterID] = details.Images
+			groupedCentroids[clusterID] = centroid
+		}
+	}
+
+	representatives := make(map[string]string, len(grouped))
+	for clusterID, representative := range clustering.GroupSimilarClusters(grouped, groupedCentroids, ic.Config.TitleGroupDistance) {
+		representatives[fmt.Sprintf("Cluster-%d", clusterID)] = fmt.Sprintf("Cluster-%d", representative)
+	}
+	return representatives
+}
+
+// titleClusters generates the titles of the clusters in place and disambiguates near-duplicates.
+// representatives maps a cluster key to the key of the cluster whose titles it reuses; clusters
+// missing from it are titled themselves. The misc bucket keeps its fixed title.
+func (ic *ImageCluster) titleClusters(ctx context.Context, clusterDetails map[string]models.ClusterDetails, representatives map[string]string) {
+	type clusterJob struct {
+		key     string
+		details models.ClusterDetails
+	}
+
+	// Titles are generated by a pool of workers so several clusters are processed concurrently
+	workers := ic.Config.AIClusterWorkers
+	if workers < 1 {
+		workers = 1
+	}
+	jobs := make(chan clusterJob)
+	results := make(chan clusterJob)
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for job := range jobs {
+				ic.applyModelOutputs(ctx, &job.details)
+				results <- job
+			}
+		}()
+	}
+
+	go func() {
+		for key, details := range clusterDetails {
+			if representative, ok := representatives[key]; ok && representative != key {
+				continue
+			}
+			if !details.IsMisc {
+				jobs <- clusterJob{key: key, details: details}
+			}
+		}
+		close(jobs)
+		wg.Wait()
+		close(results)
+	}()
+	for job := range results {
+		clusterDetails[job.key] = job.details
+	}
+
+	reused := 0
+	for key, representative := range representatives {
+		if representative == key {
+			continue
+		}
+		source, details := clusterDetails[representative], clusterDetails[key]
+		details.Title = source.Title
+		details.CatchyPhrase = source.CatchyPhrase
+		details.Category = source.Category
+		details.ServiceOutputs = append([]models.ServiceOutput(nil), source.ServiceOutputs...)
+		clusterDetails[key] = details
+		reused++
+	}
+	if reused > 0 {
+		logger.Infof("Reused AI titles for %d of %d clusters grouped by centroid distance", reused, len(representatives))
+	}
+
+	if ic.Config.TitleSimilarity > 0 {
+		disambiguateTitles(clusterDetails, float64(ic.Config.TitleSimilarity))
+	}
+}
+
+// RetitleClusters regenerates the AI titles of existing clusters without reclustering, using the title
+// options of cfg and the given services (nil for every enabled service). Outputs of services that are not
+// rerun are kept and take part in the title consensus. With title_group_distance, clusters whose centroids
+// are close share a title as in a run; centroids are keyed like the cluster details. The clusters passed in
+// are left untouched; the retitled copies are returned.
+func RetitleClusters(ctx context.Context, cfg *config.AppConfig, clusterDetails map[string]models.ClusterDetails, centroids map[string][]float32, services []ai.ServiceConfig) map[string]models.ClusterDetails {
+	retitled := make(map[string]models.ClusterDetails, len(clusterDetails))
+	for key, details := range clusterDetails {
+		// The service outputs are updated in place, so each cluster gets its own copy
+		details.ServiceOutputs = append([]models.ServiceOutput(nil), details.ServiceOutputs...)
+		retitled[key] = details
+	}
+
+	ic := &ImageCluster{Config: cfg, Services: services}
+	ic.titleClusters(ctx, retitled, ic.titleRepresentatives(retitled, centroids))
+	return retitled
+}
+
+// disambiguateTitles appends a distinguishing label to titles that are near-duplicates of an earlier cluster's title.
+// Clusters are visited in numeric key order and the first of each group keeps its title. The label appended is the
+// cluster's dominant label, or else its first label, that the earlier cluster does not carry; when every
+// label is shared, the title is numbered instead.
+func disambiguateTitles(clusterDetails map[string]models.ClusterDetails, threshold float64) {
+	keys := make([]string, 0, len(clusterDetails))
+	for key := range clusterDetails {
+		keys = append(keys, key)
+	}
+	slices.SortFunc(keys, utils.CompareClusterKeys)
+
+	type titled struct {
+		title  string
+		labels map[string]bool
+	}
+	var seen []titled
+
+	for _, key := range keys {
+		details := clusterDetails[key]
+		if details.IsMisc || details.Title == "" || details.Title == ai.NoTitle {
+			continue
+		}
 
-		modelOutputs := ai.GenerateTitleAndCatchyPhraseMultiService(details.Labels, 3)
+		labels := strings.Split(details.Labels, ", ")
+		labelSet := make(map[string]bool, len(labels))
+		for _, label := range labels {
+			labelSet[label] = true
+		}
+
+		var duplicates []titled
+		for _, other := range seen {
+			if ai.TitleSimilarity(details.Title, other.title) >= threshold {
+				duplicates = append(duplicates, other)
+			}
+		}
+		seen = append(seen, titled{title: details.Title, labels: labelSet})
+		if len(duplicates) == 0 {
+			continue
+		}
+
+		suffix := fmt.Sprintf("%d", len(duplicates)+1)
+		for _, candidate := range append([]string{details.DominantLabel}, labels...) {
+			if candidate == "" || strings.Contains(strings.ToLower(details.Title), strings.ToLower(candidate)) {
+				continue
+			}
+			shared := false
+			for _, other := range duplicates {
+				shared = shared || other.labels[candidate]
+			}
+			if !shared {
+				suffix = candidate
+				break
+			}
+		}
+
+		logger.Infof("Disambiguating title %q of %s with %q", details.Title, key, suffix)
+		details.Title = fmt.Sprintf("%s (%s)", details.Title, suffix)
+		clusterDetails[key] = details
+	}
+}
+
+// generateTitles asks the AI services for titles and catchy phrases; tests replace it with a stub
+var generateTitles = ai.GenerateTitleAndCatchyPhraseWithServices
+
+// generateSummary asks the default AI service to describe the collection; tests replace it with a stub
+var generateSummary = ai.GenerateCollectionSummary
+
+// getImageEmbedding runs the image through the network; tests replace it to observe inference
+var getImageEmbedding = embeddings.GetImageEmbedding
+
+// titledByAI reports whether the cluster's title comes from the models rather than from its labels
+func (ic *ImageCluster) titledByAI(details models.ClusterDetails) bool {
+	return !ic.Config.Deterministic && len(details.Images) >= ic.Config.AIMinClusterSize
+}
+
+// applyModelOutputs generates titles and catchy phrases for the cluster with every available service
+func (ic *ImageCluster) applyModelOutputs(ctx context.Context, details *models.ClusterDetails) {
+	// AI output varies between runs, so deterministic runs title clusters from their labels instead.
+	// Clusters below the AI size threshold are titled the same way to save model calls.
+	if !ic.titledByAI(*details) {
+		details.Title = utils.TopLabels(details.Labels, 3)
+		return
+	}
+
+	services := ic.Services
+	if services == nil {
+		services = ai.AvailableServices
+	}
+	if ic.Config.AICategory {
+		ctx = prompt.WithCategory(ctx)
+	}
+	ctx = prompt.WithLimits(ctx, ic.Config.TitleMaxChars, ic.Config.PhraseMaxChars)
+	modelOutputs := generateTitles(ctx, details.Labels, 3, services)
+	defaultService := ai.DefaultService()
+	for i, output := range modelOutputs {
+		if ic.Config.TitleOverflow == "relax" && !ic.titleFits(output.Title) {
+			output = ic.relaxTitle(ctx, output, details.Labels, services)
+			modelOutputs[i] = output
+		}
+		title, untitled := ic.fitTitle(output.Title, details.Labels)
+		details.SetServiceOutput(models.ServiceOutput{
+			ServiceName:  output.ServiceName,
+			Title:        title,
+			CatchyPhrase: ai.TruncateAtWord(output.CatchyPhrase, ic.Config.PhraseMaxChars),
+			Category:     output.Category,
+			Untitled:     untitled,
+		})
+
+		if output.ServiceName == defaultService {
+			details.Title = output.Title
+			details.CatchyPhrase = output.CatchyPhrase
+			details.Category = output.Category
+		}
+	}
+
+	// Replace the default title with the consensus across services when a strategy is configured.
+	// It covers every stored output, so services that were not rerun while retitling still count.
+	if ic.Config.TitleStrategy != "" {
+		order := make(map[string]int, len(modelOutputs))
 		for _, output := range modelOutputs {
-			details.SetServiceOutput(models.ServiceOutput{
+			order[output.ServiceName] = output.Order
+		}
+		for _, service := range ai.AvailableServices {
+			order[service.Name] = service.Order
+		}
+		candidates := make([]ai.ModelOutput, len(details.ServiceOutputs))
+		for i, output := range details.ServiceOutputs {
+			candidates[i] = ai.ModelOutput{
 				ServiceName:  output.ServiceName,
 				Title:        output.Title,
 				CatchyPhrase: output.CatchyPhrase,
-			})
+				Category:     output.Category,
+				Order:        order[output.ServiceName],
+			}
+		}
+		sort.SliceStable(candidates, func(i, j int) bool { return candidates[i].Order < candidates[j].Order })
+		if consensus, ok := ai.SelectConsensusOutput(candidates, ic.Config.TitleStrategy, ic.Config.TitleMaxChars); ok {
+			details.Title = consensus.Title
+			details.CatchyPhrase = consensus.CatchyPhrase
+			details.Category = consensus.Category
+		}
+	}
+
+	// Models do not reliably respect the requested lengths, so the limits are enforced here
+	details.Title, _ = ic.fitTitle(details.Title, details.Labels)
+	details.CatchyPhrase = ai.TruncateAtWord(details.CatchyPhrase, ic.Config.PhraseMaxChars)
+}
 
-			if output.ServiceName == "Claude 3" {
-				details.Title = output.Title
-				details.CatchyPhrase = output.CatchyPhrase
+// titleFits reports whether a model title is present and within the title limit
+func (ic *ImageCluster) titleFits(title string) bool {
+	return title != ai.NoTitle && strings.TrimSpace(title) != "" && len([]rune(title)) <= ic.Config.TitleMaxChars
+}
+
+// relaxTitle asks the service that returned a missing or over-length title again, with a prompt that
+// allows titles of twice the limit. The original output is kept when the retry gives no title either.
+func (ic *ImageCluster) relaxTitle(ctx context.Context, output ai.ModelOutput, labels string, services []ai.ServiceConfig) ai.ModelOutput {
+	for _, service := range services {
+		if service.Name != output.ServiceName {
+			continue
+		}
+		relaxed := prompt.WithLimits(ctx, 2*ic.Config.TitleMaxChars, ic.Config.PhraseMaxChars)
+		for _, retried := range generateTitles(relaxed, labels, 3, []ai.ServiceConfig{service}) {
+			if retried.Title != ai.NoTitle && strings.TrimSpace(retried.Title) != "" {
+				logger.Infof("%s retitled a cluster within the relaxed limit of %d characters", service.Name, 2*ic.Config.TitleMaxChars)
+				return retried
 			}
 		}
+	}
+	return output
+}
 
-		clusterDetails[clusterKey] = details
+// fitTitle applies the title overflow policy to a model title that is missing or longer than the limit.
+// It returns the title to use and whether the output counts as untitled. The "relax" policy accepts the
+// titles of its relaxed retry up to twice the limit, "labels" titles the cluster from its labels, and
+// "untitled" gives up on it. Clusters without labels, as when Rekognition is off, fall back to untitled
+// under "labels". Without a policy, over-length titles are truncated.
+func (ic *ImageCluster) fitTitle(title, labels string) (string, bool) {
+	limit := ic.Config.TitleMaxChars
+	if title == ai.NoTitle || strings.TrimSpace(title) == "" {
+		switch ic.Config.TitleOverflow {
+		case "labels":
+			return ic.labelTitle(labels)
+		case "untitled":
+			return ai.NoTitle, true
+		}
+		return title, title == ai.NoTitle
 	}
 
-	return clusterDetails
+	if len([]rune(title)) <= limit {
+		return title, false
+	}
+	switch ic.Config.TitleOverflow {
+	case "relax":
+		return ai.TruncateAtWord(title, 2*limit), false
+	case "labels":
+		return ic.labelTitle(labels)
+	case "untitled":
+		return ai.NoTitle, true
+	}
+	return ai.TruncateAtWord(title, limit), false
+}
+
+// labelTitle titles a cluster from its top labels, or marks it untitled when it has none
+func (ic *ImageCluster) labelTitle(labels string) (string, bool) {
+	if title := utils.TopLabels(labels, 3); title != "" {
+		return title, false
+	}
+	return ai.NoTitle, true
+}
+
+// prepareMiscDetails builds the misc bucket for the members of clusters removed by the cohesion filter.
+// The bucket is not sent to the AI services since its images are unrelated by definition.
+func prepareMiscDetails(itemIDs []string, items []ItemDetails) models.ClusterDetails {
+	var details models.ClusterDetails
+	details = details.Init()
+	details.Title = "Miscellaneous"
+	details.CatchyPhrase = "Images that did not fit a cohesive cluster"
+	details.IsMisc = true
+
+	itemMap := makeItemMap(items)
+	labelsSet := make(map[string]struct{})
+	for _, id := range itemIDs {
+		if item, exists := itemMap[id]; exists {
+			for _, label := range item.Labels {
+				labelsSet[label] = struct{}{}
+			}
+			details.Images = append(details.Images, filepath.Base(item.ImagePath))
+		}
+	}
+	details.Labels = formatLabels(labelsSet)
+
+	return details
+}
+
+// buildImageResults pairs every image with its cluster key, labels and clustering embedding
+func buildImageResults(items []ItemDetails, embeddingsList [][]float32, clusters map[int][]string, misc []string) []ImageResult {
+	clusterByItem := make(map[string]string)
+	for clusterID, itemIDs := range clusters {
+		for _, id := range itemIDs {
+			clusterByItem[id] = fmt.Sprintf("Cluster-%d", clusterID)
+		}
+	}
+	for _, id := range misc {
+		clusterByItem[id] = "Cluster-misc"
+	}
+
+	results := make([]ImageResult, len(items))
+	for i, item := range items {
+		results[i] = ImageResult{
+			Filename:  filepath.Base(item.ImagePath),
+			ID:        item.ID,
+			ProductID: item.ProductID,
+			ClusterID: clusterByItem[item.ID],
+			Labels:    item.Labels,
+			Embedding: embeddingsList[i],
+
+			LabelDetails: item.LabelDetails,
+		}
+	}
+	return results
+}
+
+// BuildLabelClusterMatrix counts the images carrying each label in each cluster. Images left out of every
+// cluster are skipped. Clusters are ordered by numeric key with the misc bucket last, and labels by how many
+// images carry them, most first, ties broken by name. A positive topLabels keeps only that many of the most
+// frequent labels.
+func BuildLabelClusterMatrix(results []ImageResult, topLabels int) models.LabelClusterMatrix {
+	counts := make(map[string]map[string]int)
+	totals := make(map[string]int)
+	clusterSet := make(map[string]bool)
+	for _, result := range results {
+		if result.ClusterID == "" {
+			continue
+		}
+		clusterSet[result.ClusterID] = true
+		for _, label := range result.Labels {
+			if counts[label] == nil {
+				counts[label] = make(map[string]int)
+			}
+			counts[label][result.ClusterID]++
+			totals[label]++
+		}
+	}
+
+	clusterKeys := make([]string, 0, len(clusterSet))
+	for key := range clusterSet {
+		clusterKeys = append(clusterKeys, key)
+	}
+	slices.SortFunc(clusterKeys, utils.CompareClusterKeys)
+
+	labels := make([]string, 0, len(totals))
+	for label := range totals {
+		labels = append(labels, label)
+	}
+	sort.Slice(labels, func(i, j int) bool {
+		if totals[labels[i]] != totals[labels[j]] {
+			return totals[labels[i]] > totals[labels[j]]
+		}
+		return labels[i] < labels[j]
+	})
+	if topLabels > 0 && len(labels) > topLabels {
+		labels = labels[:topLabels]
+	}
+
+	matrix := models.LabelClusterMatrix{
+		Labels:   labels,
+		Clusters: clusterKeys,
+		Counts:   make([][]int, len(labels)),
+	}
+	for i, label := range labels {
+		matrix.Counts[i] = make([]int, len(clusterKeys))
+		for j, key := range clusterKeys {
+			matrix.Counts[i][j] = counts[label][key]
+		}
+	}
+	return matrix
+}
+
+// attachOriginalFilenames maps every clustered image's stored filename back to the name it was uploaded with
+func attachOriginalFilenames(clusterDetails map[string]models.ClusterDetails, items []ItemDetails) {
+	originals := make(map[string]string, len(items))
+	for _, item := range items {
+		originals[filepath.Base(item.ImagePath)] = item.OriginalFilename
+	}
+	for key, details := range clusterDetails {
+		details.OriginalFilenames = make(map[string]string, len(details.Images))
+		for _, image := range details.Images {
+			if original := originals[image]; original != "" {
+				details.OriginalFilenames[image] = original
+			}
+		}
+		clusterDetails[key] = details
+	}
 }
 
 func makeItemMap(items []ItemDetails) map[string]ItemDetails {
@@ -241,9 +1532,21 @@ func formatLabels(labelsSet map[string]struct{}) string {
 	for label := range labelsSet {
 		labels = append(labels, label)
 	}
+	sort.Strings(labels)
 	return strings.Join(labels, ", ")
 }
 
+// dominantLabel returns the most frequent label, breaking ties alphabetically
+func dominantLabel(labelCounts map[string]int) string {
+	dominant := ""
+	for label, count := range labelCounts {
+		if count > labelCounts[dominant] || (count == labelCounts[dominant] && label < dominant) {
+			dominant = label
+		}
+	}
+	return dominant
+}
+
 func getItemIDs(items []ItemDetails) []string {
 	ids := make([]string, len(items))
 	for i, item := range items {
@@ -251,3 +1554,21 @@ func getItemIDs(items []ItemDetails) []string {
 	}
 	return ids
 }
+
+// collectionSummaryText lists every cluster but the misc bucket with its title, top labels and size, in key order
+func collectionSummaryText(clusterDetails map[string]models.ClusterDetails) string {
+	keys := make([]string, 0, len(clusterDetails))
+	for key, details := range clusterDetails {
+		if !details.IsMisc {
+			keys = append(keys, key)
+		}
+	}
+	slices.SortFunc(keys, utils.CompareClusterKeys)
+
+	lines := make([]string, 0, len(keys))
+	for _, key := range keys {
+		details := clusterDetails[key]
+		lines = append(lines, fmt.Sprintf("%s: %s (%d images)", details.Title, utils.TopLabels(details.Labels, 5), len(details.Images)))
+	}
+	return strings.Join(lines, "; ")
+}
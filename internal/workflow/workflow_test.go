@@ -0,0 +1,1257 @@
+package workflow
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"math"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awsrekognition "github.com/aws/aws-sdk-go-v2/service/rekognition"
+	"github.com/aws/aws-sdk-go-v2/service/rekognition/types"
+
+	"imageclust/internal/ai"
+	"imageclust/internal/ai/prompt"
+	"imageclust/internal/clustering"
+	"imageclust/internal/config"
+	"imageclust/internal/embeddings"
+	"imageclust/internal/models"
+	"imageclust/internal/rekognition"
+	"imageclust/internal/utils"
+)
+
+// stubTitles replaces the AI services for the duration of the test. generate receives the
+// request context, so stubs can inspect the prompt options set on it.
+func stubTitles(t *testing.T, generate func(ctx context.Context, labels string) []ai.ModelOutput) {
+	t.Helper()
+	original := generateTitles
+	generateTitles = func(ctx context.Context, labels string, retries int, services []ai.ServiceConfig) []ai.ModelOutput {
+		return generate(ctx, labels)
+	}
+	t.Cleanup(func() { generateTitles = original })
+}
+
+// titledCluster returns a cluster large enough to be titled by the AI services
+func titledCluster(labels string) models.ClusterDetails {
+	var details models.ClusterDetails
+	details = details.Init()
+	details.Labels = labels
+	details.Images = []string{"a.jpg", "b.jpg"}
+	return details
+}
+
+func TestApplyModelOutputsTrimsOverLengthOutput(t *testing.T) {
+	stubTitles(t, func(ctx context.Context, labels string) []ai.ModelOutput {
+		return []ai.ModelOutput{{
+			ServiceName:  ai.DefaultService(),
+			Title:        "A Remarkably Long Title For Shoes",
+			CatchyPhrase: "Step out in style with shoes that go the distance",
+		}}
+	})
+
+	ic := &ImageCluster{Config: &config.AppConfig{TitleMaxChars: 20, PhraseMaxChars: 30}}
+	details := titledCluster("Shoe, Sneaker")
+	ic.applyModelOutputs(context.Background(), &details)
+
+	if len([]rune(details.Title)) > 20 {
+		t.Errorf("title %q is longer than 20 characters", details.Title)
+	}
+	if len([]rune(details.CatchyPhrase)) > 30 {
+		t.Errorf("catchy phrase %q is longer than 30 characters", details.CatchyPhrase)
+	}
+	if !strings.HasPrefix(details.Title, "A Remarkably") {
+		t.Errorf("title %q was not cut at a word boundary of the model title", details.Title)
+	}
+	for _, output := range details.ServiceOutputs {
+		if len([]rune(output.Title)) > 20 || len([]rune(output.CatchyPhrase)) > 30 {
+			t.Errorf("service output %+v exceeds the limits", output)
+		}
+	}
+}
+
+func TestApplyModelOutputsRequestsConfiguredLimits(t *testing.T) {
+	var requested string
+	stubTitles(t, func(ctx context.Context, labels string) []ai.ModelOutput {
+		requested, _ = prompt.Render(ctx, "test", "{{.TitleMaxChars}}/{{.PhraseMaxChars}}", prompt.NewData(labels))
+		return []ai.ModelOutput{{ServiceName: ai.DefaultService(), Title: "Shoes", CatchyPhrase: "Walk on"}}
+	})
+
+	ic := &ImageCluster{Config: &config.AppConfig{TitleMaxChars: 40, PhraseMaxChars: 150}}
+	details := titledCluster("Shoe")
+	ic.applyModelOutputs(context.Background(), &details)
+
+	if requested != "40/150" {
+		t.Errorf("prompt asked for %q, want the configured 40/150", requested)
+	}
+}
+
+func TestConfiguredDefaultServicePopulatesTitle(t *testing.T) {
+	original := ai.AvailableServices
+	ai.AvailableServices = []ai.ServiceConfig{
+		{Name: "First", Order: 1},
+		{Name: "Second", Order: 2},
+	}
+	t.Cleanup(func() {
+		ai.AvailableServices = original
+		ai.SetDefaultService("")
+	})
+	if err := ai.SetDefaultService("Second"); err != nil {
+		t.Fatal(err)
+	}
+	if err := ai.SetDefaultService("Missing"); err == nil {
+		t.Error("an unknown service was accepted as the default")
+	}
+	stubTitles(t, func(ctx context.Context, labels string) []ai.ModelOutput {
+		return []ai.ModelOutput{
+			{ServiceName: "First", Title: "First Title", CatchyPhrase: "First phrase", Order: 1},
+			{ServiceName: "Second", Title: "Second Title", CatchyPhrase: "Second phrase", Order: 2},
+		}
+	})
+
+	ic := &ImageCluster{Config: &config.AppConfig{TitleMaxChars: 40, PhraseMaxChars: 150}}
+	details := titledCluster("Shoe")
+	ic.applyModelOutputs(context.Background(), &details)
+
+	if details.Title != "Second Title" || details.CatchyPhrase != "Second phrase" {
+		t.Errorf("cluster got %q / %q, want the output of the configured default service", details.Title, details.CatchyPhrase)
+	}
+}
+
+func TestTitleOverflowPolicies(t *testing.T) {
+	const longTitle = "Comfortable Running Shoes For Every Season"
+	tests := []struct {
+		name         string
+		policy       string
+		labels       string
+		modelTitle   string
+		wantTitle    string
+		wantUntitled bool
+		wantRetry    bool
+	}{
+		{"truncate by default", "", "Shoe, Sneaker", longTitle, "Comfortable Running…", false, false},
+		{"relax asks again", "relax", "Shoe, Sneaker", longTitle, "Running Shoes For All Seasons", false, true},
+		{"relax retries empty titles", "relax", "Shoe, Sneaker", "", "Running Shoes For All Seasons", false, true},
+		{"labels", "labels", "Shoe, Sneaker, Footwear, Clothing", longTitle, "Shoe, Sneaker, Footwear", false, false},
+		{"labels without labels", "labels", "", "", ai.NoTitle, true, false},
+		{"untitled", "untitled", "Shoe", longTitle, ai.NoTitle, true, false},
+		{"untitled empty", "untitled", "Shoe", "", ai.NoTitle, true, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			retried := false
+			stubTitles(t, func(ctx context.Context, labels string) []ai.ModelOutput {
+				limit, _ := prompt.Render(ctx, "test", "{{.TitleMaxChars}}", prompt.NewData(labels))
+				title := tt.modelTitle
+				if limit == "40" {
+					// The relaxed prompt allows twice the limit
+					retried = true
+					title = "Running Shoes For All Seasons"
+				}
+				return []ai.ModelOutput{{ServiceName: ai.DefaultService(), Title: title, CatchyPhrase: "Walk on"}}
+			})
+
+			ic := &ImageCluster{Config: &config.AppConfig{TitleMaxChars: 20, PhraseMaxChars: 100, TitleOverflow: tt.policy}}
+			details := titledCluster(tt.labels)
+			ic.applyModelOutputs(context.Background(), &details)
+
+			if details.Title != tt.wantTitle {
+				t.Errorf("title = %q, want %q", details.Title, tt.wantTitle)
+			}
+			if retried != tt.wantRetry {
+				t.Errorf("relaxed retry = %v, want %v", retried, tt.wantRetry)
+			}
+			if len(details.ServiceOutputs) != 1 || details.ServiceOutputs[0].Untitled != tt.wantUntitled {
+				t.Errorf("service outputs %+v, want untitled=%v", details.ServiceOutputs, tt.wantUntitled)
+			}
+		})
+	}
+}
+
+func TestRetitleClustersKeepsClustersAndRegeneratesTitles(t *testing.T) {
+	stubTitles(t, func(ctx context.Context, labels string) []ai.ModelOutput {
+		return []ai.ModelOutput{{ServiceName: ai.DefaultService(), Title: "Fresh " + labels, CatchyPhrase: "New phrase"}}
+	})
+
+	original := map[string]models.ClusterDetails{}
+	for key, labels := range map[string]string{"Cluster-0": "Shoe", "Cluster-1": "Hat"} {
+		details := titledCluster(labels)
+		details.Title = "Old " + labels
+		details.SetServiceOutput(models.ServiceOutput{ServiceName: ai.DefaultService(), Title: details.Title})
+		original[key] = details
+	}
+	misc := titledCluster("Shoe, Hat")
+	misc.Title, misc.IsMisc = "Miscellaneous", true
+	original["Cluster-misc"] = misc
+
+	cfg := &config.AppConfig{TitleMaxChars: 25, PhraseMaxChars: 100}
+	retitled := RetitleClusters(context.Background(), cfg, original, nil, nil)
+
+	for key, before := range original {
+		after := retitled[key]
+		if !slices.Equal(after.Images, before.Images) || after.Labels != before.Labels {
+			t.Errorf("%s: members changed from %v to %v", key, before.Images, after.Images)
+		}
+		if before.IsMisc {
+			if after.Title != "Miscellaneous" {
+				t.Errorf("misc bucket retitled to %q", after.Title)
+			}
+			continue
+		}
+		if want := "Fresh " + before.Labels; after.Title != want || after.ServiceOutputs[0].Title != want {
+			t.Errorf("%s: title %q, service output %q, want %q", key, after.Title, after.ServiceOutputs[0].Title, want)
+		}
+		if !strings.HasPrefix(before.Title, "Old ") || before.ServiceOutputs[0].Title != before.Title {
+			t.Errorf("%s: the clusters passed in were modified", key)
+		}
+	}
+}
+
+func TestRetitleClustersConsensusIncludesKeptOutputs(t *testing.T) {
+	rerun := ai.ServiceConfig{Name: "Rerun Service", Order: 9}
+	stubTitles(t, func(ctx context.Context, labels string) []ai.ModelOutput {
+		return []ai.ModelOutput{{ServiceName: rerun.Name, Title: "A Much Longer New Title", Order: rerun.Order}}
+	})
+
+	details := titledCluster("Shoe")
+	details.Title = "Old Title"
+	details.SetServiceOutput(models.ServiceOutput{ServiceName: "Kept Service", Title: "Shoes"})
+	cfg := &config.AppConfig{TitleMaxChars: 25, PhraseMaxChars: 100, TitleStrategy: ai.ConsensusShortest}
+
+	retitled := RetitleClusters(context.Background(), cfg, map[string]models.ClusterDetails{"Cluster-0": details}, nil, []ai.ServiceConfig{rerun})
+	if got := retitled["Cluster-0"].Title; got != "Shoes" {
+		t.Errorf("title = %q, want the kept service's shorter %q", got, "Shoes")
+	}
+	if outputs := retitled["Cluster-0"].ServiceOutputs; len(outputs) != 2 {
+		t.Errorf("got %d service outputs, want the kept and the rerun one", len(outputs))
+	}
+}
+
+func TestRetitleClustersGroupsByCentroid(t *testing.T) {
+	calls := 0
+	var mu sync.Mutex
+	stubTitles(t, func(ctx context.Context, labels string) []ai.ModelOutput {
+		mu.Lock()
+		calls++
+		mu.Unlock()
+		return []ai.ModelOutput{{ServiceName: ai.DefaultService(), Title: "Shared " + labels}}
+	})
+
+	large := titledCluster("Shoe")
+	large.Images = append(large.Images, "c.jpg")
+	clusters := map[string]models.ClusterDetails{
+		"Cluster-0": large,
+		"Cluster-1": titledCluster("Sneaker"),
+		"Cluster-2": titledCluster("Hat"),
+	}
+	centroids := map[string][]float32{
+		"Cluster-0": {0, 0},
+		"Cluster-1": {0.1, 0},
+		"Cluster-2": {5, 5},
+	}
+	cfg := &config.AppConfig{TitleMaxChars: 25, PhraseMaxChars: 100, TitleGroupDistance: 1}
+
+	retitled := RetitleClusters(context.Background(), cfg, clusters, centroids, nil)
+	if calls != 2 {
+		t.Errorf("models called for %d clusters, want 2", calls)
+	}
+	if retitled["Cluster-1"].Title != "Shared Shoe" {
+		t.Errorf("nearby cluster titled %q, want the larger cluster's title", retitled["Cluster-1"].Title)
+	}
+	if retitled["Cluster-2"].Title != "Shared Hat" {
+		t.Errorf("distant cluster titled %q", retitled["Cluster-2"].Title)
+	}
+}
+
+func TestBuildLabelClusterMatrixCounts(t *testing.T) {
+	results := []ImageResult{
+		{Filename: "a.jpg", ClusterID: "Cluster-10", Labels: []string{"Shoe", "Red"}},
+		{Filename: "b.jpg", ClusterID: "Cluster-10", Labels: []string{"Shoe"}},
+		{Filename: "c.jpg", ClusterID: "Cluster-2", Labels: []string{"Shoe", "Blue"}},
+		{Filename: "d.jpg", ClusterID: "Cluster-misc", Labels: []string{"Red"}},
+		{Filename: "e.jpg", ClusterID: "Cluster-1", Labels: []string{"Hat"}},
+		{Filename: "f.jpg", Labels: []string{"Shoe"}}, // Left out of every cluster
+	}
+
+	matrix := BuildLabelClusterMatrix(results, 0)
+
+	wantClusters := []string{"Cluster-1", "Cluster-2", "Cluster-10", "Cluster-misc"}
+	if !slices.Equal(matrix.Clusters, wantClusters) {
+		t.Fatalf("clusters = %v, want %v", matrix.Clusters, wantClusters)
+	}
+	wantLabels := []string{"Shoe", "Red", "Blue", "Hat"}
+	if !slices.Equal(matrix.Labels, wantLabels) {
+		t.Fatalf("labels = %v, want %v", matrix.Labels, wantLabels)
+	}
+	wantCounts := [][]int{
+		{0, 1, 2, 0}, // Shoe
+		{0, 0, 1, 1}, // Red
+		{0, 1, 0, 0}, // Blue
+		{1, 0, 0, 0}, // Hat
+	}
+	for i := range wantCounts {
+		if !slices.Equal(matrix.Counts[i], wantCounts[i]) {
+			t.Errorf("%s counts = %v, want %v", matrix.Labels[i], matrix.Counts[i], wantCounts[i])
+		}
+	}
+
+	if top := BuildLabelClusterMatrix(results, 2); !slices.Equal(top.Labels, []string{"Shoe", "Red"}) {
+		t.Errorf("top 2 labels = %v", top.Labels)
+	}
+}
+
+func TestDisambiguateTitlesVisitsClustersNumerically(t *testing.T) {
+	clusters := map[string]models.ClusterDetails{
+		"Cluster-10": {Title: "Running Shoes", Labels: "Shoe, Red", DominantLabel: "Red"},
+		"Cluster-2":  {Title: "Running Shoes", Labels: "Shoe, Blue", DominantLabel: "Blue"},
+	}
+
+	disambiguateTitles(clusters, 0.9)
+
+	if got := clusters["Cluster-2"].Title; got != "Running Shoes" {
+		t.Errorf("Cluster-2 title = %q, want it kept as the first of the group", got)
+	}
+	if got := clusters["Cluster-10"].Title; got != "Running Shoes (Red)" {
+		t.Errorf("Cluster-10 title = %q, want %q", got, "Running Shoes (Red)")
+	}
+}
+
+func TestCreateEmbeddingsLabelsOnlySkipsTheNetwork(t *testing.T) {
+	original := getImageEmbedding
+	defer func() { getImageEmbedding = original }()
+	calls := 0
+	getImageEmbedding = func(appCtx *embeddings.AppContext, imagePath string, crop *embeddings.CropBox) ([]float32, error) {
+		calls++
+		return nil, nil
+	}
+
+	ic := &ImageCluster{
+		Config:          &config.AppConfig{LabelsOnly: true},
+		EmbeddingsModel: &embeddings.AppContext{LabelSet: map[string]int{"Shoe": 0, "Bag": 1, "Hat": 2}},
+	}
+	items := []ItemDetails{
+		{ID: "a", ImagePath: "a.jpg", Labels: []string{"Shoe"}},
+		{ID: "b", ImagePath: "b.jpg", Labels: []string{"Bag", "Hat"}},
+	}
+	vectors, ids, failed := ic.createEmbeddings(items)
+
+	if calls != 0 {
+		t.Errorf("the network ran %d times in labels-only mode", calls)
+	}
+	if len(failed) != 0 || !slices.Equal(ids, []string{"a", "b"}) {
+		t.Fatalf("got ids %v and failures %v, want both items embedded", ids, failed)
+	}
+	want := [][]float32{{1, 0, 0}, {0, 1, 1}}
+	for i := range want {
+		if !slices.Equal(vectors[i], want[i]) {
+			t.Errorf("embedding of %s = %v, want the label vector %v", ids[i], vectors[i], want[i])
+		}
+	}
+}
+
+// fakeRekognition reports the moderation and object labels configured for each image file name
+type fakeRekognition struct {
+	rekognition.RekognitionAPI
+	moderation map[string][]string
+	labels     map[string][]types.Label
+	text       map[string][]string
+}
+
+func (f *fakeRekognition) DetectText(ctx context.Context, params *awsrekognition.DetectTextInput, optFns ...func(*awsrekognition.Options)) (*awsrekognition.DetectTextOutput, error) {
+	var detections []types.TextDetection
+	for _, word := range f.text[string(params.Image.Bytes)] {
+		detections = append(detections, types.TextDetection{
+			DetectedText: aws.String(word),
+			Type:         types.TextTypesWord,
+			Confidence:   aws.Float32(95),
+		})
+	}
+	return &awsrekognition.DetectTextOutput{TextDetections: detections}, nil
+}
+
+func (f *fakeRekognition) DetectLabels(ctx context.Context, params *awsrekognition.DetectLabelsInput, optFns ...func(*awsrekognition.Options)) (*awsrekognition.DetectLabelsOutput, error) {
+	var labels []types.Label
+	for _, label := range f.labels[string(params.Image.Bytes)] {
+		if aws.ToFloat32(label.Confidence) >= aws.ToFloat32(params.MinConfidence) {
+			labels = append(labels, label)
+		}
+	}
+	return &awsrekognition.DetectLabelsOutput{Labels: labels}, nil
+}
+
+func (f *fakeRekognition) DetectModerationLabels(ctx context.Context, params *awsrekognition.DetectModerationLabelsInput, optFns ...func(*awsrekognition.Options)) (*awsrekognition.DetectModerationLabelsOutput, error) {
+	// The fake images hold their own name, so the request bytes identify them
+	var labels []types.ModerationLabel
+	for _, name := range f.moderation[string(params.Image.Bytes)] {
+		labels = append(labels, types.ModerationLabel{Name: aws.String(name), Confidence: aws.Float32(90)})
+	}
+	return &awsrekognition.DetectModerationLabelsOutput{ModerationLabels: labels}, nil
+}
+
+func TestModerateImageRejectsOrFlags(t *testing.T) {
+	client := &fakeRekognition{moderation: map[string][]string{"flagged.jpg": {"Violence"}}}
+
+	for _, action := range []string{"reject", "flag"} {
+		t.Run(action, func(t *testing.T) {
+			dir := t.TempDir()
+			ic := &ImageCluster{
+				Config:         &config.AppConfig{ModerationAction: action, ModerationConfidence: 60},
+				RekognitionSvc: &rekognition.RekognitionService{Client: client, CacheDir: t.TempDir()},
+			}
+
+			var rejected []string
+			for _, name := range []string{"clean.jpg", "flagged.jpg"} {
+				path := filepath.Join(dir, name)
+				if err := os.WriteFile(path, []byte(name), 0644); err != nil {
+					t.Fatal(err)
+				}
+				isRejected, err := ic.moderateImage(context.Background(), models.UploadedImage{Filename: name}, path)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if isRejected {
+					rejected = append(rejected, name)
+				}
+			}
+
+			if len(ic.Flagged) != 1 || ic.Flagged[0].Filename != "flagged.jpg" || !slices.Equal(ic.Flagged[0].ModerationLabels, []string{"Violence"}) {
+				t.Fatalf("flagged = %+v, want flagged.jpg with Violence", ic.Flagged)
+			}
+			wantRejected := action == "reject"
+			if ic.Flagged[0].Rejected != wantRejected || (len(rejected) == 1) != wantRejected {
+				t.Errorf("rejected = %v, flagged as rejected %v; want rejection %v", rejected, ic.Flagged[0].Rejected, wantRejected)
+			}
+			if _, err := os.Stat(filepath.Join(dir, "flagged.jpg")); os.IsNotExist(err) != wantRejected {
+				t.Errorf("flagged image removed = %v, want %v", os.IsNotExist(err), wantRejected)
+			}
+		})
+	}
+}
+
+func TestDeterministicRunsProduceIdenticalClusters(t *testing.T) {
+	stubTitles(t, func(ctx context.Context, labels string) []ai.ModelOutput {
+		t.Error("AI services were called in deterministic mode")
+		return nil
+	})
+
+	// Three well separated groups of four images, whose labels are listed in varying order
+	groupLabels := [][]string{{"Shoe", "Sneaker", "Footwear"}, {"Bag", "Handbag", "Accessories"}, {"Hat", "Cap", "Clothing"}}
+	var items []ItemDetails
+	var vectors [][]float32
+	var ids []string
+	for i := 0; i < 12; i++ {
+		group := i % 3
+		labels := slices.Clone(groupLabels[group])
+		if i%2 == 1 {
+			slices.Reverse(labels)
+		}
+		id := fmt.Sprintf("item-%d", i)
+		items = append(items, ItemDetails{ID: id, ImagePath: fmt.Sprintf("/images/%d.jpg", i), Labels: labels})
+		vectors = append(vectors, []float32{float32(group * 10), float32(i) * 0.01})
+		ids = append(ids, id)
+	}
+
+	run := func() []byte {
+		ic := &ImageCluster{Config: &config.AppConfig{Deterministic: true}}
+		clusters, ok := clustering.PerformClusteringWithConstraints(vectors, ids, 3, 6, "")
+		if !ok {
+			t.Fatal("clustering failed")
+		}
+		result, err := json.Marshal(ic.prepareClusterDetails(context.Background(), clusters, nil, items))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return result
+	}
+
+	first, second := run(), run()
+	if !bytes.Equal(first, second) {
+		t.Errorf("identical input produced different results:\n%s\n%s", first, second)
+	}
+}
+
+func TestAIMinClusterSizeSkipsSmallClusters(t *testing.T) {
+	var mu sync.Mutex
+	var titled []string
+	stubTitles(t, func(ctx context.Context, labels string) []ai.ModelOutput {
+		mu.Lock()
+		titled = append(titled, labels)
+		mu.Unlock()
+		return []ai.ModelOutput{{ServiceName: ai.DefaultService(), Title: "Shoes", CatchyPhrase: "Walk on"}}
+	})
+
+	small := titledCluster("Hat, Cap, Clothing")
+	small.Images = []string{"1.jpg", "2.jpg", "3.jpg"}
+	large := titledCluster("Shoe, Sneaker")
+	large.Images = []string{"1.jpg", "2.jpg", "3.jpg", "4.jpg", "5.jpg", "6.jpg"}
+	clusters := map[string]models.ClusterDetails{"Cluster-0": small, "Cluster-1": large}
+
+	ic := &ImageCluster{Config: &config.AppConfig{AIMinClusterSize: 4, AIClusterWorkers: 2}}
+	ic.titleClusters(context.Background(), clusters, nil)
+
+	if !slices.Equal(titled, []string{"Shoe, Sneaker"}) {
+		t.Errorf("AI titled clusters with labels %q, want only the six-image cluster", titled)
+	}
+	if got := clusters["Cluster-0"]; got.Title != "Hat, Cap, Clothing" || len(got.ServiceOutputs) != 0 {
+		t.Errorf("small cluster titled %q with outputs %+v, want its labels and no AI output", got.Title, got.ServiceOutputs)
+	}
+	if got := clusters["Cluster-1"]; got.Title != "Shoes" {
+		t.Errorf("large cluster titled %q, want the AI title", got.Title)
+	}
+}
+
+// stubEmbeddings replaces the network with fixed image embeddings keyed by file name.
+// Images without an entry fail to embed.
+func stubEmbeddings(t *testing.T, vectors map[string][]float32) {
+	t.Helper()
+	original := getImageEmbedding
+	getImageEmbedding = func(appCtx *embeddings.AppContext, imagePath string, crop *embeddings.CropBox) ([]float32, error) {
+		if vector, ok := vectors[filepath.Base(imagePath)]; ok {
+			return vector, nil
+		}
+		return nil, fmt.Errorf("inference failed for %s", filepath.Base(imagePath))
+	}
+	t.Cleanup(func() { getImageEmbedding = original })
+}
+
+// testRun returns an ImageCluster writing into temporary directories, with clusters of minSize to maxSize
+func testRun(t *testing.T, cfg *config.AppConfig, minSize, maxSize int) *ImageCluster {
+	t.Helper()
+	tempDir := t.TempDir()
+	return &ImageCluster{
+		TempDir: tempDir,
+		EmbeddingsModel: &embeddings.AppContext{
+			ImageDir: filepath.Join(tempDir, "images"),
+			CacheDir: filepath.Join(tempDir, "cache"),
+		},
+		MinClusterSize: minSize,
+		MaxClusterSize: maxSize,
+		Config:         cfg,
+	}
+}
+
+// uploads returns one placeholder upload per file name
+func uploads(names ...string) []models.UploadedImage {
+	images := make([]models.UploadedImage, len(names))
+	for i, name := range names {
+		images[i] = models.UploadedImage{Filename: name, Data: []byte(name)}
+	}
+	return images
+}
+
+func TestRunWithoutRekognitionClustersOnImageEmbeddings(t *testing.T) {
+	stubEmbeddings(t, map[string][]float32{
+		"shoe1.jpg": {0, 0}, "shoe2.jpg": {0.1, 0}, "shoe3.jpg": {0, 0.1},
+		"hat1.jpg": {10, 10}, "hat2.jpg": {10.1, 10}, "hat3.jpg": {10, 10.1},
+	})
+
+	// RekognitionSvc stays nil, so any label detection would panic
+	ic := testRun(t, &config.AppConfig{UseRekognition: false, Deterministic: true}, 3, 3)
+	clusters, _, err := ic.Run(context.Background(), uploads("shoe1.jpg", "hat1.jpg", "shoe2.jpg", "hat2.jpg", "shoe3.jpg", "hat3.jpg"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(clusters) != 2 {
+		t.Fatalf("got %d clusters, want 2: %v", len(clusters), clusters)
+	}
+	for key, details := range clusters {
+		prefix := strings.TrimRight(details.Images[0], "0123456789.jpg")
+		for _, image := range details.Images {
+			if !strings.HasPrefix(image, prefix) {
+				t.Errorf("%s mixes %v", key, details.Images)
+				break
+			}
+		}
+	}
+	if len(ic.EmbeddingsModel.LabelSet) != 0 {
+		t.Errorf("label set = %v, want it empty without Rekognition", ic.EmbeddingsModel.LabelSet)
+	}
+	for _, result := range ic.Results {
+		if len(result.Labels) != 0 || len(result.Embedding) != 2 {
+			t.Errorf("%s: labels %v and embedding %v, want no labels and the 2-dimensional image embedding",
+				result.Filename, result.Labels, result.Embedding)
+		}
+	}
+}
+
+func TestEmbeddingFallbackKeepsAFailedImageInTheClustering(t *testing.T) {
+	stubEmbeddings(t, map[string][]float32{"shoe1.jpg": {0, 0}, "hat1.jpg": {0.1, 0}, "hat2.jpg": {0, 0.1}})
+
+	ic := &ImageCluster{
+		Config:          &config.AppConfig{EmbeddingFallback: true},
+		EmbeddingsModel: &embeddings.AppContext{EmbeddingDim: 2, LabelSet: map[string]int{"Hat": 0, "Shoe": 1}},
+	}
+	items := []ItemDetails{
+		{ID: "shoe1", ImagePath: "shoe1.jpg", Labels: []string{"Shoe"}},
+		{ID: "shoe2", ImagePath: "shoe2.jpg", Labels: []string{"Shoe"}},
+		{ID: "hat1", ImagePath: "hat1.jpg", Labels: []string{"Hat"}},
+		{ID: "hat2", ImagePath: "hat2.jpg", Labels: []string{"Hat"}},
+	}
+	vectors, ids, failed := ic.createEmbeddings(items)
+	if len(failed) != 0 || len(ids) != len(items) {
+		t.Fatalf("got ids %v and failures %v, want every item embedded", ids, failed)
+	}
+	if want := []float32{0, 0, 0, 1}; !slices.Equal(vectors[1], want) {
+		t.Errorf("fallback embedding = %v, want the zero-padded label vector %v", vectors[1], want)
+	}
+
+	clusters, ok := clustering.PerformClusteringWithConstraints(vectors, ids, 2, 2, "")
+	if !ok {
+		t.Fatal("clustering failed")
+	}
+	found := false
+	for _, refs := range clusters {
+		if slices.Contains(refs, "shoe2") {
+			found = true
+			if !slices.Contains(refs, "shoe1") {
+				t.Errorf("shoe2 was clustered with %v, want it next to shoe1 by its labels", refs)
+			}
+		}
+	}
+	if !found {
+		t.Errorf("shoe2 is missing from the clusters %v", clusters)
+	}
+
+	// Without the fallback the failed image is reported instead
+	ic.Config.EmbeddingFallback = false
+	if _, _, failed := ic.createEmbeddings(items); len(failed) != 1 || failed[0].ID != "shoe2" {
+		t.Errorf("failures = %v, want shoe2 reported", failed)
+	}
+}
+
+// writePNG writes a blank PNG of the given size and returns its path
+func writePNG(t *testing.T, dir, name string, width, height int) string {
+	t.Helper()
+	var encoded bytes.Buffer
+	if err := png.Encode(&encoded, image.NewGray(image.Rect(0, 0, width, height))); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, name)
+	if err := os.WriteFile(path, encoded.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestAspectBucketsSeparatePortraitAndLandscape(t *testing.T) {
+	dir := t.TempDir()
+	var items []ItemDetails
+	var ids []string
+	var vectors [][]float32
+	for i := 0; i < 6; i++ {
+		id, width, height := fmt.Sprintf("portrait-%d", i), 100, 200
+		if i%2 == 1 {
+			id, width, height = fmt.Sprintf("landscape-%d", i), 200, 100
+		}
+		items = append(items, ItemDetails{ID: id, ImagePath: writePNG(t, dir, id+".png", width, height)})
+		ids = append(ids, id)
+		// Identical embeddings, so only the buckets can keep the shapes apart
+		vectors = append(vectors, []float32{1, 1})
+	}
+
+	ic := &ImageCluster{Config: &config.AppConfig{AspectBuckets: []float64{1}}}
+	buckets, err := ic.aspectBuckets(items, ids)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, id := range ids {
+		want := 0
+		if strings.HasPrefix(id, "landscape") {
+			want = 1
+		}
+		if buckets[i] != want {
+			t.Errorf("%s is in bucket %d, want %d", id, buckets[i], want)
+		}
+	}
+
+	clusters, ok := clustering.PerformBucketedClustering(vectors, ids, buckets, 3, 3, "", "")
+	if !ok {
+		t.Fatal("bucketed clustering failed")
+	}
+	if len(clusters) != 2 {
+		t.Fatalf("got %d clusters, want one per bucket: %v", len(clusters), clusters)
+	}
+	for clusterID, refs := range clusters {
+		shape := strings.Split(refs[0], "-")[0]
+		for _, ref := range refs {
+			if !strings.HasPrefix(ref, shape) {
+				t.Errorf("cluster %d mixes shapes: %v", clusterID, refs)
+				break
+			}
+		}
+	}
+}
+
+func TestPrepareClusterDetailsKeepsImagesAlignedWithMembers(t *testing.T) {
+	items := []ItemDetails{
+		{ID: "a", ImagePath: "/images/a.jpg", Labels: []string{"Shoe"}},
+		{ID: "b", Labels: []string{"Shoe"}}, // A product without an image
+		{ID: "c", ImagePath: "/images/c.jpg", Labels: []string{"Shoe"}},
+	}
+	ic := &ImageCluster{Config: &config.AppConfig{Deterministic: true}}
+	details := ic.prepareClusterDetails(context.Background(), map[int][]string{0: {"a", "b", "c"}}, nil, items)
+
+	images := details["Cluster-0"].Images
+	if len(images) != 3 {
+		t.Fatalf("images = %v, want one entry per member", images)
+	}
+	if images[0] != "a.jpg" || images[2] != "c.jpg" {
+		t.Errorf("images = %v, want a.jpg and c.jpg at the positions of a and c", images)
+	}
+}
+
+func TestRunRecordsTheTimingOfEachStep(t *testing.T) {
+	stubEmbeddings(t, map[string][]float32{"1.jpg": {0, 0}, "2.jpg": {0, 1}, "3.jpg": {1, 0}})
+
+	ic := testRun(t, &config.AppConfig{Deterministic: true}, 3, 3)
+	if _, _, err := ic.Run(context.Background(), uploads("1.jpg", "2.jpg", "3.jpg")); err != nil {
+		t.Fatal(err)
+	}
+
+	encoded, err := json.Marshal(ic.Timings)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var timings map[string]float64
+	if err := json.Unmarshal(encoded, &timings); err != nil {
+		t.Fatal(err)
+	}
+	for _, field := range []string{"labelDetectionMs", "embeddingMs", "clusteringMs", "aiGenerationMs", "htmlGenerationMs", "totalMs"} {
+		value, ok := timings[field]
+		if !ok {
+			t.Errorf("timings %s are missing %s", encoded, field)
+		} else if value < 0 {
+			t.Errorf("%s = %v, want a non-negative duration", field, value)
+		}
+	}
+	if ic.Timings.TotalMs < ic.Timings.EmbeddingMs+ic.Timings.ClusteringMs {
+		t.Errorf("total %vms is shorter than its steps: %+v", ic.Timings.TotalMs, ic.Timings)
+	}
+}
+
+func TestMissingModelIsReportedAndLabelsOnlyRunsWithoutIt(t *testing.T) {
+	t.Setenv("AWS_EC2_METADATA_DISABLED", "true")
+	original := embeddings.ModelRegistry["resnet50"]
+	t.Cleanup(func() { embeddings.ModelRegistry["resnet50"] = original })
+	missing := filepath.Join(t.TempDir(), "missing.onnx")
+	embeddings.SetModelPath("resnet50", missing)
+
+	_, err := NewImageCluster(&config.AppConfig{UseRekognition: true}, t.TempDir())
+	if err == nil {
+		t.Fatal("created an image cluster without the model")
+	}
+	for _, want := range []string{"model file not found at " + missing, original.DownloadURL} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("err = %v, want it to contain %q", err, want)
+		}
+	}
+
+	ic, err := NewImageCluster(&config.AppConfig{UseRekognition: true, LabelsOnly: true}, t.TempDir())
+	if err != nil {
+		t.Fatalf("labels-only mode needs no model, got %v", err)
+	}
+	if ic.EmbeddingsModel.Nets != nil {
+		t.Error("labels-only mode loaded the network")
+	}
+}
+
+func TestFeatureMaskedDimensionsDoNotAffectDistances(t *testing.T) {
+	// Two image dimensions followed by two label dimensions
+	a := []float32{1, 2, 1, 0}
+	b := []float32{1, 2, 0, 1} // Same image, different labels
+	c := []float32{4, 6, 1, 0} // Different image, same labels
+
+	tests := []struct {
+		mask               string
+		wantAB, wantAC     float32
+		wantStart, wantEnd int
+	}{
+		{mask: "image", wantAB: 0, wantAC: 5, wantStart: 0, wantEnd: 2},
+		{mask: "labels", wantAB: float32(math.Sqrt(2)), wantAC: 0, wantStart: 2, wantEnd: 4},
+		{mask: "0:1", wantAB: 0, wantAC: 3, wantStart: 0, wantEnd: 1},
+	}
+	for _, tt := range tests {
+		ic := &ImageCluster{
+			Config:          &config.AppConfig{FeatureMask: tt.mask},
+			EmbeddingsModel: &embeddings.AppContext{LabelSet: map[string]int{"Shoe": 0, "Hat": 1}},
+		}
+		start, end, err := ic.featureRange(len(a))
+		if err != nil {
+			t.Fatalf("%s: %v", tt.mask, err)
+		}
+		if start != tt.wantStart || end != tt.wantEnd {
+			t.Errorf("%s: range %d:%d, want %d:%d", tt.mask, start, end, tt.wantStart, tt.wantEnd)
+		}
+		masked := clustering.SliceEmbeddings([][]float32{a, b, c}, start, end)
+		ab, _, _ := clustering.ExplainDistance(masked[0], masked[1], 0)
+		ac, _, _ := clustering.ExplainDistance(masked[0], masked[2], 0)
+		if math.Abs(float64(ab-tt.wantAB)) > 1e-6 || math.Abs(float64(ac-tt.wantAC)) > 1e-6 {
+			t.Errorf("%s: distances %v and %v, want %v and %v", tt.mask, ab, ac, tt.wantAB, tt.wantAC)
+		}
+	}
+
+	ic := &ImageCluster{Config: &config.AppConfig{FeatureMask: "3:9"}, EmbeddingsModel: &embeddings.AppContext{}}
+	if _, _, err := ic.featureRange(len(a)); err == nil {
+		t.Error("accepted a mask beyond the embedding")
+	}
+}
+
+func TestAggregateProductViewsAveragesEachProduct(t *testing.T) {
+	items := []ItemDetails{
+		{ID: "img_0", ProductID: "boot"},
+		{ID: "img_1"},
+		{ID: "img_2", ProductID: "boot"},
+		{ID: "img_3", ProductID: "boot"},
+	}
+	vectors := [][]float32{{1, 0}, {5, 5}, {2, 3}, {3, 6}}
+	ids := []string{"img_0", "img_1", "img_2", "img_3"}
+
+	aggregated, products, views := aggregateProductViews(items, vectors, ids, embeddings.AggregateMean)
+	if !slices.Equal(products, []string{"img_0", "img_1"}) {
+		t.Fatalf("products = %v, want the boot represented by img_0 and img_1 on its own", products)
+	}
+	if !slices.Equal(aggregated[0], []float32{2, 3}) {
+		t.Errorf("boot embedding = %v, want the mean of its three views [2 3]", aggregated[0])
+	}
+	if !slices.Equal(aggregated[1], []float32{5, 5}) {
+		t.Errorf("single view embedding = %v, want it unchanged", aggregated[1])
+	}
+	if !slices.Equal(views["img_0"], []string{"img_0", "img_2", "img_3"}) {
+		t.Errorf("boot views = %v, want all three images", views["img_0"])
+	}
+
+	// The clustered representative expands back to every view
+	clusters, misc := expandProductViews(map[int][]string{0: {"img_0"}}, []string{"img_1"}, views)
+	if !slices.Equal(clusters[0], []string{"img_0", "img_2", "img_3"}) || !slices.Equal(misc, []string{"img_1"}) {
+		t.Errorf("expanded to %v and misc %v", clusters, misc)
+	}
+}
+
+func TestWithinFailureTolerance(t *testing.T) {
+	tests := []struct {
+		maxImages     int
+		maxPercent    float64
+		failed, total int
+		want          bool
+	}{
+		{failed: 1, total: 20, want: false}, // No tolerance by default
+		{maxImages: 2, failed: 2, total: 20, want: true},
+		{maxImages: 2, failed: 3, total: 20, want: false},
+		{maxPercent: 10, failed: 2, total: 20, want: true},
+		{maxPercent: 10, failed: 3, total: 20, want: false},
+		{maxPercent: 10, failed: 1, total: 9, want: false},               // 10% of 9 rounds down to no images
+		{maxImages: 1, maxPercent: 20, failed: 4, total: 20, want: true}, // The larger allowance applies
+	}
+	for _, tt := range tests {
+		ic := &ImageCluster{Config: &config.AppConfig{MaxFailedImages: tt.maxImages, MaxFailedPercent: tt.maxPercent}}
+		if got := ic.withinFailureTolerance(tt.failed, tt.total); got != tt.want {
+			t.Errorf("%d of %d failed with max %d or %v%%: got %v, want %v",
+				tt.failed, tt.total, tt.maxImages, tt.maxPercent, got, tt.want)
+		}
+	}
+}
+
+func TestRunContinuesWithinTheFailureTolerance(t *testing.T) {
+	// Four of five images embed; the fifth has no stubbed embedding
+	stubEmbeddings(t, map[string][]float32{"1.jpg": {0, 0}, "2.jpg": {0, 1}, "3.jpg": {1, 0}, "4.jpg": {1, 1}})
+	images := uploads("1.jpg", "2.jpg", "3.jpg", "4.jpg", "5.jpg")
+
+	ic := testRun(t, &config.AppConfig{Deterministic: true, MaxFailedPercent: 20}, 2, 4)
+	if _, _, err := ic.Run(context.Background(), images); err != nil {
+		t.Fatalf("one of five failing is within 20%%: %v", err)
+	}
+	if len(ic.Failed) != 1 || ic.Failed[0].Filename != "5.jpg" {
+		t.Errorf("failed = %+v, want 5.jpg reported", ic.Failed)
+	}
+
+	ic = testRun(t, &config.AppConfig{Deterministic: true, MaxFailedPercent: 10}, 2, 4)
+	if _, _, err := ic.Run(context.Background(), images); err == nil {
+		t.Error("one of five failing exceeds 10% but the run succeeded")
+	}
+}
+
+// cameraJPEG writes a small JPEG whose EXIF data names the camera model and returns its path
+func cameraJPEG(t *testing.T, dir, name, model string) string {
+	t.Helper()
+	var encoded bytes.Buffer
+	if err := jpeg.Encode(&encoded, image.NewGray(image.Rect(0, 0, 8, 8)), nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// Big-endian TIFF header, then IFD0 with one ASCII model entry whose text follows the IFD
+	value := append([]byte(model), 0)
+	tiff := []byte("MM\x00\x2a\x00\x00\x00\x08")
+	tiff = binary.BigEndian.AppendUint16(tiff, 1)
+	tiff = binary.BigEndian.AppendUint16(tiff, 0x0110)
+	tiff = binary.BigEndian.AppendUint16(tiff, 2)
+	tiff = binary.BigEndian.AppendUint32(tiff, uint32(len(value)))
+	tiff = binary.BigEndian.AppendUint32(tiff, 26)
+	tiff = binary.BigEndian.AppendUint32(tiff, 0)
+	tiff = append(tiff, value...)
+	payload := append([]byte("Exif\x00\x00"), tiff...)
+
+	segment := []byte{0xff, 0xe1}
+	segment = binary.BigEndian.AppendUint16(segment, uint16(len(payload)+2))
+	segment = append(segment, payload...)
+	data := encoded.Bytes()
+	data = append(append(append([]byte{}, data[:2]...), segment...), data[2:]...)
+
+	path := filepath.Join(dir, name)
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestSharedEXIFFieldsBringImagesCloser(t *testing.T) {
+	dir := t.TempDir()
+	items := []ItemDetails{
+		{ID: "a", ImagePath: cameraJPEG(t, dir, "a.jpg", "X100V")},
+		{ID: "b", ImagePath: cameraJPEG(t, dir, "b.jpg", "X100V")},
+		{ID: "c", ImagePath: cameraJPEG(t, dir, "c.jpg", "D850")},
+	}
+	// b and c are equally far from a visually
+	stubEmbeddings(t, map[string][]float32{"a.jpg": {0, 0}, "b.jpg": {1, 0}, "c.jpg": {0, 1}})
+
+	distances := func(fields []string) (float32, float32) {
+		ic := &ImageCluster{
+			Config:          &config.AppConfig{EXIFFields: fields},
+			EmbeddingsModel: &embeddings.AppContext{},
+		}
+		metadata := make(map[string][]string)
+		for i := range items {
+			items[i].Metadata = ic.exifFeatures(items[i].ImagePath)
+			metadata[items[i].ID] = items[i].Metadata
+		}
+		ic.EmbeddingsModel.MetadataSet = embeddings.IndexLabels(metadata)
+		vectors, _, failed := ic.createEmbeddings(items)
+		if len(failed) != 0 {
+			t.Fatalf("embedding failed: %v", failed)
+		}
+		ab, _ := clustering.EuclideanDistance.Distance(vectors[0], vectors[1])
+		ac, _ := clustering.EuclideanDistance.Distance(vectors[0], vectors[2])
+		return ab, ac
+	}
+
+	if ab, ac := distances(nil); ab != ac {
+		t.Fatalf("without EXIF features the distances are %v and %v, want them equal", ab, ac)
+	}
+	if items[0].Metadata != nil {
+		t.Errorf("features %v were read without any EXIF fields configured", items[0].Metadata)
+	}
+	ab, ac := distances([]string{"model"})
+	if ab >= ac {
+		t.Errorf("with the camera model, a-b is %v and a-c %v; want the shared model to bring b closer", ab, ac)
+	}
+	if !slices.Equal(items[0].Metadata, []string{"model=X100V"}) {
+		t.Errorf("features of a = %v, want [model=X100V]", items[0].Metadata)
+	}
+}
+
+func TestRunReportsAndExcludesOutliers(t *testing.T) {
+	stubEmbeddings(t, map[string][]float32{
+		"shoe1.jpg": {0, 0}, "shoe2.jpg": {0.1, 0}, "shoe3.jpg": {0, 0.1}, "shoe4.jpg": {0.1, 0.1},
+		"odd.jpg": {50, 50},
+	})
+
+	for _, action := range []string{"flag", "exclude"} {
+		cfg := &config.AppConfig{Deterministic: true, OutlierThreshold: 5, OutlierNeighbors: 2, OutlierAction: action}
+		ic := testRun(t, cfg, 1, 5)
+		clusters, _, err := ic.Run(context.Background(), uploads("shoe1.jpg", "shoe2.jpg", "odd.jpg", "shoe3.jpg", "shoe4.jpg"))
+		if err != nil {
+			t.Fatalf("%s: %v", action, err)
+		}
+
+		if len(ic.Outliers) != 1 || ic.Outliers[0].Filename != "odd.jpg" {
+			t.Fatalf("%s: outliers = %+v, want only odd.jpg", action, ic.Outliers)
+		}
+		if got := ic.Outliers[0]; got.Excluded != (action == "exclude") || got.Distance <= 5 {
+			t.Errorf("%s: outlier reported as %+v", action, got)
+		}
+		misc, ok := clusters["Cluster-misc"]
+		if excluded := ok && slices.Contains(misc.Images, "odd.jpg"); excluded != (action == "exclude") {
+			t.Errorf("%s: odd.jpg in the misc bucket = %v, clusters %v", action, excluded, clusters)
+		}
+	}
+}
+
+func TestAICategoryFlowsToTheClusterAndServiceOutput(t *testing.T) {
+	var requested string
+	stubTitles(t, func(ctx context.Context, labels string) []ai.ModelOutput {
+		requested, _ = prompt.Render(ctx, "test", "{{.Category}}", prompt.NewData(labels))
+		return []ai.ModelOutput{{ServiceName: ai.DefaultService(), Title: "Sunny Picks", CatchyPhrase: "Bright finds", Category: "Summer Dresses"}}
+	})
+
+	ic := &ImageCluster{Config: &config.AppConfig{AICategory: true, TitleMaxChars: 40, PhraseMaxChars: 150}}
+	details := titledCluster("Dress, Sandal")
+	ic.applyModelOutputs(context.Background(), &details)
+
+	if requested != "true" {
+		t.Errorf("the prompt category flag rendered as %q, want it requested", requested)
+	}
+	if details.Category != "Summer Dresses" {
+		t.Errorf("cluster category = %q, want the default service's category", details.Category)
+	}
+	if len(details.ServiceOutputs) != 1 || details.ServiceOutputs[0].Category != "Summer Dresses" {
+		t.Errorf("service outputs = %+v, want the category recorded", details.ServiceOutputs)
+	}
+}
+
+func TestRunWithOnlyUndersizedClusters(t *testing.T) {
+	// Three tight pairs: each pair merges, but no two pairs fit in one cluster of at most 3
+	stubEmbeddings(t, map[string][]float32{
+		"shoe1.jpg": {0, 0}, "shoe2.jpg": {0.1, 0},
+		"hat1.jpg": {10, 10}, "hat2.jpg": {10.1, 10},
+		"bag1.jpg": {-10, 10}, "bag2.jpg": {-10.1, 10},
+	})
+	images := uploads("shoe1.jpg", "hat1.jpg", "bag1.jpg", "shoe2.jpg", "hat2.jpg", "bag2.jpg")
+
+	ic := testRun(t, &config.AppConfig{Deterministic: true}, 3, 3)
+	_, _, err := ic.Run(context.Background(), images)
+	if !errors.Is(err, ErrNoValidClusters) {
+		t.Fatalf("error = %v, want ErrNoValidClusters", err)
+	}
+	if !strings.Contains(err.Error(), "at least 3 similar images") {
+		t.Errorf("error %q does not explain the minimum size", err)
+	}
+
+	ic = testRun(t, &config.AppConfig{Deterministic: true, EmptyResult: "misc"}, 3, 3)
+	clusters, _, err := ic.Run(context.Background(), images)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ic.NoValidClusters {
+		t.Error("NoValidClusters is not set")
+	}
+	misc, ok := clusters["Cluster-misc"]
+	if len(clusters) != 1 || !ok || len(misc.Images) != len(images) {
+		t.Errorf("clusters = %v, want every image in the misc bucket only", clusters)
+	}
+}
+
+// processUploads stores and labels the uploads as the first step of a run does
+func processUploads(t *testing.T, ic *ImageCluster, images []models.UploadedImage) []ItemDetails {
+	t.Helper()
+	if err := ic.createDirectories(); err != nil {
+		t.Fatal(err)
+	}
+	items, err := ic.processImages(context.Background(), images)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return items
+}
+
+func TestLabelDetailsKeepConfidenceAndParents(t *testing.T) {
+	sneaker := types.Label{
+		Name:       aws.String("Sneaker"),
+		Confidence: aws.Float32(91.5),
+		Parents:    []types.Parent{{Name: aws.String("Shoe")}, {Name: aws.String("Footwear")}},
+	}
+	client := &fakeRekognition{labels: map[string][]types.Label{"shoe.jpg": {sneaker}}}
+
+	for _, enabled := range []bool{false, true} {
+		ic := testRun(t, &config.AppConfig{UseRekognition: true, LabelDetails: enabled}, 1, 1)
+		ic.RekognitionSvc = &rekognition.RekognitionService{Client: client, CacheDir: t.TempDir()}
+		items := processUploads(t, ic, uploads("shoe.jpg"))
+
+		results := buildImageResults(items, [][]float32{{0}}, map[int][]string{0: {items[0].ID}}, nil)
+		encoded, err := json.Marshal(results[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		var decoded map[string]interface{}
+		if err := json.Unmarshal(encoded, &decoded); err != nil {
+			t.Fatal(err)
+		}
+
+		details, ok := decoded["labelDetails"].([]interface{})
+		if !enabled {
+			if ok {
+				t.Errorf("label details %v returned without label_details", details)
+			}
+			continue
+		}
+		if len(details) != 1 {
+			t.Fatalf("label details = %s, want the Sneaker label", encoded)
+		}
+		label := details[0].(map[string]interface{})
+		if label["Confidence"] != 91.5 {
+			t.Errorf("confidence = %v, want 91.5", label["Confidence"])
+		}
+		if parents, _ := label["Parents"].([]interface{}); len(parents) != 2 {
+			t.Errorf("parents = %v, want Shoe and Footwear", label["Parents"])
+		}
+	}
+}
+
+func TestOriginalFilenamesSurviveSanitizingAndAppearInOutput(t *testing.T) {
+	originals := []string{"red dress (front).jpg", "red dress (back).jpg", "blue hat #2.jpg"}
+	var images []models.UploadedImage
+	vectors := make(map[string][]float32)
+	for i, original := range originals {
+		data := []byte(original)
+		stored := utils.ContentHashFilename(data, original)
+		images = append(images, models.UploadedImage{Filename: stored, OriginalFilename: original, Data: data})
+		vectors[stored] = []float32{float32(i), 0}
+	}
+	stubEmbeddings(t, vectors)
+
+	ic := testRun(t, &config.AppConfig{Deterministic: true, OriginalFilenames: true}, 1, 3)
+	clusters, htmlPath, err := ic.Run(context.Background(), images)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	found := 0
+	for key, details := range clusters {
+		for _, image := range details.Images {
+			original := details.OriginalFilenames[image]
+			if !slices.Contains(originals, original) || image == original {
+				t.Errorf("%s: %s maps to original name %q", key, image, original)
+			}
+			found++
+		}
+	}
+	if found != len(originals) {
+		t.Errorf("found %d clustered images, want %d", found, len(originals))
+	}
+	for _, result := range ic.Results {
+		if !slices.Contains(originals, result.OriginalFilename) {
+			t.Errorf("result for %s has original name %q", result.Filename, result.OriginalFilename)
+		}
+	}
+
+	page, err := os.ReadFile(htmlPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, original := range originals {
+		if !strings.Contains(html.UnescapeString(string(page)), original) {
+			t.Errorf("the report does not show %q", original)
+		}
+	}
+}
+
+func TestCollectionSummaryComesFromTheGenerator(t *testing.T) {
+	stubTitles(t, func(ctx context.Context, labels string) []ai.ModelOutput {
+		return []ai.ModelOutput{{ServiceName: ai.DefaultService(), Title: "Shoes", CatchyPhrase: "Walk on"}}
+	})
+	var described string
+	original := generateSummary
+	generateSummary = func(ctx context.Context, clusterText string, retries int) string {
+		described = clusterText
+		return "A footwear-heavy collection."
+	}
+	t.Cleanup(func() { generateSummary = original })
+	stubEmbeddings(t, map[string][]float32{"shoe1.jpg": {0, 0}, "shoe2.jpg": {0.1, 0}})
+
+	ic := testRun(t, &config.AppConfig{CollectionSummary: true, TitleMaxChars: 40, PhraseMaxChars: 150}, 2, 2)
+	_, htmlPath, err := ic.Run(context.Background(), uploads("shoe1.jpg", "shoe2.jpg"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if ic.Summary != "A footwear-heavy collection." {
+		t.Errorf("summary = %q, want the generator's", ic.Summary)
+	}
+	if !strings.Contains(described, "Shoes") || !strings.Contains(described, "(2 images)") {
+		t.Errorf("the generator was given %q, want the cluster titles and sizes", described)
+	}
+	page, err := os.ReadFile(htmlPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(page), "A footwear-heavy collection.") {
+		t.Error("the report does not show the summary")
+	}
+
+	// Deterministic runs skip the AI summary
+	ic = testRun(t, &config.AppConfig{CollectionSummary: true, Deterministic: true}, 2, 2)
+	described = ""
+	if _, _, err := ic.Run(context.Background(), uploads("shoe1.jpg", "shoe2.jpg")); err != nil {
+		t.Fatal(err)
+	}
+	if ic.Summary != "" || described != "" {
+		t.Errorf("a deterministic run produced the summary %q", ic.Summary)
+	}
+}
+
+func TestDetectedTextAppearsInTheFeatureVector(t *testing.T) {
+	client := &fakeRekognition{text: map[string][]string{
+		"tee.jpg":    {"NIKE", "Size-M"},
+		"hoodie.jpg": {"Nike"},
+		"cap.jpg":    {"ADIDAS"},
+	}}
+	ic := testRun(t, &config.AppConfig{UseRekognition: true, DetectText: true, LabelsOnly: true}, 1, 3)
+	ic.RekognitionSvc = &rekognition.RekognitionService{Client: client, CacheDir: t.TempDir()}
+	items := processUploads(t, ic, uploads("tee.jpg", "hoodie.jpg", "cap.jpg"))
+
+	if want := []string{"text=nike", "text=size"}; !slices.Equal(items[0].Metadata, want) {
+		t.Errorf("features of tee.jpg = %v, want %v with the single-letter token dropped", items[0].Metadata, want)
+	}
+
+	metadata := make(map[string][]string)
+	for _, item := range items {
+		metadata[item.ID] = item.Metadata
+	}
+	ic.EmbeddingsModel.MetadataSet = embeddings.IndexLabels(metadata)
+	vectors, _, failed := ic.createEmbeddings(items)
+	if len(failed) != 0 {
+		t.Fatalf("embedding failed: %v", failed)
+	}
+
+	nike, ok := ic.EmbeddingsModel.MetadataSet["text=nike"]
+	if !ok {
+		t.Fatalf("metadata set %v has no text=nike feature", ic.EmbeddingsModel.MetadataSet)
+	}
+	if vectors[0][nike] != 1 || vectors[1][nike] != 1 || vectors[2][nike] != 0 {
+		t.Errorf("text=nike in the vectors = %v, %v, %v; want it set for the two Nike items only",
+			vectors[0][nike], vectors[1][nike], vectors[2][nike])
+	}
+}
+
+func TestMinLabelsRetriesAtALowerConfidence(t *testing.T) {
+	client := &fakeRekognition{labels: map[string][]types.Label{
+		"shoe.jpg":  {{Name: aws.String("Shoe"), Confidence: aws.Float32(95)}},
+		"faint.jpg": {{Name: aws.String("Hat"), Confidence: aws.Float32(60)}},
+	}}
+
+	for _, action := range []string{"retry", "flag"} {
+		ic := testRun(t, &config.AppConfig{UseRekognition: true, MinLabels: 1, MinLabelsAction: action}, 1, 2)
+		ic.RekognitionSvc = &rekognition.RekognitionService{Client: client, CacheDir: t.TempDir()}
+		items := processUploads(t, ic, uploads("shoe.jpg", "faint.jpg"))
+
+		if !slices.Equal(items[0].Labels, []string{"Shoe"}) || items[0].RetriedLabels {
+			t.Errorf("%s: shoe.jpg labels %v (retried %v), want Shoe at the normal confidence", action, items[0].Labels, items[0].RetriedLabels)
+		}
+		if action == "retry" {
+			if !slices.Equal(items[1].Labels, []string{"Hat"}) || !items[1].RetriedLabels {
+				t.Errorf("retry: faint.jpg labels %v (retried %v), want Hat from the retry", items[1].Labels, items[1].RetriedLabels)
+			}
+			if len(ic.LowLabels) != 0 {
+				t.Errorf("retry: low-label images %+v, want none after a successful retry", ic.LowLabels)
+			}
+			continue
+		}
+		if len(items[1].Labels) != 0 {
+			t.Errorf("flag: faint.jpg labels %v, want none without a retry", items[1].Labels)
+		}
+		if len(ic.LowLabels) != 1 || ic.LowLabels[0].Filename != "faint.jpg" || ic.LowLabels[0].LabelCount != 0 {
+			t.Errorf("flag: low-label images %+v, want faint.jpg with no labels", ic.LowLabels)
+		}
+	}
+}
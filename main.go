@@ -1,22 +1,166 @@
 package main
 
 import (
+	"encoding/json"
 	"github.com/gorilla/mux"
+	"imageclust/internal/ai"
+	"imageclust/internal/ai/openai"
+	"imageclust/internal/embeddings"
 	"imageclust/internal/handlers"
+	"imageclust/internal/logger"
+	"imageclust/internal/utils"
 	"log"
 	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
 )
 
 func main() {
+	// Gate verbose logging; request and response bodies are only written at debug level
+	if levelName := os.Getenv("LOG_LEVEL"); levelName != "" {
+		level, err := logger.ParseLevel(levelName)
+		if err != nil {
+			log.Printf("Invalid LOG_LEVEL, using info: %v", err)
+		}
+		logger.SetLevel(level)
+	}
+
+	// Cap concurrent model calls across all requests to avoid throttling
+	if maxCalls, err := strconv.Atoi(os.Getenv("AI_MAX_CONCURRENT_CALLS")); err == nil {
+		ai.SetMaxConcurrentCalls(maxCalls)
+	}
+
+	// The default service fills each cluster's title and catchy phrase; a typo would silently leave them empty
+	if err := ai.SetDefaultService(os.Getenv("AI_DEFAULT_SERVICE")); err != nil {
+		log.Fatalf("Invalid AI_DEFAULT_SERVICE: %v", err)
+	}
+
+	// OpenAI calls share one pooled client; its timeout and idle pool size are tunable
+	openAITimeout, _ := strconv.Atoi(os.Getenv("OPENAI_TIMEOUT_SECONDS"))
+	openAIIdleConns, _ := strconv.Atoi(os.Getenv("OPENAI_MAX_IDLE_CONNS"))
+	openai.ConfigureHTTPClient(time.Duration(openAITimeout)*time.Second, openAIIdleConns)
+
+	// Served images are immutable within a session, so browsers may cache them
+	if maxAge, err := strconv.Atoi(os.Getenv("IMAGE_CACHE_MAX_AGE")); err == nil {
+		handlers.SetImageCacheMaxAge(time.Duration(maxAge) * time.Second)
+	}
+
+	// Uploads are streamed to disk, so the limit guards disk space rather than memory
+	if maxUploadMB, err := strconv.ParseInt(os.Getenv("MAX_UPLOAD_SIZE_MB"), 10, 64); err == nil {
+		handlers.SetMaxUploadSize(maxUploadMB << 20)
+	}
+
+	// Rate limiting is off unless a per-minute allowance is configured
+	if perMinute, err := strconv.ParseFloat(os.Getenv("RATE_LIMIT_PER_MINUTE"), 64); err == nil {
+		burst, _ := strconv.Atoi(os.Getenv("RATE_LIMIT_BURST"))
+		handlers.SetRateLimit(perMinute, burst)
+	}
+	// RATE_LIMIT_TRUST_PROXY is the number of proxies in front of the server, with true meaning one
+	trustedProxies := 0
+	if value := os.Getenv("RATE_LIMIT_TRUST_PROXY"); value == "true" {
+		trustedProxies = 1
+	} else if n, err := strconv.Atoi(value); err == nil {
+		trustedProxies = n
+	}
+	handlers.SetRateLimitKey(os.Getenv("RATE_LIMIT_KEY_HEADER"), trustedProxies)
+
+	// Image URL downloads never reach internal addresses unless explicitly allowed
+	utils.SetAllowPrivateImageHosts(os.Getenv("IMAGE_URL_ALLOW_PRIVATE_HOSTS") == "true")
+
+	// Image URL downloads can carry default headers, such as credentials for a protected CDN
+	if headersJSON := os.Getenv("IMAGE_DOWNLOAD_HEADERS"); headersJSON != "" {
+		var values map[string]string
+		if err := json.Unmarshal([]byte(headersJSON), &values); err != nil {
+			log.Fatalf("Invalid IMAGE_DOWNLOAD_HEADERS, expected a JSON object of header names to values: %v", err)
+		}
+		headers := http.Header{}
+		for name, value := range values {
+			headers.Set(name, value)
+		}
+		var hosts []string
+		for _, host := range strings.Split(os.Getenv("IMAGE_DOWNLOAD_HEADER_HOSTS"), ",") {
+			if host = strings.TrimSpace(host); host != "" {
+				hosts = append(hosts, host)
+			}
+		}
+		if len(hosts) == 0 {
+			log.Fatalf("IMAGE_DOWNLOAD_HEADERS requires IMAGE_DOWNLOAD_HEADER_HOSTS, the hosts the headers may be sent to")
+		}
+		utils.SetImageDownloadHeaders(headers, hosts)
+	}
+
+	// Admin endpoints stay disabled unless a token is configured
+	handlers.SetAdminToken(os.Getenv("ADMIN_API_TOKEN"))
+
+	// Finished sessions beyond the cap are evicted with their temp directories
+	if maxSessions, err := strconv.Atoi(os.Getenv("MAX_SESSIONS")); err == nil {
+		handlers.SetMaxSessions(maxSessions)
+	}
+
+	// Empty forward passes are rerun this many times before the image fails
+	if retries, err := strconv.Atoi(os.Getenv("FORWARD_RETRIES")); err == nil {
+		embeddings.SetForwardRetries(retries)
+	}
+
+	// Check the model up front; without it only labels_only requests can succeed
+	embeddings.SetModelPath("resnet50", os.Getenv("MODEL_PATH"))
+
+	// Extra ONNX models can be blended with ResNet50 per request through embedding_models
+	if modelsJSON := os.Getenv("EMBEDDING_MODELS"); modelsJSON != "" {
+		var models map[string]struct {
+			Path   string `json:"path"`
+			Layer  string `json:"layer"`
+			Dim    int    `json:"dim"`
+			SwapRB bool   `json:"swapRB"`
+		}
+		if err := json.Unmarshal([]byte(modelsJSON), &models); err != nil {
+			log.Fatalf("Invalid EMBEDDING_MODELS, expected a JSON object of model names to {path, layer, dim, swapRB}: %v", err)
+		}
+		for name, model := range models {
+			if err := embeddings.RegisterModel(name, model.Path, model.Layer, model.Dim, model.SwapRB); err != nil {
+				log.Fatalf("Invalid EMBEDDING_MODELS: %v", err)
+			}
+		}
+	}
+	if os.Getenv("MODEL_AUTO_DOWNLOAD") == "true" {
+		if err := embeddings.EnsureModel("resnet50", os.Getenv("MODEL_DOWNLOAD_URL"), os.Getenv("MODEL_SHA256")); err != nil {
+			logger.Errorf("Failed to download model: %v", err)
+		}
+	}
+	if err := embeddings.ModelRegistry["resnet50"].CheckFile(); err != nil {
+		logger.Errorf("%v. Only labels_only requests will succeed until the model is available", err)
+	}
+
 	router := mux.NewRouter()
 	router.Use(handlers.EnableCORS)
 
 	// API routes
 	apiRouter := router.PathPrefix("/api").Subrouter()
-	apiRouter.HandleFunc("/cluster", handlers.ClusterAndGenerateHandler).Methods("POST")
+	apiRouter.HandleFunc("/cluster/export.ndjson", handlers.ExportNDJSONHandler).Methods("GET")
+	apiRouter.HandleFunc("/cluster/export.parquet", handlers.ExportParquetHandler).Methods("GET")
+	apiRouter.HandleFunc("/cluster/export.html", handlers.ExportHTMLBundleHandler).Methods("GET")
+	apiRouter.HandleFunc("/cluster/export.pdf", handlers.ExportPDFHandler).Methods("GET")
+	apiRouter.HandleFunc("/cluster/explain", handlers.ExplainHandler).Methods("GET")
+	apiRouter.HandleFunc("/cluster/graph", handlers.GraphHandler).Methods("GET")
+	apiRouter.HandleFunc("/cluster/label-matrix", handlers.LabelMatrixHandler).Methods("GET")
 	apiRouter.HandleFunc("/image/{imageName:.*}", handlers.ImageHandler).Methods("GET")
 	apiRouter.HandleFunc("/view", handlers.ViewHandler).Methods("GET")
 
+	adminRouter := apiRouter.NewRoute().Subrouter()
+	adminRouter.Use(handlers.RequireAdminToken)
+	adminRouter.HandleFunc("/sessions", handlers.SessionsHandler).Methods("GET")
+
+	// Rate limit the routes that do expensive work; image and export fetches stay unlimited,
+	// since a single results page requests every thumbnail
+	limitedRouter := apiRouter.NewRoute().Subrouter()
+	limitedRouter.Use(handlers.RateLimit)
+	limitedRouter.HandleFunc("/cluster", handlers.ClusterAndGenerateHandler).Methods("POST")
+	limitedRouter.HandleFunc("/preprocess/preview", handlers.PreprocessPreviewHandler).Methods("POST")
+	limitedRouter.HandleFunc("/render", handlers.RenderHandler).Methods("POST")
+	limitedRouter.HandleFunc("/retitle", handlers.RetitleHandler).Methods("POST")
+
 	// Serve static files
 	spa := handlers.SpaHandler{StaticPath: "frontend/build", IndexPath: "index.html"}
 	router.PathPrefix("/").Handler(spa)